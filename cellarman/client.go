@@ -0,0 +1,125 @@
+package cellarman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrUnauthenticated is returned when the server rejects the caller's credentials.
+	ErrUnauthenticated = errors.New("cellarman: unauthenticated")
+	// ErrFieldNotAllowed is returned when the field isn't on the caller's allow-list.
+	ErrFieldNotAllowed = errors.New("cellarman: field not allowed")
+	// ErrDekNotAllowed is returned when the DEK to encrypt with, or the DEK of the ciphertext to
+	// decrypt, isn't one of the caller's tenant.
+	ErrDekNotAllowed = errors.New("cellarman: DEK not allowed")
+)
+
+// Client calls a Cellarman server.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	// Adds the caller's credentials to a request, e.g. a bearer token; may be nil.
+	authorize func(*http.Request) error
+}
+
+// NewClient returns a client of the server at baseURL. When httpClient is nil,
+// http.DefaultClient is used.
+func NewClient(baseURL string, httpClient *http.Client, authorize func(*http.Request) error) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient, authorize: authorize}
+}
+
+// Encrypt encrypts the value of the field with the DEK and algorithm (e.g.
+// utils.AlgorithmDeterministic).
+func (c *Client) Encrypt(
+	ctx context.Context, field string, value interface{}, keyID primitive.Binary, algorithm string,
+) (primitive.Binary, error) {
+	encoded, err := marshalValue(value)
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+	req := EncryptRequest{Field: field, Value: encoded, KeyID: keyID.Data, Algorithm: algorithm}
+	var resp EncryptResponse
+	if err := c.call(ctx, EncryptPath, req, &resp); err != nil {
+		return primitive.Binary{}, err
+	}
+	return primitive.Binary{Subtype: _encryptedSubtype, Data: resp.Ciphertext}, nil
+}
+
+// Decrypt decrypts a ciphertext of the field and returns the decoded Go value, as
+// utils.Decryptor.Decrypt does.
+func (c *Client) Decrypt(
+	ctx context.Context, field string, ciphertext primitive.Binary,
+) (interface{}, error) {
+	var resp DecryptResponse
+	req := DecryptRequest{Field: field, Ciphertext: ciphertext.Data}
+	if err := c.call(ctx, DecryptPath, req, &resp); err != nil {
+		return nil, err
+	}
+	value, err := unmarshalValue(resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := value.Unmarshal(&decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode the decrypted value: %w", err)
+	}
+	return decoded, nil
+}
+
+func (c *Client) call(ctx context.Context, path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode the request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create the request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.authorize != nil {
+		if err := c.authorize(req); err != nil {
+			return fmt.Errorf("failed to authorize the request: %w", err)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cellarman request to %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp errorResponse
+		_ = json.NewDecoder(io.LimitReader(resp.Body, _maxRequestSize)).Decode(&errResp)
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("%w: %s", ErrUnauthenticated, errResp.Error)
+		case http.StatusForbidden:
+			if detail, ok := strings.CutPrefix(errResp.Error, ErrOutOfScope.Error()+": "); ok {
+				return fmt.Errorf("%w: %s", ErrOutOfScope, detail)
+			}
+			if detail, ok := strings.CutPrefix(errResp.Error, ErrDekNotAllowed.Error()+": "); ok {
+				return fmt.Errorf("%w: %s", ErrDekNotAllowed, detail)
+			}
+			return fmt.Errorf("%w: %s", ErrFieldNotAllowed, errResp.Error)
+		default:
+			return fmt.Errorf("cellarman request to %s failed with status %d: %s",
+				path, resp.StatusCode, errResp.Error)
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode the response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Package cellarman exposes explicit encryption and decryption over HTTP, so downstream services
+// (e.g. CDC consumers) can encrypt and decrypt individual fields without access to MongoDB or the
+// KMS providers. Only the Cellarman server holds the key vault client and the KMS credentials.
+package cellarman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	EncryptPath = "/v1/encrypt"
+	DecryptPath = "/v1/decrypt"
+
+	// The largest request body the server reads.
+	_maxRequestSize = 16 << 20
+)
+
+// CSFLE and QE ciphertext is BinData subtype 6, and DEK IDs are UUIDs (subtype 4); the requests
+// carry only the bytes.
+const (
+	_encryptedSubtype byte = 6
+	_uuidSubtype      byte = 4
+)
+
+// Authenticator identifies the caller of a request, e.g. from a client certificate or a bearer
+// token. An error rejects the request as unauthenticated.
+type Authenticator func(r *http.Request) (caller string, err error)
+
+// Server serves the encrypt and decrypt endpoints. Each caller may only use the DEKs of its own
+// tenant, and only for the fields on its allow-list. The DEK of a request (the key ID of an
+// encrypt request, or the one in the header of the ciphertext to decrypt) is resolved to its
+// tenant and checked against the caller's before any KMS call, so a caller can't decrypt another
+// tenant's ciphertext by naming one of its own fields. Ciphertext doesn't record the field it was
+// encrypted for, so within the tenant the allow-list applies to the field the caller names in the
+// request.
+type Server struct {
+	cipher       utils.ExplicitCipher
+	decryptor    *utils.Decryptor
+	authenticate Authenticator
+	tenantOf     TenantResolver
+	scopes       map[string]CallerScope
+	// Set by RequireTokens.
+	tokens *Tokens
+}
+
+// CallerScope is what a caller may use: the DEKs of its tenant (the provider name, e.g.
+// local:100) and the fields on its allow-list.
+type CallerScope struct {
+	Tenant string
+	Fields []string
+}
+
+// NewServer returns a server that encrypts with cipher and decrypts with decryptor. scopes holds
+// the tenant and fields of each caller, as identified by authenticate, and tenantOf resolves the
+// DEK of a request to its tenant.
+func NewServer(
+	cipher utils.ExplicitCipher, decryptor *utils.Decryptor, authenticate Authenticator,
+	tenantOf TenantResolver, scopes map[string]CallerScope,
+) (*Server, error) {
+	if cipher == nil || decryptor == nil || authenticate == nil || tenantOf == nil {
+		return nil, fmt.Errorf("a cipher, a decryptor, an authenticator and a tenant resolver are required")
+	}
+	for caller, scope := range scopes {
+		if scope.Tenant == "" {
+			return nil, fmt.Errorf("caller '%s' has no tenant", caller)
+		}
+	}
+	return &Server{
+		cipher:       cipher,
+		decryptor:    decryptor,
+		authenticate: authenticate,
+		tenantOf:     tenantOf,
+		scopes:       scopes,
+	}, nil
+}
+
+// EncryptRequest is the body of an encrypt request. The value is Extended JSON (canonical, so the
+// BSON type of a number is kept), and the key ID is the DEK UUID.
+type EncryptRequest struct {
+	Field     string          `json:"field"`
+	Value     json.RawMessage `json:"value"`
+	KeyID     []byte          `json:"keyId"`
+	Algorithm string          `json:"algorithm"`
+}
+
+// EncryptResponse is the body of a successful encrypt response.
+type EncryptResponse struct {
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// DecryptRequest is the body of a decrypt request.
+type DecryptRequest struct {
+	Field      string `json:"field"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// DecryptResponse is the body of a successful decrypt response. The value is canonical Extended
+// JSON.
+type DecryptResponse struct {
+	Value json.RawMessage `json:"value"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP authenticates the caller and serves EncryptPath and DecryptPath.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	caller, err := s.authenticate(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	ctx := utils.WithEncryptionContext(r.Context(), withActor(r.Context(), caller))
+
+	r.Body = http.MaxBytesReader(w, r.Body, _maxRequestSize)
+	switch r.URL.Path {
+	case EncryptPath:
+		var req EncryptRequest
+		if !s.decodeRequest(w, r, caller, &req, &req.Field) {
+			return
+		}
+		keyID := primitive.Binary{Subtype: _uuidSubtype, Data: req.KeyID}
+		if status, err := s.checkDek(ctx, r, caller, req.Field, keyID); err != nil {
+			writeError(w, status, err)
+			return
+		}
+		resp, err := s.encrypt(ctx, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	case DecryptPath:
+		var req DecryptRequest
+		if !s.decodeRequest(w, r, caller, &req, &req.Field) {
+			return
+		}
+		info, err := utils.InspectCiphertext(primitive.Binary{Subtype: _encryptedSubtype, Data: req.Ciphertext})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if status, err := s.checkDek(ctx, r, caller, req.Field, info.KeyID); err != nil {
+			writeError(w, status, err)
+			return
+		}
+		resp, err := s.decrypt(ctx, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+	}
+}
+
+// decodeRequest decodes the request body into req and checks the caller may use the field it
+// names. On failure, the error response is written and false returned.
+func (s *Server) decodeRequest(
+	w http.ResponseWriter, r *http.Request, caller string, req interface{}, field *string,
+) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	if *field == "" {
+		writeError(w, http.StatusBadRequest, errors.New("field is required"))
+		return false
+	}
+	if !slices.Contains(s.scopes[caller].Fields, *field) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("caller '%s' may not use field '%s'", caller, *field))
+		return false
+	}
+	return true
+}
+
+// checkDek checks that the DEK of the request is the caller's tenant's and, with RequireTokens,
+// that the request's token covers the field and the tenant. It returns the status of the error
+// response on failure.
+func (s *Server) checkDek(
+	ctx context.Context, r *http.Request, caller, field string, keyID primitive.Binary,
+) (int, error) {
+	if len(keyID.Data) == 0 {
+		return http.StatusBadRequest, errors.New("keyId is required")
+	}
+	tenant, err := s.tenantOf(ctx, keyID)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if tenant != s.scopes[caller].Tenant {
+		return http.StatusForbidden, fmt.Errorf("%w: caller '%s' may not use the DEKs of '%s'",
+			ErrDekNotAllowed, caller, tenant)
+	}
+	return s.checkToken(r, field, tenant)
+}
+
+func (s *Server) encrypt(ctx context.Context, req EncryptRequest) (EncryptResponse, error) {
+	value, err := unmarshalValue(req.Value)
+	if err != nil {
+		return EncryptResponse{}, err
+	}
+	if req.Algorithm == "" {
+		return EncryptResponse{}, errors.New("algorithm is required")
+	}
+	opts := options.Encrypt().
+		SetAlgorithm(req.Algorithm).
+		SetKeyID(primitive.Binary{Subtype: _uuidSubtype, Data: req.KeyID})
+	ciphertext, err := s.cipher.Encrypt(ctx, value, opts)
+	if err != nil {
+		utils.EncryptionContextFrom(ctx).Metrics.Count("encrypt_errors", 1)
+		return EncryptResponse{}, fmt.Errorf("failed to encrypt '%s': %w", req.Field, err)
+	}
+	utils.EncryptionContextFrom(ctx).Metrics.Count("encryptions", 1)
+	return EncryptResponse{Ciphertext: ciphertext.Data}, nil
+}
+
+func (s *Server) decrypt(ctx context.Context, req DecryptRequest) (DecryptResponse, error) {
+	value, err := s.decryptor.Decrypt(ctx, primitive.Binary{Subtype: _encryptedSubtype, Data: req.Ciphertext})
+	if err != nil {
+		return DecryptResponse{}, fmt.Errorf("failed to decrypt '%s': %w", req.Field, err)
+	}
+	encoded, err := marshalValue(value)
+	if err != nil {
+		return DecryptResponse{}, err
+	}
+	return DecryptResponse{Value: encoded}, nil
+}
+
+// withActor returns the EncryptionContext of ctx with the caller as the actor, so the metrics and
+// logs of the request are attributed to it.
+func withActor(ctx context.Context, caller string) utils.EncryptionContext {
+	ec := utils.EncryptionContextFrom(ctx)
+	ec.Actor = caller
+	return ec
+}
+
+// marshalValue encodes a single value as canonical Extended JSON.
+func marshalValue(value interface{}) (json.RawMessage, error) {
+	doc, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the value: %w", err)
+	}
+	var wrapper struct {
+		V json.RawMessage `json:"v"`
+	}
+	if err := json.Unmarshal(doc, &wrapper); err != nil {
+		return nil, fmt.Errorf("failed to encode the value: %w", err)
+	}
+	return wrapper.V, nil
+}
+
+// unmarshalValue decodes a single Extended JSON value.
+func unmarshalValue(data json.RawMessage) (bson.RawValue, error) {
+	if len(data) == 0 {
+		return bson.RawValue{}, errors.New("value is required")
+	}
+	wrapped := append(append([]byte(`{"v":`), data...), '}')
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON(wrapped, true, &doc); err != nil {
+		return bson.RawValue{}, fmt.Errorf("invalid Extended JSON value: %w", err)
+	}
+	return doc.Lookup("v"), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
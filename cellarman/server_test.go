@@ -0,0 +1,332 @@
+package cellarman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errBadRequest stands for any error response with status 400, which the client has no sentinel
+// for.
+var errBadRequest = errors.New("bad request")
+
+// fakeTenantOf resolves a DEK of the fake key vault to its tenant from its dek-<provider> alt
+// name, as utils.DekProviderName does on a real key vault.
+func fakeTenantOf(kv *testutil.FakeKeyVault) TenantResolver {
+	return func(_ context.Context, keyID primitive.Binary) (string, error) {
+		for _, key := range kv.Keys() {
+			if bytes.Equal(key["_id"].(primitive.Binary).Data, keyID.Data) {
+				return strings.TrimPrefix(key["keyAltNames"].([]string)[0], "dek-"), nil
+			}
+		}
+		return "", fmt.Errorf("DEK %x does not exist", keyID.Data)
+	}
+}
+
+type serverFixture struct {
+	kv       *testutil.FakeKeyVault
+	server   *Server
+	url      string
+	dek100   primitive.Binary
+	dek200   primitive.Binary
+	clientOf func(caller string, authorize func(*http.Request) error) *Client
+}
+
+// newServerFixture serves a server whose caller "billing" may use the email and ssn fields of
+// tenant local:100, and "other" the email field of local:200. Callers authenticate with a Caller
+// header.
+func newServerFixture(t *testing.T) *serverFixture {
+	t.Helper()
+	kv := testutil.NewFakeKeyVault()
+	f := &serverFixture{
+		kv:     kv,
+		dek100: kv.AddKey("local:100", "dek-local:100"),
+		dek200: kv.AddKey("local:200", "dek-local:200"),
+	}
+	authenticate := func(r *http.Request) (string, error) {
+		caller := r.Header.Get("Caller")
+		if caller == "" {
+			return "", errors.New("no caller")
+		}
+		return caller, nil
+	}
+	server, err := NewServer(kv, utils.NewDecryptor(kv), authenticate, fakeTenantOf(kv), map[string]CallerScope{
+		"billing": {Tenant: "local:100", Fields: []string{"email", "ssn"}},
+		"other":   {Tenant: "local:200", Fields: []string{"email"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.server = server
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	f.url = httpServer.URL
+	f.clientOf = func(caller string, authorize func(*http.Request) error) *Client {
+		return NewClient(f.url, httpServer.Client(), func(r *http.Request) error {
+			r.Header.Set("Caller", caller)
+			if authorize != nil {
+				return authorize(r)
+			}
+			return nil
+		})
+	}
+	return f
+}
+
+func (f *serverFixture) encrypt(t *testing.T, keyID primitive.Binary, value interface{}) primitive.Binary {
+	t.Helper()
+	raw, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := f.kv.Encrypt(context.Background(), bson.Raw(raw).Lookup("v"),
+		options.Encrypt().SetKeyID(keyID).SetAlgorithm(utils.AlgorithmDeterministic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func TestServerDecrypt(t *testing.T) {
+	f := newServerFixture(t)
+	ciphertext := f.encrypt(t, f.dek100, "alice@example.com")
+
+	value, err := f.clientOf("billing", nil).Decrypt(context.Background(), "email", ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if value != "alice@example.com" {
+		t.Errorf("Decrypt() = %v, want alice@example.com", value)
+	}
+}
+
+func TestServerEncrypt(t *testing.T) {
+	f := newServerFixture(t)
+	client := f.clientOf("billing", nil)
+
+	ciphertext, err := client.Encrypt(context.Background(), "ssn", "123-45-6789", f.dek100,
+		utils.AlgorithmDeterministic)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	info, err := utils.InspectCiphertext(ciphertext)
+	if err != nil {
+		t.Fatalf("InspectCiphertext() error = %v", err)
+	}
+	if !bytes.Equal(info.KeyID.Data, f.dek100.Data) {
+		t.Errorf("ciphertext DEK = %x, want %x", info.KeyID.Data, f.dek100.Data)
+	}
+	value, err := client.Decrypt(context.Background(), "ssn", ciphertext)
+	if err != nil || value != "123-45-6789" {
+		t.Errorf("Decrypt() = %v, %v, want 123-45-6789", value, err)
+	}
+}
+
+// TestServerEncryptMetrics checks that the encrypt handler counts its encryptions and failures.
+func TestServerEncryptMetrics(t *testing.T) {
+	f := newServerFixture(t)
+	metrics := utils.NewPrometheusMetrics("")
+	ctx := utils.WithEncryptionContext(context.Background(), utils.EncryptionContext{Metrics: metrics})
+	value, err := marshalValue("123-45-6789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := EncryptRequest{
+		Field: "ssn", Value: value, KeyID: f.dek100.Data, Algorithm: utils.AlgorithmDeterministic,
+	}
+
+	if _, err := f.server.encrypt(ctx, req); err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+	f.kv.EncryptErr = errors.New("kms unavailable")
+	if _, err := f.server.encrypt(ctx, req); err == nil {
+		t.Fatal("encrypt() with a failing key vault succeeded, want an error")
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"encryptions_total 1", "encrypt_errors_total 1"} {
+		if !strings.Contains(recorder.Body.String(), want) {
+			t.Errorf("metrics:\n%s\nwant them to contain %q", recorder.Body.String(), want)
+		}
+	}
+}
+
+// TestServerScope checks that a caller can only use its own tenant's DEKs for the fields on its
+// allow-list, and that a rejected request never reaches the key vault.
+func TestServerScope(t *testing.T) {
+	f := newServerFixture(t)
+	ciphertext100 := f.encrypt(t, f.dek100, "alice@example.com")
+	ciphertext200 := f.encrypt(t, f.dek200, "bob@example.com")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		call    func() error
+		wantErr error
+	}{
+		{name: "decrypt a field not on the allow-list", wantErr: ErrFieldNotAllowed, call: func() error {
+			_, err := f.clientOf("other", nil).Decrypt(ctx, "ssn", ciphertext200)
+			return err
+		}},
+		{name: "decrypt another tenant's ciphertext", wantErr: ErrDekNotAllowed, call: func() error {
+			_, err := f.clientOf("other", nil).Decrypt(ctx, "email", ciphertext100)
+			return err
+		}},
+		{name: "encrypt with another tenant's DEK", wantErr: ErrDekNotAllowed, call: func() error {
+			_, err := f.clientOf("billing", nil).Encrypt(ctx, "email", "x", f.dek200, utils.AlgorithmDeterministic)
+			return err
+		}},
+		{name: "encrypt with an unknown DEK", wantErr: errBadRequest, call: func() error {
+			unknown := primitive.Binary{Subtype: 4, Data: bytes.Repeat([]byte{7}, 16)}
+			_, err := f.clientOf("billing", nil).Encrypt(ctx, "email", "x", unknown, utils.AlgorithmDeterministic)
+			return err
+		}},
+		{name: "unknown caller", wantErr: ErrFieldNotAllowed, call: func() error {
+			_, err := f.clientOf("nobody", nil).Decrypt(ctx, "email", ciphertext100)
+			return err
+		}},
+		{name: "unauthenticated", wantErr: ErrUnauthenticated, call: func() error {
+			_, err := NewClient(f.url, nil, nil).Decrypt(ctx, "email", ciphertext100)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decryptCalls := f.kv.DecryptCalls
+			err := tt.call()
+			if tt.wantErr == errBadRequest {
+				if err == nil || !strings.Contains(err.Error(), "status 400") {
+					t.Fatalf("error = %v, want a bad request", err)
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if f.kv.DecryptCalls != decryptCalls {
+				t.Error("the rejected request was decrypted")
+			}
+		})
+	}
+}
+
+func TestServerTokens(t *testing.T) {
+	f := newServerFixture(t)
+	clock := utils.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	tokens, err := NewTokens(bytes.Repeat([]byte{1}, _minTokenKeySize), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.server.RequireTokens(tokens)
+	ciphertext := f.encrypt(t, f.dek100, "alice@example.com")
+	ctx := context.Background()
+
+	emailToken, err := tokens.Issue("local:100", []string{"email"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTenantToken, err := tokens.Issue("local:200", []string{"email"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withEmailToken := f.clientOf("billing", WithToken(emailToken, nil))
+	if value, err := withEmailToken.Decrypt(ctx, "email", ciphertext); err != nil || value != "alice@example.com" {
+		t.Errorf("Decrypt() with a token = %v, %v, want alice@example.com", value, err)
+	}
+	if _, err := f.clientOf("billing", nil).Decrypt(ctx, "email", ciphertext); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Decrypt() without a token error = %v, want %v", err, ErrUnauthenticated)
+	}
+	if _, err := withEmailToken.Decrypt(ctx, "ssn", ciphertext); !errors.Is(err, ErrOutOfScope) {
+		t.Errorf("Decrypt() of a field outside the token error = %v, want %v", err, ErrOutOfScope)
+	}
+	// A token of another tenant doesn't widen the caller's scope, nor does the caller's scope widen
+	// the token's.
+	withOtherToken := f.clientOf("billing", WithToken(otherTenantToken, nil))
+	if _, err := withOtherToken.Decrypt(ctx, "email", ciphertext); !errors.Is(err, ErrOutOfScope) {
+		t.Errorf("Decrypt() with another tenant's token error = %v, want %v", err, ErrOutOfScope)
+	}
+
+	// An expired token is rejected before any KMS call.
+	clock.Advance(time.Minute)
+	decryptCalls := f.kv.DecryptCalls
+	_, err = withEmailToken.Decrypt(ctx, "email", ciphertext)
+	if !errors.Is(err, ErrUnauthenticated) || !strings.Contains(err.Error(), "token expired") {
+		t.Errorf("Decrypt() with an expired token error = %v, want %v", err, ErrTokenExpired)
+	}
+	if f.kv.DecryptCalls != decryptCalls {
+		t.Error("the request with an expired token was decrypted")
+	}
+}
+
+func TestTokensVerify(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	tokens, err := NewTokens(bytes.Repeat([]byte{1}, _minTokenKeySize), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := tokens.Issue("local:100", []string{"email", "ssn"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokens.Verify(token)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	expiresAt := clock.Now().Add(time.Minute)
+	if claims.Tenant != "local:100" || len(claims.Fields) != 2 || !claims.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Verify() = %+v, want local:100, [email ssn], expiring in a minute", claims)
+	}
+
+	otherKey, err := NewTokens(bytes.Repeat([]byte{2}, _minTokenKeySize), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	forged, err := otherKey.Issue("local:200", []string{"email", "ssn"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, token := range map[string]string{
+		"signed with another key": forged,
+		"swapped payload":         forgedPayload + "." + signature,
+		"no signature":            payload,
+		"not base64":              "!." + signature,
+	} {
+		if _, err := tokens.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Verify() of a token %s error = %v, want %v", name, err, ErrInvalidToken)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := tokens.Verify(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("Verify() of an expired token error = %v, want %v", err, ErrTokenExpired)
+	}
+	if _, err := NewTokens(make([]byte, _minTokenKeySize-1), nil); err == nil {
+		t.Error("NewTokens() with a short key succeeded, want an error")
+	}
+}
+
+func TestNewServerRequiresTenant(t *testing.T) {
+	kv := testutil.NewFakeKeyVault()
+	authenticate := func(*http.Request) (string, error) { return "", nil }
+	if _, err := NewServer(kv, utils.NewDecryptor(kv), authenticate, fakeTenantOf(kv),
+		map[string]CallerScope{"billing": {Fields: []string{"email"}}}); err == nil {
+		t.Error("NewServer() with a caller without tenant succeeded, want an error")
+	}
+	if _, err := NewServer(kv, utils.NewDecryptor(kv), authenticate, nil, nil); err == nil {
+		t.Error("NewServer() without a tenant resolver succeeded, want an error")
+	}
+}
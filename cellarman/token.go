@@ -0,0 +1,157 @@
+package cellarman
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrInvalidToken is returned for a token that is malformed or wasn't issued with the key.
+	ErrInvalidToken = errors.New("cellarman: invalid token")
+	// ErrTokenExpired is returned for a token past its expiry.
+	ErrTokenExpired = errors.New("cellarman: token expired")
+	// ErrOutOfScope is returned when a request is for a tenant or field the token doesn't cover.
+	ErrOutOfScope = errors.New("cellarman: request out of the token's scope")
+)
+
+const (
+	// The header a token is presented in. It is separate from the Authorization header, which the
+	// caller's own authentication may use.
+	TokenHeader = "Cellarman-Token"
+
+	// The smallest HMAC key Tokens accepts.
+	_minTokenKeySize = 32
+)
+
+// TokenClaims is the scope of a token: the tenant (provider name) whose DEKs it may use, the
+// fields it may encrypt and decrypt, and when it expires.
+type TokenClaims struct {
+	Tenant    string    `json:"tenant"`
+	Fields    []string  `json:"fields"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// Tokens issues and verifies short-lived capability tokens, signed with HMAC-SHA256. A token is
+// the base64url encoded JSON claims and signature, separated by a dot.
+type Tokens struct {
+	key   []byte
+	clock utils.Clock
+}
+
+// NewTokens returns the issuer and verifier of tokens signed with the key. When clock is nil, the
+// real clock is used.
+func NewTokens(key []byte, clock utils.Clock) (*Tokens, error) {
+	if len(key) < _minTokenKeySize {
+		return nil, fmt.Errorf("the token key must be at least %d bytes, got %d", _minTokenKeySize, len(key))
+	}
+	if clock == nil {
+		clock = utils.RealClock()
+	}
+	return &Tokens{key: key, clock: clock}, nil
+}
+
+// Issue returns a token for the tenant's fields, valid for ttl.
+func (t *Tokens) Issue(tenant string, fields []string, ttl time.Duration) (string, error) {
+	if tenant == "" || len(fields) == 0 {
+		return "", fmt.Errorf("a token needs a tenant and at least one field")
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("the token lifetime must be positive, got %v", ttl)
+	}
+	claims, err := json.Marshal(TokenClaims{Tenant: tenant, Fields: fields, ExpiresAt: t.clock.Now().Add(ttl)})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the token claims: %w", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload)), nil
+}
+
+// Verify checks the signature and the expiry of a token and returns its claims.
+func (t *Tokens) Verify(token string) (TokenClaims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, t.sign(payload)) {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	if !t.clock.Now().Before(claims.ExpiresAt) {
+		return TokenClaims{}, fmt.Errorf("%w at %v", ErrTokenExpired, claims.ExpiresAt)
+	}
+	return claims, nil
+}
+
+func (t *Tokens) sign(payload string) []byte {
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// TenantResolver returns the tenant whose DEK the key ID is, e.g. utils.DekProviderName on the
+// server's ClientEncryption.
+type TenantResolver func(ctx context.Context, keyID primitive.Binary) (string, error)
+
+// RequireTokens makes the server require a token (in TokenHeader) on every request, on top of
+// the caller's authentication and scope. The request's field must be one of the token's, and the
+// DEK of the value must be the token's tenant's; both are checked before any KMS call.
+func (s *Server) RequireTokens(tokens *Tokens) {
+	s.tokens = tokens
+}
+
+// checkToken verifies the request's token and that it covers the field and the tenant of the
+// request's DEK. It returns the status of the error response on failure.
+func (s *Server) checkToken(r *http.Request, field, tenant string) (int, error) {
+	if s.tokens == nil {
+		return 0, nil
+	}
+	token := r.Header.Get(TokenHeader)
+	if token == "" {
+		return http.StatusUnauthorized, fmt.Errorf("%w: no token", ErrInvalidToken)
+	}
+	claims, err := s.tokens.Verify(token)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	if !slices.Contains(claims.Fields, field) {
+		return http.StatusForbidden, fmt.Errorf("%w: field '%s'", ErrOutOfScope, field)
+	}
+	if tenant != claims.Tenant {
+		return http.StatusForbidden, fmt.Errorf("%w: the DEK is not the tenant's", ErrOutOfScope)
+	}
+	return 0, nil
+}
+
+// WithToken returns a Client authorizer that presents the token, after authorize (which may be
+// nil) added the caller's credentials.
+func WithToken(token string, authorize func(*http.Request) error) func(*http.Request) error {
+	return func(r *http.Request) error {
+		if authorize != nil {
+			if err := authorize(r); err != nil {
+				return err
+			}
+		}
+		r.Header.Set(TokenHeader, token)
+		return nil
+	}
+}
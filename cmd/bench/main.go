@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+)
+
+// The benchmark shares the CSFLE key vault, so it measures against the same DEKs.
+const _keyVaultNamespace = "csfle_keyvault.datakeys"
+
+func main() {
+	count := flag.Int("count", 1000, "number of values to encrypt and decrypt")
+	size := flag.Int("size", 64, "size in bytes of each plaintext value")
+	algorithm := flag.String("algorithm", utils.AlgorithmDeterministic, "encryption algorithm")
+	devOrgID := flag.String("org", "don:identity:dvrv-us-1:devo/100", "Dev org DON of the tenant")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	providerName, err := utils.GetProviderName(*devOrgID)
+	if err != nil {
+		log.Fatalf("Failed to get provider name: %v", err)
+	}
+
+	dek, kmsProviders, err := utils.GetDek(ctx, providerName, _keyVaultNamespace)
+	if err != nil {
+		log.Fatalf("Failed to initialize the data key: %v", err)
+	}
+
+	// One ClientEncryption is reused for every operation, so after the first operation the DEK
+	// comes from the driver's cache and we measure the cryptographic cost, not the key lookup.
+	var res utils.Resources
+	defer res.Close(ctx)
+	_, clientEnc, err := utils.OpenKeyVault(ctx, &res, _keyVaultNamespace, kmsProviders)
+	if err != nil {
+		log.Fatalf("Failed to open the key vault: %v", err)
+	}
+
+	result, err := utils.RunBenchmark(ctx, clientEnc, utils.BenchmarkConfig{
+		Count:     *count,
+		ValueSize: *size,
+		KeyID:     *dek,
+		Algorithm: *algorithm,
+	})
+	if err != nil {
+		log.Fatalf("Benchmark failed: %v", err)
+	}
+
+	fmt.Printf("Values: %d x %d bytes (%s)\n", result.Count, *size, *algorithm)
+	fmt.Printf("Encrypt: %.0f ops/sec, p50 %v, p99 %v\n",
+		result.EncryptOpsPerSec, result.EncryptP50, result.EncryptP99)
+	fmt.Printf("Decrypt: %.0f ops/sec, p50 %v, p99 %v\n",
+		result.DecryptOpsPerSec, result.DecryptP50, result.DecryptP99)
+}
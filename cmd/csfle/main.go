@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -22,8 +23,19 @@ const _keyVaultNamespace = "csfle_keyvault.datakeys"
 const _databaseName = "csfle_db"
 const _collectionName = "users"
 
+var _usersColl = utils.CollRef{Database: _databaseName, Name: _collectionName}
+
 func main() {
-	ctx := context.Background()
+	ingest := flag.Bool("ingest", false,
+		"read newline-delimited JSON users from stdin, encrypt and insert them, then exit")
+	metricsAddr := flag.String("metrics-addr", "",
+		"serve Prometheus metrics on this address (e.g. :9090) while the demo runs")
+	flag.Parse()
+	ctx, shutdownMetrics, err := utils.StartMetrics(context.Background(), *metricsAddr, "mongodb_enc")
+	if err != nil {
+		log.Fatalf("Failed to start the metrics server: %v", err)
+	}
+	defer shutdownMetrics()
 
 	// Get the provider name based on the Dev org ID.
 	providerName, err := utils.GetProviderName("don:identity:dvrv-us-1:devo/100")
@@ -99,6 +111,24 @@ func main() {
 	}
 	defer encClient.Disconnect(ctx)
 
+	// A regular client, which doesn't encrypt or decrypt, e.g. for the null encrypted fields of an
+	// insert and for reading the stored ciphertext below.
+	client, err := newClient(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create regular client: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	if *ingest {
+		// Bulk load: every line is encrypted per the schemaMap, like the single insert below.
+		inserted, errs := utils.IngestJSONL(ctx, encClient, _usersColl, os.Stdin)
+		for _, err := range errs {
+			log.Printf("Ingest error: %v", err)
+		}
+		fmt.Printf("Inserted %d documents, %d errors\n", inserted, len(errs))
+		return
+	}
+
 	ssn, err := generateRandomSSN()
 	if err != nil {
 		log.Fatalf("Failed to generate random SSN: %v", err)
@@ -109,7 +139,7 @@ func main() {
 	// Write with encryption. The driver will automatically encrypt the 'ssn' field based on the
 	// schemaMap.
 	doc := bson.M{"name": "Bob", "email": email, "ssn": ssn}
-	if err := insertUser(ctx, encClient, doc); err != nil {
+	if err := insertUser(ctx, encClient, client, doc); err != nil {
 		log.Fatalf("Insert failed: %v", err)
 	}
 
@@ -127,17 +157,11 @@ func main() {
 
 	// Read with a regular client. The driver will not automatically decrypt the 'ssn' field,
 	// so it will return the encrypted value.
-	client, err := newClient(ctx)
-	if err != nil {
-		log.Fatalf("Failed to create regular client: %v", err)
-	}
-	defer client.Disconnect(ctx)
-
 	// Using a regular client to read the encrypted data with a cleartext filter. This will return
 	// the encrypted fields as it is. This is similar to how a downstream service would get the
 	// data via CDC.
 	filter = bson.M{"email": email}
-	if rs, err := readUser(ctx, client, filter); err != nil {
+	if rs, err := utils.FindOneAs[encryptedUser](ctx, client, _usersColl, filter); err != nil {
 		log.Fatalf("Read failed: %v", err)
 	} else {
 		fmt.Printf("Read by %s and the results: %v\n", email, rs)
@@ -150,7 +174,7 @@ func main() {
 		// BinData blobs without knowing or caring that they are encrypted. Adding explicit metadata
 		// on the document would break this principle and give the server knowledge about the
 		// encryption scheme.
-		ssnEncrypted := rs["ssn"].(primitive.Binary)
+		ssnEncrypted := rs.SSN
 		fmt.Printf("SSN (encrypted): %v\n", ssnEncrypted)
 
 		// We need to explicitly decrypt the 'ssn' field in the results. To decrypt the SSN we need
@@ -190,6 +214,31 @@ func main() {
 	} else {
 		fmt.Printf("Read by %s and the decrypted result: %v\n", ssn, rs)
 	}
+
+	// Without a schemaMap, the filter value can be encrypted explicitly instead, with the same DEK
+	// and algorithm as the schemaMap would use. The deterministic ciphertext then matches the
+	// stored one.
+	var res utils.Resources
+	defer res.Close(ctx)
+	_, clientEnc, err := utils.OpenKeyVault(ctx, &res, _keyVaultNamespace, kmsProviders)
+	if err != nil {
+		log.Fatalf("Failed to open the key vault: %v", err)
+	}
+	users, err := utils.ReadByExplicitlyEncrypted(
+		ctx, encClientWithNoSchema, clientEnc, _usersColl, "ssn", ssn, *dek, utils.AlgorithmDeterministic,
+	)
+	if err != nil {
+		log.Fatalf("Read failed: %v", err)
+	}
+	fmt.Printf("Read by explicitly encrypted %s and the decrypted result: %v\n", ssn, users)
+}
+
+// encryptedUser is a user as read through a regular client, where the encrypted fields are
+// still ciphertext.
+type encryptedUser struct {
+	Name  string           `bson:"name"`
+	Email string           `bson:"email"`
+	SSN   primitive.Binary `bson:"ssn"`
 }
 
 func decryptBinaryValue(
@@ -210,12 +259,13 @@ func decryptBinaryValue(
 	if err != nil {
 		return nil, fmt.Errorf("failed to create client encryption: %v", err)
 	}
-	defer clientEnc.Close(ctx)
+	defer utils.CloseClientEncryption(clientEnc)
 
 	// The ClientEncryption.Decrypt method automatically handles looking up the DEK
 	// based on the metadata embedded within the primitive.Binary (BinData) value. The driver will
 	// use a per-connection cache to avoid repeated lookups.
-	decryptedValue, err := clientEnc.Decrypt(ctx, encryptedValue)
+	// Transient KMS errors, such as throttling, are retried per the configured policy.
+	decryptedValue, err := utils.DecryptWithRetry(ctx, clientEnc, encryptedValue)
 	if err != nil {
 		return nil, fmt.Errorf("failed to explicitly decrypt the value: %w", err)
 	}
@@ -226,7 +276,7 @@ func getSchemaMap(dek primitive.Binary) bson.M {
 	// Define the JSON Schema for automatic encryption. The 'ssn' field will be deterministically
 	// encrypted using the provided DEK.
 	return bson.M{
-		_databaseName + "." + _collectionName: bson.M{
+		_usersColl.String(): bson.M{
 			"bsonType": "object",
 			"properties": bson.M{
 				"ssn": bson.M{
@@ -245,11 +295,11 @@ func getSchemaMap(dek primitive.Binary) bson.M {
 }
 
 func newClient(ctx context.Context) (*mongo.Client, error) {
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, fmt.Errorf("MONGODB_URI environment variable is not set")
+	clientOpts, err := utils.ClientOptions()
+	if err != nil {
+		return nil, err
 	}
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(ctx, clientOpts)
 	if err != nil {
 		return nil, fmt.Errorf("client failed to connect: %w", err)
 	}
@@ -259,30 +309,24 @@ func newClient(ctx context.Context) (*mongo.Client, error) {
 func newClientWithAutoEncryptionWithNoSchemaMap(
 	ctx context.Context, providers map[string]map[string]interface{},
 ) (*mongo.Client, error) {
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, fmt.Errorf("MONGODB_URI environment variable is not set")
+	clientOpts, err := utils.ClientOptions()
+	if err != nil {
+		return nil, err
 	}
 	autoEncryptionOpts := options.AutoEncryption().
 		SetKeyVaultNamespace(_keyVaultNamespace).
 		SetKmsProviders(providers)
 
-	return mongo.Connect(ctx, options.Client().
-		ApplyURI(uri).
-		SetAutoEncryptionOptions(autoEncryptionOpts),
-	)
+	return mongo.Connect(ctx, clientOpts.SetAutoEncryptionOptions(autoEncryptionOpts))
 }
 
-func insertUser(ctx context.Context, client *mongo.Client, doc bson.M) error {
-	users := client.Database(_databaseName).Collection(_collectionName)
-	_, err := users.InsertOne(ctx, doc)
-	return err
+func insertUser(ctx context.Context, encClient, rawClient *mongo.Client, doc bson.M) error {
+	return utils.InsertEncrypted(ctx, encClient, rawClient, _usersColl, doc, []string{"ssn"})
 }
 
 func readUser(ctx context.Context, client *mongo.Client, filter bson.M) (bson.M, error) {
-	users := client.Database(_databaseName).Collection(_collectionName)
 	var result bson.M
-	if err := users.FindOne(ctx, filter).Decode(&result); err != nil {
+	if err := _usersColl.Collection(client).FindOne(ctx, filter).Decode(&result); err != nil {
 		return nil, err
 	}
 	return result, nil
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPlanSchemaMapToQE plans the move of the users collection to QE: the deterministic ssn
+// becomes an equality field, under a DEK yet to be generated.
+func TestPlanSchemaMapToQE(t *testing.T) {
+	dek := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	plan, err := utils.PlanCSFLEtoQE(getSchemaMap(dek))
+	if err != nil {
+		t.Fatalf("PlanCSFLEtoQE() error = %v", err)
+	}
+	want := bson.M{
+		_usersColl.String(): bson.M{"fields": []bson.M{{
+			"keyId":    nil,
+			"path":     "ssn",
+			"bsonType": "string",
+			"queries":  []bson.M{{"queryType": "equality"}},
+		}}},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("PlanCSFLEtoQE() = %v, want %v", plan, want)
+	}
+}
+
+func TestDescribeSchemaMap(t *testing.T) {
+	dek := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	got, err := utils.DescribeEncryptionConfig(getSchemaMap(dek))
+	if err != nil {
+		t.Fatalf("DescribeEncryptionConfig() error = %v", err)
+	}
+	want := []utils.FieldDescription{{
+		Namespace: _usersColl.String(),
+		Path:      "ssn",
+		BSONType:  "string",
+		Algorithm: utils.AlgorithmDeterministic,
+		Queryable: true,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DescribeEncryptionConfig() = %+v, want %+v", got, want)
+	}
+}
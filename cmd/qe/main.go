@@ -2,13 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
-	"os"
 
 	"github.com/prabath/mongodb-enc-poc/utils"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -20,7 +19,14 @@ const (
 )
 
 func main() {
-	ctx := context.Background()
+	metricsAddr := flag.String("metrics-addr", "",
+		"serve Prometheus metrics on this address (e.g. :9090) while the demo runs")
+	flag.Parse()
+	ctx, shutdownMetrics, err := utils.StartMetrics(context.Background(), *metricsAddr, "mongodb_enc")
+	if err != nil {
+		log.Fatalf("Failed to start the metrics server: %v", err)
+	}
+	defer shutdownMetrics()
 
 	devOrgID := "don:identity:dvrv-us-1:devo/10"
 	providerName, err := utils.GetProviderName(devOrgID)
@@ -39,77 +45,41 @@ func main() {
 		providerName: {"key": localMasterKey},
 	}
 
-	autoEncryptionOptions := options.AutoEncryption().
-		SetKeyVaultNamespace(_keyVaultNamespace).
-		SetKmsProviders(kmsProviders)
-
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		log.Fatalf("MONGODB_URI environment variable is not set")
-	}
-
-	encryptedClient, err := mongo.Connect(
-		ctx,
-		options.Client().ApplyURI(uri).SetAutoEncryptionOptions(autoEncryptionOptions),
-	)
-	if err != nil {
-		log.Fatalf("Failed to create encrypted client: %v", err)
-	}
-
-	defer encryptedClient.Disconnect(ctx)
-
-	opts := options.ClientEncryption().
-		SetKeyVaultNamespace(_keyVaultNamespace).
-		SetKmsProviders(kmsProviders)
-	clientEncryption, err := mongo.NewClientEncryption(encryptedClient, opts)
+	// The collection is created, and the DEKs of its fields, through a regular client. The
+	// encrypting client is created once the encryptedFields of the collection, keyIds included,
+	// are known, so it encrypts per the local encryptedFieldsMap instead of trusting whatever the
+	// server reports for the collection.
+	var res utils.Resources
+	defer res.Close(ctx)
+	keyVaultClient, clientEncryption, err := utils.OpenKeyVault(ctx, &res, _keyVaultNamespace, kmsProviders)
 	if err != nil {
-		log.Fatalf("Failed to create client encryption: %v", err)
+		log.Fatalf("Failed to open the key vault: %v", err)
 	}
 
-	database := encryptedClient.Database(_databaseName)
+	usersColl := utils.CollRef{Database: _databaseName, Name: _collectionName}
+	database := keyVaultClient.Database(_databaseName)
 	filter := bson.D{{Key: "name", Value: _collectionName}}
 	collectionNames, err := database.ListCollectionNames(ctx, filter)
 	if err != nil {
 		log.Fatalf("Failed to list collections: %v", err)
 	}
 
+	encryptedFieldsMap, err := utils.NewEncryptedFieldsBuilder().
+		AddEquality("ssn", "string").
+		AddRange("age", "int", 0, 120).
+		AddUnindexed("email", "string").
+		Build()
+	if err != nil {
+		log.Fatalf("Invalid encrypted fields: %v", err)
+	}
+
+	var encryptedFields bson.M
 	if len(collectionNames) == 0 {
-		encryptedFieldsMap := bson.M{
-			"fields": []bson.M{
-				{
-					"keyId":    nil,
-					"path":     "ssn",
-					"bsonType": "string",
-					"queries": []bson.M{
-						{
-							"queryType": "equality",
-						},
-					},
-				},
-				{
-					"keyId":    nil,
-					"path":     "age",
-					"bsonType": "int",
-					"queries": []bson.M{
-						{
-							"queryType": "range",
-							"min":       0,
-							"max":       120,
-						},
-					},
-				},
-				{
-					"keyId":    nil,
-					"path":     "email",
-					"bsonType": "string",
-				},
-			},
-		}
 		createCollectionOptions := options.CreateCollection().SetEncryptedFields(encryptedFieldsMap)
-		_, _, err =
+		_, encryptedFields, err =
 			clientEncryption.CreateEncryptedCollection(
 				ctx,
-				encryptedClient.Database(_databaseName),
+				database,
 				_collectionName,
 				createCollectionOptions,
 				providerName,
@@ -118,13 +88,40 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to create the encrypted collection: %v", err)
 		}
+	} else {
+		// The collection exists; make sure it was created with the fields we expect, otherwise the
+		// inserts below would fail with a much less helpful error.
+		err = utils.VerifyEncryptedFields(ctx, keyVaultClient, usersColl, encryptedFieldsMap)
+		if err != nil {
+			log.Fatalf("Existing collection is not usable: %v", err)
+		}
+		encryptedFields, err = utils.CollectionEncryptedFields(ctx, keyVaultClient, usersColl)
+		if err != nil {
+			log.Fatalf("Failed to read the encrypted fields: %v", err)
+		}
 	}
 
-	coll := encryptedClient.Database(_databaseName).Collection(_collectionName)
+	encryptedClient, err := utils.NewClient(ctx, utils.Config{
+		KeyVaultNamespace:  _keyVaultNamespace,
+		KMSProviders:       kmsProviders,
+		EncryptedFieldsMap: bson.M{usersColl.String(): encryptedFields},
+	})
+	if err != nil {
+		log.Fatalf("Failed to create encrypted client: %v", err)
+	}
+	defer encryptedClient.Disconnect(ctx)
+
+	coll := usersColl.Collection(encryptedClient)
 
 	doc := bson.M{"name": "Bob", "email": "prabath@devrev.ai", "ssn": "987-65-4320", "age": 30}
-	_, err = coll.InsertOne(context.TODO(), doc)
+	if err := utils.ValidateRangeValue("age", doc["age"], encryptedFieldsMap); err != nil {
+		log.Fatalf("Invalid document: %v", err)
+	}
+	encFields, err := utils.EncryptedFieldPathsFromCollection(ctx, keyVaultClient, usersColl)
 	if err != nil {
+		log.Fatalf("Failed to read the encrypted fields: %v", err)
+	}
+	if err := utils.InsertEncrypted(ctx, encryptedClient, keyVaultClient, usersColl, doc, encFields); err != nil {
 		log.Fatalf("Unable to insert document: %+v", err)
 	}
 
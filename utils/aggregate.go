@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AggregateDecrypted runs an aggregation pipeline, e.g. one joining the users to another collection
+// with $lookup, and returns the results with every encrypted field decrypted, including the fields
+// of the joined documents.
+//
+// Decryption of the results doesn't depend on the schema map: the driver decrypts any ciphertext
+// in the server's reply using the DEK id embedded in it. The limitations are on the way in, where
+// the driver analyzes the pipeline to encrypt it:
+//   - Before MongoDB 8.1 (and libmongocrypt 1.13), the query analysis of CSFLE and QE rejects a
+//     pipeline with $lookup over collections that have encrypted fields. A client created with
+//     bypassAutoEncryption (see NewEncClient) still decrypts the results automatically, so it can
+//     be used instead, provided the pipeline has no filters on encrypted fields.
+//   - The join keys (localField/foreignField) can't be randomly encrypted fields. Deterministic
+//     fields only match if both sides were encrypted with the same DEK.
+//
+// The stages are checked before the pipeline is sent, and a malformed one (e.g. a $lookup without
+// its "as" field) is reported with its index and operator.
+func AggregateDecrypted(
+	ctx context.Context, client *mongo.Client, coll CollRef, pipeline mongo.Pipeline,
+) ([]bson.M, error) {
+	if err := checkPipeline(pipeline); err != nil {
+		return nil, fmt.Errorf("invalid aggregation on %s: %w", coll, err)
+	}
+	cursor, err := coll.Collection(client).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("aggregation on %s failed: %w", coll, err)
+	}
+	return aggregationResults(ctx, cursor, coll)
+}
+
+// aggregationResults decodes the documents of the cursor of an aggregation on coll, and closes it.
+func aggregationResults(ctx context.Context, cursor *mongo.Cursor, coll CollRef) ([]bson.M, error) {
+	defer cursor.Close(ctx)
+	var results []bson.M
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode the aggregation results of %s: %w", coll, err)
+	}
+	return results, nil
+}
+
+// checkPipeline checks that every stage has a single operator, and that each $lookup names the
+// field to write the joined documents to and how to match them: either the collection to join and
+// both join keys, or a sub-pipeline (whose stages are checked too).
+func checkPipeline(pipeline mongo.Pipeline) error {
+	for i, stage := range pipeline {
+		if len(stage) != 1 || !strings.HasPrefix(stage[0].Key, "$") {
+			return fmt.Errorf("stage %d must have a single $ operator", i)
+		}
+		if stage[0].Key != "$lookup" {
+			continue
+		}
+		if err := checkLookup(stage[0].Value); err != nil {
+			return fmt.Errorf("stage %d ($lookup): %w", i, err)
+		}
+	}
+	return nil
+}
+
+func checkLookup(spec interface{}) error {
+	data, err := bson.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("invalid specification: %w", err)
+	}
+	var lookup struct {
+		From         string          `bson:"from"`
+		As           string          `bson:"as"`
+		LocalField   string          `bson:"localField"`
+		ForeignField string          `bson:"foreignField"`
+		Pipeline     *mongo.Pipeline `bson:"pipeline"`
+	}
+	if err := bson.Unmarshal(data, &lookup); err != nil {
+		return fmt.Errorf("invalid specification: %w", err)
+	}
+	switch {
+	case lookup.As == "":
+		return fmt.Errorf("'as' is required")
+	case (lookup.LocalField == "") != (lookup.ForeignField == ""):
+		return fmt.Errorf("'localField' and 'foreignField' must be set together")
+	case lookup.LocalField == "" && lookup.Pipeline == nil:
+		return fmt.Errorf("either the join keys or a 'pipeline' is required")
+	case lookup.From == "" && lookup.Pipeline == nil:
+		return fmt.Errorf("'from' is required")
+	case lookup.Pipeline != nil:
+		return checkPipeline(*lookup.Pipeline)
+	}
+	return nil
+}
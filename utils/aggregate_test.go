@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestAggregateDecrypted(t *testing.T) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"name": "Bob"}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "accounts", "localField": "_id", "foreignField": "userId", "as": "accounts",
+		}}},
+	}
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	_, err := AggregateDecrypted(context.Background(), unreachableClient(t), coll, pipeline)
+	if err == nil || !strings.Contains(err.Error(), "aggregation on csfle_db.users failed") {
+		t.Errorf("AggregateDecrypted() error = %v, want the aggregation on csfle_db.users to fail", err)
+	}
+}
+
+// TestAggregateDecryptedInvalidLookup checks that a malformed stage is reported with its index
+// before anything is sent to the server.
+func TestAggregateDecryptedInvalidLookup(t *testing.T) {
+	match := bson.D{{Key: "$match", Value: bson.M{"name": "Bob"}}}
+	tests := []struct {
+		name   string
+		lookup bson.M
+		want   string
+	}{
+		{
+			name:   "no as",
+			lookup: bson.M{"from": "accounts", "localField": "_id", "foreignField": "userId"},
+			want:   "stage 1 ($lookup): 'as' is required",
+		},
+		{
+			name:   "no foreignField",
+			lookup: bson.M{"from": "accounts", "localField": "_id", "as": "accounts"},
+			want:   "stage 1 ($lookup): 'localField' and 'foreignField' must be set together",
+		},
+		{
+			name:   "no join",
+			lookup: bson.M{"from": "accounts", "as": "accounts"},
+			want:   "stage 1 ($lookup): either the join keys or a 'pipeline' is required",
+		},
+		{
+			name:   "no from",
+			lookup: bson.M{"localField": "_id", "foreignField": "userId", "as": "accounts"},
+			want:   "stage 1 ($lookup): 'from' is required",
+		},
+		{
+			name: "invalid sub-pipeline",
+			lookup: bson.M{"from": "accounts", "as": "accounts", "pipeline": bson.A{
+				bson.M{"$match": bson.M{}, "$limit": 1},
+			}},
+			want: "stage 1 ($lookup): stage 0 must have a single $ operator",
+		},
+	}
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := mongo.Pipeline{match, {{Key: "$lookup", Value: tt.lookup}}}
+			// The client is never reached: an invalid pipeline fails before it's sent.
+			_, err := AggregateDecrypted(context.Background(), unreachableClient(t), coll, pipeline)
+			if err == nil || !strings.Contains(err.Error(), tt.want) ||
+				!strings.Contains(err.Error(), "invalid aggregation on csfle_db.users") {
+				t.Errorf("AggregateDecrypted() error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	valid := bson.M{"from": "accounts", "as": "accounts", "pipeline": bson.A{bson.M{"$limit": 1}}}
+	if err := checkPipeline(mongo.Pipeline{match, {{Key: "$lookup", Value: valid}}}); err != nil {
+		t.Errorf("checkPipeline() of a $lookup with a sub-pipeline error = %v", err)
+	}
+}
+
+// TestAggregationResults feeds the results of a $lookup, as the encrypting client returns them
+// with the joined documents decrypted, through the decoding of AggregateDecrypted.
+func TestAggregationResults(t *testing.T) {
+	cursor := keyCursor(t, bson.M{
+		"_id":  1,
+		"name": "Bob",
+		"ssn":  "987-65-4320",
+		"accounts": bson.A{
+			bson.M{"userId": 1, "iban": "DE89370400440532013000", "holder": bson.M{"ssn": "987-65-4320"}},
+			bson.M{"userId": 1, "iban": "GB29NWBK60161331926819", "holder": bson.M{"ssn": "987-65-4320"}},
+		},
+	})
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	results, err := aggregationResults(context.Background(), cursor, coll)
+	if err != nil {
+		t.Fatalf("aggregationResults() error = %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("aggregationResults() returned %d documents, want 1", len(results))
+	}
+	accounts, ok := results[0]["accounts"].(bson.A)
+	if !ok || len(accounts) != 2 {
+		t.Fatalf("joined accounts = %#v, want 2 documents", results[0]["accounts"])
+	}
+	for i, account := range accounts {
+		holder, _ := account.(bson.M)["holder"].(bson.M)
+		if holder["ssn"] != "987-65-4320" {
+			t.Errorf("joined account %d holder ssn = %v, want 987-65-4320", i, holder["ssn"])
+		}
+	}
+	if results[0]["ssn"] != "987-65-4320" {
+		t.Errorf("ssn = %v, want 987-65-4320", results[0]["ssn"])
+	}
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const _defaultDecryptPartitions = 4
+
+// BatchDecryptor decrypts a batch of documents (e.g. a page of a CDC stream) concurrently. The
+// work is partitioned by DEK UUID, so all the values encrypted with the same DEK are decrypted by
+// the same worker, one after the other, which keeps the driver's per-key cache warm and avoids
+// workers contending for the same key; values encrypted with different DEKs decrypt in parallel.
+type BatchDecryptor struct {
+	decryptor  *Decryptor
+	partitions int
+	onDecrypt  func(worker int, keyID primitive.Binary)
+}
+
+// NewBatchDecryptor returns a BatchDecryptor with the given number of partitions (workers). A
+// non-positive count uses the default.
+func NewBatchDecryptor(decryptor *Decryptor, partitions int) *BatchDecryptor {
+	if partitions <= 0 {
+		partitions = _defaultDecryptPartitions
+	}
+	return &BatchDecryptor{decryptor: decryptor, partitions: partitions}
+}
+
+// Partitions returns the number of partitions the work is spread over.
+func (b *BatchDecryptor) Partitions() int {
+	return b.partitions
+}
+
+// SetOnDecrypt sets a hook which is called, from the worker, for every value the worker decrypts.
+func (b *BatchDecryptor) SetOnDecrypt(hook func(worker int, keyID primitive.Binary)) {
+	b.onDecrypt = hook
+}
+
+type decryptTask struct {
+	ref   ciphertextRef
+	keyID primitive.Binary
+	value interface{}
+	err   error
+}
+
+// DecryptDocuments decrypts, in place, every ciphertext in the documents and returns them. If any
+// value fails to decrypt, the first failure is returned and the documents are left untouched.
+func (b *BatchDecryptor) DecryptDocuments(ctx context.Context, docs []bson.M) ([]bson.M, error) {
+	partitions := make([][]*decryptTask, b.partitions)
+	for i, doc := range docs {
+		for _, ref := range findCiphertext(doc, "") {
+			info, err := InspectCiphertext(ref.ciphertext)
+			if err != nil {
+				return nil, fmt.Errorf("document %d, field '%s': %w", i, ref.path, err)
+			}
+			p := partitionOf(info.KeyID, b.partitions)
+			partitions[p] = append(partitions[p], &decryptTask{ref: ref, keyID: info.KeyID})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for worker, tasks := range partitions {
+		if len(tasks) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(worker int, tasks []*decryptTask) {
+			defer wg.Done()
+			for _, task := range tasks {
+				if err := ctx.Err(); err != nil {
+					task.err = err
+					return
+				}
+				if b.onDecrypt != nil {
+					b.onDecrypt(worker, task.keyID)
+				}
+				task.value, task.err = b.decryptor.Decrypt(ctx, task.ref.ciphertext)
+			}
+		}(worker, tasks)
+	}
+	wg.Wait()
+
+	// The documents are only modified once all the workers are done; the maps in a document
+	// can't be written to concurrently.
+	for _, tasks := range partitions {
+		for _, task := range tasks {
+			if task.err != nil {
+				return nil, fmt.Errorf("failed to decrypt field '%s': %w", task.ref.path, task.err)
+			}
+		}
+	}
+	for _, tasks := range partitions {
+		for _, task := range tasks {
+			task.ref.set(task.value)
+		}
+	}
+	return docs, nil
+}
+
+func partitionOf(keyID primitive.Binary, partitions int) int {
+	h := fnv.New32a()
+	h.Write(keyID.Data)
+	return int(h.Sum32() % uint32(partitions))
+}
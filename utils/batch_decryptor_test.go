@@ -0,0 +1,83 @@
+package utils_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestBatchDecryptorPartitionsByDek decrypts the documents of three tenants and checks, through
+// the hook, that each DEK's values were all decrypted by one worker.
+func TestBatchDecryptorPartitionsByDek(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	var keyIDs []primitive.Binary
+	for _, provider := range []string{"local:100", "local:200", "local:300"} {
+		keyIDs = append(keyIDs, fake.AddKey(provider, "dek-"+provider))
+	}
+	var docs []bson.M
+	for i := range 30 {
+		keyID := keyIDs[i%len(keyIDs)]
+		docs = append(docs, bson.M{
+			"ssn":     encryptWith(t, fake, keyID, fmt.Sprintf("ssn-%d", i)),
+			"profile": bson.M{"email": encryptWith(t, fake, keyID, fmt.Sprintf("user%d@example.com", i))},
+			"name":    fmt.Sprintf("user %d", i),
+		})
+	}
+
+	batch := utils.NewBatchDecryptor(utils.NewDecryptor(fake), 2)
+	if batch.Partitions() != 2 {
+		t.Errorf("Partitions() = %d, want 2", batch.Partitions())
+	}
+	var mu sync.Mutex
+	workers := make(map[string]map[int]bool)
+	batch.SetOnDecrypt(func(worker int, keyID primitive.Binary) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := string(keyID.Data)
+		if workers[key] == nil {
+			workers[key] = make(map[int]bool)
+		}
+		workers[key][worker] = true
+	})
+
+	got, err := batch.DecryptDocuments(context.Background(), docs)
+	if err != nil {
+		t.Fatalf("DecryptDocuments() error = %v", err)
+	}
+	for i, doc := range got {
+		email := doc["profile"].(bson.M)["email"]
+		if doc["ssn"] != fmt.Sprintf("ssn-%d", i) || email != fmt.Sprintf("user%d@example.com", i) {
+			t.Errorf("document %d = %v, want it decrypted", i, doc)
+		}
+	}
+	if len(workers) != len(keyIDs) {
+		t.Errorf("the hook saw %d DEKs, want %d", len(workers), len(keyIDs))
+	}
+	for key, ran := range workers {
+		if len(ran) != 1 {
+			t.Errorf("the values of DEK %x were decrypted by workers %v, want one", key, ran)
+		}
+	}
+}
+
+func TestBatchDecryptorFailure(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ciphertext := encryptWith(t, fake, keyID, "987-65-4320")
+	fake.DecryptErr = fmt.Errorf("KMS unavailable")
+
+	docs := []bson.M{{"ssn": ciphertext}}
+	batch := utils.NewBatchDecryptor(utils.NewDecryptor(fake), 0)
+	if _, err := batch.DecryptDocuments(context.Background(), docs); err == nil {
+		t.Fatal("DecryptDocuments() succeeded, want the decryption error")
+	}
+	if _, ok := docs[0]["ssn"].(primitive.Binary); !ok {
+		t.Errorf("document = %v, want it untouched", docs[0])
+	}
+}
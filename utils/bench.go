@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExplicitCipher is the explicit encryption subset of *mongo.ClientEncryption.
+type ExplicitCipher interface {
+	Encrypt(ctx context.Context, val bson.RawValue, opts ...*options.EncryptOptions) (primitive.Binary, error)
+	Decrypt(ctx context.Context, val primitive.Binary) (bson.RawValue, error)
+}
+
+type BenchmarkConfig struct {
+	// Number of values to encrypt and then decrypt.
+	Count int
+	// Size in bytes of each plaintext string value.
+	ValueSize int
+	// DEK to encrypt with, and the algorithm to use.
+	KeyID     primitive.Binary
+	Algorithm string
+}
+
+type BenchmarkResult struct {
+	Count            int
+	EncryptOpsPerSec float64
+	DecryptOpsPerSec float64
+	EncryptP50       time.Duration
+	EncryptP99       time.Duration
+	DecryptP50       time.Duration
+	DecryptP99       time.Duration
+}
+
+// RunBenchmark performs cfg.Count explicit encryptions of representative values followed by the
+// decryption of each ciphertext, all through the one cipher (ClientEncryption), and reports the
+// throughput and latency of each. This helps with capacity planning, e.g. choosing contention
+// factors and connection pool sizes.
+func RunBenchmark(ctx context.Context, cipher ExplicitCipher, cfg BenchmarkConfig) (BenchmarkResult, error) {
+	if cfg.Count <= 0 {
+		return BenchmarkResult{}, fmt.Errorf("benchmark count must be positive: %d", cfg.Count)
+	}
+	if cfg.ValueSize <= 0 {
+		return BenchmarkResult{}, fmt.Errorf("benchmark value size must be positive: %d", cfg.ValueSize)
+	}
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = AlgorithmDeterministic
+	}
+
+	values, err := benchmarkValues(cfg.Count, cfg.ValueSize)
+	if err != nil {
+		return BenchmarkResult{}, err
+	}
+	opts := options.Encrypt().SetKeyID(cfg.KeyID).SetAlgorithm(cfg.Algorithm)
+
+	ciphertexts := make([]primitive.Binary, cfg.Count)
+	encryptLatencies := make([]time.Duration, cfg.Count)
+	encryptStart := time.Now()
+	for i, value := range values {
+		start := time.Now()
+		ciphertexts[i], err = cipher.Encrypt(ctx, value, opts)
+		if err != nil {
+			return BenchmarkResult{}, fmt.Errorf("failed to encrypt value %d: %w", i, err)
+		}
+		encryptLatencies[i] = time.Since(start)
+	}
+	encryptElapsed := time.Since(encryptStart)
+
+	decryptLatencies := make([]time.Duration, cfg.Count)
+	decryptStart := time.Now()
+	for i, ciphertext := range ciphertexts {
+		start := time.Now()
+		if _, err := cipher.Decrypt(ctx, ciphertext); err != nil {
+			return BenchmarkResult{}, fmt.Errorf("failed to decrypt value %d: %w", i, err)
+		}
+		decryptLatencies[i] = time.Since(start)
+	}
+	decryptElapsed := time.Since(decryptStart)
+
+	return BenchmarkResult{
+		Count:            cfg.Count,
+		EncryptOpsPerSec: opsPerSec(cfg.Count, encryptElapsed),
+		DecryptOpsPerSec: opsPerSec(cfg.Count, decryptElapsed),
+		EncryptP50:       percentile(encryptLatencies, 50),
+		EncryptP99:       percentile(encryptLatencies, 99),
+		DecryptP50:       percentile(decryptLatencies, 50),
+		DecryptP99:       percentile(decryptLatencies, 99),
+	}, nil
+}
+
+func benchmarkValues(count, size int) ([]bson.RawValue, error) {
+	buf := make([]byte, (size+1)/2)
+	values := make([]bson.RawValue, count)
+	for i := range values {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate benchmark value: %w", err)
+		}
+		value, err := toRawValue(hex.EncodeToString(buf)[:size])
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func opsPerSec(count int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+// percentile returns the p-th percentile of the latencies using the nearest-rank method. It sorts
+// the slice in place.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	rank := (p*len(latencies) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
@@ -0,0 +1,37 @@
+package utils_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	result, err := utils.RunBenchmark(context.Background(), fake, utils.BenchmarkConfig{
+		Count:     100,
+		ValueSize: 31,
+		KeyID:     keyID,
+	})
+	if err != nil {
+		t.Fatalf("RunBenchmark() error = %v", err)
+	}
+	if result.Count != 100 || result.EncryptOpsPerSec <= 0 || result.DecryptOpsPerSec <= 0 {
+		t.Errorf("RunBenchmark() = %+v, want 100 values at a non-zero throughput", result)
+	}
+	if result.EncryptP50 > result.EncryptP99 || result.DecryptP50 > result.DecryptP99 {
+		t.Errorf("RunBenchmark() = %+v, want p50 <= p99", result)
+	}
+}
+
+func TestRunBenchmarkInvalidConfig(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	for _, cfg := range []utils.BenchmarkConfig{{Count: 0, ValueSize: 64}, {Count: 10, ValueSize: 0}} {
+		if _, err := utils.RunBenchmark(context.Background(), fake, cfg); err == nil {
+			t.Errorf("RunBenchmark(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Blob subtypes found in the first byte of a ciphertext (BinData subtype 6).
+const (
+	_blobSubtypeDeterministic byte = 1
+	_blobSubtypeRandom        byte = 2
+	_blobSubtypeQEUnindexed   byte = 6
+	_blobSubtypeQEEquality    byte = 7
+	_blobSubtypeQERange       byte = 9
+	_blobSubtypeQEEqualityV2  byte = 14
+	_blobSubtypeQERangeV2     byte = 15
+	_blobSubtypeQEUnindexedV2 byte = 16
+)
+
+const (
+	_ciphertextHeaderSize      = 1 + 16 + 1
+	_uuidSubtype          byte = 4
+)
+
+// CiphertextInfo is the metadata found in the header of a ciphertext.
+type CiphertextInfo struct {
+	// The blob subtype, which tells the encryption algorithm.
+	BlobSubtype byte
+	// The UUID of the DEK the value was encrypted with.
+	KeyID primitive.Binary
+	// The BSON type of the value before encryption.
+	OriginalType bsontype.Type
+}
+
+// Algorithm returns the name of the algorithm the value was encrypted with.
+func (c CiphertextInfo) Algorithm() string {
+	switch c.BlobSubtype {
+	case _blobSubtypeDeterministic:
+		return AlgorithmDeterministic
+	case _blobSubtypeRandom:
+		return AlgorithmRandom
+	case _blobSubtypeQEEquality, _blobSubtypeQEEqualityV2:
+		return "Indexed (equality)"
+	case _blobSubtypeQERange, _blobSubtypeQERangeV2:
+		return "Range"
+	case _blobSubtypeQEUnindexed, _blobSubtypeQEUnindexedV2:
+		return "Unindexed"
+	default:
+		return "unknown"
+	}
+}
+
+// InspectCiphertext parses the header of a CSFLE or QE ciphertext without decrypting it. Both lay
+// out the header the same way: one byte of blob subtype, the 16 byte UUID of the DEK, and one byte
+// with the BSON type of the plaintext.
+//
+// The input may come from a compromised or buggy writer, so the header is validated rather than
+// trusted: an unknown blob subtype, an invalid BSON type or a missing payload is an error.
+func InspectCiphertext(bin primitive.Binary) (CiphertextInfo, error) {
+	if bin.Subtype != _encryptedSubtype {
+		return CiphertextInfo{}, fmt.Errorf("not a ciphertext: binary subtype is %d", bin.Subtype)
+	}
+	// A valid ciphertext always carries an encrypted payload after the header.
+	if len(bin.Data) <= _ciphertextHeaderSize {
+		return CiphertextInfo{}, fmt.Errorf("ciphertext is too short: %d bytes", len(bin.Data))
+	}
+
+	info := CiphertextInfo{
+		BlobSubtype:  bin.Data[0],
+		OriginalType: bsontype.Type(bin.Data[17]),
+	}
+	if info.Algorithm() == "unknown" {
+		return CiphertextInfo{}, fmt.Errorf("unknown ciphertext blob subtype %d", info.BlobSubtype)
+	}
+	if !info.OriginalType.IsValid() {
+		return CiphertextInfo{}, fmt.Errorf("invalid BSON type %d in the ciphertext header", bin.Data[17])
+	}
+
+	keyID := make([]byte, 16)
+	copy(keyID, bin.Data[1:17])
+	info.KeyID = primitive.Binary{Subtype: _uuidSubtype, Data: keyID}
+	return info, nil
+}
+
+// RequiredDeks returns the distinct DEK UUIDs needed to decrypt every ciphertext in the document,
+// sorted by UUID.
+func RequiredDeks(doc bson.M) ([]primitive.Binary, error) {
+	seen := make(map[string]struct{})
+	var keyIDs []primitive.Binary
+	for _, ref := range findCiphertext(doc, "") {
+		info, err := InspectCiphertext(ref.ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", ref.path, err)
+		}
+		if _, ok := seen[string(info.KeyID.Data)]; ok {
+			continue
+		}
+		seen[string(info.KeyID.Data)] = struct{}{}
+		keyIDs = append(keyIDs, info.KeyID)
+	}
+	sort.Slice(keyIDs, func(i, j int) bool { return bytes.Compare(keyIDs[i].Data, keyIDs[j].Data) < 0 })
+	return keyIDs, nil
+}
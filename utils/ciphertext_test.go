@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// addCiphertextSeeds seeds a fuzz target with the real ciphertext of the deterministic vectors,
+// on top of the corpus in testdata/fuzz.
+func addCiphertextSeeds(f *testing.F) {
+	vectors, _ := loadDeterministicVectors(f)
+	for _, vector := range vectors.Vectors[:4] {
+		ciphertext, err := base64.StdEncoding.DecodeString(vector.Ciphertext)
+		if err != nil {
+			f.Fatalf("invalid ciphertext of vector %s: %v", vector.Name, err)
+		}
+		f.Add(ciphertext)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{_blobSubtypeRandom})
+	f.Add(append([]byte{_blobSubtypeDeterministic}, make([]byte, _ciphertextHeaderSize-1)...))
+}
+
+// FuzzInspectCiphertext checks that the header parser never panics, and that whatever it accepts
+// is a well-formed header it copied out of the input.
+func FuzzInspectCiphertext(f *testing.F) {
+	addCiphertextSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		input := bytes.Clone(data)
+		info, err := InspectCiphertext(primitive.Binary{Subtype: _encryptedSubtype, Data: data})
+		if !bytes.Equal(data, input) {
+			t.Fatal("InspectCiphertext modified its input")
+		}
+		if err != nil {
+			if !reflect.DeepEqual(info, CiphertextInfo{}) {
+				t.Fatalf("InspectCiphertext returned %+v along with the error %v", info, err)
+			}
+			return
+		}
+		if len(data) <= _ciphertextHeaderSize {
+			t.Fatalf("InspectCiphertext accepted a %d byte ciphertext", len(data))
+		}
+		if info.Algorithm() == "unknown" || !info.OriginalType.IsValid() {
+			t.Fatalf("InspectCiphertext accepted the invalid header %+v", info)
+		}
+		if info.KeyID.Subtype != _uuidSubtype || !bytes.Equal(info.KeyID.Data, data[1:17]) {
+			t.Fatalf("key id = %v, want the UUID %x", info.KeyID, data[1:17])
+		}
+		// The key ID must not alias the input, which the caller may reuse.
+		data[1] ^= 0xff
+		if info.KeyID.Data[0] == data[1] {
+			t.Fatal("the key id aliases the ciphertext")
+		}
+	})
+}
+
+// FuzzRequiredDeks checks that RequiredDeks never panics on a document holding arbitrary
+// ciphertext, nested or not, and fails exactly when one of them has an invalid header.
+func FuzzRequiredDeks(f *testing.F) {
+	addCiphertextSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		bin := primitive.Binary{Subtype: _encryptedSubtype, Data: data}
+		doc := bson.M{
+			"a":      bin,
+			"nested": bson.M{"b": bin, "list": bson.A{bin, "plaintext", bson.D{{Key: "c", Value: bin}}}},
+		}
+		keyIDs, err := RequiredDeks(doc)
+		_, inspectErr := InspectCiphertext(bin)
+		if (err != nil) != (inspectErr != nil) {
+			t.Fatalf("RequiredDeks error = %v, InspectCiphertext error = %v", err, inspectErr)
+		}
+		if err == nil && (len(keyIDs) != 1 || !bytes.Equal(keyIDs[0].Data, data[1:17])) {
+			t.Fatalf("RequiredDeks() = %v, want the single DEK %x", keyIDs, data[1:17])
+		}
+	})
+}
+
+func TestInspectCiphertextMalformed(t *testing.T) {
+	valid := append([]byte{_blobSubtypeRandom}, make([]byte, 16)...)
+	valid = append(valid, byte(bson.TypeString), 0xaa)
+	tests := []struct {
+		name string
+		bin  primitive.Binary
+	}{
+		{name: "not subtype 6", bin: primitive.Binary{Subtype: 0, Data: valid}},
+		{name: "empty", bin: primitive.Binary{Subtype: _encryptedSubtype}},
+		{name: "header only", bin: primitive.Binary{Subtype: _encryptedSubtype, Data: valid[:_ciphertextHeaderSize]}},
+		{name: "unknown blob subtype", bin: primitive.Binary{Subtype: _encryptedSubtype,
+			Data: append([]byte{3}, valid[1:]...)}},
+		{name: "invalid BSON type", bin: primitive.Binary{Subtype: _encryptedSubtype,
+			Data: append(append(bytes.Clone(valid[:17]), 0x42), valid[18:]...)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if info, err := InspectCiphertext(tt.bin); err == nil {
+				t.Errorf("InspectCiphertext() = %+v, want an error", info)
+			}
+		})
+	}
+	if _, err := InspectCiphertext(primitive.Binary{Subtype: _encryptedSubtype, Data: valid}); err != nil {
+		t.Errorf("InspectCiphertext() of a valid header error = %v", err)
+	}
+}
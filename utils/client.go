@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewClient connects a client configured for automatic encryption, with CSFLE or QE depending on
+// which of cfg.SchemaMap and cfg.EncryptedFieldsMap is set; exactly one must be. The connection
+// settings come from cfg too, not from the configuration set with SetConfig.
+func NewClient(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	autoEncryptionOpts, err := cfg.autoEncryptionOptions()
+	if err != nil {
+		return nil, err
+	}
+	return connectEncClient(ctx, cfg, autoEncryptionOpts)
+}
+
+// autoEncryptionOptions builds the automatic encryption options of NewClient.
+func (c Config) autoEncryptionOptions() (*options.AutoEncryptionOptions, error) {
+	if c.KeyVaultNamespace == "" {
+		return nil, fmt.Errorf("no key vault namespace configured")
+	}
+	if len(c.KMSProviders) == 0 {
+		return nil, fmt.Errorf("no KMS providers configured")
+	}
+	opts := options.AutoEncryption().
+		SetKeyVaultNamespace(c.KeyVaultNamespace).
+		SetKmsProviders(c.KMSProviders).
+		SetBypassAutoEncryption(c.BypassAutoEncryption)
+	switch {
+	case len(c.SchemaMap) > 0 && len(c.EncryptedFieldsMap) > 0:
+		return nil, fmt.Errorf("both a schema map (CSFLE) and an encryptedFields map (QE) are configured; " +
+			"set only one")
+	case len(c.SchemaMap) > 0:
+		opts.SetSchemaMap(c.SchemaMap)
+	case len(c.EncryptedFieldsMap) > 0:
+		opts.SetEncryptedFieldsMap(c.EncryptedFieldsMap)
+	default:
+		return nil, fmt.Errorf("neither a schema map (CSFLE) nor an encryptedFields map (QE) is configured")
+	}
+	return opts, nil
+}
+
+// connectEncClient connects a client with the connection settings of cfg and the given automatic
+// encryption options.
+func connectEncClient(
+	ctx context.Context, cfg Config, autoEncryptionOpts *options.AutoEncryptionOptions,
+) (*mongo.Client, error) {
+	clientOpts, err := cfg.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLibmongocrypt(); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkKeyCacheTTL(); err != nil {
+		return nil, err
+	}
+	if err := checkLocalKeyLengths(autoEncryptionOpts.KmsProviders); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyKMSTLS(autoEncryptionOpts); err != nil {
+		return nil, err
+	}
+
+	client, err := mongo.Connect(ctx, clientOpts.SetAutoEncryptionOptions(autoEncryptionOpts))
+	if err != nil {
+		return nil, fmt.Errorf("encryption client failed to connect: %w", classifyCryptProviderError(err))
+	}
+	return client, nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAutoEncryptionOptions(t *testing.T) {
+	schemaMap := map[string]interface{}{"csfle_db.users": bson.M{"bsonType": "object"}}
+	encryptedFieldsMap := map[string]interface{}{"qe_db.users": bson.M{"fields": bson.A{}}}
+	base := Config{
+		KeyVaultNamespace: "encryption.__keyVault",
+		KMSProviders:      map[string]map[string]interface{}{"local": {"key": make([]byte, _masterKeySize)}},
+	}
+
+	csfle := base
+	csfle.SchemaMap = schemaMap
+	opts, err := csfle.autoEncryptionOptions()
+	if err != nil {
+		t.Fatalf("autoEncryptionOptions() of CSFLE error = %v", err)
+	}
+	if !reflect.DeepEqual(opts.SchemaMap, schemaMap) || opts.EncryptedFieldsMap != nil {
+		t.Errorf("CSFLE options = %v, %v, want only the schema map", opts.SchemaMap, opts.EncryptedFieldsMap)
+	}
+	if opts.KeyVaultNamespace != base.KeyVaultNamespace ||
+		!reflect.DeepEqual(opts.KmsProviders, base.KMSProviders) {
+		t.Errorf("CSFLE options = %s, %v, want the configured key vault",
+			opts.KeyVaultNamespace, opts.KmsProviders)
+	}
+
+	qe := base
+	qe.EncryptedFieldsMap = encryptedFieldsMap
+	if opts, err = qe.autoEncryptionOptions(); err != nil {
+		t.Fatalf("autoEncryptionOptions() of QE error = %v", err)
+	}
+	if !reflect.DeepEqual(opts.EncryptedFieldsMap, encryptedFieldsMap) || opts.SchemaMap != nil {
+		t.Errorf("QE options = %v, %v, want only the encryptedFields map", opts.EncryptedFieldsMap, opts.SchemaMap)
+	}
+
+	both := csfle
+	both.EncryptedFieldsMap = encryptedFieldsMap
+	for name, tt := range map[string]struct {
+		cfg     Config
+		wantErr string
+	}{
+		"both":         {cfg: both, wantErr: "set only one"},
+		"neither":      {cfg: base, wantErr: "neither a schema map"},
+		"no key vault": {cfg: Config{SchemaMap: schemaMap, KMSProviders: base.KMSProviders}, wantErr: "key vault"},
+		"no providers": {cfg: Config{SchemaMap: schemaMap, KeyVaultNamespace: "a.b"}, wantErr: "KMS providers"},
+	} {
+		if _, err := tt.cfg.autoEncryptionOptions(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("autoEncryptionOptions() with %s error = %v, want %q", name, err, tt.wantErr)
+		}
+	}
+}
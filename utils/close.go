@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The default time we allow a ClientEncryption to tear down its key vault and mongocryptd
+// connections.
+const _defaultCloseTimeout = 10 * time.Second
+
+type contextCloser interface {
+	Close(ctx context.Context) error
+}
+
+// CloseClientEncryption closes the ClientEncryption with a fresh bounded context. It's meant to be
+// deferred, in place of clientEnc.Close(ctx), where ctx may already be cancelled by the time the
+// deferred call runs.
+func CloseClientEncryption(clientEnc *mongo.ClientEncryption) error {
+	return closeClientEncryption(clientEnc, _defaultCloseTimeout)
+}
+
+// closeClientEncryption deliberately does not derive from the request context; if the request
+// context is already cancelled, Close would fail straight away and leak the underlying
+// connections.
+func closeClientEncryption(ce contextCloser, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ce.Close(ctx)
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recordingCloser records the context it was closed with.
+type recordingCloser struct {
+	ctxErr      error
+	hasDeadline bool
+	err         error
+}
+
+func (c *recordingCloser) Close(ctx context.Context) error {
+	c.ctxErr = ctx.Err()
+	_, c.hasDeadline = ctx.Deadline()
+	return c.err
+}
+
+// TestCloseClientEncryption closes, as a deferred call does, after the request context is
+// cancelled.
+func TestCloseClientEncryption(t *testing.T) {
+	closer := &recordingCloser{}
+	func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer func() {
+			if err := closeClientEncryption(closer, time.Second); err != nil {
+				t.Errorf("closeClientEncryption() error = %v", err)
+			}
+		}()
+		cancel()
+		<-ctx.Done()
+	}()
+	if closer.ctxErr != nil {
+		t.Errorf("Close() got a context with error %v, want a live one", closer.ctxErr)
+	}
+	if !closer.hasDeadline {
+		t.Error("Close() got a context without a deadline, want it bounded by the timeout")
+	}
+
+	closer = &recordingCloser{err: errors.New("connection reset")}
+	if err := closeClientEncryption(closer, time.Second); !errors.Is(err, closer.err) {
+		t.Errorf("closeClientEncryption() error = %v, want %v", err, closer.err)
+	}
+}
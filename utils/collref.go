@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CollRef identifies a collection by its database and collection names.
+type CollRef struct {
+	Database string
+	Name     string
+}
+
+// The characters the server doesn't allow in a database name, on any platform.
+const _illegalDatabaseNameChars = "/\\. \"$\x00"
+
+// The maximum length in bytes of a database name.
+const _maxDatabaseNameLength = 63
+
+// ParseCollRef parses a <db>.<collection> namespace, e.g. "csfle_db.users", and checks that both
+// names are legal. The collection name may itself contain dots; the database name may not.
+func ParseCollRef(namespace string) (CollRef, error) {
+	dbName, collName, ok := strings.Cut(namespace, ".")
+	if !ok || dbName == "" || collName == "" {
+		return CollRef{}, fmt.Errorf("invalid namespace format, expected <db>.<collection>: %s", namespace)
+	}
+	coll := CollRef{Database: dbName, Name: collName}
+	if err := coll.Validate(); err != nil {
+		return CollRef{}, err
+	}
+	return coll, nil
+}
+
+// Validate checks that the database and collection names are legal, so a typo fails here rather
+// than as a server error on the first write.
+func (c CollRef) Validate() error {
+	switch {
+	case c.Database == "":
+		return fmt.Errorf("invalid namespace '%s': the database name is empty", c)
+	case len(c.Database) > _maxDatabaseNameLength:
+		return fmt.Errorf("invalid namespace '%s': the database name is longer than %d bytes",
+			c, _maxDatabaseNameLength)
+	case strings.ContainsAny(c.Database, _illegalDatabaseNameChars):
+		return fmt.Errorf("invalid namespace '%s': the database name may not contain any of %q",
+			c, _illegalDatabaseNameChars)
+	case c.Name == "":
+		return fmt.Errorf("invalid namespace '%s': the collection name is empty", c)
+	case strings.ContainsAny(c.Name, "$\x00"):
+		return fmt.Errorf("invalid namespace '%s': the collection name may not contain '$' or a null", c)
+	case strings.HasPrefix(c.Name, "system."):
+		return fmt.Errorf("invalid namespace '%s': the system. prefix is reserved", c)
+	}
+	return nil
+}
+
+// Collection returns the *mongo.Collection for the reference, bound to the given client.
+func (c CollRef) Collection(client *mongo.Client) *mongo.Collection {
+	return client.Database(c.Database).Collection(c.Name)
+}
+
+func (c CollRef) String() string {
+	return c.Database + "." + c.Name
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCollRef(t *testing.T) {
+	tests := []struct {
+		namespace string
+		want      CollRef
+		wantErr   string
+	}{
+		{namespace: "csfle_db.users", want: CollRef{Database: "csfle_db", Name: "users"}},
+		{namespace: "db.coll.with.dots", want: CollRef{Database: "db", Name: "coll.with.dots"}},
+		{namespace: "users", wantErr: "expected <db>.<collection>"},
+		{namespace: ".users", wantErr: "expected <db>.<collection>"},
+		{namespace: "db.", wantErr: "expected <db>.<collection>"},
+		{namespace: "my db.users", wantErr: "the database name may not contain"},
+		{namespace: "db$.users", wantErr: "the database name may not contain"},
+		{namespace: strings.Repeat("d", 64) + ".users", wantErr: "longer than 63 bytes"},
+		{namespace: "db.us$ers", wantErr: "may not contain '$' or a null"},
+		{namespace: "db.us\x00ers", wantErr: "may not contain '$' or a null"},
+		{namespace: "db.system.users", wantErr: "the system. prefix is reserved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			got, err := ParseCollRef(tt.namespace)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseCollRef() = %v, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ParseCollRef() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// FuzzParseCollRef checks that the namespace parser never panics, and that a namespace it accepts
+// is valid and round-trips through String.
+func FuzzParseCollRef(f *testing.F) {
+	for _, seed := range []string{"csfle_db.users", "db.a.b", "db.", ".coll", "db.system.users", "d\x00b.c"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, namespace string) {
+		coll, err := ParseCollRef(namespace)
+		if err != nil {
+			if coll != (CollRef{}) {
+				t.Fatalf("ParseCollRef(%q) returned %v along with the error %v", namespace, coll, err)
+			}
+			return
+		}
+		if err := coll.Validate(); err != nil {
+			t.Fatalf("ParseCollRef(%q) accepted the invalid %v: %v", namespace, coll, err)
+		}
+		if coll.String() != namespace {
+			t.Fatalf("ParseCollRef(%q).String() = %q", namespace, coll.String())
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// CommandEvent is a redacted driver command monitoring event: it names the command but carries
+// neither the command nor the reply, which may hold plaintext values of unencrypted fields (and,
+// for a failure, the server's message echoing them).
+type CommandEvent struct {
+	// "started", "succeeded" or "failed".
+	Phase        string
+	CommandName  string
+	DatabaseName string
+	// Ties the started event of a command to its succeeded or failed event.
+	RequestID int64
+	// The duration of the command, for succeeded and failed events.
+	Duration time.Duration
+}
+
+// commandMonitor returns the driver command monitor reporting redacted events to observe. On an
+// encrypting client the monitored commands are the ones sent to the server, after encryption, so
+// they show what the server actually receives.
+func commandMonitor(observe func(CommandEvent)) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			observe(CommandEvent{
+				Phase: "started", CommandName: e.CommandName, DatabaseName: e.DatabaseName, RequestID: e.RequestID,
+			})
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			observe(finishedCommandEvent("succeeded", e.CommandFinishedEvent))
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			observe(finishedCommandEvent("failed", e.CommandFinishedEvent))
+		},
+	}
+}
+
+func finishedCommandEvent(phase string, e event.CommandFinishedEvent) CommandEvent {
+	return CommandEvent{
+		Phase:        phase,
+		CommandName:  e.CommandName,
+		DatabaseName: e.DatabaseName,
+		RequestID:    e.RequestID,
+		Duration:     e.Duration,
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// TestCommandMonitor feeds the monitor of Config.OnCommand the events of an insert, and checks
+// that a test observer captures them without the command or the reply.
+func TestCommandMonitor(t *testing.T) {
+	var events []CommandEvent
+	opts, err := Config{URI: "mongodb://localhost:27017", OnCommand: func(e CommandEvent) {
+		events = append(events, e)
+	}}.ClientOptions()
+	if err != nil {
+		t.Fatalf("ClientOptions() error = %v", err)
+	}
+	if opts.Monitor == nil {
+		t.Fatal("ClientOptions() set no command monitor")
+	}
+
+	command, err := bson.Marshal(bson.M{"insert": "users", "documents": bson.A{bson.M{"name": "Bob"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	opts.Monitor.Started(ctx, &event.CommandStartedEvent{
+		Command: command, DatabaseName: "csfle_db", CommandName: "insert", RequestID: 7,
+	})
+	opts.Monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{
+		CommandName: "insert", DatabaseName: "csfle_db", RequestID: 7, Duration: time.Millisecond,
+	}})
+	opts.Monitor.Failed(ctx, &event.CommandFailedEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", RequestID: 8, Duration: time.Second},
+		Failure:              "E11000 duplicate key error: { name: \"Bob\" }",
+	})
+
+	want := []CommandEvent{
+		{Phase: "started", CommandName: "insert", DatabaseName: "csfle_db", RequestID: 7},
+		{Phase: "succeeded", CommandName: "insert", DatabaseName: "csfle_db", RequestID: 7,
+			Duration: time.Millisecond},
+		{Phase: "failed", CommandName: "find", RequestID: 8, Duration: time.Second},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("captured events = %+v, want %+v", events, want)
+	}
+
+	opts, err = Config{URI: "mongodb://localhost:27017"}.ClientOptions()
+	if err != nil || opts.Monitor != nil {
+		t.Errorf("ClientOptions() without OnCommand = %v, %v, want no monitor", opts.Monitor, err)
+	}
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Config holds the connection settings applied to every client this package creates.
+type Config struct {
+	// Connection string of the cluster. When empty, MONGODB_URI is used.
+	URI string
+	// How long to wait for a suitable server before failing an operation. When zero, the driver
+	// default (30s) applies; health checks want a much shorter fail-fast.
+	ServerSelectionTimeout time.Duration
+	// How long to wait for a connection to be established. When zero, the driver default applies.
+	ConnectTimeout time.Duration
+	// TLS settings per KMS provider name, for the providers that need more than the defaults.
+	KMSTLS map[string]KMSTLSOptions
+	// When set, the DEKs GetDek creates carry an expiresAt this far in the future, so a rotation
+	// job can find them with FindExpiringDeks.
+	DEKLifetime time.Duration
+	// The clock used for DEK expiration. When nil, the real clock is used.
+	Clock Clock
+	// The maximum size in bytes of the ciphertext of a single field, checked before encryption.
+	// When zero, 8MiB.
+	MaxEncryptedFieldSize int
+	// Called by GetDek after it created a DEK, e.g. to register the UUID with an external key
+	// inventory. If it fails, the DEK is deleted again and GetDek fails, so the next call creates
+	// and registers a new one.
+	OnDEKCreated func(providerName string, keyID primitive.Binary) error
+	// The BSON registry of the clients, for decoding documents into custom Go types (e.g. a typed
+	// SSN). Decryption happens before decoding, so a codec sees the plaintext value of an encrypted
+	// field. When nil, the driver's default registry is used.
+	Registry *bsoncodec.Registry
+	// How long encrypting clients and ClientEncryptions keep unwrapped DEKs; zero is the
+	// libmongocrypt default of 60s. Only the default is supported with the current driver (see
+	// ErrKeyCacheTTLUnsupported).
+	KeyCacheTTL time.Duration
+	// Normalizers of string fields by dotted path, e.g. NormalizeEmail for "email", applied by the
+	// insert and read helpers before a value (or a filter on it) is encrypted, so equality on a
+	// deterministically encrypted field ignores the differences the normalizer removes.
+	Normalizers map[string]Normalizer
+	// Fields (dotted paths) the insert helpers strip from a document before it is encrypted and
+	// inserted, e.g. a transient request ID, so they never reach the database. An encrypted field
+	// can't be omitted.
+	OmitFields []string
+	// How the insert helpers handle an encrypted field that is null. When zero, NullReject.
+	NullEncryptedFields NullPolicy
+	// The key vault namespace of the helpers that aren't given one, e.g. ProvisionTenant.
+	KeyVaultNamespace string
+	// When set, a master key file readable or writable by group or others is refused with
+	// ErrInsecureMasterKeyFile instead of only logging a warning.
+	RejectInsecureMasterKeyFile bool
+	// When set, LoadOrCreateMasterKey fails with ErrMasterKeyMissing instead of generating a key
+	// when the file doesn't exist, as production must never regenerate a lost key.
+	RequireExistingMasterKey bool
+	// When set, the insert helpers read each inserted document back through the regular client
+	// they're given and fail with ErrEncryptionDidNotEngage if an encrypted field was stored in
+	// plaintext. This costs a read per insert, for the collections where a misconfiguration must
+	// not go unnoticed.
+	VerifyEncryptionOnInsert bool
+	// The retries of decryptions that fail with a transient KMS error, e.g. throttling. When zero,
+	// a decryption is tried up to 3 times.
+	KMSRetry KMSRetryPolicy
+	// When set, called with a redacted event (see CommandEvent) for every command the clients send,
+	// for debugging what actually goes over the wire. On an encrypting client the commands are
+	// observed after encryption.
+	OnCommand func(CommandEvent)
+
+	// The automatic encryption settings of a client created with NewClient.
+
+	// The KMS providers that wrap the DEKs.
+	KMSProviders map[string]map[string]interface{}
+	// The CSFLE JSON schemas by namespace. Exclusive with EncryptedFieldsMap.
+	SchemaMap bson.M
+	// The QE encryptedFields by namespace. Exclusive with SchemaMap.
+	EncryptedFieldsMap bson.M
+	// When set, the client only decrypts, and writes are not encrypted automatically.
+	BypassAutoEncryption bool
+}
+
+var _config Config
+
+// SetConfig sets the connection settings used by the clients created in this package.
+func SetConfig(cfg Config) {
+	_config = cfg
+}
+
+// ClientOptions builds the driver client options for the configuration.
+func (c Config) ClientOptions() (*options.ClientOptions, error) {
+	uri := c.URI
+	if uri == "" {
+		uri = os.Getenv("MONGODB_URI")
+	}
+	if uri == "" {
+		return nil, fmt.Errorf("MONGODB_URI environment variable is not set")
+	}
+	if c.ServerSelectionTimeout < 0 || c.ConnectTimeout < 0 {
+		return nil, fmt.Errorf("connection timeouts must not be negative")
+	}
+
+	opts := options.Client().ApplyURI(uri)
+	if err := applyURIDefaults(uri, opts); err != nil {
+		return nil, err
+	}
+	if c.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(c.ServerSelectionTimeout)
+	}
+	if c.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(c.ConnectTimeout)
+	}
+	if c.Registry != nil {
+		opts.SetRegistry(c.Registry)
+	}
+	if c.OnCommand != nil {
+		opts.SetMonitor(commandMonitor(c.OnCommand))
+	}
+	return opts, nil
+}
+
+func (c Config) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+// ClientOptions builds the driver client options from the configuration set with SetConfig.
+func ClientOptions() (*options.ClientOptions, error) {
+	return _config.ClientOptions()
+}
+
+// applyURIDefaults fills in the settings we rely on when the connection string leaves them out,
+// without overriding anything the user set explicitly:
+//   - retryWrites=true, so a write that fails on a primary election is retried once.
+//   - w=majority, so an acknowledged write (and a DEK in the key vault) survives a failover.
+//   - authSource=admin when credentials are given but neither authSource nor a database is, which
+//     is where Atlas users are defined.
+func applyURIDefaults(uri string, opts *options.ClientOptions) error {
+	// ApplyURI has parsed the connection string already; unset settings are left nil.
+	if err := opts.Validate(); err != nil {
+		return fmt.Errorf("invalid MongoDB connection string: %w", err)
+	}
+	if opts.RetryWrites == nil {
+		opts.SetRetryWrites(true)
+	}
+	if opts.WriteConcern == nil {
+		opts.SetWriteConcern(writeconcern.Majority())
+	}
+	if opts.Auth != nil && opts.Auth.AuthSource == "" && isPasswordAuth(opts.Auth.AuthMechanism) &&
+		uriDatabase(uri) == "" {
+		opts.Auth.AuthSource = "admin"
+	}
+	return nil
+}
+
+// isPasswordAuth reports whether the mechanism authenticates users defined in a database, as
+// opposed to $external (X.509, AWS, etc.).
+func isPasswordAuth(mechanism string) bool {
+	return mechanism == "" || strings.HasPrefix(mechanism, "SCRAM-")
+}
+
+// uriDatabase returns the database named in the path of the connection string, if any.
+func uriDatabase(uri string) string {
+	// Connection strings can list several hosts, which net/url doesn't accept, so the path is
+	// found by hand: it starts at the first slash after the scheme.
+	_, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return ""
+	}
+	_, path, ok := strings.Cut(rest, "/")
+	if !ok {
+		return ""
+	}
+	database, _, _ := strings.Cut(path, "?")
+	return database
+}
@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// InsertStruct inserts a Go struct through the given client. When the client is configured for
+// automatic encryption, the driver marshals the struct to BSON first and then encrypts the fields
+// declared in the schema map, so the bson tags on the struct must match the schema map paths.
+func InsertStruct(ctx context.Context, client *mongo.Client, coll CollRef, v interface{}) error {
+	if _, err := coll.Collection(client).InsertOne(ctx, v); err != nil {
+		return fmt.Errorf("failed to insert document into %s: %w", coll, err)
+	}
+	return nil
+}
+
+// InsertEncrypted inserts a document through an encrypting client, after checking that none of
+// the values of encFields (the schema map paths encrypted for the collection) would encrypt to
+// more than the configured maximum. An oversized value is rejected with ErrFieldTooLarge before
+// anything is sent, instead of the server rejecting the encrypted document as too large. A
+// duplicate value of an encrypted field with a unique index is reported as
+// ErrDuplicateEncryptedValue naming the field. A null encrypted field is rejected or stored as a
+// plain null, per Config.NullEncryptedFields. The fields with a configured normalizer are
+// normalized before they are encrypted. With Config.VerifyEncryptionOnInsert, an encrypted field
+// stored in plaintext fails the insert with ErrEncryptionDidNotEngage (the document stays stored).
+// The fields of Config.OmitFields are stripped from the document first. When the insert isn't
+// acknowledged by the write concern, WriteConcernErrorFrom extracts the write concern error from
+// the returned error. rawClient is a regular (non-encrypting) client of the same cluster, which
+// stores the null fields under NullStoreUnencrypted and reads the document back with
+// Config.VerifyEncryptionOnInsert; it may be nil when neither is set.
+func InsertEncrypted(
+	ctx context.Context, encClient, rawClient *mongo.Client, coll CollRef, doc interface{}, encFields []string,
+) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the document: %w", err)
+	}
+	if data, err = omitFields(data, encFields); err != nil {
+		return err
+	}
+	if data, err = normalizeDocument(data); err != nil {
+		return err
+	}
+	doc = bson.Raw(data)
+	if err := checkEncryptedFieldSizes(data, encFields); err != nil {
+		return err
+	}
+	nulls := nullEncryptedFields(data, encFields)
+	if len(nulls) > 0 {
+		if _config.NullEncryptedFields != NullStoreUnencrypted {
+			return fmt.Errorf("%w: %v must be absent or non-null", ErrNullEncryptedField, nulls)
+		}
+		if rawClient == nil {
+			return fmt.Errorf("a regular client is required to store the null encrypted fields %v", nulls)
+		}
+		if doc, err = withoutFields(data, nulls); err != nil {
+			return err
+		}
+	}
+
+	if _config.VerifyEncryptionOnInsert && rawClient == nil {
+		return fmt.Errorf("a regular client is required to verify the encryption of the inserted document")
+	}
+
+	ec := EncryptionContextFrom(ctx)
+	start := time.Now()
+	result, err := coll.Collection(encClient).InsertOne(ctx, doc)
+	ec.Metrics.Observe("encrypted_insert", time.Since(start))
+	if err != nil {
+		ec.Metrics.Count("encrypted_insert_errors", 1)
+		if field, ok := duplicateEncryptedField(err, encFields); ok {
+			return fmt.Errorf("%w: the '%s' value already exists in %s", ErrDuplicateEncryptedValue, field, coll)
+		}
+		return fmt.Errorf("failed to insert document into %s: %w", coll, err)
+	}
+	if _config.VerifyEncryptionOnInsert {
+		if err := verifyStoredEncryption(ctx, rawClient, coll, result.InsertedID, encFields, nulls); err != nil {
+			return err
+		}
+	}
+	if len(nulls) > 0 {
+		return storeNullFields(ctx, rawClient, coll, result.InsertedID, nulls)
+	}
+	return nil
+}
+
+// omitFields strips the configured Config.OmitFields from the document, refusing to omit an
+// encrypted field.
+func omitFields(data bson.Raw, encFields []string) (bson.Raw, error) {
+	if len(_config.OmitFields) == 0 {
+		return data, nil
+	}
+	for _, field := range _config.OmitFields {
+		for _, encField := range encFields {
+			if pathsOverlap(field, encField) {
+				return nil, fmt.Errorf("the omitted field '%s' would omit the encrypted field '%s'", field, encField)
+			}
+		}
+	}
+	doc, err := withoutFields(data, _config.OmitFields)
+	if err != nil {
+		return nil, err
+	}
+	stripped, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the document: %w", err)
+	}
+	return stripped, nil
+}
+
+// ErrDuplicateEncryptedValue is returned when an insert violates a unique index on a
+// deterministically encrypted field.
+var ErrDuplicateEncryptedValue = errors.New("duplicate value for a unique encrypted field")
+
+// The key of a duplicate key error message (E11000 ... dup key: { email: BinData(6, ...) }), for
+// servers that don't report the keyPattern.
+var _dupKeyPattern = regexp.MustCompile(`dup key: \{ ?"?([^:"\s]+)"?:`)
+
+// duplicateEncryptedField returns the encrypted field whose unique index an insert violated. The
+// server reports the ciphertext, which means nothing to the caller, so the field is found from
+// the key of the violated index.
+func duplicateEncryptedField(err error, encFields []string) (string, bool) {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return "", false
+	}
+	for _, we := range writeErr.WriteErrors {
+		if we.Code != 11000 {
+			continue
+		}
+		var keys []string
+		if keyPattern, ok := we.Raw.Lookup("keyPattern").DocumentOK(); ok {
+			elems, _ := keyPattern.Elements()
+			for _, elem := range elems {
+				keys = append(keys, elem.Key())
+			}
+		} else if match := _dupKeyPattern.FindStringSubmatch(we.Message); match != nil {
+			keys = append(keys, match[1])
+		}
+		for _, key := range keys {
+			if slices.Contains(encFields, key) {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// EncryptedFieldsMetadataField is the document field InsertEncryptedWithFieldList records the
+// encrypted fields of the document in, so downstream consumers know what to decrypt without
+// inspecting the BSON types of the values.
+const EncryptedFieldsMetadataField = "_encFields"
+
+// InsertEncryptedWithFieldList is InsertEncrypted for collections that opt into document-level
+// metadata: the document is stored with an EncryptedFieldsMetadataField array listing the
+// encFields it contains, replacing any value the document had for it. The list names fields only,
+// and the field itself is not encrypted.
+func InsertEncryptedWithFieldList(
+	ctx context.Context, encClient, rawClient *mongo.Client, coll CollRef, doc interface{}, encFields []string,
+) error {
+	withList, err := withFieldList(doc, encFields)
+	if err != nil {
+		return err
+	}
+	return InsertEncrypted(ctx, encClient, rawClient, coll, withList, encFields)
+}
+
+// withFieldList returns the document with an EncryptedFieldsMetadataField listing the encFields
+// it contains.
+func withFieldList(doc interface{}, encFields []string) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the document: %w", err)
+	}
+	// A null field isn't encrypted (see NullPolicy), so it isn't listed.
+	nulls := nullEncryptedFields(data, encFields)
+	present := []string{}
+	for _, field := range encFields {
+		_, err := bson.Raw(data).LookupErr(strings.Split(field, ".")...)
+		if err == nil && !slices.Contains(nulls, field) {
+			present = append(present, field)
+		}
+	}
+
+	var withList bson.D
+	if err := bson.Unmarshal(data, &withList); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the document: %w", err)
+	}
+	for i := 0; i < len(withList); i++ {
+		if withList[i].Key == EncryptedFieldsMetadataField {
+			withList = append(withList[:i], withList[i+1:]...)
+			i--
+		}
+	}
+	return append(withList, bson.E{Key: EncryptedFieldsMetadataField, Value: present}), nil
+}
+
+// InsertReport describes an insert through an encrypting client.
+type InsertReport struct {
+	InsertedID interface{}
+	// The DEK UUID that encrypted each encrypted field of the stored document, by dotted path.
+	Deks map[string]primitive.Binary
+}
+
+// InsertWithReport inserts a document through an encrypting client, and reports which DEK
+// encrypted each field, to tie the write to a key for audit and per-tenant tracing. The driver
+// doesn't expose the DEKs it used, so the stored document is read back through a regular client
+// (an encrypting one would decrypt it) and the UUIDs are taken from its ciphertext.
+func InsertWithReport(
+	ctx context.Context, encClient, rawClient *mongo.Client, coll CollRef, doc interface{},
+) (InsertReport, error) {
+	result, err := coll.Collection(encClient).InsertOne(ctx, doc)
+	if err != nil {
+		return InsertReport{}, fmt.Errorf("failed to insert document into %s: %w", coll, err)
+	}
+	stored := coll.Collection(rawClient).FindOne(ctx, bson.M{"_id": result.InsertedID})
+	return reportDeks(stored, coll, result.InsertedID)
+}
+
+// reportDeks builds the InsertReport of the inserted document, as a regular client reads it back.
+func reportDeks(res *mongo.SingleResult, coll CollRef, insertedID interface{}) (InsertReport, error) {
+	report := InsertReport{InsertedID: insertedID, Deks: make(map[string]primitive.Binary)}
+	var stored bson.M
+	if err := res.Decode(&stored); err != nil {
+		return report, fmt.Errorf("failed to read back the inserted document from %s: %w", coll, err)
+	}
+	for _, ref := range findCiphertext(stored, "") {
+		info, err := InspectCiphertext(ref.ciphertext)
+		if err != nil {
+			return report, fmt.Errorf("field '%s': %w", ref.path, err)
+		}
+		report.Deks[ref.path] = info.KeyID
+	}
+	return report, nil
+}
+
+// ReadStruct reads a single document and decodes it into T. The driver decrypts the encrypted
+// fields before decoding, so an encrypted string field decodes into a plain Go string.
+func ReadStruct[T any](ctx context.Context, client *mongo.Client, coll CollRef, filter bson.M) (T, error) {
+	return FindOneAs[T](ctx, client, coll, filter)
+}
+
+// FindOneAs reads a single document and decodes it into T, so callers get typed fields instead of
+// casting the values of a bson.M (which panics on an unexpected type). Through an encrypting
+// client, the encrypted fields decode into their plaintext Go types; through a regular client
+// they are ciphertext and decode into primitive.Binary fields. Custom types decode with the codecs
+// of the client's registry (see Config.Registry). Filters on the fields with a configured
+// normalizer are normalized, as the stored values are. An encrypted field stored as a plain null (see
+// NullStoreUnencrypted) decodes as a zero value; note that an encrypting client can't query an
+// encrypted field for null, only a regular one can. A missing document returns an error wrapping
+// mongo.ErrNoDocuments.
+func FindOneAs[T any](ctx context.Context, client *mongo.Client, coll CollRef, filter bson.M) (T, error) {
+	return decodeOneAs[T](coll.Collection(client).FindOne(ctx, normalizeFilter(filter)), coll)
+}
+
+// decodeOneAs decodes the document of a FindOne result into T.
+func decodeOneAs[T any](res *mongo.SingleResult, coll CollRef) (T, error) {
+	var result T
+	if err := res.Decode(&result); err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to read document from %s as %T: %w", coll, result, err)
+	}
+	return result, nil
+}
+
+// BulkWriteEncrypted runs a mixed batch of inserts, updates and deletes through an encrypting
+// client. Auto-encryption is applied to each write model individually: the driver encrypts the
+// schema map fields in inserted documents and replacements, in update operators ($set etc.), and
+// in the filters of update and delete models, so an update-by-ssn matches the stored ciphertext.
+//
+// The batch is ordered, so a failed model stops the remaining ones from being applied.
+func BulkWriteEncrypted(
+	ctx context.Context, client *mongo.Client, coll CollRef, models []mongo.WriteModel,
+) (*mongo.BulkWriteResult, error) {
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no write models to apply")
+	}
+	result, err := coll.Collection(client).BulkWrite(ctx, models)
+	if err != nil {
+		return result, fmt.Errorf("encrypted bulk write to %s failed: %w", coll, err)
+	}
+	return result, nil
+}
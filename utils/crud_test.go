@@ -0,0 +1,303 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type testProfile struct {
+	Email string `bson:"email"`
+}
+
+type testUser struct {
+	Name    string      `bson:"name"`
+	SSN     string      `bson:"ssn"`
+	Profile testProfile `bson:"profile"`
+}
+
+// TestStructEncryptedPaths checks that a User struct marshals its fields to the schema map paths
+// of cmd/csfle, which is what the driver encrypts when InsertStruct sends it.
+func TestStructEncryptedPaths(t *testing.T) {
+	data, err := bson.Marshal(testUser{Name: "Bob", SSN: "987-65-4320", Profile: testProfile{Email: "a@b.c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"ssn": "987-65-4320", "profile.email": "a@b.c"} {
+		value, err := bson.Raw(data).LookupErr(strings.Split(path, ".")...)
+		if err != nil {
+			t.Errorf("the marshalled struct has no '%s': %v", path, err)
+			continue
+		}
+		if got, ok := value.StringValueOK(); !ok || got != want {
+			t.Errorf("the marshalled struct has %s = %v, want %q", path, value, want)
+		}
+	}
+}
+
+// TestDecodeOneAs decodes a read result, as the encrypting client returns it with the ssn
+// decrypted, back into a User.
+func TestDecodeOneAs(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	doc := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "profile", Value: bson.D{{Key: "email", Value: "a@b.c"}}},
+	}
+	got, err := decodeOneAs[testUser](mongo.NewSingleResultFromDocument(doc, nil, nil), coll)
+	if err != nil {
+		t.Fatalf("decodeOneAs() error = %v", err)
+	}
+	want := testUser{Name: "Bob", SSN: "987-65-4320", Profile: testProfile{Email: "a@b.c"}}
+	if got != want {
+		t.Errorf("decodeOneAs() = %+v, want %+v", got, want)
+	}
+
+	_, err = decodeOneAs[testUser](mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil), coll)
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("decodeOneAs() of a missing document error = %v, want mongo.ErrNoDocuments", err)
+	}
+}
+
+// TestDecodeOneAsTypeMismatch decodes a document read through a regular client, where the ssn is
+// still ciphertext, into a User: it fails with an error instead of the panic of a cast.
+func TestDecodeOneAsTypeMismatch(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: []byte{1, 2, 3}}
+	res := mongo.NewSingleResultFromDocument(bson.D{{Key: "ssn", Value: ciphertext}}, nil, nil)
+	got, err := decodeOneAs[testUser](res, coll)
+	if err == nil || !strings.Contains(err.Error(), "as utils.testUser") {
+		t.Errorf("decodeOneAs() error = %v, want a decode error naming the type", err)
+	}
+	if got != (testUser{}) {
+		t.Errorf("decodeOneAs() = %+v, want the zero value", got)
+	}
+}
+
+// testSSN is a typed SSN, decoded from its string form by the codec of ssnRegistry.
+type testSSN struct {
+	Area, Group, Serial string
+}
+
+func ssnRegistry() *bsoncodec.Registry {
+	registry := bson.NewRegistry()
+	registry.RegisterTypeDecoder(reflect.TypeOf(testSSN{}), bsoncodec.ValueDecoderFunc(
+		func(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+			s, err := vr.ReadString()
+			if err != nil {
+				return err
+			}
+			parts := strings.Split(s, "-")
+			if len(parts) != 3 {
+				return fmt.Errorf("malformed SSN %q", s)
+			}
+			val.Set(reflect.ValueOf(testSSN{Area: parts[0], Group: parts[1], Serial: parts[2]}))
+			return nil
+		}))
+	return registry
+}
+
+// TestDecodeOneAsCustomCodec decodes the decrypted ssn into a typed SSN with the codec of the
+// registry set in Config.Registry.
+func TestDecodeOneAsCustomCodec(t *testing.T) {
+	registry := ssnRegistry()
+	opts, err := Config{URI: "mongodb://localhost:27017", Registry: registry}.ClientOptions()
+	if err != nil {
+		t.Fatalf("ClientOptions() error = %v", err)
+	}
+	if opts.Registry != registry {
+		t.Error("ClientOptions() dropped the registry")
+	}
+
+	type user struct {
+		SSN testSSN `bson:"ssn"`
+	}
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	res := mongo.NewSingleResultFromDocument(bson.D{{Key: "ssn", Value: "987-65-4320"}}, nil, registry)
+	got, err := decodeOneAs[user](res, coll)
+	if err != nil {
+		t.Fatalf("decodeOneAs() error = %v", err)
+	}
+	if want := (testSSN{Area: "987", Group: "65", Serial: "4320"}); got.SSN != want {
+		t.Errorf("decodeOneAs() = %+v, want %+v", got.SSN, want)
+	}
+}
+
+// TestDuplicateEncryptedField maps the E11000 error of a second insert of the same
+// deterministically encrypted email back to the email field.
+func TestDuplicateEncryptedField(t *testing.T) {
+	keyPattern, err := bson.Marshal(bson.M{"keyPattern": bson.M{"email": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const dupMessage = `E11000 duplicate key error collection: csfle_db.users index: email_1 ` +
+		`dup key: { email: BinData(6, "AbCd") }`
+	writeErr := func(code int, message string, raw bson.Raw) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: code, Message: message, Raw: raw}}}
+	}
+	tests := []struct {
+		name      string
+		err       error
+		wantField string
+	}{
+		{name: "key pattern", err: writeErr(11000, "E11000 duplicate key error", keyPattern), wantField: "email"},
+		{name: "message", err: writeErr(11000, dupMessage, nil), wantField: "email"},
+		{name: "wrapped", err: fmt.Errorf("insert: %w", writeErr(11000, dupMessage, nil)), wantField: "email"},
+		{name: "plaintext field", err: writeErr(11000, `E11000 dup key: { name: "Bob" }`, nil)},
+		{name: "other code", err: writeErr(121, "Document failed validation", keyPattern)},
+		{name: "not a write error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, ok := duplicateEncryptedField(tt.err, []string{"ssn", "email"})
+			if field != tt.wantField || ok != (tt.wantField != "") {
+				t.Errorf("duplicateEncryptedField() = %q, %t, want %q", field, ok, tt.wantField)
+			}
+		})
+	}
+}
+
+// TestReportDeks reports the DEK of a user inserted with the tenant's DEK, as a regular client
+// reads the stored document back.
+func TestReportDeks(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	tenantDek := primitive.Binary{Subtype: 4, Data: []byte("tenant-dek-00000")}
+	stored := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: testCiphertext(tenantDek)},
+		{Key: "profile", Value: bson.D{{Key: "email", Value: testCiphertext(tenantDek)}}},
+	}
+	report, err := reportDeks(mongo.NewSingleResultFromDocument(stored, nil, nil), coll, 1)
+	if err != nil {
+		t.Fatalf("reportDeks() error = %v", err)
+	}
+	if report.InsertedID != 1 || len(report.Deks) != 2 {
+		t.Fatalf("reportDeks() = %+v, want the DEKs of ssn and profile.email", report)
+	}
+	for _, path := range []string{"ssn", "profile.email"} {
+		if got := report.Deks[path]; string(got.Data) != string(tenantDek.Data) {
+			t.Errorf("DEK of %s = %x, want the tenant's DEK %x", path, got.Data, tenantDek.Data)
+		}
+	}
+
+	missing := mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	if _, err := reportDeks(missing, coll, 1); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("reportDeks() of a missing document error = %v, want mongo.ErrNoDocuments", err)
+	}
+}
+
+// TestOmitFields strips _internal and a nested request ID from a document before it's encrypted,
+// keeping ssn for the encryption.
+func TestOmitFields(t *testing.T) {
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+	_config.OmitFields = []string{"_internal", "meta.requestId"}
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "_internal", Value: "req-1"},
+		{Key: "meta", Value: bson.D{{Key: "requestId", Value: "req-1"}, {Key: "source", Value: "api"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := omitFields(data, []string{"ssn"})
+	if err != nil {
+		t.Fatalf("omitFields() error = %v", err)
+	}
+	var got bson.D
+	if err := bson.Unmarshal(stripped, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "meta", Value: bson.D{{Key: "source", Value: "api"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("omitFields() = %v, want %v", got, want)
+	}
+
+	for _, omitted := range []string{"ssn", "profile"} {
+		_config.OmitFields = []string{omitted}
+		_, err := omitFields(data, []string{"ssn", "profile.email"})
+		if err == nil || !strings.Contains(err.Error(), "would omit the encrypted field") {
+			t.Errorf("omitFields() of %s error = %v, want it refused", omitted, err)
+		}
+	}
+	_config.OmitFields = nil
+	if got, err := omitFields(data, []string{"ssn"}); err != nil || !reflect.DeepEqual(got, bson.Raw(data)) {
+		t.Errorf("omitFields() without Config.OmitFields = %v, %v, want the document as is", got, err)
+	}
+}
+
+// TestWithFieldList lists ssn, the only encrypted field of the document with a value, in its
+// _encFields, replacing the one the caller set.
+func TestWithFieldList(t *testing.T) {
+	doc := bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: EncryptedFieldsMetadataField, Value: bson.A{"forged"}},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "profile", Value: bson.D{{Key: "email", Value: nil}}},
+	}
+	got, err := withFieldList(doc, []string{"ssn", "profile.email", "dob"})
+	if err != nil {
+		t.Fatalf("withFieldList() error = %v", err)
+	}
+	want := bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "profile", Value: bson.D{{Key: "email", Value: nil}}},
+		{Key: EncryptedFieldsMetadataField, Value: []string{"ssn"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withFieldList() = %v, want %v", got, want)
+	}
+
+	got, err = withFieldList(bson.M{"name": "Bob"}, []string{"ssn"})
+	if err != nil {
+		t.Fatalf("withFieldList() error = %v", err)
+	}
+	if list := got[len(got)-1]; list.Key != EncryptedFieldsMetadataField || len(list.Value.([]string)) != 0 {
+		t.Errorf("withFieldList() of a document without encrypted fields = %v, want an empty list", got)
+	}
+}
+
+func TestBulkWriteEncrypted(t *testing.T) {
+	client := unreachableClient(t)
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	models := []mongo.WriteModel{
+		mongo.NewInsertOneModel().SetDocument(bson.M{"name": "Bob", "ssn": "987-65-4320"}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"ssn": "987-65-4320"}).
+			SetUpdate(bson.M{"$set": bson.M{"email": "bob@example.com"}}),
+	}
+	tests := []struct {
+		name    string
+		models  []mongo.WriteModel
+		wantErr string
+	}{
+		{name: "no models", wantErr: "no write models to apply"},
+		{name: "insert and update by ssn", models: models,
+			wantErr: "encrypted bulk write to csfle_db.users failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := BulkWriteEncrypted(context.Background(), client, coll, tt.models)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("BulkWriteEncrypted() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/mongocrypt"
+)
+
+// ErrCryptProviderMissing is returned when the process has nothing to perform automatic
+// encryption with: libmongocrypt isn't linked in, or neither crypt_shared nor mongocryptd is
+// available to analyze the queries.
+var ErrCryptProviderMissing = errors.New("no crypt provider available for automatic encryption")
+
+const _cryptProviderRemediation = "install the crypt_shared library (and set cryptSharedLibPath) " +
+	"or put mongocryptd on the PATH; explicit encryption only needs libmongocrypt " +
+	"(build with -tags cse)"
+
+// _libmongocryptVersion returns the version of the linked libmongocrypt, or "" if there's none.
+var _libmongocryptVersion = mongocrypt.Version
+
+// _algorithmMinVersions is the first libmongocrypt version that supports each algorithm.
+var _algorithmMinVersions = map[string][3]int{
+	AlgorithmDeterministic: {1, 0, 0},
+	AlgorithmRandom:        {1, 0, 0},
+	"Indexed":              {1, 8, 0},
+	"Unindexed":            {1, 8, 0},
+	"RangePreview":         {1, 8, 0},
+	// Range queries went GA, with a new payload format, in 1.11.
+	"Range": {1, 11, 0},
+}
+
+// CheckAlgorithmSupport checks that the linked libmongocrypt supports the encryption algorithm,
+// so e.g. a range field fails with a clear message at startup, rather than with an obscure error
+// from the first range query on an older library.
+func CheckAlgorithmSupport(algorithm string) error {
+	minVersion, ok := _algorithmMinVersions[algorithm]
+	if !ok {
+		return fmt.Errorf("unknown encryption algorithm '%s'", algorithm)
+	}
+	version := _libmongocryptVersion()
+	if version == "" {
+		return fmt.Errorf("%w: libmongocrypt is not loaded, build with -tags cse", ErrCryptProviderMissing)
+	}
+	current, err := parseLibmongocryptVersion(version)
+	if err != nil {
+		return err
+	}
+	if slices.Compare(current[:], minVersion[:]) < 0 {
+		return fmt.Errorf("algorithm '%s' needs libmongocrypt %d.%d.%d or later, but %s is linked",
+			algorithm, minVersion[0], minVersion[1], minVersion[2], version)
+	}
+	return nil
+}
+
+// parseLibmongocryptVersion parses the major, minor and patch of a version such as 1.11.0 or
+// 1.12.0-pre.
+func parseLibmongocryptVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	core, _, _ := strings.Cut(version, "-")
+	parts := strings.Split(core, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return parsed, fmt.Errorf("unrecognized libmongocrypt version '%s'", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("unrecognized libmongocrypt version '%s'", version)
+		}
+		parsed[i] = n
+	}
+	return parsed, nil
+}
+
+// checkLibmongocrypt fails fast if the binary was built without the cse build tag. Without it the
+// driver panics as soon as it sets up any encryption.
+func checkLibmongocrypt() error {
+	if _libmongocryptVersion() == "" {
+		return fmt.Errorf("%w: libmongocrypt is not loaded, build with -tags cse", ErrCryptProviderMissing)
+	}
+	return nil
+}
+
+// classifyCryptProviderError maps the driver's errors for a missing crypt_shared library or
+// mongocryptd binary to ErrCryptProviderMissing, and returns any other error as is.
+func classifyCryptProviderError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, exec.ErrNotFound) ||
+		strings.Contains(err.Error(), "failed to load the crypt_shared library") {
+		return fmt.Errorf("%w: %s: %v", ErrCryptProviderMissing, _cryptProviderRemediation, err)
+	}
+	return err
+}
+
+// NewEncClientOrExplicitOnly behaves like NewEncClient, but on a machine without crypt_shared or
+// mongocryptd (typically a developer laptop) it falls back to a client with automatic encryption
+// bypassed. That client still decrypts automatically, but writes and filters must be encrypted
+// explicitly. The returned flag reports whether the fallback was taken, which is also logged to the
+// logger of ctx's EncryptionContext.
+func NewEncClientOrExplicitOnly(
+	ctx context.Context,
+	keyVaultNamespace string,
+	schemaMap bson.M,
+	kmsProviders map[string]map[string]interface{},
+) (*mongo.Client, bool, error) {
+	client, err := NewEncClient(ctx, keyVaultNamespace, schemaMap, kmsProviders, false)
+	if err == nil {
+		return client, false, nil
+	}
+	// Without libmongocrypt, there's nothing to fall back to.
+	if !errors.Is(err, ErrCryptProviderMissing) || checkLibmongocrypt() != nil {
+		return nil, false, err
+	}
+	EncryptionContextFrom(ctx).Logger.WarnContext(ctx,
+		"automatic encryption unavailable, falling back to explicit encryption", "error", err)
+	client, err = NewEncClient(ctx, keyVaultNamespace, schemaMap, kmsProviders, true)
+	if err != nil {
+		return nil, false, err
+	}
+	return client, true, nil
+}
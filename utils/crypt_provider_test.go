@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// stubLibmongocryptVersion makes the linked libmongocrypt appear to be the given version, "" for
+// none, for the duration of the test.
+func stubLibmongocryptVersion(t *testing.T, version string) {
+	original := _libmongocryptVersion
+	_libmongocryptVersion = func() string { return version }
+	t.Cleanup(func() { _libmongocryptVersion = original })
+}
+
+func TestClassifyCryptProviderError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantMissing bool
+	}{
+		{name: "mongocryptd not on the PATH", wantMissing: true,
+			err: fmt.Errorf("failed to spawn mongocryptd: %w", &exec.Error{Name: "mongocryptd", Err: exec.ErrNotFound})},
+		{name: "crypt_shared not found", wantMissing: true,
+			err: errors.New("failed to load the crypt_shared library: no such file")},
+		{name: "other error", err: errors.New("server selection timeout")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyCryptProviderError(tt.err)
+			if errors.Is(err, ErrCryptProviderMissing) != tt.wantMissing {
+				t.Errorf("classifyCryptProviderError() = %v, want ErrCryptProviderMissing: %t", err, tt.wantMissing)
+			}
+			if !errors.Is(err, tt.err) && !tt.wantMissing {
+				t.Errorf("classifyCryptProviderError() = %v, want the error as is", err)
+			}
+		})
+	}
+	if err := classifyCryptProviderError(nil); err != nil {
+		t.Errorf("classifyCryptProviderError(nil) = %v", err)
+	}
+}
+
+// TestNewEncClientWithoutCryptProvider checks that a process without libmongocrypt gets
+// ErrCryptProviderMissing, with no fallback, instead of the driver's panic.
+func TestNewEncClientWithoutCryptProvider(t *testing.T) {
+	stubLibmongocryptVersion(t, "")
+	SetConfig(Config{URI: "mongodb://localhost:27017"})
+	t.Cleanup(func() { SetConfig(Config{}) })
+
+	kmsProviders := map[string]map[string]interface{}{"local:100": {"key": make([]byte, _masterKeySize)}}
+	schemaMap := bson.M{"csfle_db.users": bson.M{"bsonType": "object"}}
+	_, err := NewEncClient(context.Background(), "csfle_keyvault.datakeys", schemaMap, kmsProviders, false)
+	if !errors.Is(err, ErrCryptProviderMissing) {
+		t.Errorf("NewEncClient() error = %v, want ErrCryptProviderMissing", err)
+	}
+	client, explicitOnly, err := NewEncClientOrExplicitOnly(
+		context.Background(), "csfle_keyvault.datakeys", schemaMap, kmsProviders)
+	if !errors.Is(err, ErrCryptProviderMissing) || client != nil || explicitOnly {
+		t.Errorf("NewEncClientOrExplicitOnly() = %v, %t, %v, want ErrCryptProviderMissing", client, explicitOnly, err)
+	}
+}
+
+func TestParseLibmongocryptVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		wantErr bool
+	}{
+		{version: "1.11.0", want: [3]int{1, 11, 0}},
+		{version: "1.12.0-pre", want: [3]int{1, 12, 0}},
+		{version: "1.8", want: [3]int{1, 8, 0}},
+		{version: "1", wantErr: true},
+		{version: "1.8.0.1", wantErr: true},
+		{version: "1.x.0", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := parseLibmongocryptVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLibmongocryptVersion() error = %v, want an error: %t", err, tt.wantErr)
+			}
+			if got != tt.want && !tt.wantErr {
+				t.Errorf("parseLibmongocryptVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAlgorithmSupport(t *testing.T) {
+	tests := []struct {
+		name      string
+		version   string
+		algorithm string
+		wantErr   string
+	}{
+		{name: "range on 1.11", version: "1.11.0", algorithm: "Range"},
+		{name: "range on a pre-release", version: "1.12.0-pre", algorithm: "Range"},
+		{name: "range on 1.8", version: "1.8.4", algorithm: "Range",
+			wantErr: "algorithm 'Range' needs libmongocrypt 1.11.0 or later, but 1.8.4 is linked"},
+		{name: "range preview on 1.8", version: "1.8.4", algorithm: "RangePreview"},
+		{name: "indexed on 1.7", version: "1.7.2", algorithm: "Indexed", wantErr: "needs libmongocrypt 1.8.0"},
+		{name: "deterministic", version: "1.0.0", algorithm: AlgorithmDeterministic},
+		{name: "unknown algorithm", version: "1.11.0", algorithm: "AES_256_GCM", wantErr: "unknown"},
+		{name: "no libmongocrypt", version: "", algorithm: "Range", wantErr: "libmongocrypt is not loaded"},
+		{name: "unparsable version", version: "dev", algorithm: "Range", wantErr: "unrecognized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubLibmongocryptVersion(t, tt.version)
+			err := CheckAlgorithmSupport(tt.algorithm)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckAlgorithmSupport(%s) error = %v", tt.algorithm, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckAlgorithmSupport(%s) error = %v, want %q", tt.algorithm, err, tt.wantErr)
+			}
+		})
+	}
+}
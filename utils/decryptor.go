@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CSFLE and QE store ciphertext as BinData with subtype 6.
+const _encryptedSubtype byte = 6
+
+// Decryptor explicitly decrypts ciphertext read through a regular (non-encrypting) client, e.g.
+// documents a downstream service receives via CDC. The ClientEncryption looks up the DEK based on
+// the metadata embedded within each ciphertext, so one Decryptor serves any number of tenants as
+// long as their KMS providers are configured on it.
+type Decryptor struct {
+	mu       sync.Mutex
+	keyVault KeyVault
+	// The decryptions using the current KeyVault, which a refresh waits for before closing it.
+	inFlight *sync.WaitGroup
+	// Opens a new KeyVault with the current KMS providers; nil if the Decryptor can't refresh.
+	open func() (KeyVault, error)
+	// The DEKs the current KeyVault has decrypted with, and so may have cached.
+	usedKeys map[string]struct{}
+	// The name of the primary KeyVault, and the KeyVaults tried in order when it fails to decrypt.
+	primaryName string
+	fallbacks   []NamedKeyVault
+}
+
+// NamedKeyVault is a KeyVault configured with the KMS providers of one region (or another
+// distinct set of KMS credentials), named for reporting which one decrypted a value.
+type NamedKeyVault struct {
+	Name     string
+	KeyVault KeyVault
+}
+
+// NewDecryptorWithFallback returns a Decryptor that tries the key vaults in order: in a
+// multi-region KMS setup, a DEK can be unwrapped through more than one KMS provider, and when one
+// fails (e.g. its region is down) the next one is tried. The key vaults aren't refreshable.
+func NewDecryptorWithFallback(keyVaults []NamedKeyVault) (*Decryptor, error) {
+	if len(keyVaults) == 0 {
+		return nil, errors.New("no key vaults to decrypt with")
+	}
+	d := NewDecryptor(keyVaults[0].KeyVault)
+	d.primaryName = keyVaults[0].Name
+	d.fallbacks = keyVaults[1:]
+	return d, nil
+}
+
+func NewDecryptor(keyVault KeyVault) *Decryptor {
+	return &Decryptor{keyVault: keyVault, inFlight: &sync.WaitGroup{}, usedKeys: make(map[string]struct{})}
+}
+
+// NewRefreshableDecryptor returns a Decryptor on the KeyVault returned by open, which it calls
+// again to replace the KeyVault when a DEK's cache is invalidated (see InvalidateKeyCache).
+func NewRefreshableDecryptor(open func() (KeyVault, error)) (*Decryptor, error) {
+	keyVault, err := open()
+	if err != nil {
+		return nil, err
+	}
+	d := NewDecryptor(keyVault)
+	d.open = open
+	return d, nil
+}
+
+// InvalidateKeyCache drops the cached state of a DEK, e.g. after RewrapManyDataKey rewrapped it
+// under a new master key. The DEK keeps its UUID, but a long-lived ClientEncryption still holds
+// the KMS providers it was created with, so once the unwrapped DEK expires from the driver's cache
+// it can no longer be unwrapped and decryption fails.
+//
+// The driver doesn't expose its key cache, so if this Decryptor has used the DEK, its KeyVault is
+// replaced with a freshly opened one (with the current KMS providers) and the old one is closed.
+// Decryptions go on with the old KeyVault while the new one is opened, and use the new one once
+// it's swapped in; the old one is only closed once the decryptions already running on it are
+// done, so InvalidateKeyCache blocks until then.
+func (d *Decryptor) InvalidateKeyCache(keyID primitive.Binary) error {
+	d.mu.Lock()
+	_, used := d.usedKeys[string(keyID.Data)]
+	open := d.open
+	d.mu.Unlock()
+	if !used {
+		return nil
+	}
+	if open == nil {
+		return errors.New("decryptor cannot refresh its key vault; create it with NewRefreshableDecryptor")
+	}
+
+	// Opening a ClientEncryption connects to the key vault, so it's done without holding d.mu, for
+	// the decryptions to go on meanwhile.
+	keyVault, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to reopen the key vault: %w", err)
+	}
+	d.mu.Lock()
+	if _, ok := d.usedKeys[string(keyID.Data)]; !ok {
+		// Another refresh replaced the key vault meanwhile, and nothing has used the DEK since.
+		d.mu.Unlock()
+		if closer, ok := keyVault.(contextCloser); ok {
+			_ = closeClientEncryption(closer, _defaultCloseTimeout)
+		}
+		return nil
+	}
+	old, oldInFlight := d.keyVault, d.inFlight
+	d.keyVault, d.inFlight = keyVault, &sync.WaitGroup{}
+	d.usedKeys = make(map[string]struct{})
+	d.mu.Unlock()
+
+	// useKey only adds to the WaitGroup of the current KeyVault, under d.mu, so no decryption can
+	// start on the old one past this point.
+	oldInFlight.Wait()
+	if closer, ok := old.(contextCloser); ok {
+		_ = closeClientEncryption(closer, _defaultCloseTimeout)
+	}
+	return nil
+}
+
+// Decrypt decrypts a single ciphertext and returns the decoded Go value.
+func (d *Decryptor) Decrypt(ctx context.Context, encryptedValue primitive.Binary) (interface{}, error) {
+	value, _, err := d.DecryptWithProvider(ctx, encryptedValue)
+	return value, err
+}
+
+// DecryptWithProvider decrypts a single ciphertext like Decrypt, and also returns the name of the
+// key vault (see NewDecryptorWithFallback) that decrypted it; the name is empty for a Decryptor
+// without fallbacks.
+func (d *Decryptor) DecryptWithProvider(
+	ctx context.Context, encryptedValue primitive.Binary,
+) (interface{}, string, error) {
+	if len(encryptedValue.Data) == 0 {
+		return nil, "", errors.New("encrypted value is empty or nil")
+	}
+	ec := EncryptionContextFrom(ctx)
+	start := time.Now()
+	keyVault, release := d.useKey(encryptedValue)
+	defer release()
+	primary := NamedKeyVault{Name: d.primaryName, KeyVault: keyVault}
+	keyVaults := append([]NamedKeyVault{primary}, d.fallbacks...)
+	var errs []error
+	for i, kv := range keyVaults {
+		raw, err := DecryptWithRetry(ctx, kv.KeyVault, encryptedValue)
+		if err == nil {
+			ec.Metrics.Observe("decrypt", time.Since(start))
+			if i > 0 {
+				ec.Logger.WarnContext(ctx, "decrypted with a fallback key vault",
+					"keyVault", kv.Name, "failed", keyVaults[0].Name)
+			}
+			value, err := rawValueToInterface(raw)
+			return value, kv.Name, err
+		}
+		if len(keyVaults) == 1 {
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, fmt.Errorf("%s: %w", kv.Name, err))
+		}
+		// A canceled or expired context fails the other key vaults too.
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	ec.Metrics.Observe("decrypt", time.Since(start))
+	ec.Metrics.Count("decrypt_errors", 1)
+	return nil, "", fmt.Errorf("failed to explicitly decrypt the value: %w", errors.Join(errs...))
+}
+
+// useKey records the DEK of the ciphertext as used, and returns the current KeyVault along with
+// the function to call once done with it, which InvalidateKeyCache waits for before closing it.
+func (d *Decryptor) useKey(encryptedValue primitive.Binary) (KeyVault, func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if info, err := InspectCiphertext(encryptedValue); err == nil {
+		d.usedKeys[string(info.KeyID.Data)] = struct{}{}
+	}
+	d.inFlight.Add(1)
+	return d.keyVault, d.inFlight.Done
+}
+
+func rawValueToInterface(raw bson.RawValue) (interface{}, error) {
+	var value interface{}
+	if err := raw.Unmarshal(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode the decrypted value: %w", err)
+	}
+	return value, nil
+}
+
+// asCiphertext reports whether the value is a CSFLE/QE ciphertext.
+func asCiphertext(value interface{}) (primitive.Binary, bool) {
+	bin, ok := value.(primitive.Binary)
+	if !ok || bin.Subtype != _encryptedSubtype {
+		return primitive.Binary{}, false
+	}
+	return bin, true
+}
+
+// ReadFieldAny returns the value of the field whether it was stored in plaintext (legacy documents
+// written before encryption was enabled) or as ciphertext, which is decrypted. This allows a
+// collection to be migrated to encryption incrementally.
+func ReadFieldAny(
+	ctx context.Context, decryptor *Decryptor, doc bson.M, field string,
+) (interface{}, error) {
+	value, ok := doc[field]
+	if !ok {
+		return nil, fmt.Errorf("field '%s' not found in the document", field)
+	}
+	bin, ok := asCiphertext(value)
+	if !ok {
+		return value, nil
+	}
+	return decryptor.Decrypt(ctx, bin)
+}
+
+// ciphertextRef is a ciphertext found in a document, along with a way to replace it in place.
+type ciphertextRef struct {
+	path       string
+	ciphertext primitive.Binary
+	set        func(value interface{})
+}
+
+// findCiphertext returns every ciphertext in the value, including in nested documents and
+// arrays.
+func findCiphertext(value interface{}, path string) []ciphertextRef {
+	var refs []ciphertextRef
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := value.(type) {
+	case bson.M:
+		for k, elem := range v {
+			if bin, ok := asCiphertext(elem); ok {
+				refs = append(refs, ciphertextRef{join(k), bin, func(value interface{}) { v[k] = value }})
+				continue
+			}
+			refs = append(refs, findCiphertext(elem, join(k))...)
+		}
+	case bson.D:
+		for i := range v {
+			if bin, ok := asCiphertext(v[i].Value); ok {
+				refs = append(refs, ciphertextRef{join(v[i].Key), bin, func(value interface{}) { v[i].Value = value }})
+				continue
+			}
+			refs = append(refs, findCiphertext(v[i].Value, join(v[i].Key))...)
+		}
+	case bson.A:
+		for i := range v {
+			key := fmt.Sprintf("%d", i)
+			if bin, ok := asCiphertext(v[i]); ok {
+				refs = append(refs, ciphertextRef{join(key), bin, func(value interface{}) { v[i] = value }})
+				continue
+			}
+			refs = append(refs, findCiphertext(v[i], join(key))...)
+		}
+	}
+	return refs
+}
+
+// DecryptDocument decrypts, in place, every ciphertext in the document, and returns the document.
+// It stops at the first value that fails to decrypt.
+func (d *Decryptor) DecryptDocument(ctx context.Context, doc bson.M) (bson.M, error) {
+	for _, ref := range findCiphertext(doc, "") {
+		value, err := d.Decrypt(ctx, ref.ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt field '%s': %w", ref.path, err)
+		}
+		ref.set(value)
+	}
+	return doc, nil
+}
+
+// DecryptDocumentPartial decrypts, in place, every ciphertext in the document that it can, for
+// callers with access to only some of the DEKs. A value that fails to decrypt (e.g. its DEK is
+// unknown) is left as ciphertext, and its error is recorded under its dotted path. The error map
+// is nil when every value decrypted.
+func (d *Decryptor) DecryptDocumentPartial(ctx context.Context, doc bson.M) (bson.M, map[string]error) {
+	var errs map[string]error
+	for _, ref := range findCiphertext(doc, "") {
+		value, err := d.Decrypt(ctx, ref.ciphertext)
+		if err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[ref.path] = err
+			continue
+		}
+		ref.set(value)
+	}
+	return doc, errs
+}
@@ -0,0 +1,379 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// closableKeyVault is a KeyVault with the Close of a ClientEncryption. Its decryptions wait for
+// proceed, if set, and fail the test if the key vault was closed under them.
+type closableKeyVault struct {
+	*testutil.FakeKeyVault
+	t       *testing.T
+	closed  atomic.Bool
+	started chan struct{}
+	proceed chan struct{}
+}
+
+func (kv *closableKeyVault) Decrypt(ctx context.Context, val primitive.Binary) (bson.RawValue, error) {
+	if kv.closed.Load() {
+		kv.t.Error("decrypting with a closed key vault")
+	}
+	if kv.proceed != nil {
+		kv.started <- struct{}{}
+		<-kv.proceed
+	}
+	value, err := kv.FakeKeyVault.Decrypt(ctx, val)
+	if kv.closed.Load() {
+		kv.t.Error("the key vault was closed during a decryption")
+	}
+	return value, err
+}
+
+func (kv *closableKeyVault) Close(context.Context) error {
+	kv.closed.Store(true)
+	return nil
+}
+
+func encryptWith(t *testing.T, kv utils.KeyVault, keyID primitive.Binary, value string) primitive.Binary {
+	t.Helper()
+	raw, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := kv.Encrypt(context.Background(), bson.Raw(raw).Lookup("v"),
+		options.Encrypt().SetKeyID(keyID).SetAlgorithm(utils.AlgorithmDeterministic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+// TestInvalidateKeyCacheWaitsForDecryptions invalidates the cache of a DEK while a decryption is
+// running on the key vault that used it: the old key vault must only be closed once that
+// decryption is done, and new decryptions must go to the reopened one. Run it with -race.
+func TestInvalidateKeyCacheWaitsForDecryptions(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ciphertext := encryptWith(t, fake, keyID, "alice@example.com")
+
+	first := &closableKeyVault{FakeKeyVault: fake, t: t,
+		started: make(chan struct{}), proceed: make(chan struct{})}
+	second := &closableKeyVault{FakeKeyVault: fake, t: t}
+	var opened atomic.Int32
+	decryptor, err := utils.NewRefreshableDecryptor(func() (utils.KeyVault, error) {
+		if opened.Add(1) == 1 {
+			return first, nil
+		}
+		return second, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	decrypted := make(chan error, 1)
+	go func() {
+		_, err := decryptor.Decrypt(ctx, ciphertext)
+		decrypted <- err
+	}()
+	<-first.started
+
+	invalidated := make(chan error, 1)
+	go func() { invalidated <- decryptor.InvalidateKeyCache(keyID) }()
+
+	// The refresh must not close the key vault while the decryption is running on it, but new
+	// decryptions already use the reopened one.
+	deadline := time.After(5 * time.Second)
+	for {
+		if opened.Load() == 2 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("the key vault was not reopened")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if value, err := decryptor.Decrypt(ctx, ciphertext); err != nil || value != "alice@example.com" {
+		t.Fatalf("Decrypt() during the refresh = %v, %v, want alice@example.com", value, err)
+	}
+	select {
+	case err := <-invalidated:
+		t.Fatalf("InvalidateKeyCache() returned (%v) before the running decryption was done", err)
+	default:
+	}
+	if first.closed.Load() {
+		t.Fatal("the old key vault was closed while a decryption was running on it")
+	}
+
+	close(first.proceed)
+	if err := <-decrypted; err != nil {
+		t.Errorf("Decrypt() error = %v", err)
+	}
+	if err := <-invalidated; err != nil {
+		t.Errorf("InvalidateKeyCache() error = %v", err)
+	}
+	if !first.closed.Load() {
+		t.Error("the old key vault was not closed")
+	}
+	if second.closed.Load() {
+		t.Error("the reopened key vault was closed")
+	}
+}
+
+// TestInvalidateKeyCacheDecryptsWhileReopening blocks the reopening of the key vault, and checks
+// that decryptions still go through the current one meanwhile.
+func TestInvalidateKeyCacheDecryptsWhileReopening(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ciphertext := encryptWith(t, fake, keyID, "alice@example.com")
+
+	first := &closableKeyVault{FakeKeyVault: fake, t: t}
+	second := &closableKeyVault{FakeKeyVault: fake, t: t}
+	reopening, reopen := make(chan struct{}), make(chan struct{})
+	var opened atomic.Int32
+	decryptor, err := utils.NewRefreshableDecryptor(func() (utils.KeyVault, error) {
+		if opened.Add(1) == 1 {
+			return first, nil
+		}
+		close(reopening)
+		<-reopen
+		return second, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := decryptor.Decrypt(ctx, ciphertext); err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	invalidated := make(chan error, 1)
+	go func() { invalidated <- decryptor.InvalidateKeyCache(keyID) }()
+	<-reopening
+
+	decrypted := make(chan error, 1)
+	go func() {
+		_, err := decryptor.Decrypt(ctx, ciphertext)
+		decrypted <- err
+	}()
+	select {
+	case err := <-decrypted:
+		if err != nil {
+			t.Errorf("Decrypt() while reopening error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Decrypt() blocked while the key vault was being reopened")
+	}
+
+	close(reopen)
+	if err := <-invalidated; err != nil {
+		t.Errorf("InvalidateKeyCache() error = %v", err)
+	}
+	if !first.closed.Load() || second.closed.Load() {
+		t.Errorf("closed: old key vault = %v, reopened one = %v, want true, false",
+			first.closed.Load(), second.closed.Load())
+	}
+}
+
+// TestDecryptorConcurrentInvalidation decrypts from many goroutines while the cache is invalidated
+// repeatedly, for the race detector to check the key vault swap.
+func TestDecryptorConcurrentInvalidation(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ciphertext := encryptWith(t, fake, keyID, "alice@example.com")
+	decryptor, err := utils.NewRefreshableDecryptor(func() (utils.KeyVault, error) {
+		return &closableKeyVault{FakeKeyVault: fake, t: t}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				if _, err := decryptor.Decrypt(ctx, ciphertext); err != nil {
+					t.Errorf("Decrypt() error = %v", err)
+					return
+				}
+			}
+		}()
+	}
+	for range 20 {
+		if err := decryptor.InvalidateKeyCache(keyID); err != nil {
+			t.Errorf("InvalidateKeyCache() error = %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+// TestReadFieldAny reads the ssn of a legacy document written before encryption was enabled and of
+// one written with it encrypted.
+func TestReadFieldAny(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	decryptor := utils.NewDecryptor(fake)
+	ctx := context.Background()
+
+	docs := map[string]bson.M{
+		"plaintext": {"ssn": "987-65-4320"},
+		"encrypted": {"ssn": encryptWith(t, fake, keyID, "987-65-4320")},
+	}
+	for name, doc := range docs {
+		t.Run(name, func(t *testing.T) {
+			got, err := utils.ReadFieldAny(ctx, decryptor, doc, "ssn")
+			if err != nil {
+				t.Fatalf("ReadFieldAny() error = %v", err)
+			}
+			if got != "987-65-4320" {
+				t.Errorf("ReadFieldAny() = %v, want 987-65-4320", got)
+			}
+		})
+	}
+
+	if _, err := utils.ReadFieldAny(ctx, decryptor, bson.M{"name": "Bob"}, "ssn"); err == nil {
+		t.Error("ReadFieldAny() of a missing field succeeded, want an error")
+	}
+}
+
+// TestDecryptObject decrypts an address encrypted as a whole (see SchemaBuilder.AddRandomObject)
+// back into the nested document.
+func TestDecryptObject(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	address := bson.D{{Key: "street", Value: "1 Main St"}, {Key: "zip", Value: "94105"}}
+	raw, err := bson.Marshal(bson.D{{Key: "address", Value: address}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ciphertext, err := fake.Encrypt(ctx, bson.Raw(raw).Lookup("address"),
+		options.Encrypt().SetKeyID(keyID).SetAlgorithm(utils.AlgorithmRandom))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := utils.NewDecryptor(fake).DecryptDocument(ctx, bson.M{"name": "Bob", "address": ciphertext})
+	if err != nil {
+		t.Fatalf("DecryptDocument() error = %v", err)
+	}
+	if !reflect.DeepEqual(doc["address"], address) {
+		t.Errorf("address = %#v, want %#v", doc["address"], address)
+	}
+}
+
+// TestDecryptDocumentPartial decrypts a document with one field under a known DEK and one under a
+// DEK of another tenant.
+func TestDecryptDocumentPartial(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	other := testutil.NewFakeKeyVault()
+	otherKeyID := other.AddKey("local:200", "dek-local:200")
+	unknown := encryptWith(t, other, otherKeyID, "a@b.c")
+	doc := bson.M{
+		"name":    "Bob",
+		"ssn":     encryptWith(t, fake, keyID, "987-65-4320"),
+		"profile": bson.M{"email": unknown},
+	}
+
+	got, errs := utils.NewDecryptor(fake).DecryptDocumentPartial(context.Background(), doc)
+	want := bson.M{"name": "Bob", "ssn": "987-65-4320", "profile": bson.M{"email": unknown}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DecryptDocumentPartial() = %v, want %v", got, want)
+	}
+	if len(errs) != 1 || errs["profile.email"] == nil {
+		t.Errorf("DecryptDocumentPartial() errors = %v, want one for profile.email", errs)
+	}
+
+	got, errs = utils.NewDecryptor(fake).DecryptDocumentPartial(context.Background(), bson.M{"name": "Bob"})
+	if errs != nil || !reflect.DeepEqual(got, bson.M{"name": "Bob"}) {
+		t.Errorf("DecryptDocumentPartial() of a plaintext document = %v, %v", got, errs)
+	}
+}
+
+// TestDecryptorWithFallback decrypts through the mirror DEK of region B while the KMS of region A
+// is unavailable.
+func TestDecryptorWithFallback(t *testing.T) {
+	regionA := testutil.NewFakeKeyVault()
+	regionA.DecryptErr = errors.New("kms request failed: dial tcp: connection refused")
+	regionB := testutil.NewFakeKeyVault()
+	keyID := regionB.AddKey("local:us_100", "dek-local:us_100")
+	ciphertext := encryptWith(t, regionB, keyID, "987-65-4320")
+
+	decryptor, err := utils.NewDecryptorWithFallback([]utils.NamedKeyVault{
+		{Name: "region-a", KeyVault: regionA},
+		{Name: "region-b", KeyVault: regionB},
+	})
+	if err != nil {
+		t.Fatalf("NewDecryptorWithFallback() error = %v", err)
+	}
+	ctx := context.Background()
+	value, name, err := decryptor.DecryptWithProvider(ctx, ciphertext)
+	if err != nil {
+		t.Fatalf("DecryptWithProvider() error = %v", err)
+	}
+	if value != "987-65-4320" || name != "region-b" {
+		t.Errorf("DecryptWithProvider() = %v, %s, want 987-65-4320, region-b", value, name)
+	}
+
+	regionB.DecryptErr = errors.New("kms request failed: dial tcp: i/o timeout")
+	_, err = decryptor.Decrypt(ctx, ciphertext)
+	for _, want := range []string{"region-a: kms request failed", "region-b: kms request failed"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Decrypt() with every region down error = %v, want %q", err, want)
+		}
+	}
+
+	if _, err := utils.NewDecryptorWithFallback(nil); err == nil {
+		t.Error("NewDecryptorWithFallback() without key vaults succeeded, want an error")
+	}
+}
+
+// TestDecryptWithProviderOrder checks that the key vaults are tried in order: the fallback isn't
+// called while the primary decrypts.
+func TestDecryptWithProviderOrder(t *testing.T) {
+	primary := testutil.NewFakeKeyVault()
+	keyID := primary.AddKey("local:us_100", "dek-local:us_100")
+	ciphertext := encryptWith(t, primary, keyID, "987-65-4320")
+	fallback := testutil.NewFakeKeyVault()
+
+	decryptor, err := utils.NewDecryptorWithFallback([]utils.NamedKeyVault{
+		{Name: "primary", KeyVault: primary},
+		{Name: "fallback", KeyVault: fallback},
+	})
+	if err != nil {
+		t.Fatalf("NewDecryptorWithFallback() error = %v", err)
+	}
+	value, name, err := decryptor.DecryptWithProvider(context.Background(), ciphertext)
+	if err != nil || value != "987-65-4320" || name != "primary" {
+		t.Errorf("DecryptWithProvider() = %v, %s, %v, want 987-65-4320, primary", value, name, err)
+	}
+	if primary.DecryptCalls != 1 || fallback.DecryptCalls != 0 {
+		t.Errorf("decrypted %d times with the primary and %d with the fallback, want 1 and 0",
+			primary.DecryptCalls, fallback.DecryptCalls)
+	}
+
+	primary.DecryptErr = errors.New("kms request failed: AccessDenied")
+	_, err = utils.NewDecryptor(primary).Decrypt(context.Background(), ciphertext)
+	want := "failed to explicitly decrypt the value: kms request failed: AccessDenied"
+	if !errors.Is(err, primary.DecryptErr) || err.Error() != want {
+		t.Errorf("Decrypt() without fallbacks error = %v, want %q", err, want)
+	}
+}
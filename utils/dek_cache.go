@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long GetDek trusts a resolved DEK id before looking it up in the key vault again.
+const _defaultDekCacheTTL = 5 * time.Minute
+
+// The cache GetDek uses to avoid a key vault round trip (and a new connection) for every call.
+var _dekCache = NewDekCache(_defaultDekCacheTTL, RealClock())
+
+// DekCache caches resolved DEK ids by key vault namespace and alt name. It only caches the DEK
+// id; the driver keeps its own cache of the unwrapped key material per client.
+type DekCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	clock   Clock
+	entries map[string]dekCacheEntry
+}
+
+type dekCacheEntry struct {
+	dek       primitive.Binary
+	expiresAt time.Time
+}
+
+func NewDekCache(ttl time.Duration, clock Clock) *DekCache {
+	if clock == nil {
+		clock = RealClock()
+	}
+	return &DekCache{ttl: ttl, clock: clock, entries: make(map[string]dekCacheEntry)}
+}
+
+// SetDekCache replaces the cache used by GetDek.
+func SetDekCache(cache *DekCache) {
+	_dekCache = cache
+}
+
+func dekCacheKey(keyVaultNamespace, keyAltName string) string {
+	return keyVaultNamespace + "/" + keyAltName
+}
+
+func (c *DekCache) Get(key string) (primitive.Binary, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return primitive.Binary{}, false
+	}
+	if !c.clock.Now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return primitive.Binary{}, false
+	}
+	return entry.dek, true
+}
+
+func (c *DekCache) Put(key string, dek primitive.Binary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = dekCacheEntry{dek: dek, expiresAt: c.clock.Now().Add(c.ttl)}
+}
+
+func (c *DekCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// InvalidateDek removes the entries resolving to the DEK, in every key vault namespace.
+func (c *DekCache) InvalidateDek(dek primitive.Binary) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.dek.Equal(dek) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// InvalidateAltName removes the entries of the alt name, in every key vault namespace.
+func (c *DekCache) InvalidateAltName(keyAltName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasSuffix(key, "/"+keyAltName) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// ForgetDek drops the DEK id GetDek cached for the provider's tenant, in every key vault namespace,
+// so the next GetDek looks it up in the key vault again. The helpers that delete DEKs or remove
+// their alt names do so themselves; call it after deleting or renaming the tenant's DEK otherwise,
+// e.g. with ClientEncryption.DeleteKey.
+func ForgetDek(providerName string) {
+	_dekCache.InvalidateAltName(dekAltName(providerName))
+}
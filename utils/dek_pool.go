@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dekPoolAltName returns the alt name of the i-th DEK of the provider's pool, dek-<provider>-<i>.
+// The driver doesn't accept a dash in a provider name (see _providerNamePattern), so the index
+// can't be mistaken for part of the name.
+func dekPoolAltName(providerName string, i int) string {
+	return fmt.Sprintf("%s-%d", dekAltName(providerName), i)
+}
+
+// dekAltNameProvider returns the provider name of a tenant DEK alt name, either dek-<provider> or
+// dek-<provider>-<i> for a DEK of the provider's pool.
+func dekAltNameProvider(altName string) (string, bool) {
+	providerName, ok := strings.CutPrefix(altName, _dekAltNamePrefix)
+	if !ok || providerName == "" {
+		return "", false
+	}
+	if name, index, ok := strings.Cut(providerName, "-"); ok {
+		if _, err := strconv.Atoi(index); err == nil && name != "" {
+			return name, true
+		}
+	}
+	return providerName, true
+}
+
+// EnsureDeks returns a pool of count DEKs for the provider, to spread the writes of a
+// performance-critical tenant over several keys (see DekSelector). The DEKs are registered under
+// the alt names dek-<provider>-0 to dek-<provider>-<count-1>; the ones that don't exist yet are
+// created, like GetDek creates the tenant DEK, so the call can be repeated, or repeated with a
+// larger count to grow the pool. The pool is separate from the DEK GetDek returns.
+func EnsureDeks(ctx context.Context, providerName, keyVaultNamespace string, count int) ([]primitive.Binary, error) {
+	if count <= 0 {
+		return nil, fmt.Errorf("the number of DEKs must be positive, got %d", count)
+	}
+	localMasterKey, err := LoadOrCreateMasterKey(providerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load or create master key: %v", err)
+	}
+	kmsProviders := map[string]map[string]interface{}{
+		providerName: {"key": localMasterKey},
+	}
+
+	var res Resources
+	defer res.Close(ctx)
+	client, clientEnc, err := OpenKeyVault(ctx, &res, keyVaultNamespace, kmsProviders)
+	if err != nil {
+		return nil, err
+	}
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return ensureDekPool(ctx, NewDekStore(clientEnc, keyVault), providerName, count)
+}
+
+// ensureDekPool returns the pool of count DEKs of the provider in the store, creating the missing
+// ones.
+func ensureDekPool(
+	ctx context.Context, store DekStore, providerName string, count int,
+) ([]primitive.Binary, error) {
+	deks := make([]primitive.Binary, 0, count)
+	for i := 0; i < count; i++ {
+		id, created, err := resolveDekByAltName(ctx, store, providerName, dekPoolAltName(providerName, i), nil)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			if err := initDek(ctx, store, providerName, id); err != nil {
+				return nil, err
+			}
+		}
+		deks = append(deks, id)
+	}
+	return deks, nil
+}
+
+// DekSelector picks the DEKs of a pool in turn, e.g. to choose the key of each explicitly
+// encrypted write. It is safe for concurrent use.
+type DekSelector struct {
+	deks []primitive.Binary
+	next atomic.Uint64
+}
+
+// NewDekSelector returns a round-robin selector over the DEKs, as returned by EnsureDeks.
+func NewDekSelector(deks []primitive.Binary) (*DekSelector, error) {
+	if len(deks) == 0 {
+		return nil, fmt.Errorf("no DEKs to select from")
+	}
+	return &DekSelector{deks: deks}, nil
+}
+
+// Next returns the DEK for the next write.
+func (s *DekSelector) Next() primitive.Binary {
+	i := s.next.Add(1) - 1
+	return s.deks[i%uint64(len(s.deks))]
+}
@@ -0,0 +1,71 @@
+package utils_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestEnsureDekPool requests a pool of 3 DEKs, then the same pool again, then a larger one.
+func TestEnsureDekPool(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	ctx := context.Background()
+
+	deks, err := utils.EnsureDekPool(ctx, fake, "local:100", 3)
+	if err != nil {
+		t.Fatalf("EnsureDekPool() error = %v", err)
+	}
+	distinct := make(map[string]struct{})
+	for _, dek := range deks {
+		distinct[string(dek.Data)] = struct{}{}
+	}
+	if len(deks) != 3 || len(distinct) != 3 {
+		t.Fatalf("EnsureDekPool() = %v, want 3 distinct DEKs", deks)
+	}
+	var altNames []string
+	for _, key := range fake.Keys() {
+		altNames = append(altNames, fmt.Sprint(key["keyAltNames"]))
+	}
+	sort.Strings(altNames)
+	want := []string{"[dek-local:100-0]", "[dek-local:100-1]", "[dek-local:100-2]"}
+	if !reflect.DeepEqual(altNames, want) {
+		t.Errorf("alt names = %v, want %v", altNames, want)
+	}
+
+	again, err := utils.EnsureDekPool(ctx, fake, "local:100", 3)
+	if err != nil || !reflect.DeepEqual(again, deks) || fake.CreateCalls != 3 {
+		t.Errorf("EnsureDekPool() again = %v, %v with %d DEKs created, want the same pool",
+			again, err, fake.CreateCalls)
+	}
+	grown, err := utils.EnsureDekPool(ctx, fake, "local:100", 4)
+	if err != nil || len(grown) != 4 || !reflect.DeepEqual(grown[:3], deks) {
+		t.Errorf("EnsureDekPool() of 4 = %v, %v, want the pool and a new DEK", grown, err)
+	}
+}
+
+func TestDekSelector(t *testing.T) {
+	deks := []primitive.Binary{
+		{Subtype: 4, Data: []byte{0}},
+		{Subtype: 4, Data: []byte{1}},
+		{Subtype: 4, Data: []byte{2}},
+	}
+	selector, err := utils.NewDekSelector(deks)
+	if err != nil {
+		t.Fatalf("NewDekSelector() error = %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		if got := selector.Next(); got.Data[0] != byte(i%3) {
+			t.Errorf("Next() #%d = %v, want DEK %d", i, got, i%3)
+		}
+	}
+	if _, err := utils.NewDekSelector(nil); err == nil {
+		t.Error("NewDekSelector() without DEKs succeeded, want an error")
+	}
+}
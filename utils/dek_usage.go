@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FindUnusedDeks scans every document of the collection for the DEKs its ciphertext references,
+// and returns the DEKs of the key vault that none of them do, sorted by UUID. The client must be a
+// regular (non-encrypting) one, so the documents are read as ciphertext; it is also used to read
+// the key vault.
+//
+// The result is advisory: a DEK may be used by another collection, or by a document written after
+// the scan, so check those before deleting anything.
+func FindUnusedDeks(
+	ctx context.Context, dataClient *mongo.Client, coll CollRef, keyVaultNamespace string,
+) ([]primitive.Binary, error) {
+	cursor, err := coll.Collection(dataClient).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	defer cursor.Close(ctx)
+	used, err := referencedDeks(ctx, cursor, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	keyVault, err := keyVaultCollection(dataClient, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	keyCursor, err := keyVault.Find(ctx, bson.D{}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the DEKs in %s: %w", keyVaultNamespace, err)
+	}
+	return unusedDeks(ctx, keyCursor, used, keyVaultNamespace)
+}
+
+// referencedDeks returns the UUIDs (as strings of their bytes) of the DEKs the ciphertext of the
+// documents of the cursor references.
+func referencedDeks(ctx context.Context, cursor *mongo.Cursor, coll CollRef) (map[string]struct{}, error) {
+	used := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode a document of %s: %w", coll, err)
+		}
+		keyIDs, err := RequiredDeks(doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %v of %s: %w", doc["_id"], coll, err)
+		}
+		for _, keyID := range keyIDs {
+			used[string(keyID.Data)] = struct{}{}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	return used, nil
+}
+
+// unusedDeks returns the DEKs of the key vault cursor missing from used, sorted by UUID.
+func unusedDeks(
+	ctx context.Context, keyCursor *mongo.Cursor, used map[string]struct{}, keyVaultNamespace string,
+) ([]primitive.Binary, error) {
+	var keys []struct {
+		ID primitive.Binary `bson:"_id"`
+	}
+	if err := keyCursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("failed to read the DEKs in %s: %w", keyVaultNamespace, err)
+	}
+
+	var unused []primitive.Binary
+	for _, key := range keys {
+		if _, ok := used[string(key.ID.Data)]; !ok {
+			unused = append(unused, key.ID)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return bytes.Compare(unused[i].Data, unused[j].Data) < 0 })
+	return unused, nil
+}
+
+// TenantStat is the storage and key usage of a tenant in a collection.
+type TenantStat struct {
+	// The documents with at least one field encrypted with one of the tenant's DEKs.
+	Documents int64
+	// The encrypted fields, over all those documents, encrypted with one of the tenant's DEKs.
+	EncryptedFields int64
+	// The tenant's DEKs in the key vault: the tenant DEK and those of its pool (see EnsureDeks).
+	Deks int
+}
+
+// TenantStats reports the storage and key usage of a tenant (provider name) in a collection,
+// e.g. for an operator dashboard. Nothing is decrypted: the tenant's DEKs are found by their alt
+// names in the key vault, and the documents are scanned for ciphertext that names one of them in
+// its header, which works for a collection shared by tenants too. The client must be a regular
+// (non-encrypting) one, and the scan reads the whole collection.
+func TenantStats(
+	ctx context.Context, dataClient *mongo.Client, coll CollRef, keyVaultNamespace, providerName string,
+) (TenantStat, error) {
+	keyVault, err := keyVaultCollection(dataClient, keyVaultNamespace)
+	if err != nil {
+		return TenantStat{}, err
+	}
+	filter := bson.M{"keyAltNames": bson.M{"$regex": tenantAltNamePattern(providerName)}}
+	keyCursor, err := keyVault.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return TenantStat{}, fmt.Errorf("failed to find the DEKs of %s in %s: %w", providerName, keyVaultNamespace, err)
+	}
+	var keys []struct {
+		ID primitive.Binary `bson:"_id"`
+	}
+	if err := keyCursor.All(ctx, &keys); err != nil {
+		return TenantStat{}, fmt.Errorf("failed to read the DEKs in %s: %w", keyVaultNamespace, err)
+	}
+	stat := TenantStat{Deks: len(keys)}
+	if len(keys) == 0 {
+		return stat, nil
+	}
+	tenantKeys := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		tenantKeys[string(key.ID.Data)] = struct{}{}
+	}
+
+	cursor, err := coll.Collection(dataClient).Find(ctx, bson.D{})
+	if err != nil {
+		return stat, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	defer cursor.Close(ctx)
+	stat.Documents, stat.EncryptedFields, err = tenantDocuments(ctx, cursor, coll, tenantKeys)
+	return stat, err
+}
+
+// tenantAltNamePattern matches the alt names of the tenant's DEKs: its DEK and those of its pool.
+func tenantAltNamePattern(providerName string) string {
+	return "^" + regexp.QuoteMeta(dekAltName(providerName)) + `(-\d+)?$`
+}
+
+// tenantDocuments counts the documents of the cursor with ciphertext under one of the tenant's
+// DEKs (their UUIDs as strings of their bytes), and those encrypted fields.
+func tenantDocuments(
+	ctx context.Context, cursor *mongo.Cursor, coll CollRef, tenantKeys map[string]struct{},
+) (documents, encryptedFields int64, err error) {
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return documents, encryptedFields, fmt.Errorf("failed to decode a document of %s: %w", coll, err)
+		}
+		var fields int64
+		for _, ref := range findCiphertext(doc, "") {
+			info, err := InspectCiphertext(ref.ciphertext)
+			if err != nil {
+				return documents, encryptedFields,
+					fmt.Errorf("document %v of %s, field '%s': %w", doc["_id"], coll, ref.path, err)
+			}
+			if _, ok := tenantKeys[string(info.KeyID.Data)]; ok {
+				fields++
+			}
+		}
+		if fields > 0 {
+			documents++
+			encryptedFields += fields
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return documents, encryptedFields, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	return documents, encryptedFields, nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testCiphertext returns a deterministic ciphertext header naming the DEK, with a dummy payload.
+func testCiphertext(keyID primitive.Binary) primitive.Binary {
+	data := append([]byte{_blobSubtypeDeterministic}, keyID.Data...)
+	data = append(data, byte(bson.TypeString), 0xaa)
+	return primitive.Binary{Subtype: _encryptedSubtype, Data: data}
+}
+
+// TestFindUnusedDeks diffs a key vault of two DEKs against a collection that only references the
+// first one.
+func TestFindUnusedDeks(t *testing.T) {
+	ctx := context.Background()
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	used := primitive.Binary{Subtype: 4, Data: []byte("used-dek-0000000")}
+	unused := primitive.Binary{Subtype: 4, Data: []byte("unused-dek-00000")}
+
+	referenced, err := referencedDeks(ctx, keyCursor(t,
+		bson.M{"_id": 1, "ssn": testCiphertext(used)},
+		bson.M{"_id": 2, "profile": bson.M{"email": testCiphertext(used)}},
+		bson.M{"_id": 3, "name": "Bob"},
+	), coll)
+	if err != nil {
+		t.Fatalf("referencedDeks() error = %v", err)
+	}
+	got, err := unusedDeks(ctx, keyCursor(t, bson.M{"_id": used}, bson.M{"_id": unused}), referenced, "a.b")
+	if err != nil {
+		t.Fatalf("unusedDeks() error = %v", err)
+	}
+	if len(got) != 1 || string(got[0].Data) != string(unused.Data) {
+		t.Errorf("unusedDeks() = %v, want only %v", got, unused)
+	}
+
+	malformed := primitive.Binary{Subtype: _encryptedSubtype, Data: []byte{1}}
+	if _, err := referencedDeks(ctx, keyCursor(t, bson.M{"_id": 4, "ssn": malformed}), coll); err == nil {
+		t.Error("referencedDeks() of a malformed ciphertext succeeded, want an error")
+	}
+}
+
+// TestTenantStats counts the documents and fields of tenant 100, whose DEK and pool DEK share a
+// collection with the DEK of another tenant.
+func TestTenantStats(t *testing.T) {
+	ctx := context.Background()
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	dek := primitive.Binary{Subtype: 4, Data: []byte("tenant-100-dek-0")}
+	poolDek := primitive.Binary{Subtype: 4, Data: []byte("tenant-100-dek-1")}
+	otherDek := primitive.Binary{Subtype: 4, Data: []byte("tenant-200-dek-0")}
+	tenantKeys := map[string]struct{}{string(dek.Data): {}, string(poolDek.Data): {}}
+
+	documents, fields, err := tenantDocuments(ctx, keyCursor(t,
+		bson.M{"_id": 1, "ssn": testCiphertext(dek), "profile": bson.M{"email": testCiphertext(poolDek)}},
+		bson.M{"_id": 2, "ssn": testCiphertext(poolDek), "email": testCiphertext(otherDek)},
+		bson.M{"_id": 3, "ssn": testCiphertext(otherDek)},
+		bson.M{"_id": 4, "name": "Bob"},
+	), coll, tenantKeys)
+	if err != nil {
+		t.Fatalf("tenantDocuments() error = %v", err)
+	}
+	if documents != 2 || fields != 3 {
+		t.Errorf("tenantDocuments() = %d documents, %d fields, want 2, 3", documents, fields)
+	}
+
+	pattern := regexp.MustCompile(tenantAltNamePattern("local:100"))
+	for altName, want := range map[string]bool{
+		"dek-local:100":   true,
+		"dek-local:100-3": true,
+		"dek-local:1000":  false,
+		"dek-local:10":    false,
+		"dek-local:100-x": false,
+	} {
+		if pattern.MatchString(altName) != want {
+			t.Errorf("alt name pattern of local:100 matches %s: %t, want %t", altName, !want, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build cse
+
+package utils
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/mongocrypt"
+	mcopts "go.mongodb.org/mongo-driver/x/mongo/driver/mongocrypt/options"
+)
+
+// TestDeterministicVectorsLibmongocrypt encrypts the fixtures through the linked libmongocrypt,
+// feeding it the fixture DEK instead of a key vault, and checks the ciphertext matches the
+// recorded one, so an upgrade of libmongocrypt that changes the output fails here.
+func TestDeterministicVectorsLibmongocrypt(t *testing.T) {
+	vectors, _ := loadDeterministicVectors(t)
+	masterKey, err := base64.StdEncoding.DecodeString(vectors.MasterKey)
+	if err != nil {
+		t.Fatalf("invalid master key: %v", err)
+	}
+	kmsProviders, err := bson.Marshal(bson.M{"local": bson.M{"key": masterKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyDoc bson.Raw
+	if err := bson.UnmarshalExtJSON(vectors.DataKey, false, &keyDoc); err != nil {
+		t.Fatalf("failed to parse the data key: %v", err)
+	}
+	var dataKey vectorDataKey
+	if err := bson.Unmarshal(keyDoc, &dataKey); err != nil {
+		t.Fatal(err)
+	}
+
+	crypt, err := mongocrypt.NewMongoCrypt(mcopts.MongoCrypt().
+		SetKmsProviders(kmsProviders).
+		SetCryptSharedLibDisabled(true))
+	if err != nil {
+		t.Fatalf("failed to create mongocrypt: %v", err)
+	}
+	defer crypt.Close()
+
+	for _, vector := range vectors.Vectors {
+		t.Run(vector.Name, func(t *testing.T) {
+			value := vectorValue(t, vector.Value)
+			doc, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := mcopts.ExplicitEncryption().SetKeyID(dataKey.ID).SetAlgorithm(AlgorithmDeterministic)
+			ctx, err := crypt.CreateExplicitEncryptionContext(bsoncore.Document(doc), opts)
+			if err != nil {
+				t.Fatalf("failed to create the encryption context: %v", err)
+			}
+			defer ctx.Close()
+
+			for ctx.State() == mongocrypt.NeedMongoKeys {
+				if err := ctx.AddOperationResult(bsoncore.Document(keyDoc)); err != nil {
+					t.Fatalf("failed to add the data key: %v", err)
+				}
+				if err := ctx.CompleteOperation(); err != nil {
+					t.Fatalf("failed to complete the key lookup: %v", err)
+				}
+			}
+			if ctx.State() != mongocrypt.Ready {
+				t.Fatalf("unexpected mongocrypt state %s", ctx.State())
+			}
+			encrypted, err := ctx.Finish()
+			if err != nil {
+				t.Fatalf("failed to encrypt: %v", err)
+			}
+			_, data, ok := encrypted.Lookup("v").BinaryOK()
+			if !ok {
+				t.Fatalf("encrypted value is not binary: %s", encrypted)
+			}
+			if got := base64.StdEncoding.EncodeToString(data); got != vector.Ciphertext {
+				t.Fatalf("libmongocrypt ciphertext changed:\n got %s\nwant %s", got, vector.Ciphertext)
+			}
+		})
+	}
+}
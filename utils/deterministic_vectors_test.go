@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// deterministicVectors is testdata/deterministic_vectors.json: known plaintext/ciphertext pairs
+// for the deterministic algorithm, with the local master key and the DEK they were produced with.
+type deterministicVectors struct {
+	MasterKey string          `json:"masterKey"`
+	DataKey   json.RawMessage `json:"dataKey"`
+	Vectors   []struct {
+		Name       string          `json:"name"`
+		Value      json.RawMessage `json:"value"`
+		Ciphertext string          `json:"ciphertext"`
+	} `json:"vectors"`
+}
+
+type vectorDataKey struct {
+	ID          primitive.Binary `bson:"_id"`
+	KeyMaterial primitive.Binary `bson:"keyMaterial"`
+}
+
+func loadDeterministicVectors(t testing.TB) (deterministicVectors, vectorDataKey) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "deterministic_vectors.json"))
+	if err != nil {
+		t.Fatalf("failed to read the vectors: %v", err)
+	}
+	var vectors deterministicVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("failed to parse the vectors: %v", err)
+	}
+	var dataKey vectorDataKey
+	if err := bson.UnmarshalExtJSON(vectors.DataKey, false, &dataKey); err != nil {
+		t.Fatalf("failed to parse the data key: %v", err)
+	}
+	return vectors, dataKey
+}
+
+// vectorValue decodes the extended JSON value of a vector.
+func vectorValue(t *testing.T, value json.RawMessage) bson.RawValue {
+	t.Helper()
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(`{"v": `+string(value)+`}`), false, &doc); err != nil {
+		t.Fatalf("failed to parse the value %s: %v", value, err)
+	}
+	return doc.Lookup("v")
+}
+
+// TestDeterministicVectors checks that the fixtures still encrypt to the recorded ciphertext with
+// AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic, as specified for CSFLE, and that the headers
+// InspectCiphertext parses out of them describe the DEK and the plaintext type. The ciphertext
+// depends only on the DEK and the plaintext, so any change means the crypto layer changed and
+// stored ciphertext would no longer match equality queries. With -tags cse, the same vectors are
+// run through libmongocrypt (see TestDeterministicVectorsLibmongocrypt).
+func TestDeterministicVectors(t *testing.T) {
+	vectors, dataKey := loadDeterministicVectors(t)
+	masterKey, err := base64.StdEncoding.DecodeString(vectors.MasterKey)
+	if err != nil {
+		t.Fatalf("invalid master key: %v", err)
+	}
+	dek, err := fle1Decrypt(masterKey, nil, dataKey.KeyMaterial.Data)
+	if err != nil {
+		t.Fatalf("failed to unwrap the DEK with the master key: %v", err)
+	}
+
+	for _, vector := range vectors.Vectors {
+		t.Run(vector.Name, func(t *testing.T) {
+			value := vectorValue(t, vector.Value)
+			got := fle1EncryptDeterministic(dek, dataKey.ID.Data, value)
+			if encoded := base64.StdEncoding.EncodeToString(got); encoded != vector.Ciphertext {
+				t.Fatalf("ciphertext changed:\n got %s\nwant %s", encoded, vector.Ciphertext)
+			}
+
+			info, err := InspectCiphertext(primitive.Binary{Subtype: _encryptedSubtype, Data: got})
+			if err != nil {
+				t.Fatalf("InspectCiphertext: %v", err)
+			}
+			if info.Algorithm() != AlgorithmDeterministic {
+				t.Errorf("algorithm = %s, want %s", info.Algorithm(), AlgorithmDeterministic)
+			}
+			if !bytes.Equal(info.KeyID.Data, dataKey.ID.Data) {
+				t.Errorf("key id = %x, want %x", info.KeyID.Data, dataKey.ID.Data)
+			}
+			if info.OriginalType != value.Type {
+				t.Errorf("original type = %s, want %s", info.OriginalType, value.Type)
+			}
+
+			plaintext, err := fle1Decrypt(dek, got[:_ciphertextHeaderSize], got[_ciphertextHeaderSize:])
+			if err != nil {
+				t.Fatalf("failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(plaintext, value.Value) {
+				t.Errorf("decrypted %x, want %x", plaintext, value.Value)
+			}
+		})
+	}
+}
+
+// fle1EncryptDeterministic encrypts a value with the CSFLE (FLE1) AEAD_AES_256_CBC_HMAC_SHA_512
+// construction, which libmongocrypt uses both to wrap DEKs with a local master key (random IV, no
+// associated data) and to encrypt values. The 96 byte key is a 32 byte MAC key, a 32 byte AES-256
+// key and a 32 byte IV key; the ciphertext is IV || AES-CBC(PKCS#7 padded plaintext) || the first
+// 32 bytes of the HMAC-SHA-512 of associated data || IV || AES-CBC output || the associated data
+// length in bits. The associated data is the ciphertext header.
+func fle1EncryptDeterministic(dek, keyID []byte, value bson.RawValue) []byte {
+	associatedData := append(append([]byte{_blobSubtypeDeterministic}, keyID...), byte(value.Type))
+	// The deterministic IV is derived from the plaintext, so equal values encrypt equally.
+	iv := fle1HMAC(dek[64:96], associatedData, fle1BitLength(associatedData), value.Value)[:aes.BlockSize]
+
+	padding := aes.BlockSize - len(value.Value)%aes.BlockSize
+	padded := append(append([]byte{}, value.Value...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	block, _ := aes.NewCipher(dek[32:64])
+	body := make([]byte, aes.BlockSize+len(padded))
+	copy(body, iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(body[aes.BlockSize:], padded)
+	tag := fle1HMAC(dek[:32], associatedData, body, fle1BitLength(associatedData))[:32]
+	return append(append(associatedData, body...), tag...)
+}
+
+func fle1Decrypt(key, associatedData, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 2*aes.BlockSize+32 || (len(ciphertext)-32)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length %d", len(ciphertext))
+	}
+	body, tag := ciphertext[:len(ciphertext)-32], ciphertext[len(ciphertext)-32:]
+	if !hmac.Equal(fle1HMAC(key[:32], associatedData, body, fle1BitLength(associatedData))[:32], tag) {
+		return nil, fmt.Errorf("authentication tag mismatch")
+	}
+	block, err := aes.NewCipher(key[32:64])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(body)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, body[:aes.BlockSize]).CryptBlocks(plaintext, body[aes.BlockSize:])
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func fle1HMAC(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func fle1BitLength(data []byte) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(len(data))*8)
+}
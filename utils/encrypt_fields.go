@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const _defaultEncryptConcurrency = 4
+
+// EncryptFields explicitly encrypts the given fields (dotted paths) of a document with the DEK
+// and algorithm, and returns the document with their values replaced by the ciphertext; the other
+// fields are kept as they are, in order. The fields are encrypted concurrently, at most
+// concurrency at a time (a non-positive value uses the default), through the one cipher, which is
+// much faster than one Encrypt after the other for a document with many encrypted fields. Fields
+// missing from the document are skipped. If any field fails to encrypt, the first failure is
+// returned.
+func EncryptFields(
+	ctx context.Context, cipher ExplicitCipher, doc interface{}, fields []string,
+	keyID primitive.Binary, algorithm string, concurrency int,
+) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the document: %w", err)
+	}
+	if concurrency <= 0 {
+		concurrency = _defaultEncryptConcurrency
+	}
+
+	type encryptTask struct {
+		path       string
+		value      bson.RawValue
+		ciphertext primitive.Binary
+		err        error
+	}
+	var tasks []*encryptTask
+	for _, path := range fields {
+		value, err := bson.Raw(data).LookupErr(strings.Split(path, ".")...)
+		if err != nil {
+			continue
+		}
+		if err := checkEncryptedFieldSize(path, len(value.Value)); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, &encryptTask{path: path, value: value})
+	}
+
+	opts := options.Encrypt().SetKeyID(keyID).SetAlgorithm(algorithm)
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *encryptTask) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				task.err = err
+				return
+			}
+			task.ciphertext, task.err = cipher.Encrypt(ctx, task.value, opts)
+			countEncryption(ctx, task.err)
+		}(task)
+	}
+	wg.Wait()
+
+	var encrypted bson.D
+	if err := bson.Unmarshal(data, &encrypted); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the document: %w", err)
+	}
+	for _, task := range tasks {
+		if task.err != nil {
+			return nil, fmt.Errorf("failed to encrypt field '%s': %w", task.path, task.err)
+		}
+		setPath(encrypted, strings.Split(task.path, "."), task.ciphertext)
+	}
+	return encrypted, nil
+}
+
+// setPath replaces the value of an existing field of the document.
+func setPath(doc bson.D, parts []string, value interface{}) {
+	for i, elem := range doc {
+		if elem.Key != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			doc[i].Value = value
+		} else if nested, ok := elem.Value.(bson.D); ok {
+			setPath(nested, parts[1:], value)
+		}
+		return
+	}
+}
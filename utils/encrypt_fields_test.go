@@ -0,0 +1,82 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestEncryptFields encrypts five fields of a document, one of them nested, and checks that each
+// became subtype-6 ciphertext that decrypts back while the other fields are untouched.
+func TestEncryptFields(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	doc := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: "987-65-4320"},
+		{Key: "email", Value: "bob@example.com"},
+		{Key: "phone", Value: "+15550100"},
+		{Key: "dob", Value: "1980-01-01"},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Springfield"}, {Key: "zip", Value: "94105"}}},
+	}
+	fields := []string{"ssn", "email", "phone", "dob", "address.zip", "missing"}
+
+	ctx := context.Background()
+	got, err := utils.EncryptFields(ctx, fake, doc, fields, keyID, utils.AlgorithmDeterministic, 2)
+	if err != nil {
+		t.Fatalf("EncryptFields() error = %v", err)
+	}
+	decryptor := utils.NewDecryptor(fake)
+	plaintext := map[string]string{
+		"ssn": "987-65-4320", "email": "bob@example.com", "phone": "+15550100", "dob": "1980-01-01",
+	}
+	var keys []string
+	for _, elem := range got {
+		keys = append(keys, elem.Key)
+		want, ok := plaintext[elem.Key]
+		if !ok {
+			continue
+		}
+		ciphertext, ok := elem.Value.(primitive.Binary)
+		if !ok || ciphertext.Subtype != 6 {
+			t.Errorf("%s = %#v, want subtype-6 binary", elem.Key, elem.Value)
+			continue
+		}
+		if value, err := decryptor.Decrypt(ctx, ciphertext); err != nil || value != want {
+			t.Errorf("Decrypt(%s) = %v, %v, want %s", elem.Key, value, err, want)
+		}
+	}
+	wantKeys := []string{"_id", "name", "ssn", "email", "phone", "dob", "address"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("fields = %v, want %v", keys, wantKeys)
+	}
+	if got[0].Value != int32(1) || got[1].Value != "Bob" {
+		t.Errorf("_id, name = %v, %v, want 1, Bob", got[0].Value, got[1].Value)
+	}
+	address, _ := got[6].Value.(bson.D)
+	if len(address) != 2 || address[0].Value != "Springfield" {
+		t.Fatalf("address = %v, want the city untouched", got[6].Value)
+	}
+	if zip, ok := address[1].Value.(primitive.Binary); !ok || zip.Subtype != 6 {
+		t.Errorf("address.zip = %#v, want subtype-6 binary", address[1].Value)
+	}
+}
+
+func TestEncryptFieldsFailure(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	fake.EncryptErr = errors.New("kms unavailable")
+	doc := bson.M{"name": "Bob", "ssn": "987-65-4320"}
+	_, err := utils.EncryptFields(context.Background(), fake, doc, []string{"ssn"}, keyID,
+		utils.AlgorithmDeterministic, 0)
+	if !errors.Is(err, fake.EncryptErr) {
+		t.Errorf("EncryptFields() error = %v, want %v", err, fake.EncryptErr)
+	}
+}
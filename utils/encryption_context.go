@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Metrics receives the measurements of the helpers, e.g. to export them to Prometheus.
+type Metrics interface {
+	// Count adds n to the named counter.
+	Count(name string, n int64)
+	// Observe records a duration of the named operation.
+	Observe(name string, d time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Count(string, int64)           {}
+func (noopMetrics) Observe(string, time.Duration) {}
+
+// EncryptionContext bundles the per-request collaborators of the helpers, so they travel in the
+// context instead of as parameters of every helper. The connection and key settings stay in the
+// Config set with SetConfig, since they also apply to clients created outside any request.
+type EncryptionContext struct {
+	// Where the helpers log. When nil, nothing is logged.
+	Logger *slog.Logger
+	// Where the helpers report their measurements. When nil, nothing is reported.
+	Metrics Metrics
+	// Who the operation is done for (a user or service), recorded in the logs for audit.
+	Actor string
+}
+
+type encryptionContextKey struct{}
+
+// WithEncryptionContext returns a copy of ctx carrying the EncryptionContext.
+func WithEncryptionContext(ctx context.Context, ec EncryptionContext) context.Context {
+	return context.WithValue(ctx, encryptionContextKey{}, ec)
+}
+
+// EncryptionContextFrom returns the EncryptionContext of ctx, with no-op defaults for anything it
+// doesn't carry, so the helpers can use it unconditionally.
+func EncryptionContextFrom(ctx context.Context) EncryptionContext {
+	ec, _ := ctx.Value(encryptionContextKey{}).(EncryptionContext)
+	if ec.Logger == nil {
+		ec.Logger = slog.New(slog.DiscardHandler)
+	}
+	if ec.Metrics == nil {
+		ec.Metrics = noopMetrics{}
+	}
+	return ec
+}
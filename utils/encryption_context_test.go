@@ -0,0 +1,83 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+)
+
+// recordingMetrics is a utils.Metrics that records the counters and the operations observed.
+type recordingMetrics struct {
+	mu       sync.Mutex
+	counts   map[string]int64
+	observed map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{counts: make(map[string]int64), observed: make(map[string]int)}
+}
+
+func (m *recordingMetrics) Count(name string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name] += n
+}
+
+func (m *recordingMetrics) Observe(name string, _ time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observed[name]++
+}
+
+// TestEncryptionContext decrypts through a fallback key vault with a logger and metrics in the
+// context, and then without them.
+func TestEncryptionContext(t *testing.T) {
+	primary := testutil.NewFakeKeyVault()
+	primary.DecryptErr = errors.New("kms request failed: dial tcp: connection refused")
+	fallback := testutil.NewFakeKeyVault()
+	keyID := fallback.AddKey("local:100", "dek-local:100")
+	ciphertext := encryptWith(t, fallback, keyID, "987-65-4320")
+	decryptor, err := utils.NewDecryptorWithFallback([]utils.NamedKeyVault{
+		{Name: "primary", KeyVault: primary},
+		{Name: "fallback", KeyVault: fallback},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	metrics := newRecordingMetrics()
+	ctx := utils.WithEncryptionContext(context.Background(), utils.EncryptionContext{
+		Logger:  slog.New(slog.NewTextHandler(&logged, nil)),
+		Metrics: metrics,
+		Actor:   "billing-service",
+	})
+	if ec := utils.EncryptionContextFrom(ctx); ec.Actor != "billing-service" {
+		t.Errorf("EncryptionContextFrom().Actor = %q, want billing-service", ec.Actor)
+	}
+	if _, err := decryptor.Decrypt(ctx, ciphertext); err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if !strings.Contains(logged.String(), "decrypted with a fallback key vault") {
+		t.Errorf("logged %q, want the fallback warning", logged.String())
+	}
+	if metrics.counts["decryptions"] != 1 || metrics.observed["decrypt"] != 1 {
+		t.Errorf("metrics = %v, %v, want one decryption observed", metrics.counts, metrics.observed)
+	}
+
+	ec := utils.EncryptionContextFrom(context.Background())
+	if ec.Logger == nil || ec.Metrics == nil {
+		t.Fatalf("EncryptionContextFrom() of a bare context = %+v, want no-op defaults", ec)
+	}
+	if value, err := decryptor.Decrypt(context.Background(), ciphertext); err != nil || value != "987-65-4320" {
+		t.Errorf("Decrypt() without an EncryptionContext = %v, %v", value, err)
+	}
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ExplicitCrypto encrypts and decrypts values explicitly, for services that bypass automatic
+// encryption. Encryption and decryption share one ClientEncryption, and with it the driver's cache
+// of unwrapped DEKs, so a DEK used for a write doesn't have to be fetched and unwrapped again to
+// read the value back.
+type ExplicitCrypto struct {
+	*Decryptor
+	keyVault KeyVault
+}
+
+// NewExplicitCrypto returns an ExplicitCrypto on the key vault, usually a *mongo.ClientEncryption.
+func NewExplicitCrypto(keyVault KeyVault) *ExplicitCrypto {
+	return &ExplicitCrypto{Decryptor: NewDecryptor(keyVault), keyVault: keyVault}
+}
+
+// OpenExplicitCrypto creates the ClientEncryption for an ExplicitCrypto, on the given key vault
+// client. The caller must Close it.
+func OpenExplicitCrypto(
+	keyVaultClient *mongo.Client,
+	keyVaultNamespace string,
+	kmsProviders map[string]map[string]interface{},
+) (*ExplicitCrypto, error) {
+	opts, err := _config.clientEncryptionOptions(keyVaultNamespace, kmsProviders)
+	if err != nil {
+		return nil, err
+	}
+	clientEnc, err := mongo.NewClientEncryption(keyVaultClient, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client encryption: %w", err)
+	}
+	return NewExplicitCrypto(clientEnc), nil
+}
+
+// ClientEncryption returns the ClientEncryption shared by Encrypt and Decrypt, or nil if the
+// ExplicitCrypto is on another KeyVault.
+func (e *ExplicitCrypto) ClientEncryption() *mongo.ClientEncryption {
+	clientEnc, _ := e.keyVault.(*mongo.ClientEncryption)
+	return clientEnc
+}
+
+// Encrypt encrypts a Go value with the given DEK and algorithm. A value whose ciphertext would
+// exceed the configured maximum is rejected with ErrFieldTooLarge.
+func (e *ExplicitCrypto) Encrypt(
+	ctx context.Context, value interface{}, keyID primitive.Binary, algorithm string,
+) (primitive.Binary, error) {
+	raw, err := toRawValue(value)
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+	if err := checkEncryptedFieldSize("value", len(raw.Value)); err != nil {
+		return primitive.Binary{}, err
+	}
+	opts := options.Encrypt().SetKeyID(keyID).SetAlgorithm(algorithm)
+	ciphertext, err := e.keyVault.Encrypt(ctx, raw, opts)
+	countEncryption(ctx, err)
+	if err != nil {
+		return primitive.Binary{}, fmt.Errorf("failed to explicitly encrypt the value: %w", err)
+	}
+	return ciphertext, nil
+}
+
+// ReadByExplicitlyEncrypted finds the documents whose encrypted field equals value, through a
+// client without a schema map: such a client can't encrypt the value in a filter, so it would
+// compare the plaintext against the ciphertext and match nothing. The value is encrypted
+// explicitly with the DEK and algorithm of the field instead, which only matches the stored
+// ciphertext for the deterministic algorithm. Through an auto-encrypting client the matched
+// documents are decrypted; through a regular client they are returned as stored.
+func ReadByExplicitlyEncrypted(
+	ctx context.Context,
+	client *mongo.Client,
+	clientEnc *mongo.ClientEncryption,
+	coll CollRef,
+	field string,
+	value interface{},
+	dek primitive.Binary,
+	algorithm string,
+) ([]bson.M, error) {
+	filter, err := explicitlyEncryptedFilter(ctx, clientEnc, field, value, dek, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := coll.Collection(client).Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s by '%s': %w", coll, field, err)
+	}
+	var results []bson.M
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to read the results from %s: %w", coll, err)
+	}
+	return results, nil
+}
+
+// explicitlyEncryptedFilter returns the filter matching the documents whose field holds value,
+// encrypted with the cipher as ReadByExplicitlyEncrypted does.
+func explicitlyEncryptedFilter(
+	ctx context.Context,
+	cipher ExplicitCipher,
+	field string,
+	value interface{},
+	dek primitive.Binary,
+	algorithm string,
+) (bson.M, error) {
+	if algorithm != AlgorithmDeterministic {
+		return nil, fmt.Errorf(
+			"field '%s' can only be queried if deterministically encrypted, not %s", field, algorithm,
+		)
+	}
+	raw, err := toRawValue(normalizeValue(field, value))
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := cipher.Encrypt(ctx, raw, options.Encrypt().SetKeyID(dek).SetAlgorithm(algorithm))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt the filter value of '%s': %w", field, err)
+	}
+	return bson.M{field: ciphertext}, nil
+}
+
+// Close closes the shared ClientEncryption.
+func (e *ExplicitCrypto) Close() error {
+	closer, ok := e.keyVault.(contextCloser)
+	if !ok {
+		return nil
+	}
+	return closeClientEncryption(closer, _defaultCloseTimeout)
+}
+
+// countEncryption reports the outcome of an encryption to the metrics of ctx.
+func countEncryption(ctx context.Context, err error) {
+	if err != nil {
+		EncryptionContextFrom(ctx).Metrics.Count("encrypt_errors", 1)
+		return
+	}
+	EncryptionContextFrom(ctx).Metrics.Count("encryptions", 1)
+}
+
+func toRawValue(value interface{}) (bson.RawValue, error) {
+	t, data, err := bson.MarshalValue(value)
+	if err != nil {
+		return bson.RawValue{}, fmt.Errorf("failed to marshal the value: %w", err)
+	}
+	return bson.RawValue{Type: t, Value: data}, nil
+}
@@ -0,0 +1,76 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestExplicitCryptoRoundTrip encrypts and decrypts a value through the one key vault handle of
+// an ExplicitCrypto, and closes that handle once.
+func TestExplicitCryptoRoundTrip(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	kv := &closableKeyVault{FakeKeyVault: fake, t: t}
+	crypto := utils.NewExplicitCrypto(kv)
+	ctx := context.Background()
+
+	ciphertext, err := crypto.Encrypt(ctx, "987-65-4320", keyID, utils.AlgorithmDeterministic)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	got, err := crypto.Decrypt(ctx, ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if got != "987-65-4320" {
+		t.Errorf("Decrypt() = %v, want 987-65-4320", got)
+	}
+	if crypto.ClientEncryption() != nil {
+		t.Errorf("ClientEncryption() = %v, want nil on the fake", crypto.ClientEncryption())
+	}
+
+	if err := crypto.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if !kv.closed.Load() {
+		t.Error("Close() left the shared key vault open")
+	}
+}
+
+// TestExplicitlyEncryptedFilter builds the ssn filter of a client without a schema map: the plain
+// value misses the stored document, its deterministic ciphertext matches it.
+func TestExplicitlyEncryptedFilter(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	stored := bson.M{"name": "Bob", "ssn": encryptWith(t, fake, keyID, "987-65-4320")}
+	ctx := context.Background()
+
+	// The plain read filters on the string, which never equals the stored binary.
+	if reflect.DeepEqual(interface{}("987-65-4320"), stored["ssn"]) {
+		t.Fatal("the plain filter matches the stored ciphertext")
+	}
+	filter, err := utils.ExplicitlyEncryptedFilter(ctx, fake, "ssn", "987-65-4320", keyID,
+		utils.AlgorithmDeterministic)
+	if err != nil {
+		t.Fatalf("explicitlyEncryptedFilter() error = %v", err)
+	}
+	if !reflect.DeepEqual(filter["ssn"], stored["ssn"]) {
+		t.Errorf("explicitlyEncryptedFilter() = %v, want the stored ciphertext %v", filter, stored["ssn"])
+	}
+
+	if _, err := utils.ExplicitlyEncryptedFilter(ctx, fake, "ssn", "987-65-4320", keyID,
+		utils.AlgorithmRandom); err == nil {
+		t.Error("explicitlyEncryptedFilter() with the random algorithm succeeded, want an error")
+	}
+	fake.EncryptErr = errors.New("kms unavailable")
+	if _, err := utils.ExplicitlyEncryptedFilter(ctx, fake, "ssn", "987-65-4320", keyID,
+		utils.AlgorithmDeterministic); !errors.Is(err, fake.EncryptErr) {
+		t.Errorf("explicitlyEncryptedFilter() error = %v, want %v", err, fake.EncryptErr)
+	}
+}
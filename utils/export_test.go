@@ -0,0 +1,12 @@
+package utils
+
+// Exported for the tests of the external utils_test package, which use the testutil fakes.
+var (
+	RotateTenantDeks          = rotateTenantDeks
+	RotateTenantKeyWith       = rotateTenantKey
+	EnsureDekPool             = ensureDekPool
+	ProvisionCollections      = provisionCollections
+	ExplicitlyEncryptedFilter = explicitlyEncryptedFilter
+	RotateMasterKey           = rotateMasterKey
+	RotationProviderName      = rotationProviderName
+)
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrFieldTooLarge is returned when the ciphertext of a field value would exceed the configured
+// maximum, checked before the value is sent to be encrypted.
+var ErrFieldTooLarge = errors.New("field value too large to encrypt")
+
+// The default maximum ciphertext size of a single field. A BSON document is limited to 16MiB, and
+// the rest of the document, plus the command wrapping it, needs room too.
+const _defaultMaxEncryptedFieldSize = 8 * 1024 * 1024
+
+// Sizes of the parts of a CSFLE ciphertext around the AES-256-CBC payload: the blob subtype, DEK
+// UUID and original BSON type header, the IV, and the truncated HMAC-SHA-512 tag.
+const (
+	_aesBlockSize = 16
+	_ivSize       = 16
+	_hmacTagSize  = 32
+)
+
+// MeasureInflation estimates the size in bytes of the ciphertext a value encrypts to. CSFLE
+// encrypts the BSON encoding of the value (for a string, a length prefix and a terminating NUL
+// around the bytes) with AES-256-CBC, so the payload is padded to the next 16 bytes, and the IV,
+// MAC tag and header are added to it. Both algorithms produce the same size.
+func MeasureInflation(value interface{}) (int, error) {
+	_, data, err := bson.MarshalValue(value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal the value: %w", err)
+	}
+	return inflatedSize(len(data)), nil
+}
+
+// inflatedSize is the ciphertext size of a BSON value encoding of n bytes. PKCS#7 always adds at
+// least one byte of padding.
+func inflatedSize(n int) int {
+	padded := (n/_aesBlockSize + 1) * _aesBlockSize
+	return _ciphertextHeaderSize + _ivSize + padded + _hmacTagSize
+}
+
+func (c Config) maxEncryptedFieldSize() int {
+	if c.MaxEncryptedFieldSize > 0 {
+		return c.MaxEncryptedFieldSize
+	}
+	return _defaultMaxEncryptedFieldSize
+}
+
+// checkEncryptedFieldSize rejects a BSON value encoding of n bytes whose ciphertext would be over
+// the configured maximum.
+func checkEncryptedFieldSize(field string, n int) error {
+	size, limit := inflatedSize(n), _config.maxEncryptedFieldSize()
+	if size > limit {
+		return fmt.Errorf(
+			"%w: %s would encrypt to %d bytes, over the limit of %d", ErrFieldTooLarge, field, size, limit,
+		)
+	}
+	return nil
+}
+
+// checkEncryptedFieldSizes checks the values of the encrypted fields (dotted paths) of a BSON
+// document. Fields missing from the document are skipped.
+func checkEncryptedFieldSizes(data bson.Raw, encFields []string) error {
+	for _, field := range encFields {
+		value, err := data.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			continue
+		}
+		if err := checkEncryptedFieldSize(field, len(value.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMeasureInflation(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  int
+	}{
+		// A string encodes to a 4-byte length, the bytes and a NUL: 10 bytes pad to 16.
+		{value: "hello", want: _ciphertextHeaderSize + _ivSize + 16 + _hmacTagSize},
+		// 16 bytes always gain a full block of padding.
+		{value: "hello world", want: _ciphertextHeaderSize + _ivSize + 32 + _hmacTagSize},
+		{value: int32(7), want: _ciphertextHeaderSize + _ivSize + 16 + _hmacTagSize},
+	}
+	for _, tt := range tests {
+		got, err := MeasureInflation(tt.value)
+		if err != nil {
+			t.Fatalf("MeasureInflation(%v) error = %v", tt.value, err)
+		}
+		if got != tt.want {
+			t.Errorf("MeasureInflation(%v) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckEncryptedFieldSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     bson.M
+		wantErr bool
+	}{
+		{name: "small", doc: bson.M{"ssn": "987-65-4320"}},
+		{name: "missing", doc: bson.M{"name": strings.Repeat("a", 15*1024*1024)}},
+		{name: "15MB", doc: bson.M{"ssn": strings.Repeat("a", 15*1024*1024)}, wantErr: true},
+		{name: "nested 15MB", doc: bson.M{"profile": bson.M{"ssn": strings.Repeat("a", 15*1024*1024)}},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkEncryptedFieldSizes(data, []string{"ssn", "profile.ssn"})
+			if tt.wantErr != errors.Is(err, ErrFieldTooLarge) {
+				t.Errorf("checkEncryptedFieldSizes() error = %v, want ErrFieldTooLarge: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestMaxEncryptedFieldSize checks that the limit follows the configuration.
+func TestMaxEncryptedFieldSize(t *testing.T) {
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+
+	_config.MaxEncryptedFieldSize = 100
+	if err := checkEncryptedFieldSize("ssn", 8); err != nil {
+		t.Errorf("checkEncryptedFieldSize(8) error = %v", err)
+	}
+	if err := checkEncryptedFieldSize("ssn", 64); !errors.Is(err, ErrFieldTooLarge) {
+		t.Errorf("checkEncryptedFieldSize(64) error = %v, want ErrFieldTooLarge", err)
+	}
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The size of the key material of a DEK.
+const _dekKeyMaterialSize = 96
+
+// HARegion is a region of a highly available DEK: a key vault of its own, and the KMS provider
+// (master key) of the region that wraps the region's copy of the DEK.
+type HARegion struct {
+	KeyVaultNamespace string
+	ProviderName      string
+}
+
+// GetHADeks returns the DEK of a tenant that is mirrored across regions, creating it if needed,
+// along with the KMS providers of all the regions.
+//
+// A datakey document is wrapped under a single master key, so each region keeps its own copy of
+// the DEK in its own key vault: the same key material, under the same UUID, wrapped with the
+// region's master key. The ciphertext references the DEK by UUID, so it can be decrypted with the
+// copy of any region, and a KMS outage in one region doesn't block decryption (see HADecryptor).
+// The first region is the primary; every copy has the DEK alt name of its provider.
+//
+// The key material is only known while the DEK is created, so a missing copy in one region can't
+// be recreated later; that is reported as an error. For the same reason, when a copy fails to be
+// stored, the copies already stored (the primary's included) are deleted again.
+func GetHADeks(
+	ctx context.Context, regions []HARegion,
+) (primitive.Binary, map[string]map[string]interface{}, error) {
+	if len(regions) < 2 {
+		return primitive.Binary{}, nil, fmt.Errorf("an HA DEK needs at least two regions, got %d", len(regions))
+	}
+	kmsProviders := make(map[string]map[string]interface{}, len(regions))
+	namespaces := make(map[string]struct{}, len(regions))
+	for _, region := range regions {
+		if _, ok := kmsProviders[region.ProviderName]; ok {
+			return primitive.Binary{}, nil, fmt.Errorf(
+				"provider '%s' is used by more than one region", region.ProviderName,
+			)
+		}
+		if _, ok := namespaces[region.KeyVaultNamespace]; ok {
+			return primitive.Binary{}, nil, fmt.Errorf(
+				"key vault %s is used by more than one region", region.KeyVaultNamespace,
+			)
+		}
+		namespaces[region.KeyVaultNamespace] = struct{}{}
+		localMasterKey, err := LoadOrCreateMasterKey(region.ProviderName)
+		if err != nil {
+			return primitive.Binary{}, nil, fmt.Errorf("failed to load or create master key: %w", err)
+		}
+		kmsProviders[region.ProviderName] = map[string]interface{}{"key": localMasterKey}
+	}
+
+	var res Resources
+	defer res.Close(ctx)
+	client, err := connectClient(ctx)
+	if err != nil {
+		return primitive.Binary{}, nil, fmt.Errorf("keyvault client connect error: %w", err)
+	}
+	res.AddClient(client)
+	clientEncs := make([]*mongo.ClientEncryption, len(regions))
+	for i, region := range regions {
+		clientEnc, err := openRegionClientEncryption(client, region, kmsProviders)
+		if err != nil {
+			return primitive.Binary{}, nil, err
+		}
+		clientEncs[i] = res.AddClientEncryption(clientEnc)
+	}
+
+	// Look the DEK up in every region; all the copies must be there, with the same UUID.
+	var (
+		id      primitive.Binary
+		found   int
+		missing []string
+	)
+	for i, region := range regions {
+		regionID, ok, err := findDekByAltName(ctx, clientEncs[i], dekAltName(region.ProviderName))
+		if err != nil {
+			return primitive.Binary{}, nil, fmt.Errorf("region %s: %w", region.KeyVaultNamespace, err)
+		}
+		if !ok {
+			missing = append(missing, region.KeyVaultNamespace)
+			continue
+		}
+		if found > 0 && !bytes.Equal(regionID.Data, id.Data) {
+			return primitive.Binary{}, nil, fmt.Errorf("the HA DEK copies have different UUIDs: %x in %s, %x before",
+				regionID.Data, region.KeyVaultNamespace, id.Data)
+		}
+		id = regionID
+		found++
+	}
+	if found == len(regions) {
+		return id, kmsProviders, nil
+	}
+	if found > 0 {
+		return primitive.Binary{}, nil, fmt.Errorf("the HA DEK %x is missing from %v and cannot be mirrored "+
+			"without its key material; create a new HA DEK and re-encrypt", id.Data, missing)
+	}
+
+	material := make([]byte, _dekKeyMaterialSize)
+	if _, err := rand.Read(material); err != nil {
+		return primitive.Binary{}, nil, fmt.Errorf("failed to generate DEK key material: %w", err)
+	}
+	primary := regions[0]
+	opts := options.DataKey().
+		SetKeyMaterial(material).
+		SetKeyAltNames([]string{dekAltName(primary.ProviderName)})
+	id, err = clientEncs[0].CreateDataKey(ctx, primary.ProviderName, opts)
+	if err != nil {
+		return primitive.Binary{}, nil, fmt.Errorf("failed to create DEK in %s: %w", primary.KeyVaultNamespace, err)
+	}
+	for i, region := range regions[1:] {
+		if err := mirrorDek(ctx, client, clientEncs[i+1], region, id, material); err != nil {
+			// Without all its copies, the DEK can't be completed later (see above), and would fail
+			// every following call; delete it from the regions it was stored in so the next call
+			// starts over. The failed region is included, in case its copy was stored before the
+			// error.
+			return primitive.Binary{}, nil, deleteHADekCopies(ctx, clientEncs[:i+2], regions, id, err)
+		}
+	}
+	return id, kmsProviders, nil
+}
+
+// deleteHADekCopies deletes the copies of a DEK GetHADeks failed to mirror to every region, and
+// returns the cause joined with any error deleting them.
+func deleteHADekCopies(
+	ctx context.Context, clientEncs []*mongo.ClientEncryption, regions []HARegion, id primitive.Binary, cause error,
+) error {
+	// Clean up even if ctx is what failed.
+	rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), _defaultCloseTimeout)
+	defer cancel()
+	errs := []error{cause}
+	_dekCache.InvalidateDek(id)
+	for i, clientEnc := range clientEncs {
+		if _, err := clientEnc.DeleteKey(rollbackCtx, id); err != nil {
+			errs = append(errs, fmt.Errorf("rollback: failed to delete DEK %x from %s: %w",
+				id.Data, regions[i].KeyVaultNamespace, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mirrorDek stores a copy of a DEK in the key vault of a region, wrapped with the region's
+// master key. CreateDataKey always assigns a new UUID, so the copy is created under a temporary
+// one, and its datakey document is then stored again under the UUID of the DEK. The temporary copy
+// is deleted whether or not that succeeds.
+func mirrorDek(
+	ctx context.Context,
+	client *mongo.Client,
+	clientEnc *mongo.ClientEncryption,
+	region HARegion,
+	id primitive.Binary,
+	material []byte,
+) (err error) {
+	tmpID, err := clientEnc.CreateDataKey(ctx, region.ProviderName, options.DataKey().SetKeyMaterial(material))
+	if err != nil {
+		return fmt.Errorf("failed to create the DEK copy in %s: %w", region.KeyVaultNamespace, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), _defaultCloseTimeout)
+		defer cancel()
+		if _, deleteErr := clientEnc.DeleteKey(rollbackCtx, tmpID); deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("rollback: failed to delete the temporary DEK copy %x in %s: %w",
+				tmpID.Data, region.KeyVaultNamespace, deleteErr))
+		}
+	}()
+	keyVault, err := keyVaultCollection(client, region.KeyVaultNamespace)
+	if err != nil {
+		return err
+	}
+	var doc bson.D
+	if err := keyVault.FindOne(ctx, bson.M{"_id": tmpID}).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to read the DEK copy in %s: %w", region.KeyVaultNamespace, err)
+	}
+	for i := range doc {
+		if doc[i].Key == "_id" {
+			doc[i].Value = id
+		}
+	}
+	doc = append(doc, bson.E{Key: "keyAltNames", Value: bson.A{dekAltName(region.ProviderName)}})
+	if _, err := keyVault.InsertOne(ctx, doc); err != nil {
+		return fmt.Errorf("failed to store the DEK copy in %s: %w", region.KeyVaultNamespace, err)
+	}
+	if _, err := keyVault.DeleteOne(ctx, bson.M{"_id": tmpID}); err != nil {
+		return fmt.Errorf("failed to delete the temporary DEK copy in %s: %w", region.KeyVaultNamespace, err)
+	}
+	return nil
+}
+
+// HADecryptor decrypts the ciphertext of HA DEKs (see GetHADeks), trying the copy of the DEK in
+// each region in turn, so decryption keeps working while the KMS of a region is unavailable.
+type HADecryptor struct {
+	keyVaults []NamedKeyVault
+	decryptor *Decryptor
+}
+
+// NewHADecryptor creates a ClientEncryption per region on the given key vault client, tried in
+// the order of the regions. The caller must Close it.
+func NewHADecryptor(
+	keyVaultClient *mongo.Client, regions []HARegion, kmsProviders map[string]map[string]interface{},
+) (*HADecryptor, error) {
+	h := &HADecryptor{}
+	for _, region := range regions {
+		clientEnc, err := openRegionClientEncryption(keyVaultClient, region, kmsProviders)
+		if err != nil {
+			_ = h.Close()
+			return nil, err
+		}
+		h.keyVaults = append(h.keyVaults, NamedKeyVault{Name: region.KeyVaultNamespace, KeyVault: clientEnc})
+	}
+	decryptor, err := NewDecryptorWithFallback(h.keyVaults)
+	if err != nil {
+		return nil, err
+	}
+	h.decryptor = decryptor
+	return h, nil
+}
+
+func openRegionClientEncryption(
+	keyVaultClient *mongo.Client, region HARegion, kmsProviders map[string]map[string]interface{},
+) (*mongo.ClientEncryption, error) {
+	opts, err := _config.clientEncryptionOptions(region.KeyVaultNamespace, kmsProviders)
+	if err != nil {
+		return nil, err
+	}
+	clientEnc, err := mongo.NewClientEncryption(keyVaultClient, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client encryption for %s: %w", region.KeyVaultNamespace, err)
+	}
+	return clientEnc, nil
+}
+
+// Decrypt decrypts a single ciphertext with the first region that can, and returns the decoded
+// Go value.
+func (h *HADecryptor) Decrypt(ctx context.Context, encryptedValue primitive.Binary) (interface{}, error) {
+	value, err := h.decryptor.Decrypt(ctx, encryptedValue)
+	if err != nil {
+		return nil, fmt.Errorf("no region could decrypt the value: %w", err)
+	}
+	return value, nil
+}
+
+// Close closes the ClientEncryption of every region.
+func (h *HADecryptor) Close() error {
+	var errs []error
+	for _, kv := range h.keyVaults {
+		if closer, ok := kv.KeyVault.(contextCloser); ok {
+			errs = append(errs, closeClientEncryption(closer, _defaultCloseTimeout))
+		}
+	}
+	return errors.Join(errs...)
+}
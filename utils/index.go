@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureDeterministicFieldIndex creates a regular index on a CSFLE field encrypted with the
+// deterministic algorithm. Deterministic encryption always produces the same ciphertext for the
+// same plaintext and DEK, and the driver encrypts the value in an equality filter before it's
+// sent, so the server can serve the lookup from an index on the ciphertext.
+//
+// This is only meaningful for the deterministic algorithm. With the random algorithm every write
+// produces a different ciphertext, so the field can't be queried at all and an index on it only
+// costs space. QE fields are indexed by the server through their own metadata collections and
+// must not be indexed this way either.
+func EnsureDeterministicFieldIndex(
+	ctx context.Context, client *mongo.Client, coll CollRef, field string,
+) error {
+	if field == "" {
+		return fmt.Errorf("field name is required")
+	}
+	model := mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}}}
+	if _, err := coll.Collection(client).Indexes().CreateOne(ctx, model); err != nil {
+		return fmt.Errorf("failed to create index on '%s' in %s: %w", field, coll, err)
+	}
+	return nil
+}
+
+// CheckDeterministicUniqueIndexes checks that every field declared unique has a unique index.
+// uniqueFields lists the unique fields by namespace, e.g. {"db.users": {"email"}}, and each must be
+// a deterministically encrypted field of the schema map: the same plaintext encrypts to the same
+// ciphertext, so a unique index on the ciphertext rejects duplicates, but without one duplicates
+// are silently stored. A missing index is logged as a warning through the EncryptionContext of
+// ctx and, when create is set, created. The fields that were missing an index are returned as
+// <namespace>.<path>.
+func CheckDeterministicUniqueIndexes(
+	ctx context.Context, client *mongo.Client, schemaMap bson.M, uniqueFields map[string][]string, create bool,
+) ([]string, error) {
+	var missing []string
+	for _, namespace := range sortedKeys(uniqueFields) {
+		schemaDoc, ok := asMap(schemaMap[namespace])
+		if !ok {
+			return missing, fmt.Errorf("no schema for namespace '%s'", namespace)
+		}
+		fields, err := collectEncryptedFields(schemaDoc, "", "")
+		if err != nil {
+			return missing, fmt.Errorf("invalid schema for namespace '%s': %w", namespace, err)
+		}
+		coll, err := ParseCollRef(namespace)
+		if err != nil {
+			return missing, err
+		}
+
+		indexed, err := uniqueIndexedFields(ctx, coll.Collection(client))
+		if err != nil {
+			return missing, fmt.Errorf("failed to list the indexes of %s: %w", coll, err)
+		}
+		paths, err := missingUniqueIndexes(ctx, coll, fields, uniqueFields[namespace], indexed)
+		if err != nil {
+			return missing, err
+		}
+		for _, path := range paths {
+			missing = append(missing, namespace+"."+path)
+			if !create {
+				continue
+			}
+			model := mongo.IndexModel{
+				Keys:    bson.D{{Key: path, Value: 1}},
+				Options: options.Index().SetUnique(true),
+			}
+			if _, err := coll.Collection(client).Indexes().CreateOne(ctx, model); err != nil {
+				return missing, fmt.Errorf("failed to create a unique index on '%s' in %s: %w", path, coll, err)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// missingUniqueIndexes returns the unique fields of the collection that are not among the indexed
+// ones, logging a warning for each. Every unique field must be one of the deterministically
+// encrypted fields.
+func missingUniqueIndexes(
+	ctx context.Context, coll CollRef, fields []encryptedField, unique, indexed []string,
+) ([]string, error) {
+	ec := EncryptionContextFrom(ctx)
+	var missing []string
+	for _, path := range unique {
+		i := slices.IndexFunc(fields, func(f encryptedField) bool { return f.Path == path })
+		if i < 0 || fields[i].Algorithm != AlgorithmDeterministic {
+			return missing, fmt.Errorf("unique field '%s' of %s is not deterministically encrypted", path, coll)
+		}
+		if slices.Contains(indexed, path) {
+			continue
+		}
+		missing = append(missing, path)
+		ec.Logger.WarnContext(ctx, "deterministic unique field has no unique index",
+			"namespace", coll.String(), "field", path)
+	}
+	return missing, nil
+}
+
+// uniqueIndexedFields returns the fields of the collection that have a unique single-field index.
+// A compound unique index doesn't make its fields unique on their own, so it isn't counted.
+func uniqueIndexedFields(ctx context.Context, coll *mongo.Collection) ([]string, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return uniqueSingleFieldKeys(specs), nil
+}
+
+// uniqueSingleFieldKeys returns the field of each unique single-field index.
+func uniqueSingleFieldKeys(specs []*mongo.IndexSpecification) []string {
+	var fields []string
+	for _, spec := range specs {
+		if spec.Unique == nil || !*spec.Unique {
+			continue
+		}
+		keys, err := spec.KeysDocument.Elements()
+		if err != nil || len(keys) != 1 {
+			continue
+		}
+		fields = append(fields, keys[0].Key())
+	}
+	return fields
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// TestMissingUniqueIndexes checks that a deterministic email field declared unique but lacking a
+// unique index is reported with a warning.
+func TestMissingUniqueIndexes(t *testing.T) {
+	schema := bson.M{"bsonType": "object", "properties": bson.M{
+		"email": bson.M{"encrypt": bson.M{"bsonType": "string", "algorithm": AlgorithmDeterministic}},
+		"ssn":   bson.M{"encrypt": bson.M{"bsonType": "string", "algorithm": AlgorithmDeterministic}},
+		"notes": bson.M{"encrypt": bson.M{"bsonType": "string", "algorithm": AlgorithmRandom}},
+	}}
+	fields, err := collectEncryptedFields(schema, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	var logged bytes.Buffer
+	ctx := WithEncryptionContext(context.Background(), EncryptionContext{
+		Logger: slog.New(slog.NewTextHandler(&logged, nil)),
+	})
+
+	missing, err := missingUniqueIndexes(ctx, coll, fields, []string{"email", "ssn"}, []string{"ssn"})
+	if err != nil {
+		t.Fatalf("missingUniqueIndexes() error = %v", err)
+	}
+	if !reflect.DeepEqual(missing, []string{"email"}) {
+		t.Errorf("missingUniqueIndexes() = %v, want [email]", missing)
+	}
+	if out := logged.String(); !strings.Contains(out, "deterministic unique field has no unique index") ||
+		!strings.Contains(out, "field=email") || strings.Contains(out, "field=ssn") {
+		t.Errorf("logged %q, want a warning for email only", out)
+	}
+
+	for _, path := range []string{"notes", "name"} {
+		if _, err := missingUniqueIndexes(ctx, coll, fields, []string{path}, nil); err == nil {
+			t.Errorf("missingUniqueIndexes() of the unique field %s succeeded, want an error", path)
+		}
+	}
+}
+
+func TestUniqueSingleFieldKeys(t *testing.T) {
+	keys := func(d bson.D) bson.Raw {
+		data, err := bson.Marshal(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	unique, notUnique := true, false
+	specs := []*mongo.IndexSpecification{
+		{Name: "_id_", KeysDocument: keys(bson.D{{Key: "_id", Value: 1}})},
+		{Name: "email_1", KeysDocument: keys(bson.D{{Key: "email", Value: 1}}), Unique: &unique},
+		{Name: "ssn_1", KeysDocument: keys(bson.D{{Key: "ssn", Value: 1}}), Unique: &notUnique},
+		{Name: "org_1_email_1", Unique: &unique,
+			KeysDocument: keys(bson.D{{Key: "org", Value: 1}, {Key: "email", Value: 1}})},
+	}
+	if got := uniqueSingleFieldKeys(specs); !reflect.DeepEqual(got, []string{"email"}) {
+		t.Errorf("uniqueSingleFieldKeys() = %v, want [email]", got)
+	}
+}
+
+// unreachableClient returns a client of a server that doesn't exist: the operations that need one
+// fail fast on server selection, the others run as usual.
+func unreachableClient(t *testing.T) *mongo.Client {
+	t.Helper()
+	opts := options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50 * time.Millisecond)
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Disconnect(context.Background()) })
+	return client
+}
+
+func TestEnsureDeterministicFieldIndex(t *testing.T) {
+	client := unreachableClient(t)
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	tests := []struct {
+		field   string
+		wantErr string
+	}{
+		{field: "", wantErr: "field name is required"},
+		{field: "ssn", wantErr: "failed to create index on 'ssn' in csfle_db.users"},
+	}
+	for _, tt := range tests {
+		err := EnsureDeterministicFieldIndex(context.Background(), client, coll, tt.field)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("EnsureDeterministicFieldIndex(%q) error = %v, want %q", tt.field, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// The number of documents IngestJSONL inserts at a time.
+	_ingestBatchSize = 500
+	// The longest line IngestJSONL accepts; a BSON document can't exceed 16MiB anyway.
+	_ingestMaxLineSize = 16 * 1024 * 1024
+)
+
+// ingestCollection is the part of *mongo.Collection IngestJSONL inserts through.
+type ingestCollection interface {
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (
+		*mongo.InsertManyResult, error)
+	InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (
+		*mongo.InsertOneResult, error)
+}
+
+// IngestJSONL reads newline-delimited JSON documents (MongoDB extended JSON) and inserts them in
+// batches through the given client, which encrypts them per its schema map. A line that fails to
+// parse or insert is reported, with its line number, without stopping the rest of the stream.
+// Blank lines are skipped. It returns the number of documents inserted.
+func IngestJSONL(ctx context.Context, client *mongo.Client, coll CollRef, r io.Reader) (int, []error) {
+	return ingestJSONL(ctx, coll.Collection(client), coll, r)
+}
+
+func ingestJSONL(ctx context.Context, collection ingestCollection, coll CollRef, r io.Reader) (int, []error) {
+	var (
+		inserted int
+		errs     []error
+		batch    []interface{}
+		lines    []int
+	)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		n, batchErrs := insertIngestBatch(ctx, collection, coll, batch, lines)
+		inserted += n
+		errs = append(errs, batchErrs...)
+		batch, lines = batch[:0], lines[:0]
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), _ingestMaxLineSize)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(line, false, &doc); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid JSON document: %w", lineNo, err))
+			continue
+		}
+		// Give the document its _id up front, so inserting it again after a failed batch (see
+		// insertIngestBatch) can't store it twice.
+		if _, ok := doc.Map()["_id"]; !ok {
+			doc = append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+		}
+		batch = append(batch, doc)
+		lines = append(lines, lineNo)
+		if len(batch) == _ingestBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read the input: %w", err))
+	}
+	return inserted, errs
+}
+
+// insertIngestBatch inserts a batch unordered, so one bad document doesn't stop the others, and
+// maps the failed writes back to their line numbers.
+func insertIngestBatch(
+	ctx context.Context, collection ingestCollection, coll CollRef, batch []interface{}, lines []int,
+) (int, []error) {
+	result, err := collection.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return len(result.InsertedIDs), nil
+	}
+
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+		// The batch failed as a whole, e.g. a single document failed to encrypt, so nothing says
+		// which documents are at fault: insert them one at a time to find out.
+		if ctx.Err() != nil {
+			return 0, []error{fmt.Errorf("lines %d-%d: failed to insert into %s: %w",
+				lines[0], lines[len(lines)-1], coll, err)}
+		}
+		return insertIngestDocuments(ctx, collection, coll, batch, lines)
+	}
+	var errs []error
+	for _, writeErr := range bulkErr.WriteErrors {
+		lineNo := lines[writeErr.Index]
+		errs = append(errs, fmt.Errorf("line %d: failed to insert into %s: %w", lineNo, coll, writeErr))
+	}
+	if bulkErr.WriteConcernError != nil {
+		errs = append(errs, fmt.Errorf("lines %d-%d: write concern not satisfied: %w",
+			lines[0], lines[len(lines)-1], bulkErr.WriteConcernError))
+	}
+	return len(batch) - len(bulkErr.WriteErrors), errs
+}
+
+// insertIngestDocuments inserts the documents of a failed batch one at a time, reporting each one
+// that fails by its line number. A document the batch already stored (it has an _id, see
+// IngestJSONL) fails with a duplicate key error and is reported as such, rather than stored twice.
+func insertIngestDocuments(
+	ctx context.Context, collection ingestCollection, coll CollRef, batch []interface{}, lines []int,
+) (int, []error) {
+	var (
+		inserted int
+		errs     []error
+	)
+	for i, doc := range batch {
+		if _, err := collection.InsertOne(ctx, doc); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: failed to insert into %s: %w", lines[i], coll, err))
+			continue
+		}
+		inserted++
+	}
+	return inserted, errs
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeIngestCollection stores the documents inserted into it. A document with a "bad" field
+// fails to insert: InsertMany fails as a whole, like a batch with a document that fails to
+// encrypt, unless bulkErrors is set, in which case it reports the bad documents as write errors.
+type fakeIngestCollection struct {
+	docs       []bson.D
+	bulkErrors bool
+	manyCalls  int
+	oneCalls   int
+}
+
+func isBadIngestDoc(doc interface{}) bool {
+	_, bad := doc.(bson.D).Map()["bad"]
+	return bad
+}
+
+func (c *fakeIngestCollection) InsertMany(
+	_ context.Context, documents []interface{}, _ ...*options.InsertManyOptions,
+) (*mongo.InsertManyResult, error) {
+	c.manyCalls++
+	var (
+		result    mongo.InsertManyResult
+		writeErrs []mongo.BulkWriteError
+	)
+	for i, doc := range documents {
+		if isBadIngestDoc(doc) {
+			if !c.bulkErrors {
+				return nil, errors.New("failed to encrypt the document")
+			}
+			writeErrs = append(writeErrs, mongo.BulkWriteError{
+				WriteError: mongo.WriteError{Index: i, Code: 121, Message: "validation failed"},
+			})
+		}
+	}
+	for _, doc := range documents {
+		if !isBadIngestDoc(doc) {
+			c.docs = append(c.docs, doc.(bson.D))
+			result.InsertedIDs = append(result.InsertedIDs, doc.(bson.D).Map()["_id"])
+		}
+	}
+	if len(writeErrs) > 0 {
+		return &result, mongo.BulkWriteException{WriteErrors: writeErrs}
+	}
+	return &result, nil
+}
+
+func (c *fakeIngestCollection) InsertOne(
+	_ context.Context, document interface{}, _ ...*options.InsertOneOptions,
+) (*mongo.InsertOneResult, error) {
+	c.oneCalls++
+	if isBadIngestDoc(document) {
+		return nil, errors.New("failed to encrypt the document")
+	}
+	c.docs = append(c.docs, document.(bson.D))
+	return &mongo.InsertOneResult{InsertedID: document.(bson.D).Map()["_id"]}, nil
+}
+
+func TestIngestJSONL(t *testing.T) {
+	coll := CollRef{Database: "hr", Name: "employees"}
+	tests := []struct {
+		name       string
+		input      string
+		bulkErrors bool
+		want       int
+		wantErrs   []string
+		wantOne    int
+	}{
+		{
+			name:     "malformed line",
+			input:    "{\"name\": \"alice\"}\n{\"name\": \n{\"name\": \"bob\"}\n",
+			want:     2,
+			wantErrs: []string{"line 2: invalid JSON document"},
+		},
+		{
+			name:  "blank lines",
+			input: "\n{\"name\": \"alice\"}\n   \n{\"name\": \"bob\"}",
+			want:  2,
+		},
+		{
+			name:     "batch fails as a whole",
+			input:    "{\"name\": \"alice\"}\n{\"name\": \"bob\", \"bad\": 1}\n{\"name\": \"carol\"}\n",
+			want:     2,
+			wantErrs: []string{"line 2: failed to insert into hr.employees: failed to encrypt the document"},
+			wantOne:  3,
+		},
+		{
+			name:       "write errors",
+			input:      "{\"name\": \"alice\", \"bad\": 1}\n{\"name\": \"bob\"}\n\n{\"name\": \"carol\", \"bad\": 1}\n",
+			bulkErrors: true,
+			want:       1,
+			wantErrs: []string{
+				"line 1: failed to insert into hr.employees",
+				"line 4: failed to insert into hr.employees",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collection := &fakeIngestCollection{bulkErrors: tt.bulkErrors}
+			inserted, errs := ingestJSONL(context.Background(), collection, coll, strings.NewReader(tt.input))
+			if inserted != tt.want || len(collection.docs) != tt.want {
+				t.Errorf("ingestJSONL() inserted %d (stored %d), want %d", inserted, len(collection.docs), tt.want)
+			}
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("ingestJSONL() errors = %v, want %d", errs, len(tt.wantErrs))
+			}
+			for i, want := range tt.wantErrs {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("error %d = %v, want one containing %q", i, errs[i], want)
+				}
+			}
+			if collection.oneCalls != tt.wantOne {
+				t.Errorf("InsertOne called %d times, want %d", collection.oneCalls, tt.wantOne)
+			}
+			for _, doc := range collection.docs {
+				if _, ok := doc.Map()["_id"]; !ok {
+					t.Errorf("document %v was inserted without an _id", doc)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestJSONLBatches(t *testing.T) {
+	var input strings.Builder
+	for range _ingestBatchSize + 1 {
+		input.WriteString("{\"name\": \"alice\"}\n")
+	}
+	collection := &fakeIngestCollection{}
+	inserted, errs := ingestJSONL(context.Background(), collection, CollRef{Database: "hr", Name: "employees"},
+		strings.NewReader(input.String()))
+	if inserted != _ingestBatchSize+1 || len(errs) != 0 {
+		t.Fatalf("ingestJSONL() = %d, %v, want %d, no errors", inserted, errs, _ingestBatchSize+1)
+	}
+	if collection.manyCalls != 2 {
+		t.Errorf("InsertMany called %d times, want 2", collection.manyCalls)
+	}
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How long libmongocrypt keeps an unwrapped DEK.
+const _defaultKeyCacheTTL = 60 * time.Second
+
+// ErrKeyCacheTTLUnsupported is returned when a key cache TTL is configured, which the driver in
+// use can't pass on to libmongocrypt.
+var ErrKeyCacheTTLUnsupported = errors.New("key cache TTL not supported by this driver version")
+
+// checkKeyCacheTTL validates Config.KeyCacheTTL. libmongocrypt keeps unwrapped DEKs for 60s by
+// default, so data still decrypts for up to a minute after its DEK is deleted. The keyExpirationMS
+// option that shortens this arrived in driver v2.1; v1.17 has no way to set it. Rather than
+// silently keeping the default a security-sensitive deployment asked to shorten, any TTL other
+// than the default fails client creation until the driver is upgraded.
+func (c Config) checkKeyCacheTTL() error {
+	if c.KeyCacheTTL < 0 {
+		return fmt.Errorf("key cache TTL must not be negative, got %v", c.KeyCacheTTL)
+	}
+	if c.KeyCacheTTL != 0 && c.KeyCacheTTL != _defaultKeyCacheTTL {
+		return fmt.Errorf("%w: the DEK cache TTL stays at %v, not the configured %v",
+			ErrKeyCacheTTLUnsupported, _defaultKeyCacheTTL, c.KeyCacheTTL)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCheckKeyCacheTTL checks the key cache TTL validation. The driver can't pass a TTL on to
+// libmongocrypt, so only the default is accepted.
+func TestCheckKeyCacheTTL(t *testing.T) {
+	tests := []struct {
+		name            string
+		ttl             time.Duration
+		wantErr         bool
+		wantUnsupported bool
+	}{
+		{name: "unset", ttl: 0},
+		{name: "default", ttl: _defaultKeyCacheTTL},
+		{name: "shorter", ttl: 5 * time.Second, wantErr: true, wantUnsupported: true},
+		{name: "negative", ttl: -time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{KeyCacheTTL: tt.ttl}
+			err := cfg.checkKeyCacheTTL()
+			if (err != nil) != tt.wantErr || errors.Is(err, ErrKeyCacheTTLUnsupported) != tt.wantUnsupported {
+				t.Errorf("checkKeyCacheTTL() error = %v, want an error: %t, unsupported: %t",
+					err, tt.wantErr, tt.wantUnsupported)
+			}
+			kmsProviders := map[string]map[string]interface{}{"local": {"key": make([]byte, _masterKeySize)}}
+			_, err = cfg.clientEncryptionOptions("encryption.__keyVault", kmsProviders)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("clientEncryptionOptions() error = %v, want an error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
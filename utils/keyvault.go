@@ -0,0 +1,442 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every tenant DEK is registered in the key vault under the alt name dek-<providerName>.
+const _dekAltNamePrefix = "dek-"
+
+func dekAltName(providerName string) string {
+	return _dekAltNamePrefix + providerName
+}
+
+// splitNamespace splits a "<database>.<collection>" namespace, such as the key vault namespace,
+// into its two parts.
+func splitNamespace(namespace string) (string, string, error) {
+	coll, err := ParseCollRef(namespace)
+	if err != nil {
+		return "", "", err
+	}
+	return coll.Database, coll.Name, nil
+}
+
+// ListProviders returns the distinct provider names (tenants) that have a DEK in the key vault.
+func ListProviders(ctx context.Context, keyVaultNamespace string) ([]string, error) {
+	client, err := connectClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// A DEK can carry more than one alt name (e.g. while an alt name is being migrated), so we
+	// match on any alt name with the DEK prefix and de-duplicate the provider names.
+	filter := bson.M{"keyAltNames": bson.M{"$regex": "^" + _dekAltNamePrefix}}
+	projection := options.Find().SetProjection(bson.M{"keyAltNames": 1})
+	cursor, err := keyVault.Find(ctx, filter, projection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the key vault: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	return providersOfKeys(ctx, cursor)
+}
+
+// providersOfKeys returns the sorted, distinct provider names of the DEK alt names of the key
+// documents.
+func providersOfKeys(ctx context.Context, cursor *mongo.Cursor) ([]string, error) {
+	seen := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var keyDoc struct {
+			KeyAltNames []string `bson:"keyAltNames"`
+		}
+		if err := cursor.Decode(&keyDoc); err != nil {
+			return nil, fmt.Errorf("failed to decode the DEK document: %w", err)
+		}
+		for _, altName := range keyDoc.KeyAltNames {
+			if providerName, ok := dekAltNameProvider(altName); ok {
+				seen[providerName] = struct{}{}
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate the key vault: %w", err)
+	}
+
+	providers := make([]string, 0, len(seen))
+	for providerName := range seen {
+		providers = append(providers, providerName)
+	}
+	sort.Strings(providers)
+	return providers, nil
+}
+
+// connectClient connects a regular (non-encrypting) client to the configured cluster.
+func connectClient(ctx context.Context) (*mongo.Client, error) {
+	clientOpts, err := _config.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("client failed to connect: %w", err)
+	}
+	return client, nil
+}
+
+// DataKeyInfo describes a DEK document in the key vault. It never includes the key material.
+type DataKeyInfo struct {
+	ID                  primitive.Binary  `bson:"_id"`
+	KeyAltNames         []string          `bson:"keyAltNames"`
+	Provider            string            `bson:"-"`
+	CreationDate        time.Time         `bson:"creationDate"`
+	UpdateDate          time.Time         `bson:"updateDate"`
+	Status              int32             `bson:"status"`
+	MasterKey           bson.M            `bson:"masterKey"`
+	Metadata            map[string]string `bson:"metadata,omitempty"`
+	ExpiresAt           *time.Time        `bson:"expiresAt,omitempty"`
+	MasterKeyGeneration *int              `bson:"masterKeyGeneration,omitempty"`
+}
+
+// The custom fields on the datakey document which hold the DEK metadata, intended expiration and
+// master key generation.
+// The driver and libmongocrypt ignore fields they don't know about, so the DEK stays usable.
+const (
+	_dekMetadataField            = "metadata"
+	_dekExpiresAtField           = "expiresAt"
+	_dekMasterKeyGenerationField = "masterKeyGeneration"
+)
+
+// keyVaultCollection returns the key vault collection for the given namespace.
+func keyVaultCollection(client *mongo.Client, keyVaultNamespace string) (*mongo.Collection, error) {
+	coll, err := ParseCollRef(keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return coll.Collection(client), nil
+}
+
+// CreateDataKeyWithMetadata creates a DEK and annotates its datakey document with the given
+// metadata (e.g. the creating service, environment and purpose) for auditing. CreateDataKey has no
+// way to attach custom fields, so the metadata is set on the document right after creation, through
+// the key vault collection the ClientEncryption was configured with.
+func CreateDataKeyWithMetadata(
+	ctx context.Context,
+	clientEnc *mongo.ClientEncryption,
+	keyVault *mongo.Collection,
+	provider string,
+	altNames []string,
+	meta map[string]string,
+) (primitive.Binary, error) {
+	fields := bson.M{}
+	if len(meta) > 0 {
+		fields[_dekMetadataField] = meta
+	}
+	return createAnnotatedDataKey(ctx, clientEnc, keyVault, provider, altNames, fields)
+}
+
+// CreateDataKeyWithExpiry creates a DEK which carries its intended expiration, so a rotation job
+// can find it with FindExpiringDeks. The expiration is advisory; the DEK keeps working after it.
+func CreateDataKeyWithExpiry(
+	ctx context.Context,
+	clientEnc *mongo.ClientEncryption,
+	keyVault *mongo.Collection,
+	provider string,
+	altNames []string,
+	expiresAt time.Time,
+) (primitive.Binary, error) {
+	fields := bson.M{_dekExpiresAtField: expiresAt}
+	return createAnnotatedDataKey(ctx, clientEnc, keyVault, provider, altNames, fields)
+}
+
+// createAnnotatedDataKey creates a DEK and sets the given custom fields on its datakey document.
+func createAnnotatedDataKey(
+	ctx context.Context,
+	clientEnc *mongo.ClientEncryption,
+	keyVault *mongo.Collection,
+	provider string,
+	altNames []string,
+	fields bson.M,
+) (primitive.Binary, error) {
+	opts := options.DataKey()
+	if len(altNames) > 0 {
+		opts.SetKeyAltNames(altNames)
+	}
+	keyID, err := clientEnc.CreateDataKey(ctx, provider, opts)
+	if err != nil {
+		return primitive.Binary{}, fmt.Errorf("failed to create DEK: %w", err)
+	}
+	if err := annotateDataKey(ctx, keyVault, keyID, fields); err != nil {
+		return keyID, err
+	}
+	return keyID, nil
+}
+
+func annotateDataKey(ctx context.Context, keyVault *mongo.Collection, keyID primitive.Binary, fields bson.M) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if _, err := keyVault.UpdateByID(ctx, keyID, bson.M{"$set": fields}); err != nil {
+		return fmt.Errorf("failed to annotate DEK: %w", err)
+	}
+	return nil
+}
+
+// FindExpiringDeks returns the DEKs whose expiresAt is before the given time.
+func FindExpiringDeks(ctx context.Context, keyVaultNamespace string, before time.Time) ([]DataKeyInfo, error) {
+	client, err := connectClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{_dekExpiresAtField: bson.M{"$lt": before}}
+	// Never read the wrapped key material; it's not needed here.
+	findOpts := options.Find().SetProjection(bson.M{"keyMaterial": 0}).SetSort(bson.M{_dekExpiresAtField: 1})
+	cursor, err := keyVault.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the key vault: %w", err)
+	}
+	defer cursor.Close(ctx)
+	return dataKeysOf(ctx, cursor)
+}
+
+// DescribeDataKeys lists the DEKs in the key vault along with their wrapping provider and metadata.
+func DescribeDataKeys(ctx context.Context, clientEnc *mongo.ClientEncryption) ([]DataKeyInfo, error) {
+	cursor, err := clientEnc.GetKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DEKs: %w", err)
+	}
+	defer cursor.Close(ctx)
+	return dataKeysOf(ctx, cursor)
+}
+
+// dataKeysOf decodes the key documents, along with their wrapping provider and metadata.
+func dataKeysOf(ctx context.Context, cursor *mongo.Cursor) ([]DataKeyInfo, error) {
+	var keys []DataKeyInfo
+	for cursor.Next(ctx) {
+		var info DataKeyInfo
+		if err := cursor.Decode(&info); err != nil {
+			return nil, fmt.Errorf("failed to decode the DEK document: %w", err)
+		}
+		info.Provider, _ = info.MasterKey["provider"].(string)
+		keys = append(keys, info)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate the key vault: %w", err)
+	}
+	return keys, nil
+}
+
+// ReportProviderDistribution counts the DEKs of the key vault by the KMS backend that wraps them
+// (the backend of masterKey.provider, e.g. "local" for "local:10"), so an operator can confirm a
+// migration between KMS backends, e.g. from local to aws with RewrapManyDataKey, left no DEK
+// behind. A DEK with an unknown or missing provider is counted under its provider as is.
+func ReportProviderDistribution(ctx context.Context, keyVaultNamespace string) (map[string]int, error) {
+	client, err := connectClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$masterKey.provider", "count": bson.M{"$sum": 1}}}},
+	}
+	cursor, err := keyVault.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the DEKs in %s: %w", keyVaultNamespace, err)
+	}
+	return providerDistribution(ctx, cursor, keyVaultNamespace)
+}
+
+// providerDistribution sums the DEK counts of the cursor, grouped by provider, by KMS backend.
+func providerDistribution(
+	ctx context.Context, cursor *mongo.Cursor, keyVaultNamespace string,
+) (map[string]int, error) {
+	var groups []struct {
+		Provider string `bson:"_id"`
+		Count    int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("failed to read the DEK counts of %s: %w", keyVaultNamespace, err)
+	}
+
+	distribution := make(map[string]int, len(groups))
+	for _, group := range groups {
+		backend, err := providerBackend(group.Provider)
+		if err != nil {
+			backend = group.Provider
+		}
+		distribution[backend] += group.Count
+	}
+	return distribution, nil
+}
+
+// VerifyProvidersCoverKeys is a startup check that cross-references the provider wrapping each
+// tenant DEK (masterKey.provider) against the configured KMS providers, and returns the DEKs that
+// can't be unwrapped with the current configuration. Left undetected, such a misconfiguration only
+// shows up later as decryption failures.
+func VerifyProvidersCoverKeys(
+	ctx context.Context,
+	clientEnc *mongo.ClientEncryption,
+	kmsProviders map[string]map[string]interface{},
+) ([]DataKeyInfo, error) {
+	keys, err := DescribeDataKeys(ctx, clientEnc)
+	if err != nil {
+		return nil, err
+	}
+	return uncoveredKeys(keys, kmsProviders), nil
+}
+
+// uncoveredKeys returns the tenant DEKs whose wrapping provider isn't in kmsProviders.
+func uncoveredKeys(keys []DataKeyInfo, kmsProviders map[string]map[string]interface{}) []DataKeyInfo {
+	var uncovered []DataKeyInfo
+	for _, key := range keys {
+		if !isTenantDek(key) {
+			continue
+		}
+		if _, ok := kmsProviders[key.Provider]; !ok {
+			uncovered = append(uncovered, key)
+		}
+	}
+	return uncovered
+}
+
+func isTenantDek(key DataKeyInfo) bool {
+	for _, altName := range key.KeyAltNames {
+		if strings.HasPrefix(altName, _dekAltNamePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DekProviderName returns the provider name (tenant) whose DEK the key ID is, from the DEK's alt
+// names, e.g. to check a ciphertext belongs to a tenant before decrypting it.
+func DekProviderName(ctx context.Context, clientEnc *mongo.ClientEncryption, keyID primitive.Binary) (string, error) {
+	var key DataKeyInfo
+	if err := clientEnc.GetKey(ctx, keyID).Decode(&key); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", fmt.Errorf("DEK %x does not exist", keyID.Data)
+		}
+		return "", fmt.Errorf("failed to read DEK %x: %w", keyID.Data, err)
+	}
+	for _, altName := range key.KeyAltNames {
+		if providerName, ok := dekAltNameProvider(altName); ok {
+			return providerName, nil
+		}
+	}
+	return "", fmt.Errorf("DEK %x is not a tenant DEK", keyID.Data)
+}
+
+// findDekByAltName looks up the DEK registered under the alt name, and reports whether it exists.
+func findDekByAltName(ctx context.Context, kv KeyVault, keyAltName string) (primitive.Binary, bool, error) {
+	var dekDoc bson.D
+	if err := kv.GetKeyByAltName(ctx, keyAltName).Decode(&dekDoc); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return primitive.Binary{}, false, nil
+		}
+		return primitive.Binary{}, false, fmt.Errorf("failed to decode DEK lookup result: %w", err)
+	}
+
+	idVal, ok := dekDoc.Map()["_id"]
+	if !ok {
+		return primitive.Binary{}, false, fmt.Errorf("DEK document missing _id field")
+	}
+	id, ok := idVal.(primitive.Binary)
+	if !ok {
+		return primitive.Binary{}, false, fmt.Errorf("DEK _id field is not of type primitive.Binary")
+	}
+	return id, true, nil
+}
+
+// Server error codes for a key vault that currently can't take writes.
+var _keyVaultWriteUnavailableCodes = []int{
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+}
+
+// isKeyVaultWriteUnavailable reports whether a failed key vault write may have failed because the
+// key vault is read-only, or because a DEK with the same alt name was created concurrently (the
+// key vault has a unique index on keyAltNames).
+func isKeyVaultWriteUnavailable(err error) bool {
+	if mongo.IsDuplicateKeyError(err) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	for _, code := range _keyVaultWriteUnavailableCodes {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddKeyAltName registers an additional alt name on a DEK, e.g. when the tenant identity is
+// restructured (dek-local:100 → dek-local:dvrv-us-1:100). During the migration GetDek finds the
+// DEK under either name; RemoveKeyAltName retires the old name once every caller has moved on.
+func AddKeyAltName(
+	ctx context.Context, clientEnc KeyAltNameManager, keyID primitive.Binary, altName string,
+) error {
+	if altName == "" {
+		return fmt.Errorf("alt name is required")
+	}
+	// The result is the DEK document as it was before the update.
+	if err := clientEnc.AddKeyAltName(ctx, keyID, altName).Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("DEK not found: %w", err)
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("alt name '%s' is already used by another DEK: %w", altName, err)
+		}
+		return fmt.Errorf("failed to add alt name '%s': %w", altName, err)
+	}
+	// A DEK GetDek resolved by the name before, e.g. one since deleted, must not be served for it.
+	_dekCache.InvalidateAltName(altName)
+	return nil
+}
+
+// RemoveKeyAltName removes an alt name from a DEK.
+func RemoveKeyAltName(
+	ctx context.Context, clientEnc KeyAltNameManager, keyID primitive.Binary, altName string,
+) error {
+	if err := clientEnc.RemoveKeyAltName(ctx, keyID, altName).Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("DEK not found: %w", err)
+		}
+		return fmt.Errorf("failed to remove alt name '%s': %w", altName, err)
+	}
+	// GetDek must not keep resolving the DEK by the retired name.
+	_dekCache.InvalidateAltName(altName)
+	return nil
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrMalformedKeyVault is returned when a datakey document isn't in the shape the driver expects.
+var ErrMalformedKeyVault = errors.New("malformed key vault")
+
+// The number of datakey documents ValidateKeyVault checks.
+const _keyVaultSampleSize = 100
+
+// The fields every datakey document must have, besides the _id.
+var _requiredDataKeyFields = []string{"keyMaterial", "masterKey", "creationDate"}
+
+// ValidateKeyVault checks a sample of the datakey documents in the key vault: the _id must be a
+// UUID (BinData subtype 4) and the key material, master key and creation date must be present.
+// A malformed vault, e.g. one whose documents were copied with a tool that turned the _ids into
+// strings, otherwise breaks DEK resolution with confusing errors. The first malformed document is
+// reported with ErrMalformedKeyVault.
+func ValidateKeyVault(ctx context.Context, client *mongo.Client, keyVaultNamespace string) error {
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return err
+	}
+	opts := options.Find().SetLimit(_keyVaultSampleSize)
+	cursor, err := keyVault.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to query the key vault: %w", err)
+	}
+	defer cursor.Close(ctx)
+	return validateDataKeys(ctx, cursor, keyVaultNamespace)
+}
+
+// validateDataKeys checks the datakey documents of the cursor, and reports the first malformed one.
+func validateDataKeys(ctx context.Context, cursor *mongo.Cursor, keyVaultNamespace string) error {
+	for cursor.Next(ctx) {
+		if err := validateDataKeyDocument(cursor.Current); err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrMalformedKeyVault, keyVaultNamespace, err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to iterate the key vault: %w", err)
+	}
+	return nil
+}
+
+// validateDataKeyDocument checks the shape of a datakey document.
+func validateDataKeyDocument(doc bson.Raw) error {
+	id := doc.Lookup("_id")
+	subtype, _, ok := id.BinaryOK()
+	if !ok || subtype != bsontype.BinaryUUID {
+		return fmt.Errorf("datakey _id %v is %s, not a UUID", id, describeBSONType(id))
+	}
+	for _, field := range _requiredDataKeyFields {
+		if _, err := doc.LookupErr(field); err != nil {
+			return fmt.Errorf("datakey %v has no %s", id, field)
+		}
+	}
+	return nil
+}
+
+// describeBSONType names the type of a value, including the subtype of a binary.
+func describeBSONType(v bson.RawValue) string {
+	if subtype, _, ok := v.BinaryOK(); ok {
+		return fmt.Sprintf("binary subtype %d", subtype)
+	}
+	return v.Type.String()
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateDataKeys(t *testing.T) {
+	dataKey := func(id interface{}) bson.M {
+		return bson.M{
+			"_id":          id,
+			"keyMaterial":  primitive.Binary{Data: make([]byte, 16)},
+			"masterKey":    bson.M{"provider": "local:100"},
+			"creationDate": primitive.NewDateTimeFromTime(time.Unix(0, 0)),
+		}
+	}
+	uuid := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	withoutMasterKey := dataKey(uuid)
+	delete(withoutMasterKey, "masterKey")
+	tests := []struct {
+		name    string
+		docs    []bson.M
+		wantErr string
+	}{
+		{name: "healthy", docs: []bson.M{dataKey(uuid), dataKey(uuid)}},
+		{name: "empty"},
+		{name: "string _id", docs: []bson.M{dataKey(uuid), dataKey("0b1c2d3e")},
+			wantErr: `datakey _id "0b1c2d3e" is string, not a UUID`},
+		{name: "generic binary _id", docs: []bson.M{dataKey(primitive.Binary{Data: make([]byte, 16)})},
+			wantErr: "is binary subtype 0, not a UUID"},
+		{name: "no masterKey", docs: []bson.M{withoutMasterKey}, wantErr: "has no masterKey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDataKeys(context.Background(), keyCursor(t, tt.docs...), "encryption.__keyVault")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateDataKeys() error = %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrMalformedKeyVault) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateDataKeys() error = %v, want ErrMalformedKeyVault: %q", err, tt.wantErr)
+			}
+		})
+	}
+}
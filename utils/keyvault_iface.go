@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KeyVault is the subset of *mongo.ClientEncryption the DEK resolution and decryption logic
+// depends on, so that logic can run against an in-memory fake (see the testutil package) instead
+// of a live server.
+type KeyVault interface {
+	ExplicitCipher
+	GetKeyByAltName(ctx context.Context, keyAltName string) *mongo.SingleResult
+	CreateDataKey(ctx context.Context, kmsProvider string, opts ...*options.DataKeyOptions) (primitive.Binary, error)
+	RewrapManyDataKey(
+		ctx context.Context, filter interface{}, opts ...*options.RewrapManyDataKeyOptions,
+	) (*mongo.RewrapManyDataKeyResult, error)
+}
+
+// The driver's ClientEncryption is the real KeyVault.
+var _ KeyVault = (*mongo.ClientEncryption)(nil)
+
+// KeyAltNameManager is the alt name management of *mongo.ClientEncryption, used to rename a DEK.
+// The result of either call is the DEK document as it was before the update.
+type KeyAltNameManager interface {
+	AddKeyAltName(ctx context.Context, id primitive.Binary, keyAltName string) *mongo.SingleResult
+	RemoveKeyAltName(ctx context.Context, id primitive.Binary, keyAltName string) *mongo.SingleResult
+}
+
+var _ KeyAltNameManager = (*mongo.ClientEncryption)(nil)
+
+// DekStore is a KeyVault that can also delete DEKs and set custom fields on their datakey
+// documents, which is what GetDek needs to create a DEK and complete its setup.
+type DekStore interface {
+	KeyVault
+	DeleteKey(ctx context.Context, id primitive.Binary) (*mongo.DeleteResult, error)
+	// AnnotateKey sets the fields on the datakey document of the DEK.
+	AnnotateKey(ctx context.Context, id primitive.Binary, fields bson.M) error
+}
+
+// NewDekStore returns the DekStore of a ClientEncryption, whose datakey documents are annotated
+// through the key vault collection it was configured with.
+func NewDekStore(clientEnc *mongo.ClientEncryption, keyVault *mongo.Collection) DekStore {
+	return &clientEncryptionStore{ClientEncryption: clientEnc, keyVault: keyVault}
+}
+
+type clientEncryptionStore struct {
+	*mongo.ClientEncryption
+	keyVault *mongo.Collection
+}
+
+func (s *clientEncryptionStore) AnnotateKey(ctx context.Context, id primitive.Binary, fields bson.M) error {
+	return annotateDataKey(ctx, s.keyVault, id, fields)
+}
+
+// ResolveDek returns the DEK of the tenant from the key vault, creating it if it doesn't exist
+// yet, and reports whether it was created.
+func ResolveDek(ctx context.Context, kv KeyVault, providerName string) (primitive.Binary, bool, error) {
+	return resolveDekByAltName(ctx, kv, providerName, dekAltName(providerName), nil)
+}
+
+// resolveDekByAltName returns the DEK registered under the alt name, creating it with the
+// provider's master key if it doesn't exist yet, and reports whether it was created. masterKey is
+// the masterKey document of a cloud KMS provider, nil for a local one.
+func resolveDekByAltName(
+	ctx context.Context, kv KeyVault, providerName, keyAltName string, masterKey bson.M,
+) (primitive.Binary, bool, error) {
+	id, found, err := findDekByAltName(ctx, kv, keyAltName)
+	if err != nil {
+		return primitive.Binary{}, false, err
+	}
+	if found {
+		fmt.Printf("Found existing DEK with alt name: %s\n", keyAltName)
+		return id, false, nil
+	}
+
+	fmt.Printf("DEK with alt name '%s' not found, creating a new one.\n", keyAltName)
+	opts := options.DataKey().SetKeyAltNames([]string{keyAltName})
+	if masterKey != nil {
+		opts.SetMasterKey(masterKey)
+	}
+	id, err = kv.CreateDataKey(ctx, providerName, opts)
+	if err != nil {
+		// The key vault may be temporarily read-only (e.g. during Atlas maintenance), or another
+		// process may have created the DEK since our lookup. Either way, if the DEK exists now, we
+		// can carry on with it; reads keep working while writes don't.
+		if !isKeyVaultWriteUnavailable(err) {
+			return primitive.Binary{}, false, fmt.Errorf("failed to create DEK: %v", err)
+		}
+		existing, found, lookupErr := findDekByAltName(ctx, kv, keyAltName)
+		if lookupErr != nil || !found {
+			return primitive.Binary{}, false, fmt.Errorf("failed to create DEK: %v", err)
+		}
+		fmt.Printf("Could not create DEK, using the existing DEK with alt name: %s\n", keyAltName)
+		return existing, false, nil
+	}
+	return id, true, nil
+}
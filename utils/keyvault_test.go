@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// keyCursor returns a cursor over the key documents, as the key vault returns them.
+func keyCursor(t *testing.T, docs ...bson.M) *mongo.Cursor {
+	t.Helper()
+	documents := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		documents[i] = doc
+	}
+	cursor, err := mongo.NewCursorFromDocuments(documents, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cursor
+}
+
+func TestProvidersOfKeys(t *testing.T) {
+	cursor := keyCursor(t,
+		bson.M{"keyAltNames": bson.A{"dek-local:100"}},
+		bson.M{"keyAltNames": bson.A{"dek-gcp:300"}},
+		bson.M{"keyAltNames": bson.A{"dek-local:200"}},
+	)
+	got, err := providersOfKeys(context.Background(), cursor)
+	if err != nil {
+		t.Fatalf("providersOfKeys() error = %v", err)
+	}
+	if want := []string{"gcp:300", "local:100", "local:200"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("providersOfKeys() = %v, want %v", got, want)
+	}
+}
+
+func TestProvidersOfKeysDeduplicates(t *testing.T) {
+	cursor := keyCursor(t,
+		// A DEK whose alt name is being migrated, and a pool of DEKs of one tenant.
+		bson.M{"keyAltNames": bson.A{"dek-local:100", "dek-local:prod_100"}},
+		bson.M{"keyAltNames": bson.A{"dek-local:200-0"}},
+		bson.M{"keyAltNames": bson.A{"dek-local:200-1"}},
+		// Not a tenant DEK.
+		bson.M{"keyAltNames": bson.A{"shared-reporting"}},
+		bson.M{},
+	)
+	got, err := providersOfKeys(context.Background(), cursor)
+	if err != nil {
+		t.Fatalf("providersOfKeys() error = %v", err)
+	}
+	if want := []string{"local:100", "local:200", "local:prod_100"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("providersOfKeys() = %v, want %v", got, want)
+	}
+}
+
+// TestDataKeysOf checks that the metadata set by CreateDataKeyWithMetadata is surfaced along with
+// the provider of the key document.
+func TestDataKeysOf(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	cursor := keyCursor(t,
+		bson.M{
+			"_id":         keyID,
+			"keyAltNames": bson.A{"dek-local:100"},
+			"masterKey":   bson.M{"provider": "local:100"},
+			"metadata":    bson.M{"service": "billing", "environment": "prod", "purpose": "ssn"},
+		},
+		bson.M{"_id": keyID, "masterKey": bson.M{"provider": "aws:200", "region": "us-east-1"}},
+	)
+	got, err := dataKeysOf(context.Background(), cursor)
+	if err != nil {
+		t.Fatalf("dataKeysOf() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("dataKeysOf() returned %d keys, want 2", len(got))
+	}
+	wantMeta := map[string]string{"service": "billing", "environment": "prod", "purpose": "ssn"}
+	if got[0].Provider != "local:100" || !reflect.DeepEqual(got[0].Metadata, wantMeta) {
+		t.Errorf("dataKeysOf()[0] = %s, %v, want local:100, %v", got[0].Provider, got[0].Metadata, wantMeta)
+	}
+	if got[1].Provider != "aws:200" || got[1].Metadata != nil {
+		t.Errorf("dataKeysOf()[1] = %s, %v, want aws:200 without metadata", got[1].Provider, got[1].Metadata)
+	}
+}
+
+func TestUncoveredKeys(t *testing.T) {
+	keys := []DataKeyInfo{
+		{KeyAltNames: []string{"dek-local:100"}, Provider: "local:100"},
+		// Wrapped by a provider missing from the configuration.
+		{KeyAltNames: []string{"dek-local:200"}, Provider: "local:200"},
+		// Not a tenant DEK, so not expected to be covered.
+		{KeyAltNames: []string{"shared-reporting"}, Provider: "aws:300"},
+	}
+	kmsProviders := map[string]map[string]interface{}{"local:100": {"key": make([]byte, _masterKeySize)}}
+	got := uncoveredKeys(keys, kmsProviders)
+	if len(got) != 1 || got[0].Provider != "local:200" {
+		t.Errorf("uncoveredKeys() = %v, want the DEK of local:200", got)
+	}
+}
+
+// TestProviderDistribution counts a key vault of 3 local DEKs, of two tenants, 2 aws DEKs, one
+// of them under the unnamed aws provider, and a DEK without a provider.
+func TestProviderDistribution(t *testing.T) {
+	got, err := providerDistribution(context.Background(), keyCursor(t,
+		bson.M{"_id": "local:100", "count": 2},
+		bson.M{"_id": "local:prod_200", "count": 1},
+		bson.M{"_id": "aws:100", "count": 1},
+		bson.M{"_id": "aws", "count": 1},
+		bson.M{"_id": nil, "count": 1},
+	), "encryption.__keyVault")
+	if err != nil {
+		t.Fatalf("providerDistribution() error = %v", err)
+	}
+	want := map[string]int{"local": 3, "aws": 2, "": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("providerDistribution() = %v, want %v", got, want)
+	}
+}
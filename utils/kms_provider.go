@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// KmsProvider is a KMS the DEKs of a tenant are wrapped with, so GetDekFor and NewEncClientFor
+// work with any backend without the caller building the kmsProviders map and masterKey document
+// by hand.
+type KmsProvider interface {
+	// The provider name, <backend>:<tenant>, e.g. "gcp:100" or "local:100". The tenant part keeps
+	// the DEK alt names (dek-<provider>) of the tenants on a backend apart.
+	ProviderName() string
+	// The kmsProviders entry of the provider.
+	Credentials() map[string]interface{}
+	// The masterKey document CreateDataKey takes to create a DEK with the provider; nil for a
+	// local provider, which has a single key.
+	MasterKeyDoc() bson.M
+}
+
+// LocalKmsProvider is the local KMS provider, whose master key is kept on the file system (see
+// LoadOrCreateMasterKey).
+type LocalKmsProvider struct {
+	name string
+	key  []byte
+}
+
+// NewLocalKmsProvider loads the current master key of a local provider, creating it if it doesn't
+// exist yet.
+func NewLocalKmsProvider(providerName string) (*LocalKmsProvider, error) {
+	if backend, err := providerBackend(providerName); err != nil {
+		return nil, err
+	} else if backend != "local" {
+		return nil, fmt.Errorf("provider '%s' is not a local provider", providerName)
+	}
+	key, err := LoadOrCreateMasterKey(providerName)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKmsProvider{name: providerName, key: key}, nil
+}
+
+func (p *LocalKmsProvider) ProviderName() string { return p.name }
+
+func (p *LocalKmsProvider) Credentials() map[string]interface{} {
+	return map[string]interface{}{"key": p.key}
+}
+
+func (p *LocalKmsProvider) MasterKeyDoc() bson.M { return nil }
+
+// GcpKmsProvider is a Google Cloud KMS provider, authenticated with a service account.
+type GcpKmsProvider struct {
+	// The tenant the provider is for, which names it gcp:<Tenant>; required.
+	Tenant string
+	// The service account email and its base64 encoded private key.
+	Email      string
+	PrivateKey string
+	// The host of the OAuth token endpoint, e.g. for a private endpoint; empty for the default.
+	Endpoint string
+
+	// The key encryption key the DEKs are wrapped with.
+	ProjectID string
+	Location  string
+	KeyRing   string
+	KeyName   string
+}
+
+func (p *GcpKmsProvider) ProviderName() string { return "gcp:" + p.Tenant }
+
+func (p *GcpKmsProvider) Credentials() map[string]interface{} {
+	credentials := map[string]interface{}{"email": p.Email, "privateKey": p.PrivateKey}
+	if p.Endpoint != "" {
+		credentials["endpoint"] = p.Endpoint
+	}
+	return credentials
+}
+
+func (p *GcpKmsProvider) MasterKeyDoc() bson.M {
+	return bson.M{"projectId": p.ProjectID, "location": p.Location, "keyRing": p.KeyRing, "keyName": p.KeyName}
+}
+
+// AzureKmsProvider is an Azure Key Vault provider, authenticated with a client secret.
+type AzureKmsProvider struct {
+	// The tenant the provider is for, which names it azure:<Tenant>; required.
+	Tenant string
+	// The Azure AD application the provider authenticates as.
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+
+	// The key encryption key the DEKs are wrapped with, e.g. "example.vault.azure.net" and its
+	// key name.
+	KeyVaultEndpoint string
+	KeyName          string
+}
+
+func (p *AzureKmsProvider) ProviderName() string { return "azure:" + p.Tenant }
+
+func (p *AzureKmsProvider) Credentials() map[string]interface{} {
+	return map[string]interface{}{"tenantId": p.TenantID, "clientId": p.ClientID, "clientSecret": p.ClientSecret}
+}
+
+func (p *AzureKmsProvider) MasterKeyDoc() bson.M {
+	return bson.M{"keyVaultEndpoint": p.KeyVaultEndpoint, "keyName": p.KeyName}
+}
+
+// KmsProvidersMap builds the kmsProviders map of the providers, checking the credentials and
+// masterKey document of each against what its backend requires. Each provider must be named for a
+// tenant (<backend>:<tenant>): under a bare backend name, every tenant would resolve the same
+// dek-<backend> DEK.
+func KmsProvidersMap(providers ...KmsProvider) (map[string]map[string]interface{}, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no KMS providers given")
+	}
+	kmsProviders := make(map[string]map[string]interface{}, len(providers))
+	for _, provider := range providers {
+		name := provider.ProviderName()
+		if backend, tenant, _ := strings.Cut(name, ":"); tenant == "" {
+			return nil, fmt.Errorf("KMS provider '%s' has no tenant name, expected %s:<tenant>", name, backend)
+		}
+		if _, ok := kmsProviders[name]; ok {
+			return nil, fmt.Errorf("KMS provider '%s' is given more than once", name)
+		}
+		credentials := provider.Credentials()
+		// The masterKey document is checked along with the credentials, but isn't part of them.
+		config := make(map[string]interface{}, len(credentials))
+		maps.Copy(config, credentials)
+		maps.Copy(config, provider.MasterKeyDoc())
+		if err := ValidateProviderConfig(name, config); err != nil {
+			return nil, err
+		}
+		kmsProviders[name] = credentials
+	}
+	if err := checkLocalKeyLengths(kmsProviders); err != nil {
+		return nil, err
+	}
+	return kmsProviders, nil
+}
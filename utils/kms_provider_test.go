@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func testGcpKmsProvider(tenant string) *GcpKmsProvider {
+	return &GcpKmsProvider{
+		Tenant: tenant, Email: "enc@example.iam.gserviceaccount.com", PrivateKey: "cHJpdmF0ZQ==",
+		ProjectID: "example", Location: "global", KeyRing: "ring", KeyName: "kek",
+	}
+}
+
+func testAzureKmsProvider(tenant string) *AzureKmsProvider {
+	return &AzureKmsProvider{
+		Tenant: tenant, TenantID: "aad-tenant", ClientID: "client", ClientSecret: "secret",
+		KeyVaultEndpoint: "example.vault.azure.net", KeyName: "kek",
+	}
+}
+
+func TestKmsProvidersMap(t *testing.T) {
+	localKey := bytes.Repeat([]byte{1}, _masterKeySize)
+	withEndpoint := testGcpKmsProvider("100")
+	withEndpoint.Endpoint = "oauth2.example.com"
+	noEmail := testGcpKmsProvider("100")
+	noEmail.Email = ""
+	noKeyRing := testGcpKmsProvider("100")
+	noKeyRing.KeyRing = ""
+	noSecret := testAzureKmsProvider("100")
+	noSecret.ClientSecret = ""
+	noEndpoint := testAzureKmsProvider("100")
+	noEndpoint.KeyVaultEndpoint = ""
+
+	tests := []struct {
+		name      string
+		providers []KmsProvider
+		want      []string
+		wantErr   string
+	}{
+		{name: "local", providers: []KmsProvider{&LocalKmsProvider{name: "local:100", key: localKey}},
+			want: []string{"local:100"}},
+		{name: "gcp", providers: []KmsProvider{testGcpKmsProvider("100")}, want: []string{"gcp:100"}},
+		{name: "gcp with endpoint", providers: []KmsProvider{withEndpoint}, want: []string{"gcp:100"}},
+		{name: "azure", providers: []KmsProvider{testAzureKmsProvider("100")}, want: []string{"azure:100"}},
+		{name: "tenants on every backend", providers: []KmsProvider{
+			&LocalKmsProvider{name: "local:100", key: localKey},
+			testGcpKmsProvider("100"), testGcpKmsProvider("200"), testAzureKmsProvider("100"),
+		}, want: []string{"local:100", "gcp:100", "gcp:200", "azure:100"}},
+		{name: "no providers", wantErr: "no KMS providers given"},
+		{name: "gcp without tenant", providers: []KmsProvider{testGcpKmsProvider("")},
+			wantErr: "has no tenant name"},
+		{name: "azure without tenant", providers: []KmsProvider{testAzureKmsProvider("")},
+			wantErr: "has no tenant name"},
+		{name: "local without tenant", providers: []KmsProvider{&LocalKmsProvider{name: "local", key: localKey}},
+			wantErr: "has no tenant name"},
+		{name: "invalid tenant", providers: []KmsProvider{testGcpKmsProvider("org-100")},
+			wantErr: "may only contain letters, digits and underscores"},
+		{name: "duplicate", providers: []KmsProvider{testAzureKmsProvider("100"), testAzureKmsProvider("100")},
+			wantErr: "given more than once"},
+		{name: "gcp missing email", providers: []KmsProvider{noEmail}, wantErr: "has an empty 'email'"},
+		{name: "gcp missing key ring", providers: []KmsProvider{noKeyRing}, wantErr: "is missing keyRing"},
+		{name: "azure missing secret", providers: []KmsProvider{noSecret}, wantErr: "has an empty 'clientSecret'"},
+		{name: "azure missing endpoint", providers: []KmsProvider{noEndpoint},
+			wantErr: "is missing keyVaultEndpoint"},
+		{name: "short local key", providers: []KmsProvider{&LocalKmsProvider{name: "local:100", key: localKey[:32]}},
+			wantErr: ErrInvalidLocalKeyLength.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kmsProviders, err := KmsProvidersMap(tt.providers...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("KmsProvidersMap() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("KmsProvidersMap() error = %v", err)
+			}
+			if len(kmsProviders) != len(tt.want) {
+				t.Fatalf("KmsProvidersMap() has %d providers, want %d", len(kmsProviders), len(tt.want))
+			}
+			for i, name := range tt.want {
+				if !reflect.DeepEqual(kmsProviders[name], tt.providers[i].Credentials()) {
+					t.Errorf("provider %s = %v, want %v", name, kmsProviders[name], tt.providers[i].Credentials())
+				}
+			}
+		})
+	}
+}
+
+func TestKmsProviderMasterKeyDoc(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider KmsProvider
+		want     bson.M
+	}{
+		{name: "local", provider: &LocalKmsProvider{name: "local:100"}},
+		{name: "gcp", provider: testGcpKmsProvider("100"),
+			want: bson.M{"projectId": "example", "location": "global", "keyRing": "ring", "keyName": "kek"}},
+		{name: "azure", provider: testAzureKmsProvider("100"),
+			want: bson.M{"keyVaultEndpoint": "example.vault.azure.net", "keyName": "kek"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.provider.MasterKeyDoc(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MasterKeyDoc() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestKmsProviderAltNames checks that tenants sharing a backend get DEK alt names of their own.
+func TestKmsProviderAltNames(t *testing.T) {
+	tests := []struct {
+		provider KmsProvider
+		want     string
+	}{
+		{provider: &LocalKmsProvider{name: "local:100"}, want: "dek-local:100"},
+		{provider: testGcpKmsProvider("100"), want: "dek-gcp:100"},
+		{provider: testGcpKmsProvider("200"), want: "dek-gcp:200"},
+		{provider: testAzureKmsProvider("100"), want: "dek-azure:100"},
+		{provider: testAzureKmsProvider("200"), want: "dek-azure:200"},
+	}
+	for _, tt := range tests {
+		if got := dekAltName(tt.provider.ProviderName()); got != tt.want {
+			t.Errorf("dekAltName(%s) = %s, want %s", tt.provider.ProviderName(), got, tt.want)
+		}
+	}
+}
+
+func TestNewLocalKmsProvider(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	provider, err := NewLocalKmsProvider("local:100")
+	if err != nil {
+		t.Fatalf("NewLocalKmsProvider() error = %v", err)
+	}
+	key, ok := provider.Credentials()["key"].([]byte)
+	if !ok || len(key) != _masterKeySize {
+		t.Fatalf("Credentials() key = %v, want a %d byte key", provider.Credentials()["key"], _masterKeySize)
+	}
+	again, err := NewLocalKmsProvider("local:100")
+	if err != nil {
+		t.Fatalf("NewLocalKmsProvider() error = %v", err)
+	}
+	if !bytes.Equal(again.Credentials()["key"].([]byte), key) {
+		t.Error("NewLocalKmsProvider() created a new master key instead of loading the existing one")
+	}
+
+	if _, err := NewLocalKmsProvider("gcp:100"); err == nil {
+		t.Error("NewLocalKmsProvider(gcp:100) succeeded, want an error")
+	}
+	if _, err := NewLocalKmsProvider("local:org-100"); err == nil {
+		t.Error("NewLocalKmsProvider(local:org-100) succeeded, want an error")
+	}
+}
+
+// TestGetProviderName checks that every provider name GetProviderName returns is a named local
+// provider GetDek accepts, and that org ids it couldn't accept are rejected up front.
+func TestGetProviderName(t *testing.T) {
+	tests := []struct {
+		don     string
+		want    string
+		wantErr bool
+	}{
+		{don: "don:identity:dvrv-us-1:devo/100", want: "local:100"},
+		{don: "don:identity:dvrv-us-1:devo/0abc", want: "local:0abc"},
+		{don: "don:identity:dvrv-us-1:devo/org_100", want: "local:org_100"},
+		{don: "a/b/c/100", want: "local:100"},
+		{don: "100", wantErr: true},
+		{don: "/100", wantErr: true},
+		{don: "don:identity:dvrv-us-1:devo/", wantErr: true},
+		{don: "don:identity:dvrv-us-1:devo/org-100", wantErr: true},
+		{don: "don:identity:dvrv-us-1:devo/org:100", wantErr: true},
+		{don: "don:identity:dvrv-us-1:devo/_rotation_100", wantErr: true},
+		{don: "don:identity:dvrv-us-1:devo/org 100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.don, func(t *testing.T) {
+			got, err := GetProviderName(tt.don)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("GetProviderName() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetProviderName() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetProviderName() = %s, want %s", got, tt.want)
+			}
+			if backend, err := providerBackend(got); err != nil || backend != "local" {
+				t.Errorf("providerBackend(%s) = %s, %v, want local", got, backend, err)
+			}
+			if _, err := KmsProvidersMap(&LocalKmsProvider{name: got, key: make([]byte, _masterKeySize)}); err != nil {
+				t.Errorf("KmsProvidersMap(%s) error = %v", got, err)
+			}
+		})
+	}
+}
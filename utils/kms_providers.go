@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ProviderSpec describes what a KMS backend needs to be configured and to create DEKs with.
+type ProviderSpec struct {
+	// The backend, which is also the provider name, or its prefix for a named provider
+	// (<backend>:<name>).
+	Name string
+	// The alternative sets of credential fields of the kmsProviders entry, one of which must be
+	// complete. An empty set means the provider may be configured as {}, and the driver then
+	// fetches the credentials on demand (e.g. from the environment or instance metadata).
+	Credentials [][]string
+	// The required fields of the masterKey document CreateDataKey takes for the backend.
+	MasterKey []string
+}
+
+var _supportedProviders = []ProviderSpec{
+	{
+		Name:        "aws",
+		Credentials: [][]string{{"accessKeyId", "secretAccessKey"}, {}},
+		MasterKey:   []string{"region", "key"},
+	},
+	{
+		Name:        "azure",
+		Credentials: [][]string{{"tenantId", "clientId", "clientSecret"}, {"accessToken"}, {}},
+		MasterKey:   []string{"keyVaultEndpoint", "keyName"},
+	},
+	{
+		Name:        "gcp",
+		Credentials: [][]string{{"email", "privateKey"}, {"accessToken"}, {}},
+		MasterKey:   []string{"projectId", "location", "keyRing", "keyName"},
+	},
+	{Name: "kmip", Credentials: [][]string{{"endpoint"}}},
+	{Name: "local", Credentials: [][]string{{"key"}}},
+}
+
+// SupportedProviders returns the KMS backends the driver supports, sorted by name, with the
+// fields each requires.
+func SupportedProviders() []ProviderSpec {
+	specs := make([]ProviderSpec, len(_supportedProviders))
+	copy(specs, _supportedProviders)
+	return specs
+}
+
+func providerSpec(backend string) (ProviderSpec, bool) {
+	for _, spec := range _supportedProviders {
+		if spec.Name == backend {
+			return spec, true
+		}
+	}
+	return ProviderSpec{}, false
+}
+
+// ValidateProviderConfig checks the configuration of a provider, i.e. its kmsProviders entry along
+// with the masterKey fields its DEKs are created with, e.g. for AWS
+//
+//	{"accessKeyId": "...", "secretAccessKey": "...", "region": "us-east-1", "key": "arn:aws:kms:..."}
+//
+// against the fields its backend requires. The masterKey fields are not part of the kmsProviders
+// entry the driver takes; KmsProvidersMap separates them.
+func ValidateProviderConfig(name string, cfg map[string]interface{}) error {
+	backend, err := providerBackend(name)
+	if err != nil {
+		return err
+	}
+	spec, _ := providerSpec(backend)
+	credentials := make(map[string]interface{}, len(cfg))
+	masterKey := make(map[string]interface{}, len(spec.MasterKey))
+	for field, value := range cfg {
+		if slices.Contains(spec.MasterKey, field) {
+			masterKey[field] = value
+		} else {
+			credentials[field] = value
+		}
+	}
+	if err := validateProviderConfig(name, backend, credentials); err != nil {
+		return err
+	}
+	return ValidateMasterKey(name, masterKey)
+}
+
+// ValidateMasterKey checks the masterKey document for creating a DEK with a provider against the
+// fields its backend requires, e.g. the region and key ARN for AWS.
+func ValidateMasterKey(name string, masterKey map[string]interface{}) error {
+	backend, err := providerBackend(name)
+	if err != nil {
+		return err
+	}
+	spec, _ := providerSpec(backend)
+	var missing []string
+	for _, field := range spec.MasterKey {
+		if value, ok := masterKey[field]; !ok || value == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("masterKey for provider '%s' is missing %s", name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// LoadProvidersFromFile reads the KMS providers from a JSON file that maps provider names (a
+// backend, optionally with a :<name> suffix) to their credentials, e.g.
+//
+//	{
+//	  "aws": {"accessKeyId": "...", "secretAccessKey": "..."},
+//	  "local:prod_100": {"key": "<base64 of the 96 byte master key>"}
+//	}
+//
+// The required fields of each provider are checked, and local keys are decoded from base64.
+func LoadProvidersFromFile(path string) (map[string]map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read KMS providers file '%s': %w", path, err)
+	}
+	var providers map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, fmt.Errorf("invalid KMS providers file '%s': %w", path, err)
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("KMS providers file '%s' declares no providers", path)
+	}
+
+	for name, config := range providers {
+		backend, err := providerBackend(name)
+		if err != nil {
+			return nil, err
+		}
+		if backend == "local" {
+			if err := decodeLocalKey(name, config); err != nil {
+				return nil, err
+			}
+		}
+		if err := validateProviderConfig(name, backend, config); err != nil {
+			return nil, err
+		}
+	}
+	return providers, nil
+}
+
+// providerBackend returns the KMS backend of a provider name, which is either a bare backend or
+// <backend>:<name>.
+func providerBackend(providerName string) (string, error) {
+	backend, name, named := strings.Cut(providerName, ":")
+	if _, ok := providerSpec(backend); !ok {
+		return "", fmt.Errorf("invalid provider name '%s': unknown KMS backend '%s'", providerName, backend)
+	}
+	if named && !_providerNamePattern.MatchString(name) {
+		return "", fmt.Errorf(
+			"invalid provider name '%s': the name may only contain letters, digits and underscores", providerName,
+		)
+	}
+	return backend, nil
+}
+
+// validateProviderConfig checks that a provider has one of the sets of credential fields its
+// backend requires, and no empty ones.
+func validateProviderConfig(providerName, backend string, config map[string]interface{}) error {
+	for field, value := range config {
+		if s, ok := value.(string); ok && s == "" {
+			return fmt.Errorf("provider '%s' has an empty '%s'", providerName, field)
+		}
+	}
+	var expected []string
+	spec, _ := providerSpec(backend)
+	for _, fields := range spec.Credentials {
+		if len(fields) == 0 {
+			if len(config) == 0 {
+				return nil
+			}
+			continue
+		}
+		complete := true
+		for _, field := range fields {
+			if _, ok := config[field]; !ok {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return nil
+		}
+		expected = append(expected, strings.Join(fields, ", "))
+	}
+	return fmt.Errorf(
+		"provider '%s' is missing credentials: expected %s", providerName, strings.Join(expected, " or "),
+	)
+}
+
+// decodeLocalKey replaces the base64 key of a local provider with its bytes, checking its length.
+func decodeLocalKey(providerName string, config map[string]interface{}) error {
+	encoded, ok := config["key"].(string)
+	if !ok {
+		return fmt.Errorf("provider '%s' needs a base64 'key'", providerName)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("provider '%s' has an invalid base64 'key': %w", providerName, err)
+	}
+	if err := checkLocalKeyLength(providerName, key); err != nil {
+		return err
+	}
+	config["key"] = key
+	return nil
+}
+
+// ErrInvalidLocalKeyLength is returned for a local master key that isn't the 96 bytes the local
+// KMS provider requires; the driver itself only fails later, and cryptically, when it first uses
+// the key.
+var ErrInvalidLocalKeyLength = errors.New("local master key must be 96 bytes")
+
+func checkLocalKeyLength(providerName string, key []byte) error {
+	if len(key) != _masterKeySize {
+		return fmt.Errorf("%w: provider '%s' has a %d byte key", ErrInvalidLocalKeyLength, providerName, len(key))
+	}
+	return nil
+}
+
+// checkLocalKeyLengths checks the keys of the local providers of a KMS providers map, as it is
+// handed to the driver.
+func checkLocalKeyLengths(kmsProviders map[string]map[string]interface{}) error {
+	for name, config := range kmsProviders {
+		if backend, _, _ := strings.Cut(name, ":"); backend != "local" {
+			continue
+		}
+		key, ok := config["key"].([]byte)
+		if !ok {
+			// The driver also takes the key as base64 or as primitive.Binary.
+			switch k := config["key"].(type) {
+			case string:
+				decoded, err := base64.StdEncoding.DecodeString(k)
+				if err != nil {
+					return fmt.Errorf("provider '%s' has an invalid base64 'key': %w", name, err)
+				}
+				key = decoded
+			case primitive.Binary:
+				key = k.Data
+			default:
+				return fmt.Errorf("provider '%s' needs a 'key'", name)
+			}
+		}
+		if err := checkLocalKeyLength(name, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
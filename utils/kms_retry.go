@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KMSRetryPolicy bounds the retries of a decryption that failed with a transient KMS error.
+type KMSRetryPolicy struct {
+	// The total number of attempts; 1 disables retries. When zero, 3.
+	MaxAttempts int
+	// The wait before the first retry, doubled for each following one up to MaxBackoff. When
+	// zero, 100ms and 2s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+const (
+	_defaultKMSAttempts       = 3
+	_defaultKMSInitialBackoff = 100 * time.Millisecond
+	_defaultKMSMaxBackoff     = 2 * time.Second
+)
+
+// Markers of KMS errors that are worth retrying: throttling and temporary unavailability, as
+// reported in the KMS responses libmongocrypt includes in its errors.
+var _transientKMSErrors = []string{
+	"ThrottlingException",
+	"RequestLimitExceeded",
+	"TooManyRequests",
+	"KMSInternalException",
+	"ServiceUnavailable",
+	"HTTP status=429",
+	"HTTP status=500",
+	"HTTP status=502",
+	"HTTP status=503",
+	"HTTP status=504",
+}
+
+// Markers of KMS errors that won't go away by retrying, even if the response also looks
+// transient.
+var _permanentKMSErrors = []string{
+	"AccessDenied",
+	"InvalidCiphertext",
+	"NotFoundException",
+	"DisabledException",
+	"HTTP status=400",
+	"HTTP status=401",
+	"HTTP status=403",
+}
+
+// isTransientKMSError reports whether a decryption failed with a KMS error that may succeed when
+// retried.
+func isTransientKMSError(err error) bool {
+	msg := err.Error()
+	for _, marker := range _permanentKMSErrors {
+		// AWS reports throttling with status 400, so a throttling body wins over the status.
+		if strings.Contains(msg, marker) && !(marker == "HTTP status=400" && strings.Contains(msg, "Throttling")) {
+			return false
+		}
+	}
+	for _, marker := range _transientKMSErrors {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// DecryptWithRetry decrypts a ciphertext with the cipher, retrying per Config.KMSRetry when the
+// KMS that unwraps its DEK fails with a transient error such as throttling. Permanent errors,
+// such as an access denied, fail at once.
+func DecryptWithRetry(
+	ctx context.Context, cipher ExplicitCipher, ciphertext primitive.Binary,
+) (bson.RawValue, error) {
+	policy := _config.KMSRetry
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = _defaultKMSAttempts
+	}
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = _defaultKMSInitialBackoff
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = _defaultKMSMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		value, err := cipher.Decrypt(ctx, ciphertext)
+		if err == nil {
+			EncryptionContextFrom(ctx).Metrics.Count("decryptions", 1)
+			return value, nil
+		}
+		if attempt >= policy.MaxAttempts || !isTransientKMSError(err) {
+			return value, err
+		}
+		EncryptionContextFrom(ctx).Metrics.Count("kms_retries", 1)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return bson.RawValue{}, err
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// flakyCipher fails its decryptions with errs, in order, then decrypts to "987-65-4320".
+type flakyCipher struct {
+	errs  []error
+	calls int
+}
+
+func (c *flakyCipher) Encrypt(
+	context.Context, bson.RawValue, ...*options.EncryptOptions,
+) (primitive.Binary, error) {
+	return primitive.Binary{}, errors.New("not implemented")
+}
+
+func (c *flakyCipher) Decrypt(context.Context, primitive.Binary) (bson.RawValue, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return bson.RawValue{}, c.errs[c.calls-1]
+	}
+	_, data, err := bson.MarshalValue("987-65-4320")
+	return bson.RawValue{Type: bson.TypeString, Value: data}, err
+}
+
+func TestDecryptWithRetry(t *testing.T) {
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+	_config.KMSRetry = KMSRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	throttled := errors.New("kms error: HTTP status=400. Response body=" +
+		`{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	denied := errors.New("kms error: HTTP status=400. Response body=" +
+		`{"__type":"AccessDeniedException","message":"not authorized to perform kms:Decrypt"}`)
+	unavailable := errors.New("kms error: HTTP status=503. Response body=Service Unavailable")
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "throttled once", errs: []error{throttled}, wantCalls: 2},
+		{name: "access denied", errs: []error{denied}, wantErr: denied, wantCalls: 1},
+		{name: "always unavailable", errs: []error{unavailable, unavailable, unavailable},
+			wantErr: unavailable, wantCalls: 3},
+		{name: "denied after a retry", errs: []error{throttled, denied}, wantErr: denied, wantCalls: 2},
+	}
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: make([]byte, 20)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cipher := &flakyCipher{errs: tt.errs}
+			value, err := DecryptWithRetry(context.Background(), cipher, ciphertext)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("DecryptWithRetry() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && value.StringValue() != "987-65-4320" {
+				t.Errorf("DecryptWithRetry() = %v, want 987-65-4320", value)
+			}
+			if cipher.calls != tt.wantCalls {
+				t.Errorf("Decrypt called %d times, want %d", cipher.calls, tt.wantCalls)
+			}
+		})
+	}
+
+	// The wait for a retry ends with the context.
+	_config.KMSRetry = KMSRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cipher := &flakyCipher{errs: []error{throttled}}
+	if _, err := DecryptWithRetry(ctx, cipher, ciphertext); !errors.Is(err, throttled) || cipher.calls != 1 {
+		t.Errorf("DecryptWithRetry() with a canceled context = %v after %d calls, want %v after 1",
+			err, cipher.calls, throttled)
+	}
+}
+
+func TestIsTransientKMSError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{msg: `HTTP status=400. Response body={"__type":"ThrottlingException"}`, want: true},
+		{msg: "HTTP status=429. Response body=Too Many Requests", want: true},
+		{msg: `HTTP status=500. Response body={"__type":"KMSInternalException"}`, want: true},
+		{msg: `HTTP status=400. Response body={"__type":"AccessDeniedException"}`},
+		{msg: `HTTP status=400. Response body={"__type":"InvalidCiphertextException"}`},
+		{msg: "HTTP status=403. Response body=Forbidden"},
+		{msg: "connection refused"},
+	}
+	for _, tt := range tests {
+		if got := isTransientKMSError(errors.New(tt.msg)); got != tt.want {
+			t.Errorf("isTransientKMSError(%s) = %t, want %t", tt.msg, got, tt.want)
+		}
+	}
+}
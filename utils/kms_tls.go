@@ -0,0 +1,120 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KMSTLSOptions are the TLS settings used to connect to a KMS provider, e.g. the client
+// certificate a KMIP server requires.
+type KMSTLSOptions struct {
+	// PEM encoded client certificate and its private key.
+	CertificateFile string
+	KeyFile         string
+	// PEM encoded CA certificates to verify the KMS server with, instead of the system roots.
+	CAFile string
+	// Skips the verification of the server's hostname, but not of its certificate chain. Only
+	// meant for testing against a KMS with a self-signed certificate.
+	AllowInvalidHostnames bool
+}
+
+// KMSTLSConfigs builds the per-provider TLS configurations, loading and validating the files
+// up front so a bad path or certificate fails at startup rather than on the first KMS call.
+func KMSTLSConfigs(opts map[string]KMSTLSOptions) (map[string]*tls.Config, error) {
+	configs := make(map[string]*tls.Config, len(opts))
+	for provider, providerOpts := range opts {
+		cfg, err := providerOpts.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS options for KMS provider '%s': %w", provider, err)
+		}
+		configs[provider] = cfg
+	}
+	return configs, nil
+}
+
+func (o KMSTLSOptions) tlsConfig() (*tls.Config, error) {
+	// Use TLS 1.2 at the least, as the driver does.
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if o.CertificateFile != "" || o.KeyFile != "" {
+		if o.CertificateFile == "" || o.KeyFile == "" {
+			return nil, fmt.Errorf("both a certificate file and a key file are required")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertificateFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate '%s': %w", o.CertificateFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if o.CAFile != "" {
+		caPEM, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file '%s': %w", o.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates in the CA file '%s'", o.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if o.AllowInvalidHostnames {
+		// Go can't skip only the hostname check, so we skip the default verification and verify
+		// the chain ourselves, without a hostname.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("KMS server presented no certificate")
+			}
+			verifyOpts := x509.VerifyOptions{Roots: cfg.RootCAs, Intermediates: x509.NewCertPool()}
+			for _, cert := range state.PeerCertificates[1:] {
+				verifyOpts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(verifyOpts)
+			return err
+		}
+	}
+	return cfg, nil
+}
+
+// applyKMSTLS sets the configured KMS TLS settings on the auto-encryption options.
+func (c Config) applyKMSTLS(opts *options.AutoEncryptionOptions) error {
+	if len(c.KMSTLS) == 0 {
+		return nil
+	}
+	tlsConfigs, err := KMSTLSConfigs(c.KMSTLS)
+	if err != nil {
+		return err
+	}
+	opts.SetTLSConfig(tlsConfigs)
+	return nil
+}
+
+// clientEncryptionOptions returns the options for a ClientEncryption, with the configured KMS
+// TLS settings.
+func (c Config) clientEncryptionOptions(
+	keyVaultNamespace string, kmsProviders map[string]map[string]interface{},
+) (*options.ClientEncryptionOptions, error) {
+	if err := c.checkKeyCacheTTL(); err != nil {
+		return nil, err
+	}
+	if err := checkLocalKeyLengths(kmsProviders); err != nil {
+		return nil, err
+	}
+	opts := options.ClientEncryption().
+		SetKeyVaultNamespace(keyVaultNamespace).
+		SetKmsProviders(kmsProviders)
+	if len(c.KMSTLS) > 0 {
+		tlsConfigs, err := KMSTLSConfigs(c.KMSTLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfigs)
+	}
+	return opts, nil
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key as PEM files in dir.
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kmip.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestKMSTLSConfigs(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+	configs, err := KMSTLSConfigs(map[string]KMSTLSOptions{
+		"kmip": {CertificateFile: certFile, KeyFile: keyFile, CAFile: certFile},
+	})
+	if err != nil {
+		t.Fatalf("KMSTLSConfigs() error = %v", err)
+	}
+	cfg, ok := configs["kmip"]
+	if !ok || len(configs) != 1 {
+		t.Fatalf("KMSTLSConfigs() = %v, want the kmip provider only", configs)
+	}
+	if len(cfg.Certificates) != 1 || cfg.RootCAs == nil {
+		t.Errorf("kmip TLS config has %d certificates and roots %v, want the client certificate and the CA",
+			len(cfg.Certificates), cfg.RootCAs)
+	}
+	if cfg.InsecureSkipVerify {
+		t.Error("kmip TLS config skips verification without AllowInvalidHostnames")
+	}
+
+	opts, err := Config{KMSTLS: map[string]KMSTLSOptions{"kmip": {CertificateFile: certFile, KeyFile: keyFile}}}.
+		clientEncryptionOptions("encryption.__keyVault", map[string]map[string]interface{}{"kmip": {}})
+	if err != nil {
+		t.Fatalf("clientEncryptionOptions() error = %v", err)
+	}
+	if _, ok := opts.TLSConfig["kmip"]; !ok {
+		t.Errorf("ClientEncryption TLS configs = %v, want kmip", opts.TLSConfig)
+	}
+}
+
+func TestKMSTLSConfigsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	missing := filepath.Join(dir, "missing.pem")
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    KMSTLSOptions
+		wantErr string
+	}{
+		{name: "certificate without key", opts: KMSTLSOptions{CertificateFile: certFile},
+			wantErr: "both a certificate file and a key file"},
+		{name: "missing certificate", opts: KMSTLSOptions{CertificateFile: missing, KeyFile: keyFile},
+			wantErr: "failed to load the client certificate"},
+		{name: "missing CA", opts: KMSTLSOptions{CAFile: missing},
+			wantErr: "failed to read the CA file"},
+		{name: "CA without certificates", opts: KMSTLSOptions{CAFile: notPEM}, wantErr: "no valid certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := KMSTLSConfigs(map[string]KMSTLSOptions{"kmip": tt.opts})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "'kmip'") {
+				t.Errorf("KMSTLSConfigs() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
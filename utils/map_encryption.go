@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EncryptMap encrypts each value of a map whose keys are not sensitive (e.g. metadata), with the
+// random algorithm, and returns a sub-document with the keys in plaintext, sorted, and the values
+// as ciphertext. A schema map can't do this, as it only encrypts fields it declares by name. An
+// empty (or nil) map gives an empty document.
+func EncryptMap(
+	ctx context.Context, cipher ExplicitCipher, m map[string]string, keyID primitive.Binary,
+) (bson.D, error) {
+	encrypted := bson.D{}
+	opts := options.Encrypt().SetKeyID(keyID).SetAlgorithm(AlgorithmRandom)
+	for _, key := range sortedKeys(m) {
+		// Keys become field names, which the server and the query language treat specially.
+		if key == "" || strings.HasPrefix(key, "$") || strings.Contains(key, ".") {
+			return nil, fmt.Errorf("map key '%s' cannot be stored as a field name", key)
+		}
+		raw, err := toRawValue(m[key])
+		if err != nil {
+			return nil, err
+		}
+		ciphertext, err := cipher.Encrypt(ctx, raw, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt the value of '%s': %w", key, err)
+		}
+		encrypted = append(encrypted, bson.E{Key: key, Value: ciphertext})
+	}
+	return encrypted, nil
+}
+
+// DecryptMap reverses EncryptMap on the sub-document as read (bson.D or bson.M) through a regular
+// client. Values stored in plaintext are returned as they are.
+func DecryptMap(ctx context.Context, cipher ExplicitCipher, doc interface{}) (map[string]string, error) {
+	fields, ok := asMap(doc)
+	if !ok {
+		return nil, fmt.Errorf("encrypted map is not a document: %T", doc)
+	}
+	decrypted := make(map[string]string, len(fields))
+	for key, value := range fields {
+		if plain, ok := value.(string); ok {
+			decrypted[key] = plain
+			continue
+		}
+		ciphertext, ok := asCiphertext(value)
+		if !ok {
+			return nil, fmt.Errorf("value of '%s' is neither ciphertext nor a string: %T", key, value)
+		}
+		raw, err := cipher.Decrypt(ctx, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the value of '%s': %w", key, err)
+		}
+		plain, ok := raw.StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("decrypted value of '%s' is not a string: %v", key, raw.Type)
+		}
+		decrypted[key] = plain
+	}
+	return decrypted, nil
+}
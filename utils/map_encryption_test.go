@@ -0,0 +1,68 @@
+package utils_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestEncryptMapRoundTrip encrypts a metadata map whose values are sensitive but whose keys are
+// not, and decrypts it back.
+func TestEncryptMapRoundTrip(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ctx := context.Background()
+	metadata := map[string]string{"team": "billing", "region": "us-east-1", "owner": "bob@x.com"}
+
+	encrypted, err := utils.EncryptMap(ctx, fake, metadata, keyID)
+	if err != nil {
+		t.Fatalf("EncryptMap() error = %v", err)
+	}
+	var keys []string
+	for _, elem := range encrypted {
+		keys = append(keys, elem.Key)
+		if bin, ok := elem.Value.(primitive.Binary); !ok || bin.Subtype != 6 {
+			t.Errorf("value of %s = %v, want ciphertext", elem.Key, elem.Value)
+		}
+	}
+	if want := []string{"owner", "region", "team"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("EncryptMap() keys = %v, want %v in plaintext", keys, want)
+	}
+
+	decrypted, err := utils.DecryptMap(ctx, fake, encrypted)
+	if err != nil {
+		t.Fatalf("DecryptMap() error = %v", err)
+	}
+	if !reflect.DeepEqual(decrypted, metadata) {
+		t.Errorf("DecryptMap() = %v, want %v", decrypted, metadata)
+	}
+}
+
+func TestEncryptMapEmptyAndInvalid(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ctx := context.Background()
+
+	encrypted, err := utils.EncryptMap(ctx, fake, nil, keyID)
+	if err != nil || len(encrypted) != 0 {
+		t.Fatalf("EncryptMap() of an empty map = %v, %v, want an empty document", encrypted, err)
+	}
+	decrypted, err := utils.DecryptMap(ctx, fake, encrypted)
+	if err != nil || len(decrypted) != 0 {
+		t.Errorf("DecryptMap() of an empty document = %v, %v, want an empty map", decrypted, err)
+	}
+
+	for _, key := range []string{"", "$where", "a.b"} {
+		if _, err := utils.EncryptMap(ctx, fake, map[string]string{key: "v"}, keyID); err == nil {
+			t.Errorf("EncryptMap() with the key %q succeeded, want an error", key)
+		}
+	}
+	if _, err := utils.DecryptMap(ctx, fake, bson.M{"count": int32(3)}); err == nil {
+		t.Error("DecryptMap() of a non-string value succeeded, want an error")
+	}
+}
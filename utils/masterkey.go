@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The local KMS provider requires a 96 byte master key.
+	_masterKeySize           = 96
+	_masterKeyDirPermissions = 0700
+	// Only the owner may read or write a master key file.
+	_masterKeyFilePermissions = 0600
+	_masterKeyDir             = "keys"
+)
+
+// ErrInsecureMasterKeyFile is returned when a master key file can be read or written by users
+// other than its owner, and Config.RejectInsecureMasterKeyFile is set.
+var ErrInsecureMasterKeyFile = errors.New("master key file is accessible by group or others")
+
+// ErrMasterKeyMissing is returned when a master key file is expected to exist but doesn't, e.g.
+// after a restart on a fresh volume. Creating a new key then would silently make every DEK wrapped
+// with the old one, and so all the data encrypted with them, undecryptable.
+var ErrMasterKeyMissing = errors.New("master key file does not exist")
+
+// AssertMasterKeyPersisted checks, typically at startup, that the current master key file of the
+// provider exists, so a lost key fails loudly instead of a new one being generated. Pair it with
+// Config.RequireExistingMasterKey, which makes LoadOrCreateMasterKey fail the same way.
+func AssertMasterKeyPersisted(providerName string) error {
+	generation, err := CurrentMasterKeyGeneration(providerName)
+	if err != nil {
+		return err
+	}
+	filePath := masterKeyPath(providerName, generation)
+	if _, err := os.Stat(filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: '%s'", ErrMasterKeyMissing, filePath)
+		}
+		return fmt.Errorf("error checking master key file status '%s': %w", filePath, err)
+	}
+	return nil
+}
+
+// MasterKeyFromEnv reads a local master key from an environment variable holding its base64, for
+// deployments that inject the key instead of keeping it on disk. Like the file LoadOrCreateMasterKey
+// reads, the key must be exactly 96 bytes; any other length fails with ErrInvalidLocalKeyLength.
+func MasterKeyFromEnv(envVar string) ([]byte, error) {
+	encoded, ok := os.LookupEnv(envVar)
+	if !ok || encoded == "" {
+		return nil, fmt.Errorf("environment variable '%s' holds no master key", envVar)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("environment variable '%s' is not a base64 master key: %w", envVar, err)
+	}
+	if len(key) != _masterKeySize {
+		return nil, fmt.Errorf("%w: environment variable '%s' holds a %d byte key",
+			ErrInvalidLocalKeyLength, envVar, len(key))
+	}
+	return key, nil
+}
+
+// masterKeyPath returns the file of the given generation of a provider's local master key. The
+// first generation (0) keeps the original file name, so keys created before generations were
+// tracked are still found; each rotation adds a _g<N> file.
+func masterKeyPath(providerName string, generation int) string {
+	if generation == 0 {
+		return filepath.Join(_masterKeyDir, fmt.Sprintf("%s_master_key.bin", providerName))
+	}
+	return filepath.Join(_masterKeyDir, fmt.Sprintf("%s_master_key_g%d.bin", providerName, generation))
+}
+
+// CurrentMasterKeyGeneration returns the latest generation of the provider's local master key
+// found on disk, or 0 if there's none yet.
+func CurrentMasterKeyGeneration(providerName string) (int, error) {
+	entries, err := os.ReadDir(_masterKeyDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read master key directory '%s': %w", _masterKeyDir, err)
+	}
+
+	prefix := providerName + "_master_key_g"
+	current := 0
+	for _, entry := range entries {
+		generation, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		generation, ok = strings.CutSuffix(generation, ".bin")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(generation)
+		if err != nil || n <= 0 {
+			continue
+		}
+		current = max(current, n)
+	}
+	return current, nil
+}
+
+// rotateMasterKey stores key as the next generation of the provider's local master key, which
+// LoadOrCreateMasterKey returns from then on, and returns that generation. The previous
+// generations are kept on disk but no longer loaded, so the DEKs of the provider must already be
+// wrapped with key: only RotateTenantKey calls it, once its rewrap succeeded.
+func rotateMasterKey(providerName string, key []byte) (int, error) {
+	generation, err := CurrentMasterKeyGeneration(providerName)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(masterKeyPath(providerName, generation)); err != nil {
+		return 0, fmt.Errorf("no master key to rotate for '%s': %w", providerName, err)
+	}
+	generation++
+	if err := writeMasterKeyFile(masterKeyPath(providerName, generation), key); err != nil {
+		return 0, err
+	}
+	return generation, nil
+}
+
+// generateMasterKey returns a new random local master key.
+func generateMasterKey() ([]byte, error) {
+	key := make([]byte, _masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate new master key: %w", err)
+	}
+	return key, nil
+}
+
+// writeMasterKeyFile writes a new master key file. It never overwrites an existing file, and
+// removes the file it created if the key can't be written in full, so a truncated key is never
+// left behind for LoadOrCreateMasterKey to pick up as the current generation.
+func writeMasterKeyFile(filePath string, key []byte) error {
+	if err := os.MkdirAll(_masterKeyDir, _masterKeyDirPermissions); err != nil {
+		return fmt.Errorf("failed to create master key directory '%s': %w", _masterKeyDir, err)
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, _masterKeyFilePermissions)
+	if err != nil {
+		return fmt.Errorf("failed to create master key file '%s': %w", filePath, err)
+	}
+
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filePath)
+		return fmt.Errorf("failed to write master key to file '%s': %w", filePath, err)
+	}
+	return nil
+}
+
+// checkMasterKeyFilePermissions flags a master key file with any group or other permission bits:
+// anyone who can read it can unwrap every DEK of the provider. By default a warning is logged, so
+// existing deployments keep working until the file is fixed with chmod 600; with
+// Config.RejectInsecureMasterKeyFile set, the key is refused.
+func checkMasterKeyFilePermissions(filePath string, info os.FileInfo) error {
+	// Windows doesn't have Unix permission bits; Go reports 0666 for every writable file.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	perm := info.Mode().Perm()
+	if perm&^_masterKeyFilePermissions == 0 {
+		return nil
+	}
+	if _config.RejectInsecureMasterKeyFile {
+		return fmt.Errorf("%w: '%s' has mode %04o, expected %04o",
+			ErrInsecureMasterKeyFile, filePath, perm, _masterKeyFilePermissions)
+	}
+	log.Printf("warning: master key file '%s' has mode %04o; restrict it to %04o",
+		filePath, perm, _masterKeyFilePermissions)
+	return nil
+}
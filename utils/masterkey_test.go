@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRotateMasterKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	first, err := LoadOrCreateMasterKey("local:100")
+	if err != nil {
+		t.Fatalf("LoadOrCreateMasterKey() error = %v", err)
+	}
+	key := bytes.Repeat([]byte{7}, _masterKeySize)
+	generation, err := rotateMasterKey("local:100", key)
+	if err != nil {
+		t.Fatalf("rotateMasterKey() error = %v", err)
+	}
+	if generation != 1 {
+		t.Errorf("rotateMasterKey() = generation %d, want 1", generation)
+	}
+	second, err := LoadOrCreateMasterKey("local:100")
+	if err != nil {
+		t.Fatalf("LoadOrCreateMasterKey() error = %v", err)
+	}
+	if !bytes.Equal(second, key) || bytes.Equal(first, second) {
+		t.Errorf("LoadOrCreateMasterKey() after rotation = %x, want the rotated key", second)
+	}
+	if _, err := os.Stat(masterKeyPath("local:100", 0)); err != nil {
+		t.Errorf("the previous generation was not kept: %v", err)
+	}
+}
+
+func TestWriteMasterKeyFileExisting(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	path := masterKeyPath("local:100", 0)
+	if err := writeMasterKeyFile(path, bytes.Repeat([]byte{1}, _masterKeySize)); err != nil {
+		t.Fatalf("writeMasterKeyFile() error = %v", err)
+	}
+	if err := writeMasterKeyFile(path, bytes.Repeat([]byte{2}, _masterKeySize)); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("writeMasterKeyFile() over an existing file error = %v, want os.ErrExist", err)
+	}
+	// The failed write must neither overwrite nor remove the existing key.
+	key, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(key, bytes.Repeat([]byte{1}, _masterKeySize)) {
+		t.Errorf("existing master key = %x, %v, want it unchanged", key, err)
+	}
+}
+
+// TestMasterKeyFilePermissions checks that a new master key file is created with mode 0600, and
+// that loading one readable by others logs a warning, or fails with RejectInsecureMasterKeyFile.
+func TestMasterKeyFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permission bits")
+	}
+	t.Chdir(t.TempDir())
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if _, err := LoadOrCreateMasterKey("local:100"); err != nil {
+		t.Fatalf("LoadOrCreateMasterKey() error = %v", err)
+	}
+	path := masterKeyPath("local:100", 0)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("new master key file mode = %04o, want 0600", perm)
+	}
+
+	_config.RejectInsecureMasterKeyFile = true
+	if _, err := LoadOrCreateMasterKey("local:100"); err != nil {
+		t.Errorf("LoadOrCreateMasterKey() of a 0600 file error = %v", err)
+	}
+	if logged.Len() != 0 {
+		t.Errorf("LoadOrCreateMasterKey() of a 0600 file logged %q", logged.String())
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateMasterKey("local:100"); !errors.Is(err, ErrInsecureMasterKeyFile) {
+		t.Errorf("LoadOrCreateMasterKey() of a 0644 file error = %v, want ErrInsecureMasterKeyFile", err)
+	}
+	_config.RejectInsecureMasterKeyFile = false
+	if _, err := LoadOrCreateMasterKey("local:100"); err != nil {
+		t.Errorf("LoadOrCreateMasterKey() of a 0644 file without RejectInsecureMasterKeyFile error = %v", err)
+	}
+	if !strings.Contains(logged.String(), "has mode 0644") {
+		t.Errorf("LoadOrCreateMasterKey() of a 0644 file logged %q, want a warning", logged.String())
+	}
+}
+
+// TestRequireExistingMasterKey checks that a missing master key file fails in must-exist mode
+// instead of a new key being created.
+func TestRequireExistingMasterKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+	_config.RequireExistingMasterKey = true
+
+	if err := AssertMasterKeyPersisted("local:100"); !errors.Is(err, ErrMasterKeyMissing) {
+		t.Errorf("AssertMasterKeyPersisted() error = %v, want ErrMasterKeyMissing", err)
+	}
+	if _, err := LoadOrCreateMasterKey("local:100"); !errors.Is(err, ErrMasterKeyMissing) {
+		t.Errorf("LoadOrCreateMasterKey() error = %v, want ErrMasterKeyMissing", err)
+	}
+	if _, err := os.Stat(masterKeyPath("local:100", 0)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a master key file was created in must-exist mode: %v", err)
+	}
+
+	// Once the key exists, both find it.
+	_config.RequireExistingMasterKey = false
+	created, err := LoadOrCreateMasterKey("local:100")
+	if err != nil {
+		t.Fatalf("LoadOrCreateMasterKey() error = %v", err)
+	}
+	_config.RequireExistingMasterKey = true
+	if err := AssertMasterKeyPersisted("local:100"); err != nil {
+		t.Errorf("AssertMasterKeyPersisted() error = %v", err)
+	}
+	if loaded, err := LoadOrCreateMasterKey("local:100"); err != nil || !bytes.Equal(loaded, created) {
+		t.Errorf("LoadOrCreateMasterKey() = %x, %v, want the existing key", loaded, err)
+	}
+}
+
+func TestMasterKeyFromEnv(t *testing.T) {
+	const envVar = "TEST_LOCAL_MASTER_KEY"
+	key := bytes.Repeat([]byte{7}, _masterKeySize)
+	t.Setenv(envVar, base64.StdEncoding.EncodeToString(key))
+	if got, err := MasterKeyFromEnv(envVar); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("MasterKeyFromEnv() = %x, %v, want the 96 byte key", got, err)
+	}
+
+	t.Setenv(envVar, base64.StdEncoding.EncodeToString(key[:80]))
+	_, err := MasterKeyFromEnv(envVar)
+	if !errors.Is(err, ErrInvalidLocalKeyLength) || !strings.Contains(err.Error(), "80 byte key") {
+		t.Errorf("MasterKeyFromEnv() of an 80 byte key error = %v, want ErrInvalidLocalKeyLength naming 80", err)
+	}
+	t.Setenv(envVar, "not base64!")
+	if _, err := MasterKeyFromEnv(envVar); err == nil || !strings.Contains(err.Error(), "not a base64") {
+		t.Errorf("MasterKeyFromEnv() of an invalid base64 error = %v", err)
+	}
+	t.Setenv(envVar, "")
+	if _, err := MasterKeyFromEnv(envVar); err == nil || !strings.Contains(err.Error(), "holds no master key") {
+		t.Errorf("MasterKeyFromEnv() of an empty variable error = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Normalizer maps the equivalent values of a field to one, before it is encrypted.
+type Normalizer func(string) string
+
+// NormalizeEmail trims and lowercases an email address. Deterministic encryption is
+// case-sensitive, so Bob@x.com and bob@x.com would otherwise encrypt differently, and an equality
+// query for one would miss the other.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ErrInvalidPhoneNumber is returned for a value that can't be normalized to an E.164 number.
+var ErrInvalidPhoneNumber = errors.New("invalid phone number")
+
+// The country calling code and trunk prefix (dialed before a national number within the country)
+// of the regions NormalizePhone supports for numbers without a country code.
+var _phoneRegions = map[string]struct {
+	callingCode string
+	trunkPrefix string
+}{
+	"US": {"1", "1"},
+	"CA": {"1", "1"},
+	"GB": {"44", "0"},
+	"IE": {"353", "0"},
+	"DE": {"49", "0"},
+	"FR": {"33", "0"},
+	"NL": {"31", "0"},
+	"ES": {"34", ""},
+	"IT": {"39", ""},
+	"IN": {"91", "0"},
+	"AU": {"61", "0"},
+	"NZ": {"64", "0"},
+	"JP": {"81", "0"},
+	"SG": {"65", ""},
+	"LK": {"94", "0"},
+}
+
+// E.164 numbers have at most 15 digits, country code included; we also require at least 8.
+const (
+	_minPhoneDigits = 8
+	_maxPhoneDigits = 15
+)
+
+// NormalizePhone returns the E.164 form (+<country code><number>) of a phone number, so that
+// equivalent numbers in different formats, e.g. "+1 555-0100" and "1 (555) 0100", encrypt to the
+// same deterministic ciphertext. Spaces, dashes, dots and parentheses are ignored. A number
+// without a + or 00 prefix is taken as a national number of defaultRegion (an ISO 3166 code, e.g.
+// "US"), with its trunk prefix, if any, removed. This is a format check only; whether the number
+// is assigned isn't known. An invalid number fails with ErrInvalidPhoneNumber.
+func NormalizePhone(s, defaultRegion string) (string, error) {
+	var digits strings.Builder
+	international := false
+	for i, r := range strings.TrimSpace(s) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			international = true
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", fmt.Errorf("%w: unexpected '%c' in %q", ErrInvalidPhoneNumber, r, s)
+		}
+	}
+	number := digits.String()
+	if !international {
+		if rest, ok := strings.CutPrefix(number, "00"); ok {
+			number = rest
+		} else {
+			region, ok := _phoneRegions[strings.ToUpper(defaultRegion)]
+			if !ok {
+				return "", fmt.Errorf("%w: %q has no country code and the region '%s' is not supported",
+					ErrInvalidPhoneNumber, s, defaultRegion)
+			}
+			if region.trunkPrefix != "" {
+				number = strings.TrimPrefix(number, region.trunkPrefix)
+			}
+			number = region.callingCode + number
+		}
+	}
+	if number == "" || number[0] == '0' {
+		return "", fmt.Errorf("%w: %q has no valid country code", ErrInvalidPhoneNumber, s)
+	}
+	if len(number) < _minPhoneDigits || len(number) > _maxPhoneDigits {
+		return "", fmt.Errorf("%w: %q has %d digits, expected %d to %d",
+			ErrInvalidPhoneNumber, s, len(number), _minPhoneDigits, _maxPhoneDigits)
+	}
+	return "+" + number, nil
+}
+
+// PhoneNormalizer returns a Normalizer for a phone number field (see Config.Normalizers), that
+// normalizes with NormalizePhone. A Normalizer can't fail, so an invalid number is left as it
+// is; validate numbers with NormalizePhone before the insert to reject them.
+func PhoneNormalizer(defaultRegion string) Normalizer {
+	return func(s string) string {
+		normalized, err := NormalizePhone(s, defaultRegion)
+		if err != nil {
+			return s
+		}
+		return normalized
+	}
+}
+
+// normalizeValue applies the normalizer configured for the field (dotted path) to a string value.
+func normalizeValue(field string, value interface{}) interface{} {
+	normalize, ok := _config.Normalizers[field]
+	if !ok {
+		return value
+	}
+	if s, ok := value.(string); ok {
+		return normalize(s)
+	}
+	return value
+}
+
+// normalizeDocument returns the BSON document with the configured fields normalized, or the
+// document as is if no field is configured.
+func normalizeDocument(data bson.Raw) (bson.Raw, error) {
+	if len(_config.Normalizers) == 0 {
+		return data, nil
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the document: %w", err)
+	}
+	normalizeFields(doc, "")
+	normalized, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the normalized document: %w", err)
+	}
+	return normalized, nil
+}
+
+func normalizeFields(doc bson.D, prefix string) {
+	for i, elem := range doc {
+		path := elem.Key
+		if prefix != "" {
+			path = prefix + "." + elem.Key
+		}
+		if nested, ok := elem.Value.(bson.D); ok {
+			normalizeFields(nested, path)
+			continue
+		}
+		doc[i].Value = normalizeValue(path, elem.Value)
+	}
+}
+
+// normalizeFilter returns a copy of a query filter with the values compared to the configured
+// fields normalized, directly, with $eq, or in an $in list.
+func normalizeFilter(filter bson.M) bson.M {
+	if len(_config.Normalizers) == 0 {
+		return filter
+	}
+	normalized := make(bson.M, len(filter))
+	for field, value := range filter {
+		normalized[field] = value
+		if _, ok := _config.Normalizers[field]; !ok {
+			continue
+		}
+		operators, ok := asMap(value)
+		if !ok {
+			normalized[field] = normalizeValue(field, value)
+			continue
+		}
+		ops := make(bson.M, len(operators))
+		for op, operand := range operators {
+			switch op {
+			case "$eq":
+				operand = normalizeValue(field, operand)
+			case "$in":
+				if values, ok := operand.(bson.A); ok {
+					list := make(bson.A, len(values))
+					for i, v := range values {
+						list[i] = normalizeValue(field, v)
+					}
+					operand = list
+				}
+			}
+			ops[op] = operand
+		}
+		normalized[field] = ops
+	}
+	return normalized
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// setNormalizers configures the normalizers for the duration of the test.
+func setNormalizers(t *testing.T, normalizers map[string]Normalizer) {
+	saved := _config
+	t.Cleanup(func() { _config = saved })
+	_config.Normalizers = normalizers
+}
+
+// TestNormalizeEmail inserts Bob@X.com and looks it up by bob@x.com: both reach the encryption as
+// the same value, so they encrypt to the same deterministic ciphertext.
+func TestNormalizeEmail(t *testing.T) {
+	setNormalizers(t, map[string]Normalizer{"email": NormalizeEmail, "profile.email": NormalizeEmail})
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "email", Value: " Bob@X.com "},
+		{Key: "profile", Value: bson.D{{Key: "email", Value: "Bob@X.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := normalizeDocument(data)
+	if err != nil {
+		t.Fatalf("normalizeDocument() error = %v", err)
+	}
+	wantFields := map[string]string{"email": "bob@x.com", "profile.email": "bob@x.com", "name": "Bob"}
+	for path, want := range wantFields {
+		if got := normalized.Lookup(strings.Split(path, ".")...).StringValue(); got != want {
+			t.Errorf("normalized %s = %q, want %q", path, got, want)
+		}
+	}
+
+	filter := normalizeFilter(bson.M{
+		"email": "bob@x.com",
+		"name":  "Bob",
+	})
+	if filter["email"] != normalized.Lookup("email").StringValue() || filter["name"] != "Bob" {
+		t.Errorf("normalizeFilter() = %v, want the stored email", filter)
+	}
+	filter = normalizeFilter(bson.M{"email": bson.M{"$in": bson.A{"BOB@x.com", "Alice@X.com"}}})
+	wantIn := bson.M{"email": bson.M{"$in": bson.A{"bob@x.com", "alice@x.com"}}}
+	if !reflect.DeepEqual(filter, wantIn) {
+		t.Errorf("normalizeFilter() = %v, want %v", filter, wantIn)
+	}
+	filter = normalizeFilter(bson.M{"email": bson.M{"$eq": "BOB@x.com"}})
+	if want := (bson.M{"email": bson.M{"$eq": "bob@x.com"}}); !reflect.DeepEqual(filter, want) {
+		t.Errorf("normalizeFilter() = %v, want %v", filter, want)
+	}
+}
+
+func TestNormalizeWithoutNormalizers(t *testing.T) {
+	setNormalizers(t, nil)
+	data, err := bson.Marshal(bson.D{{Key: "email", Value: "Bob@X.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normalized, err := normalizeDocument(data); err != nil || !reflect.DeepEqual(normalized, bson.Raw(data)) {
+		t.Errorf("normalizeDocument() = %v, %v, want the document as is", normalized, err)
+	}
+	if filter := normalizeFilter(bson.M{"email": "Bob@X.com"}); filter["email"] != "Bob@X.com" {
+		t.Errorf("normalizeFilter() = %v, want the filter as is", filter)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		number  string
+		region  string
+		want    string
+		wantErr bool
+	}{
+		{number: "+1 555-0100", region: "US", want: "+15550100"},
+		{number: "15550100", region: "US", want: "+15550100"},
+		{number: "(555) 0100", region: "US", want: "+15550100"},
+		{number: "001 555 0100", region: "GB", want: "+15550100"},
+		{number: "020 7946 0018", region: "GB", want: "+442079460018"},
+		{number: "+44 20 7946 0018", region: "", want: "+442079460018"},
+		{number: "077 123 4567", region: "lk", want: "+94771234567"},
+		{number: "555-0100 ext 2", region: "US", wantErr: true},
+		{number: "1+5550100", region: "US", wantErr: true},
+		{number: "020 7946 0018", region: "BR", wantErr: true},
+		{number: "+0 555 0100", region: "US", wantErr: true},
+		{number: "+1 555", region: "US", wantErr: true},
+		{number: "+1 555 0100 0100 0100", region: "US", wantErr: true},
+		{number: "", region: "US", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			got, err := NormalizePhone(tt.number, tt.region)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPhoneNumber) {
+					t.Errorf("NormalizePhone() = %q, %v, want ErrInvalidPhoneNumber", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("NormalizePhone() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestPhoneNormalizer inserts +1 555-0100 and looks it up by 15550100: both reach the encryption
+// as the same value, so each finds the other's deterministic ciphertext.
+func TestPhoneNormalizer(t *testing.T) {
+	setNormalizers(t, map[string]Normalizer{"phone": PhoneNormalizer("US")})
+
+	data, err := bson.Marshal(bson.D{{Key: "name", Value: "Bob"}, {Key: "phone", Value: "+1 555-0100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized, err := normalizeDocument(data)
+	if err != nil {
+		t.Fatalf("normalizeDocument() error = %v", err)
+	}
+	stored := normalized.Lookup("phone").StringValue()
+	if stored != "+15550100" {
+		t.Errorf("normalized phone = %q, want +15550100", stored)
+	}
+	if filter := normalizeFilter(bson.M{"phone": "15550100"}); filter["phone"] != stored {
+		t.Errorf("normalizeFilter() = %v, want the stored phone %s", filter, stored)
+	}
+	if got := PhoneNormalizer("US")("call me"); got != "call me" {
+		t.Errorf("PhoneNormalizer() of an invalid number = %q, want it as is", got)
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// NullPolicy is how the insert helpers handle an encrypted field that is explicitly null (or
+// undefined). Null can't be encrypted: automatic encryption fails the whole insert on it, while an
+// absent field is simply skipped.
+type NullPolicy int
+
+const (
+	// NullReject rejects the document with ErrNullEncryptedField before anything is sent.
+	NullReject NullPolicy = iota
+	// NullStoreUnencrypted stores the field as a plain BSON null. The document is inserted without
+	// the field through the encrypting client, which can't write a null to an encrypted field,
+	// and the field is then set to null through the regular client the helper was given. The two
+	// writes are not atomic: if the second fails the field stays absent, which most queries treat
+	// the same as null.
+	NullStoreUnencrypted
+)
+
+// ErrNullEncryptedField is returned for a document with a null encrypted field under NullReject.
+var ErrNullEncryptedField = errors.New("encrypted field is null")
+
+// nullEncryptedFields returns the encFields (dotted paths) whose value in the BSON document is
+// null or undefined.
+func nullEncryptedFields(data bson.Raw, encFields []string) []string {
+	var nulls []string
+	for _, field := range encFields {
+		value, err := data.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			continue
+		}
+		if value.Type == bsontype.Null || value.Type == bsontype.Undefined {
+			nulls = append(nulls, field)
+		}
+	}
+	return nulls
+}
+
+// withoutFields returns a copy of the BSON document without the given dotted paths.
+func withoutFields(data bson.Raw, paths []string) (bson.D, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the document: %w", err)
+	}
+	for _, path := range paths {
+		doc = removePath(doc, strings.Split(path, "."))
+	}
+	return doc, nil
+}
+
+func removePath(doc bson.D, parts []string) bson.D {
+	for i, elem := range doc {
+		if elem.Key != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			return append(doc[:i], doc[i+1:]...)
+		}
+		if nested, ok := elem.Value.(bson.D); ok {
+			doc[i].Value = removePath(nested, parts[1:])
+		}
+		return doc
+	}
+	return doc
+}
+
+// storeNullFields sets the given fields of an inserted document to null through a regular client.
+func storeNullFields(
+	ctx context.Context, rawClient *mongo.Client, coll CollRef, id interface{}, fields []string,
+) error {
+	nulls := bson.D{}
+	for _, field := range fields {
+		nulls = append(nulls, bson.E{Key: field, Value: nil})
+	}
+	_, err := coll.Collection(rawClient).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": nulls})
+	if err != nil {
+		return fmt.Errorf("failed to store the null encrypted fields %v of %v in %s: %w", fields, id, coll, err)
+	}
+	return nil
+}
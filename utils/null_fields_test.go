@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNullEncryptedFields(t *testing.T) {
+	data, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "ssn", Value: nil},
+		{Key: "profile", Value: bson.D{{Key: "ssn", Value: primitive.Undefined{}}, {Key: "email", Value: "a@b.c"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := nullEncryptedFields(data, []string{"ssn", "email", "profile.ssn", "profile.email", "name"})
+	if want := []string{"ssn", "profile.ssn"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nullEncryptedFields() = %v, want %v", got, want)
+	}
+
+	doc, err := withoutFields(data, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "name", Value: "Bob"}, {Key: "profile", Value: bson.D{{Key: "email", Value: "a@b.c"}}}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("withoutFields() = %v, want %v", doc, want)
+	}
+}
+
+// TestInsertEncryptedNullPolicy checks what InsertEncrypted does with a null ssn before anything is
+// sent: the clients are nil, so it fails the test with a panic if it gets as far as inserting.
+func TestInsertEncryptedNullPolicy(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	doc := bson.M{"name": "Bob", "ssn": nil}
+	t.Cleanup(func() { SetConfig(Config{}) })
+
+	SetConfig(Config{NullEncryptedFields: NullReject})
+	err := InsertEncrypted(context.Background(), nil, nil, coll, doc, []string{"ssn"})
+	if !errors.Is(err, ErrNullEncryptedField) {
+		t.Errorf("InsertEncrypted() under NullReject error = %v, want ErrNullEncryptedField", err)
+	}
+
+	SetConfig(Config{NullEncryptedFields: NullStoreUnencrypted})
+	err = InsertEncrypted(context.Background(), nil, nil, coll, doc, []string{"ssn"})
+	if err == nil || !strings.Contains(err.Error(), "regular client is required") {
+		t.Errorf("InsertEncrypted() under NullStoreUnencrypted without a regular client error = %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrUnsortableField is returned when asked to sort on a randomly encrypted field. Its ciphertext
+// differs on every write, so an order on it is meaningless and not even stable.
+var ErrUnsortableField = errors.New("field cannot be sorted on")
+
+// pageToken is the position after the last document of a page. Plaintext fields use keyset
+// pagination (the last sort value and _id); deterministic fields fall back to an offset.
+type pageToken struct {
+	Value  interface{} `bson:"v"`
+	ID     interface{} `bson:"id"`
+	Offset int64       `bson:"o,omitempty"`
+}
+
+// PaginateEncrypted returns a page of documents sorted by sortField (ties broken by _id) and the
+// token for the next page, which is empty after the last page. An empty cursorToken starts from
+// the first page. The schema is the CSFLE schema map the client was configured with; it tells
+// how sortField is encrypted, if at all.
+//
+// A plaintext field is paginated with a keyset, which stays correct under concurrent writes.
+// A deterministically encrypted field sorts by its ciphertext: the order is stable but unrelated
+// to the plaintext order. The driver rejects range operators ($gt etc.) on encrypted fields, so
+// such a field is paginated by offset instead. A randomly encrypted field is rejected with
+// ErrUnsortableField.
+func PaginateEncrypted(
+	ctx context.Context,
+	client *mongo.Client,
+	coll CollRef,
+	schema bson.M,
+	sortField string,
+	pageSize int,
+	cursorToken string,
+) ([]bson.M, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("page size must be positive: %d", pageSize)
+	}
+	algorithm, err := fieldAlgorithm(schema, coll, sortField)
+	if err != nil {
+		return nil, "", err
+	}
+	if algorithm == AlgorithmRandom {
+		return nil, "", fmt.Errorf("%w: '%s' is randomly encrypted", ErrUnsortableField, sortField)
+	}
+	keyset := algorithm == ""
+
+	token, err := decodePageToken(cursorToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	filter := bson.M{}
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: sortField, Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(pageSize))
+	if keyset && token.ID != nil {
+		filter = bson.M{"$or": bson.A{
+			bson.M{sortField: bson.M{"$gt": token.Value}},
+			bson.M{sortField: token.Value, "_id": bson.M{"$gt": token.ID}},
+		}}
+	} else if !keyset {
+		findOpts.SetSkip(token.Offset)
+	}
+
+	cursor, err := coll.Collection(client).Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read a page of %s: %w", coll, err)
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, "", fmt.Errorf("failed to decode a page of %s: %w", coll, err)
+	}
+	if len(docs) < pageSize {
+		return docs, "", nil
+	}
+
+	last := docs[len(docs)-1]
+	next := pageToken{Offset: token.Offset + int64(len(docs))}
+	if keyset {
+		next = pageToken{Value: last[sortField], ID: last["_id"]}
+	}
+	nextToken, err := encodePageToken(next)
+	if err != nil {
+		return nil, "", err
+	}
+	return docs, nextToken, nil
+}
+
+// fieldAlgorithm returns the algorithm the field is encrypted with in the collection's schema, or
+// an empty string if it isn't encrypted.
+func fieldAlgorithm(schema bson.M, coll CollRef, field string) (string, error) {
+	collSchema, ok := asMap(schema[coll.String()])
+	if !ok {
+		return "", nil
+	}
+	fields, err := collectEncryptedFields(collSchema, "", "")
+	if err != nil {
+		return "", fmt.Errorf("invalid schema for %s: %w", coll, err)
+	}
+	for _, f := range fields {
+		if f.Path == field {
+			return f.Algorithm, nil
+		}
+	}
+	return "", nil
+}
+
+func encodePageToken(token pageToken) (string, error) {
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the page token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(cursorToken string) (pageToken, error) {
+	var token pageToken
+	if cursorToken == "" {
+		return token, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursorToken)
+	if err != nil {
+		return token, fmt.Errorf("invalid page token: %w", err)
+	}
+	if err := bson.Unmarshal(data, &token); err != nil {
+		return token, fmt.Errorf("invalid page token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPaginateEncryptedRejectsRandomField(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	schemaMap, err := NewSchemaBuilder().
+		AddDeterministic("ssn", "string", keyID).
+		AddRandom("notes", "string", keyID).
+		BuildSchemaMap(coll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected before anything is sent, so the client is never used.
+	_, _, err = PaginateEncrypted(context.Background(), nil, coll, schemaMap, "notes", 10, "")
+	if !errors.Is(err, ErrUnsortableField) {
+		t.Errorf("PaginateEncrypted() by a random field error = %v, want ErrUnsortableField", err)
+	}
+	if _, _, err := PaginateEncrypted(context.Background(), nil, coll, schemaMap, "name", 0, ""); err == nil {
+		t.Error("PaginateEncrypted() with a page size of 0 succeeded, want an error")
+	}
+
+	algorithms := map[string]string{"ssn": AlgorithmDeterministic, "notes": AlgorithmRandom, "name": ""}
+	for field, want := range algorithms {
+		if got, err := fieldAlgorithm(schemaMap, coll, field); err != nil || got != want {
+			t.Errorf("fieldAlgorithm(%s) = %q, %v, want %q", field, got, err, want)
+		}
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	id := primitive.NewObjectID()
+	tests := map[string]pageToken{
+		"keyset": {Value: "Bob", ID: id},
+		"offset": {Offset: 20},
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := encodePageToken(token)
+			if err != nil {
+				t.Fatalf("encodePageToken() error = %v", err)
+			}
+			got, err := decodePageToken(encoded)
+			if err != nil {
+				t.Fatalf("decodePageToken() error = %v", err)
+			}
+			if got.Value != token.Value || got.ID != token.ID || got.Offset != token.Offset {
+				t.Errorf("decodePageToken() = %+v, want %+v", got, token)
+			}
+		})
+	}
+
+	if got, err := decodePageToken(""); err != nil || got != (pageToken{}) {
+		t.Errorf("decodePageToken(\"\") = %+v, %v, want the first page", got, err)
+	}
+	garbage, _ := encodePageToken(pageToken{})
+	for _, token := range []string{"not base64!", garbage[:len(garbage)-2]} {
+		if _, err := decodePageToken(token); err == nil {
+			t.Errorf("decodePageToken(%q) succeeded, want an error", token)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The default number of workers of ScanForUnencryptedFieldsParallel.
+const _defaultScanWorkers = 4
+
+// ScanForUnencryptedFields audits a collection for PII stored in plaintext: it returns the _ids,
+// in _id order, of the documents in which any of encFields (dotted paths) is present but not
+// ciphertext, e.g. written by a client without the schema map. The client must be a regular
+// (non-encrypting) one, which reads the stored values as they are.
+func ScanForUnencryptedFields(
+	ctx context.Context, rawClient *mongo.Client, coll CollRef, encFields []string,
+) ([]interface{}, error) {
+	return scanUnencrypted(ctx, rawClient, coll, encFields, bson.D{})
+}
+
+// ScanForUnencryptedFieldsParallel is ScanForUnencryptedFields for large collections: the
+// collection is split into ranges of _id of about the same size, which up to workers goroutines
+// scan concurrently. The result is the same, in the same order, as a serial scan. When the _ids
+// are not all of the same BSON type, range queries can't cover them all, and the collection is
+// scanned serially.
+func ScanForUnencryptedFieldsParallel(
+	ctx context.Context, rawClient *mongo.Client, coll CollRef, encFields []string, workers int,
+) ([]interface{}, error) {
+	if workers <= 0 {
+		workers = _defaultScanWorkers
+	}
+	ranges, ok, err := idRanges(ctx, rawClient, coll, workers)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return ScanForUnencryptedFields(ctx, rawClient, coll, encFields)
+	}
+
+	results := make([][]interface{}, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, idRange := range ranges {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = scanUnencrypted(ctx, rawClient, coll, encFields, idRange)
+		}()
+	}
+	wg.Wait()
+
+	// The ranges are in _id order, so concatenating them keeps the order of a serial scan.
+	var offenders []interface{}
+	for i := range ranges {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		offenders = append(offenders, results[i]...)
+	}
+	return offenders, nil
+}
+
+// idRanges splits the collection into at most n filters on consecutive ranges of _id, with
+// $bucketAuto. It reports false if the _ids are of more than one BSON type.
+func idRanges(ctx context.Context, client *mongo.Client, coll CollRef, n int) ([]bson.D, bool, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$bucketAuto", Value: bson.D{{Key: "groupBy", Value: "$_id"}, {Key: "buckets", Value: n}}}},
+	}
+	cursor, err := coll.Collection(client).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to partition %s by _id: %w", coll, err)
+	}
+	var buckets []idBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, false, fmt.Errorf("failed to partition %s by _id: %w", coll, err)
+	}
+	ranges, ok := bucketRanges(buckets)
+	return ranges, ok, nil
+}
+
+// idBucket is a bucket of _ids returned by $bucketAuto.
+type idBucket struct {
+	ID struct {
+		Min bson.RawValue `bson:"min"`
+		Max bson.RawValue `bson:"max"`
+	} `bson:"_id"`
+}
+
+// bucketRanges returns the filters on the _id ranges of the buckets, in order. It reports false if
+// the _ids are of more than one BSON type.
+func bucketRanges(buckets []idBucket) ([]bson.D, bool) {
+	if len(buckets) == 0 {
+		return nil, true
+	}
+	idType := buckets[0].ID.Min.Type
+	ranges := make([]bson.D, 0, len(buckets))
+	for i, bucket := range buckets {
+		if bucket.ID.Min.Type != idType || bucket.ID.Max.Type != idType {
+			return nil, false
+		}
+		// Each bucket includes its min and excludes its max, except for the last one.
+		upper := "$lt"
+		if i == len(buckets)-1 {
+			upper = "$lte"
+		}
+		ranges = append(ranges, bson.D{{Key: "_id", Value: bson.D{
+			{Key: "$gte", Value: bucket.ID.Min},
+			{Key: upper, Value: bucket.ID.Max},
+		}}})
+	}
+	return ranges, true
+}
+
+// scanUnencrypted returns, in _id order, the _ids of the documents matching the filter in which
+// any of encFields is present but not ciphertext.
+func scanUnencrypted(
+	ctx context.Context, client *mongo.Client, coll CollRef, encFields []string, filter bson.D,
+) ([]interface{}, error) {
+	if len(encFields) == 0 {
+		return nil, fmt.Errorf("no encrypted fields to scan %s for", coll)
+	}
+	// The server returns the documents that have any of the fields, and whether each value is
+	// ciphertext is checked here, as a query can't match on the binary subtype.
+	candidates := bson.A{}
+	projection := bson.D{{Key: "_id", Value: 1}}
+	for _, field := range encFields {
+		candidates = append(candidates, bson.D{{Key: field, Value: bson.D{{Key: "$exists", Value: true}}}})
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	filter = append(filter, bson.E{Key: "$or", Value: candidates})
+	opts := options.Find().SetProjection(projection).SetSort(bson.D{{Key: "_id", Value: 1}})
+
+	cursor, err := coll.Collection(client).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	defer cursor.Close(ctx)
+	return unencryptedOffenders(ctx, cursor, coll, encFields)
+}
+
+// unencryptedOffenders returns the _ids of the documents of the cursor in which any of encFields
+// is present but not ciphertext.
+func unencryptedOffenders(
+	ctx context.Context, cursor *mongo.Cursor, coll CollRef, encFields []string,
+) ([]interface{}, error) {
+	var offenders []interface{}
+	for cursor.Next(ctx) {
+		for _, field := range encFields {
+			value, err := cursor.Current.LookupErr(strings.Split(field, ".")...)
+			if err != nil {
+				continue
+			}
+			var decoded interface{}
+			if err := value.Unmarshal(&decoded); err != nil {
+				return nil, fmt.Errorf("failed to decode '%s' in %s: %w", field, coll, err)
+			}
+			if _, ok := asCiphertext(decoded); !ok {
+				var id interface{}
+				if err := cursor.Current.Lookup("_id").Unmarshal(&id); err != nil {
+					return nil, fmt.Errorf("failed to decode an _id in %s: %w", coll, err)
+				}
+				offenders = append(offenders, id)
+				break
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", coll, err)
+	}
+	return offenders, nil
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestParallelScanMatchesSerial scans a seeded collection serially, and then range by range as
+// the parallel scan partitions it, and expects the same offenders in the same order.
+func TestParallelScanMatchesSerial(t *testing.T) {
+	ctx := context.Background()
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	encFields := []string{"ssn", "profile.email"}
+	ciphertext := testCiphertext(primitive.Binary{Subtype: 4, Data: make([]byte, 16)})
+	var docs []bson.M
+	for id := int32(1); id <= 10; id++ {
+		doc := bson.M{"_id": id, "ssn": ciphertext}
+		switch id % 4 {
+		case 0:
+			doc["ssn"] = "987-65-4320"
+		case 1:
+			doc["profile"] = bson.M{"email": "a@b.c"}
+		case 2:
+			delete(doc, "ssn")
+		}
+		docs = append(docs, doc)
+	}
+
+	serial, err := unencryptedOffenders(ctx, keyCursor(t, docs...), coll, encFields)
+	if err != nil {
+		t.Fatalf("unencryptedOffenders() error = %v", err)
+	}
+	want := []interface{}{int32(1), int32(4), int32(5), int32(8), int32(9)}
+	if !reflect.DeepEqual(serial, want) {
+		t.Fatalf("serial scan = %v, want %v", serial, want)
+	}
+
+	// The buckets $bucketAuto returns for 3 buckets.
+	var buckets []idBucket
+	err = keyCursor(t,
+		bson.M{"_id": bson.M{"min": int32(1), "max": int32(4)}},
+		bson.M{"_id": bson.M{"min": int32(4), "max": int32(8)}},
+		bson.M{"_id": bson.M{"min": int32(8), "max": int32(10)}},
+	).All(ctx, &buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, ok := bucketRanges(buckets)
+	if !ok || len(ranges) != 3 {
+		t.Fatalf("bucketRanges() = %v, %t, want 3 ranges", ranges, ok)
+	}
+	var parallel []interface{}
+	for _, idRange := range ranges {
+		var inRange []bson.M
+		for _, doc := range docs {
+			if matchesIDRange(t, idRange, doc["_id"].(int32)) {
+				inRange = append(inRange, doc)
+			}
+		}
+		offenders, err := unencryptedOffenders(ctx, keyCursor(t, inRange...), coll, encFields)
+		if err != nil {
+			t.Fatalf("unencryptedOffenders() error = %v", err)
+		}
+		parallel = append(parallel, offenders...)
+	}
+	if !reflect.DeepEqual(parallel, serial) {
+		t.Errorf("parallel scan = %v, want the serial scan %v", parallel, serial)
+	}
+}
+
+// matchesIDRange evaluates a filter of bucketRanges on an int32 _id.
+func matchesIDRange(t *testing.T, idRange bson.D, id int32) bool {
+	t.Helper()
+	for _, bound := range idRange[0].Value.(bson.D) {
+		limit := bound.Value.(bson.RawValue).Int32()
+		switch bound.Key {
+		case "$gte":
+			if id < limit {
+				return false
+			}
+		case "$lt":
+			if id >= limit {
+				return false
+			}
+		case "$lte":
+			if id > limit {
+				return false
+			}
+		default:
+			t.Fatalf("unexpected operator %s", bound.Key)
+		}
+	}
+	return true
+}
+
+func TestBucketRangesMixedIDTypes(t *testing.T) {
+	var buckets []idBucket
+	err := keyCursor(t,
+		bson.M{"_id": bson.M{"min": int32(1), "max": int32(4)}},
+		bson.M{"_id": bson.M{"min": int32(4), "max": "user-1"}},
+	).All(context.Background(), &buckets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranges, ok := bucketRanges(buckets); ok {
+		t.Errorf("bucketRanges() of mixed _id types = %v, want a serial scan", ranges)
+	}
+	if ranges, ok := bucketRanges(nil); !ok || ranges != nil {
+		t.Errorf("bucketRanges() of an empty collection = %v, %t, want no ranges", ranges, ok)
+	}
+}
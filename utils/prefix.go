@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Prefix search on an encrypted string field.
+//
+// The full value stays randomly encrypted; alongside it we store a normalized prefix of the value
+// (e.g. the first 3 characters of a name, lowercased) in a separate, deterministically encrypted
+// field, and look documents up by the prefix with an equality query.
+//
+// Security implications: the deterministic prefix field reveals which documents share a prefix,
+// and short prefixes have few possible values, so their frequencies are open to frequency analysis
+// (e.g. common name prefixes stand out). The shorter the prefix, the more it leaks and the less it
+// narrows a search. Only use this for fields where that leak is acceptable.
+
+// PrefixFieldName returns the name of the field holding the searchable prefix of the field.
+func PrefixFieldName(field string) string {
+	return field + "_prefix"
+}
+
+// DerivePrefix returns the normalized (trimmed and lowercased) first n characters of the value.
+// Values shorter than n characters are used as a whole.
+func DerivePrefix(value string, n int) string {
+	normalized := strings.ToLower(strings.TrimSpace(value))
+	if utf8.RuneCountInString(normalized) <= n {
+		return normalized
+	}
+	return string([]rune(normalized)[:n])
+}
+
+// AddSearchPrefix declares the deterministically encrypted prefix field of a randomly encrypted
+// string field, so the prefix can be searched with PrefixSearch.
+func (b *SchemaBuilder) AddSearchPrefix(path string, keyID primitive.Binary) *SchemaBuilder {
+	return b.AddDeterministic(PrefixFieldName(path), "string", keyID)
+}
+
+// WithSearchPrefix sets the prefix field of the document's string field, before the document is
+// inserted through an encrypting client.
+func WithSearchPrefix(doc bson.M, field string, n int) (bson.M, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("prefix length must be positive: %d", n)
+	}
+	value, ok := doc[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("field '%s' is not a string", field)
+	}
+	doc[PrefixFieldName(field)] = DerivePrefix(value, n)
+	return doc, nil
+}
+
+// PrefixSearch returns the documents whose field starts with the query (case-insensitively),
+// through an encrypting client. The server matches on the first n characters of the query; any
+// characters beyond those are matched against the decrypted values. The query must have at least
+// n characters.
+func PrefixSearch(
+	ctx context.Context, client *mongo.Client, coll CollRef, field, query string, n int,
+) ([]bson.M, error) {
+	if utf8.RuneCountInString(strings.TrimSpace(query)) < n {
+		return nil, fmt.Errorf("prefix search on '%s' needs at least %d characters", field, n)
+	}
+	filter := bson.M{PrefixFieldName(field): DerivePrefix(query, n)}
+	cursor, err := coll.Collection(client).Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("prefix search on %s failed: %w", coll, err)
+	}
+	var candidates []bson.M
+	if err := cursor.All(ctx, &candidates); err != nil {
+		return nil, fmt.Errorf("failed to decode the prefix search results: %w", err)
+	}
+	return matchPrefix(candidates, field, query), nil
+}
+
+// matchPrefix returns the decrypted documents whose field starts with the whole query.
+func matchPrefix(candidates []bson.M, field, query string) []bson.M {
+	normalizedQuery := strings.ToLower(strings.TrimSpace(query))
+	var docs []bson.M
+	for _, doc := range candidates {
+		value, _ := doc[field].(string)
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), normalizedQuery) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestDerivePrefix(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "Robert", want: "rob"},
+		{value: "  ROBIN ", want: "rob"},
+		{value: "Al", want: "al"},
+		{value: "Émile", want: "émi"},
+	}
+	for _, tt := range tests {
+		if got := DerivePrefix(tt.value, 3); got != tt.want {
+			t.Errorf("DerivePrefix(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestSearchPrefix stores the prefix of "Robert" and checks that a search for "Rob" looks it up by
+// the same (deterministically encrypted) prefix value, and that a longer query narrows the match.
+func TestSearchPrefix(t *testing.T) {
+	doc, err := WithSearchPrefix(bson.M{"name": "Robert"}, "name", 3)
+	if err != nil {
+		t.Fatalf("WithSearchPrefix() error = %v", err)
+	}
+	if doc["name_prefix"] != "rob" || doc["name_prefix"] != DerivePrefix("Rob", 3) {
+		t.Errorf("name_prefix = %v, want the prefix a search for Rob looks up", doc["name_prefix"])
+	}
+	if _, err := WithSearchPrefix(bson.M{"name": 42}, "name", 3); err == nil {
+		t.Error("WithSearchPrefix() of a non-string field succeeded, want an error")
+	}
+
+	// What the server returns for the prefix rob, decrypted.
+	robert, robin := bson.M{"name": "Robert"}, bson.M{"name": "Robin"}
+	candidates := []bson.M{robert, robin}
+	if got := matchPrefix(candidates, "name", "Rob"); !reflect.DeepEqual(got, candidates) {
+		t.Errorf("matchPrefix(Rob) = %v, want %v", got, candidates)
+	}
+	if got := matchPrefix(candidates, "name", "robe"); !reflect.DeepEqual(got, []bson.M{robert}) {
+		t.Errorf("matchPrefix(robe) = %v, want %v", got, robert)
+	}
+
+	if _, err := PrefixSearch(context.Background(), nil, CollRef{}, "name", "Ro", 3); err == nil {
+		t.Error("PrefixSearch() with a query shorter than the prefix succeeded, want an error")
+	}
+}
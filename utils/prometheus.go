@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusMetrics is a Metrics that keeps the measurements in memory and serves them in the
+// Prometheus text exposition format. Each counter is exported as <namespace>_<name>_total, and each
+// observed operation as a <namespace>_<name>_seconds summary with only its _sum and _count, which
+// is enough for rates and average durations without pulling in the Prometheus client library.
+type PrometheusMetrics struct {
+	namespace string
+
+	mu           sync.Mutex
+	counters     map[string]int64
+	observations map[string]*observation
+}
+
+type observation struct {
+	count int64
+	sum   time.Duration
+}
+
+// The characters Prometheus doesn't allow in a metric name.
+var _invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics whose metric names are prefixed with
+// namespace, e.g. "mongodb_enc".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:    namespace,
+		counters:     map[string]int64{},
+		observations: map[string]*observation{},
+	}
+}
+
+func (m *PrometheusMetrics) Count(name string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += n
+}
+
+func (m *PrometheusMetrics) Observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.observations[name]
+	if !ok {
+		o = &observation{}
+		m.observations[name] = o
+	}
+	o.count++
+	o.sum += d
+}
+
+// ServeHTTP writes the current measurements, sorted by name.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	m.mu.Lock()
+	for _, name := range sortedKeys(m.counters) {
+		metric := m.metricName(name) + "_total"
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s %d\n", metric, metric, m.counters[name])
+	}
+	for _, name := range sortedKeys(m.observations) {
+		o := m.observations[name]
+		metric := m.metricName(name) + "_seconds"
+		fmt.Fprintf(&b, "# TYPE %s summary\n", metric)
+		fmt.Fprintf(&b, "%s_sum %s\n", metric, strconv.FormatFloat(o.sum.Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count %d\n", metric, o.count)
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func (m *PrometheusMetrics) metricName(name string) string {
+	name = _invalidMetricNameChars.ReplaceAllString(name, "_")
+	if m.namespace == "" {
+		return name
+	}
+	return m.namespace + "_" + name
+}
+
+// ServeMetrics starts an HTTP server that exposes the metrics on /metrics at addr (e.g. ":9090")
+// for Prometheus to scrape. The address is bound before it returns, so a port that is taken fails
+// here rather than in the background. Stop the server with Shutdown or Close.
+func ServeMetrics(addr string, metrics *PrometheusMetrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on '%s': %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("metrics server on '%s' failed: %v", addr, err)
+		}
+	}()
+	return server, nil
+}
+
+// StartMetrics starts a metrics server on addr, as ServeMetrics does, and returns ctx carrying its
+// metrics (prefixed with namespace) in its EncryptionContext, so the helpers called with it report
+// to the server. The returned shutdown stops the server, letting a scrape in progress finish.
+// Without addr, nothing is started, ctx is returned as is, and shutdown does nothing.
+func StartMetrics(ctx context.Context, addr, namespace string) (context.Context, func(), error) {
+	if addr == "" {
+		return ctx, func() {}, nil
+	}
+	metrics := NewPrometheusMetrics(namespace)
+	server, err := ServeMetrics(addr, metrics)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ec, _ := ctx.Value(encryptionContextKey{}).(EncryptionContext)
+	ec.Metrics = metrics
+	shutdown := func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), _defaultCloseTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			_ = server.Close()
+		}
+	}
+	return WithEncryptionContext(ctx, ec), shutdown, nil
+}
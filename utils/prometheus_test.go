@@ -0,0 +1,126 @@
+package utils_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to scrape %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("scraping %s returned %s", url, resp.Status)
+	}
+	return string(body)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := utils.NewPrometheusMetrics("mongodb_enc")
+	metrics.Count("encrypted_insert_errors", 2)
+	metrics.Count("encrypted_insert_errors", 1)
+	metrics.Observe("encrypted_insert", 250*time.Millisecond)
+	metrics.Observe("encrypted_insert", 750*time.Millisecond)
+	metrics.Count("dek-cache.hits", 1)
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	want := strings.Join([]string{
+		"# TYPE mongodb_enc_dek_cache_hits_total counter",
+		"mongodb_enc_dek_cache_hits_total 1",
+		"# TYPE mongodb_enc_encrypted_insert_errors_total counter",
+		"mongodb_enc_encrypted_insert_errors_total 3",
+		"# TYPE mongodb_enc_encrypted_insert_seconds summary",
+		"mongodb_enc_encrypted_insert_seconds_sum 1",
+		"mongodb_enc_encrypted_insert_seconds_count 2",
+	}, "\n") + "\n"
+	if got := scrape(t, server.URL); got != want {
+		t.Errorf("scraped metrics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestStartMetrics scrapes the metrics server after an encrypt and read cycle through the context
+// it returned, and checks the server is gone once shut down.
+func TestStartMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, shutdown, err := utils.StartMetrics(context.Background(), addr, "mongodb_enc")
+	if err != nil {
+		t.Fatalf("StartMetrics() error = %v", err)
+	}
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	doc := bson.D{
+		{Key: "name", Value: "Alice"}, {Key: "ssn", Value: "987-65-4320"}, {Key: "email", Value: "a@b.c"},
+	}
+	encrypted, err := utils.EncryptFields(ctx, fake, doc, []string{"ssn", "email"}, keyID,
+		utils.AlgorithmDeterministic, 0)
+	if err != nil {
+		t.Fatalf("EncryptFields() error = %v", err)
+	}
+	decryptor := utils.NewDecryptor(fake)
+	for _, field := range encrypted[1:] {
+		if _, err := decryptor.Decrypt(ctx, field.Value.(primitive.Binary)); err != nil {
+			t.Fatalf("Decrypt(%s) error = %v", field.Key, err)
+		}
+	}
+	unknownKey := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	if _, err := utils.NewExplicitCrypto(fake).Encrypt(ctx, "x", unknownKey, utils.AlgorithmRandom); err == nil {
+		t.Fatal("Encrypt() with an unknown DEK succeeded, want an error")
+	}
+
+	got := scrape(t, "http://"+addr+"/metrics")
+	for _, want := range []string{
+		"mongodb_enc_encryptions_total 2",
+		"mongodb_enc_encrypt_errors_total 1",
+		"mongodb_enc_decryptions_total 2",
+		"mongodb_enc_decrypt_seconds_count 2",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("scraped metrics:\n%s\nwant them to contain %q", got, want)
+		}
+	}
+
+	// The address is taken now.
+	if _, _, err := utils.StartMetrics(context.Background(), addr, "mongodb_enc"); err == nil {
+		t.Error("StartMetrics() on a taken address succeeded, want an error")
+	}
+
+	shutdown()
+	if resp, err := http.Get("http://" + addr + "/metrics"); err == nil {
+		resp.Body.Close()
+		t.Error("the metrics server still serves after shutdown")
+	}
+}
+
+func TestStartMetricsWithoutAddr(t *testing.T) {
+	ctx := context.Background()
+	got, shutdown, err := utils.StartMetrics(ctx, "", "mongodb_enc")
+	if err != nil || got != ctx {
+		t.Fatalf("StartMetrics() = %v, %v, want the context as is", got, err)
+	}
+	shutdown()
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Local KMS provider names are local:<name>, where the name may only contain letters, digits and
+// underscores. The environment is a prefix of the name, separated from the org id by an
+// underscore, so it must not contain one itself.
+var _environmentPattern = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// The names the driver accepts after the <backend>: prefix of a named KMS provider.
+var _providerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// GetProviderNameWithEnv returns the provider name of a Dev org qualified with an environment
+// (e.g. local:prod_100). Two environments sharing a key vault namespace would otherwise derive the
+// same provider name, and so the same DEK alt name, for the same org, and reuse each other's DEKs.
+func GetProviderNameWithEnv(devOrgDON, env string) (string, error) {
+	if !_environmentPattern.MatchString(env) {
+		return "", fmt.Errorf("invalid environment '%s': only letters and digits are allowed", env)
+	}
+	providerName, err := GetProviderName(devOrgDON)
+	if err != nil {
+		return "", err
+	}
+	orgID := strings.TrimPrefix(providerName, "local:")
+	return fmt.Sprintf("local:%s_%s", env, orgID), nil
+}
+
+// ValidateProviderUnique checks that no other environment (or an unqualified provider name) in
+// the key vault has a DEK for the same org as the given environment-qualified provider name.
+func ValidateProviderUnique(ctx context.Context, keyVaultNamespace, providerName string) error {
+	if _, _, ok := splitEnvProviderName(providerName); !ok {
+		return fmt.Errorf("provider name '%s' is not qualified with an environment", providerName)
+	}
+	providers, err := ListProviders(ctx, keyVaultNamespace)
+	if err != nil {
+		return err
+	}
+	return checkProviderUnique(keyVaultNamespace, providerName, providers)
+}
+
+// checkProviderUnique checks that none of the providers of the key vault is another environment's
+// (or the unqualified) provider name of the same org as the environment-qualified providerName.
+func checkProviderUnique(keyVaultNamespace, providerName string, providers []string) error {
+	env, orgID, ok := splitEnvProviderName(providerName)
+	if !ok {
+		return fmt.Errorf("provider name '%s' is not qualified with an environment", providerName)
+	}
+	for _, other := range providers {
+		if other == providerName {
+			continue
+		}
+		otherEnv, otherOrgID, qualified := splitEnvProviderName(other)
+		if !qualified {
+			otherEnv, otherOrgID = "unqualified", strings.TrimPrefix(other, "local:")
+		}
+		if otherOrgID == orgID {
+			return fmt.Errorf(
+				"org '%s' of environment '%s' also has a DEK under provider '%s' (environment '%s') "+
+					"in the key vault %s", orgID, env, other, otherEnv, keyVaultNamespace,
+			)
+		}
+	}
+	return nil
+}
+
+// ParseProviderName recovers the KMS backend and org id from a provider name built by
+// GetProviderName, e.g. for logging and audit: local:100 gives backend local and org 100. The org
+// id is the whole name after the backend, underscores included, so local:prod_100 gives org
+// prod_100; use ParseProviderNameWithEnv for the names of GetProviderNameWithEnv.
+func ParseProviderName(providerName string) (backend, orgID string, err error) {
+	backend, name, ok := strings.Cut(providerName, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid provider name '%s': expected <backend>:<org>", providerName)
+	}
+	if _, ok := providerSpec(backend); !ok {
+		return "", "", fmt.Errorf("invalid provider name '%s': unknown KMS backend '%s'", providerName, backend)
+	}
+	if !_providerNamePattern.MatchString(name) {
+		return "", "", fmt.Errorf(
+			"invalid provider name '%s': the name may only contain letters, digits and underscores", providerName,
+		)
+	}
+	if strings.HasPrefix(name, "_") {
+		return "", "", fmt.Errorf("invalid provider name '%s': the name may not start with an underscore",
+			providerName)
+	}
+	return backend, name, nil
+}
+
+// ParseProviderNameWithEnv recovers the KMS backend, environment and org id from a provider name
+// built by GetProviderNameWithEnv: local:prod_100 gives backend local, environment prod and org
+// 100. Environments never contain an underscore, so the name is split at its first one and the
+// org id keeps any others, e.g. local:prod_my_org gives org my_org.
+func ParseProviderNameWithEnv(providerName string) (backend, env, orgID string, err error) {
+	backend, name, err := ParseProviderName(providerName)
+	if err != nil {
+		return "", "", "", err
+	}
+	env, orgID, ok := strings.Cut(name, "_")
+	if !ok || orgID == "" {
+		return "", "", "", fmt.Errorf(
+			"invalid provider name '%s': expected <backend>:<environment>_<org>", providerName,
+		)
+	}
+	return backend, env, orgID, nil
+}
+
+// splitEnvProviderName splits a provider name built by GetProviderNameWithEnv into the environment
+// and org id.
+func splitEnvProviderName(providerName string) (string, string, bool) {
+	name, ok := strings.CutPrefix(providerName, "local:")
+	if !ok {
+		return "", "", false
+	}
+	env, orgID, ok := strings.Cut(name, "_")
+	if !ok || env == "" || orgID == "" {
+		return "", "", false
+	}
+	return env, orgID, true
+}
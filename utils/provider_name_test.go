@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseProviderNameRoundTrip checks that ParseProviderName and ParseProviderNameWithEnv
+// recover the org id of every name GetProviderName and GetProviderNameWithEnv build, including an
+// org id with underscores.
+func TestParseProviderNameRoundTrip(t *testing.T) {
+	for _, orgID := range []string{"100", "0abc", "ORG42", "my_org", "org_"} {
+		don := "don:identity:dvrv-us-1:devo/" + orgID
+		plain, err := GetProviderName(don)
+		if err != nil {
+			t.Fatalf("GetProviderName(%s) error = %v", don, err)
+		}
+		if backend, got, err := ParseProviderName(plain); err != nil || backend != "local" || got != orgID {
+			t.Errorf("ParseProviderName(%s) = %s, %s, %v, want local, %s", plain, backend, got, err, orgID)
+		}
+
+		qualified, err := GetProviderNameWithEnv(don, "prod")
+		if err != nil {
+			t.Fatalf("GetProviderNameWithEnv(%s) error = %v", don, err)
+		}
+		backend, env, got, err := ParseProviderNameWithEnv(qualified)
+		if err != nil || backend != "local" || env != "prod" || got != orgID {
+			t.Errorf("ParseProviderNameWithEnv(%s) = %s, %s, %s, %v, want local, prod, %s",
+				qualified, backend, env, got, err, orgID)
+		}
+	}
+}
+
+func TestParseProviderName(t *testing.T) {
+	tests := []struct {
+		providerName string
+		wantBackend  string
+		wantOrgID    string
+		wantErr      bool
+	}{
+		{providerName: "local:100", wantBackend: "local", wantOrgID: "100"},
+		{providerName: "local:org_100", wantBackend: "local", wantOrgID: "org_100"},
+		{providerName: "local:prod_100", wantBackend: "local", wantOrgID: "prod_100"},
+		{providerName: "gcp:100", wantBackend: "gcp", wantOrgID: "100"},
+		{providerName: "aws:100", wantBackend: "aws", wantOrgID: "100"},
+		{providerName: "local", wantErr: true},
+		{providerName: "local:", wantErr: true},
+		{providerName: ":100", wantErr: true},
+		{providerName: "vault:100", wantErr: true},
+		{providerName: "local:org-100", wantErr: true},
+		{providerName: "local:_100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.providerName, func(t *testing.T) {
+			backend, orgID, err := ParseProviderName(tt.providerName)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseProviderName() = %s, %s, want an error", backend, orgID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseProviderName() error = %v", err)
+			}
+			if backend != tt.wantBackend || orgID != tt.wantOrgID {
+				t.Errorf("ParseProviderName() = %s, %s, want %s, %s", backend, orgID, tt.wantBackend, tt.wantOrgID)
+			}
+		})
+	}
+}
+
+func TestParseProviderNameWithEnv(t *testing.T) {
+	tests := []struct {
+		providerName string
+		wantBackend  string
+		wantEnv      string
+		wantOrgID    string
+		wantErr      bool
+	}{
+		{providerName: "local:prod_100", wantBackend: "local", wantEnv: "prod", wantOrgID: "100"},
+		{providerName: "local:prod_my_org", wantBackend: "local", wantEnv: "prod", wantOrgID: "my_org"},
+		{providerName: "azure:staging_100", wantBackend: "azure", wantEnv: "staging", wantOrgID: "100"},
+		{providerName: "local:100", wantErr: true},
+		{providerName: "local:prod_", wantErr: true},
+		{providerName: "local:_100", wantErr: true},
+		{providerName: "vault:prod_100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.providerName, func(t *testing.T) {
+			backend, env, orgID, err := ParseProviderNameWithEnv(tt.providerName)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseProviderNameWithEnv() = %s, %s, %s, want an error", backend, env, orgID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseProviderNameWithEnv() error = %v", err)
+			}
+			if backend != tt.wantBackend || env != tt.wantEnv || orgID != tt.wantOrgID {
+				t.Errorf("ParseProviderNameWithEnv() = %s, %s, %s, want %s, %s, %s",
+					backend, env, orgID, tt.wantBackend, tt.wantEnv, tt.wantOrgID)
+			}
+		})
+	}
+}
+
+func TestGetProviderNameWithEnv(t *testing.T) {
+	don := "don:identity:dvrv-us-1:devo/100"
+	prod, err := GetProviderNameWithEnv(don, "prod")
+	if err != nil {
+		t.Fatalf("GetProviderNameWithEnv(prod) error = %v", err)
+	}
+	staging, err := GetProviderNameWithEnv(don, "staging")
+	if err != nil {
+		t.Fatalf("GetProviderNameWithEnv(staging) error = %v", err)
+	}
+	if prod != "local:prod_100" || staging != "local:staging_100" {
+		t.Errorf("GetProviderNameWithEnv() = %s, %s, want local:prod_100, local:staging_100", prod, staging)
+	}
+	if dekAltName(prod) == dekAltName(staging) {
+		t.Errorf("both environments use the DEK alt name %s", dekAltName(prod))
+	}
+	for _, env := range []string{"", "prod_eu", "prod-eu"} {
+		if _, err := GetProviderNameWithEnv(don, env); err == nil {
+			t.Errorf("GetProviderNameWithEnv(%q) succeeded, want an error", env)
+		}
+	}
+}
+
+func TestCheckProviderUnique(t *testing.T) {
+	const ns = "csfle_keyvault.datakeys"
+	tests := []struct {
+		name      string
+		providers []string
+		wantErr   string
+	}{
+		{name: "alone", providers: []string{"local:prod_100"}},
+		{name: "other orgs", providers: []string{"local:prod_100", "local:staging_200", "local:300"}},
+		{name: "other environment", providers: []string{"local:prod_100", "local:staging_100"},
+			wantErr: "also has a DEK under provider 'local:staging_100' (environment 'staging')"},
+		{name: "unqualified", providers: []string{"local:100"},
+			wantErr: "also has a DEK under provider 'local:100' (environment 'unqualified')"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkProviderUnique(ns, "local:prod_100", tt.providers)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkProviderUnique() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkProviderUnique() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if err := checkProviderUnique(ns, "local:100", nil); err == nil {
+		t.Error("checkProviderUnique() of an unqualified provider name succeeded, want an error")
+	}
+}
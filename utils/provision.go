@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CollectionSpec describes a QE collection to create for a tenant.
+type CollectionSpec struct {
+	Name string
+	// The encryptedFields document, e.g. built with EncryptedFieldsBuilder. Each field with a nil
+	// (or no) keyId is given a new DEK of the tenant.
+	EncryptedFields bson.M
+}
+
+// ProvisionTenant creates all the QE collections of a new tenant in db. The DEKs of every
+// collection are created first, in a single pass on one ClientEncryption in the configured key
+// vault namespace, and the collections are then created concurrently. If anything fails, the
+// collections created so far (with their QE state collections) and the DEKs created for them are
+// removed again, so provisioning can simply be retried.
+func ProvisionTenant(ctx context.Context, db *mongo.Database, providerName string, specs []CollectionSpec) error {
+	if len(specs) == 0 {
+		return fmt.Errorf("no collections to provision for '%s'", providerName)
+	}
+	names := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		if _, ok := names[spec.Name]; ok || spec.Name == "" {
+			return fmt.Errorf("collection name '%s' is empty or given more than once", spec.Name)
+		}
+		names[spec.Name] = struct{}{}
+	}
+	keyVaultNamespace := _config.KeyVaultNamespace
+	if keyVaultNamespace == "" {
+		return fmt.Errorf("no key vault namespace configured to provision '%s'", providerName)
+	}
+
+	localMasterKey, err := LoadOrCreateMasterKey(providerName)
+	if err != nil {
+		return fmt.Errorf("failed to load or create master key: %w", err)
+	}
+	kmsProviders := map[string]map[string]interface{}{
+		providerName: {"key": localMasterKey},
+	}
+	clientEncOpts, err := _config.clientEncryptionOptions(keyVaultNamespace, kmsProviders)
+	if err != nil {
+		return err
+	}
+	clientEnc, err := mongo.NewClientEncryption(db.Client(), clientEncOpts)
+	if err != nil {
+		return fmt.Errorf("failed to create client encryption: %w", err)
+	}
+	var res Resources
+	defer res.Close(ctx)
+	res.AddClientEncryption(clientEnc)
+	keyVault, err := keyVaultCollection(db.Client(), keyVaultNamespace)
+	if err != nil {
+		return err
+	}
+
+	create := func(ctx context.Context, name string, encryptedFields bson.M) error {
+		return db.CreateCollection(ctx, name, options.CreateCollection().SetEncryptedFields(encryptedFields))
+	}
+	drop := func(ctx context.Context, name string) error {
+		return dropQECollection(ctx, db, name)
+	}
+	return provisionCollections(ctx, NewDekStore(clientEnc, keyVault), providerName, specs, create, drop)
+}
+
+// provisionCollections creates the DEKs of the collections of the specs in store, then the
+// collections concurrently with create, and on failure drops the created collections with drop
+// and deletes the created DEKs.
+func provisionCollections(
+	ctx context.Context, store DekStore, providerName string, specs []CollectionSpec,
+	create func(ctx context.Context, name string, encryptedFields bson.M) error,
+	drop func(ctx context.Context, name string) error,
+) error {
+	var (
+		mu          sync.Mutex
+		createdKeys []primitive.Binary
+		created     []string
+	)
+	rollback := func(cause error) error {
+		// Clean up even if ctx is what failed.
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), _defaultCloseTimeout)
+		defer cancel()
+		errs := []error{cause}
+		for _, name := range created {
+			if err := drop(rollbackCtx, name); err != nil {
+				errs = append(errs, fmt.Errorf("rollback: %w", err))
+			}
+		}
+		for _, keyID := range createdKeys {
+			if _, err := store.DeleteKey(rollbackCtx, keyID); err != nil {
+				errs = append(errs, fmt.Errorf("rollback: failed to delete DEK %x: %w", keyID.Data, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	encryptedFields := make([]bson.M, len(specs))
+	for i, spec := range specs {
+		fields, keys, err := resolveFieldKeys(ctx, store, providerName, spec)
+		createdKeys = append(createdKeys, keys...)
+		if err != nil {
+			return rollback(err)
+		}
+		encryptedFields[i] = fields
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for i, spec := range specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := create(ctx, spec.Name, encryptedFields[i])
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to create collection '%s': %w", spec.Name, err))
+				return
+			}
+			created = append(created, spec.Name)
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return rollback(errors.Join(errs...))
+	}
+	return nil
+}
+
+// resolveFieldKeys returns a copy of the encryptedFields of the spec in which every field has a
+// keyId, creating a DEK for each field that didn't, and the DEKs it created.
+func resolveFieldKeys(
+	ctx context.Context, kv KeyVault, providerName string, spec CollectionSpec,
+) (bson.M, []primitive.Binary, error) {
+	// Copy the document, so the caller's spec keeps its nil keyIds.
+	data, err := bson.Marshal(spec.EncryptedFields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid encryptedFields for '%s': %w", spec.Name, err)
+	}
+	var encryptedFields bson.M
+	if err := bson.Unmarshal(data, &encryptedFields); err != nil {
+		return nil, nil, fmt.Errorf("invalid encryptedFields for '%s': %w", spec.Name, err)
+	}
+	fields, ok := encryptedFields["fields"].(bson.A)
+	if !ok || len(fields) == 0 {
+		return nil, nil, fmt.Errorf("encryptedFields for '%s' declare no fields", spec.Name)
+	}
+
+	var created []primitive.Binary
+	for _, f := range fields {
+		field, ok := asMap(f)
+		if !ok {
+			return nil, created, fmt.Errorf("invalid field in the encryptedFields for '%s'", spec.Name)
+		}
+		if field["keyId"] != nil {
+			continue
+		}
+		keyID, err := kv.CreateDataKey(ctx, providerName, options.DataKey())
+		if err != nil {
+			return nil, created, fmt.Errorf("failed to create DEK for '%s.%v': %w", spec.Name, field["path"], err)
+		}
+		created = append(created, keyID)
+		field["keyId"] = keyID
+	}
+	return encryptedFields, created, nil
+}
+
+// dropQECollection drops a QE collection along with its state collections, which a client
+// without the collection in its encryptedFieldsMap would leave behind.
+func dropQECollection(ctx context.Context, db *mongo.Database, name string) error {
+	state := "enxcol_." + name
+	for _, coll := range []string{name, state + ".esc", state + ".ecoc", state + ".ecc"} {
+		if err := db.Collection(coll).Drop(ctx); err != nil {
+			return fmt.Errorf("failed to drop collection '%s': %w", coll, err)
+		}
+	}
+	return nil
+}
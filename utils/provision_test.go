@@ -0,0 +1,120 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeDatabase records the collections provisionCollections creates and drops; creating one of
+// failing fails.
+type fakeDatabase struct {
+	mu      sync.Mutex
+	failing string
+	created map[string]bson.M
+	dropped []string
+}
+
+func (db *fakeDatabase) create(_ context.Context, name string, encryptedFields bson.M) error {
+	if name == db.failing {
+		return errors.New("collection already exists")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.created[name] = encryptedFields
+	return nil
+}
+
+func (db *fakeDatabase) drop(_ context.Context, name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.dropped = append(db.dropped, name)
+	return nil
+}
+
+func tenantSpecs(t *testing.T, accountsKeyID primitive.Binary) []utils.CollectionSpec {
+	t.Helper()
+	users, err := utils.NewEncryptedFieldsBuilder().
+		AddEquality("ssn", "string").
+		AddUnindexed("email", "string").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := bson.M{"fields": bson.A{
+		bson.M{"keyId": accountsKeyID, "path": "iban", "bsonType": "string"},
+	}}
+	return []utils.CollectionSpec{
+		{Name: "users", EncryptedFields: users},
+		{Name: "accounts", EncryptedFields: accounts},
+	}
+}
+
+func TestProvisionCollections(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	accountsKeyID := fake.AddKey("local:100")
+	specs := tenantSpecs(t, accountsKeyID)
+	db := &fakeDatabase{created: make(map[string]bson.M)}
+
+	err := utils.ProvisionCollections(context.Background(), fake, "local:100", specs, db.create, db.drop)
+	if err != nil {
+		t.Fatalf("provisionCollections() error = %v", err)
+	}
+	if len(db.created) != 2 || db.dropped != nil {
+		t.Fatalf("created %v and dropped %v, want users and accounts created", db.created, db.dropped)
+	}
+	if len(fake.Keys()) != 3 {
+		t.Errorf("key vault holds %d DEKs, want the one of accounts and one per field of users", len(fake.Keys()))
+	}
+	for _, field := range db.created["users"]["fields"].(bson.A) {
+		if keyID, ok := field.(bson.M)["keyId"].(primitive.Binary); !ok || len(keyID.Data) == 0 {
+			t.Errorf("users field %v has no DEK", field)
+		}
+	}
+	keyID := db.created["accounts"]["fields"].(bson.A)[0].(bson.M)["keyId"]
+	if !reflect.DeepEqual(keyID, accountsKeyID) {
+		t.Errorf("accounts keyId = %v, want the given %v", keyID, accountsKeyID)
+	}
+	if specKeyID := specs[0].EncryptedFields["fields"].([]bson.M)[0]["keyId"]; specKeyID != nil {
+		t.Errorf("the caller's users spec was given the keyId %v", specKeyID)
+	}
+}
+
+// TestProvisionCollectionsRollback provisions two collections where the second fails: the first
+// is dropped again and the DEKs created for it are deleted.
+func TestProvisionCollectionsRollback(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	accountsKeyID := fake.AddKey("local:100")
+	db := &fakeDatabase{failing: "accounts", created: make(map[string]bson.M)}
+
+	err := utils.ProvisionCollections(context.Background(), fake, "local:100", tenantSpecs(t, accountsKeyID),
+		db.create, db.drop)
+	if err == nil || !strings.Contains(err.Error(), "failed to create collection 'accounts'") {
+		t.Fatalf("provisionCollections() error = %v, want the failure of accounts", err)
+	}
+	if !slices.Equal(db.dropped, []string{"users"}) {
+		t.Errorf("dropped %v, want users", db.dropped)
+	}
+	keys := fake.Keys()
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0]["_id"], accountsKeyID) {
+		t.Errorf("key vault holds %v, want only the DEK given for accounts", keys)
+	}
+
+	fake.CreateErr = errors.New("KMS unavailable")
+	db = &fakeDatabase{created: make(map[string]bson.M)}
+	err = utils.ProvisionCollections(context.Background(), fake, "local:100", tenantSpecs(t, accountsKeyID),
+		db.create, db.drop)
+	if !errors.Is(err, fake.CreateErr) || len(db.created) != 0 {
+		t.Errorf("provisionCollections() = %v with %v created, want the DEK failure before any collection",
+			err, db.created)
+	}
+}
@@ -0,0 +1,415 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// QE keeps its metadata in companion collections named enxcol_.<collection>.esc and
+// enxcol_.<collection>.ecoc (enxcol_.<collection>.ecc on pre-7.0 servers).
+var _qeStateCollectionPattern = regexp.MustCompile(`^enxcol_\.(.+)\.(esc|ecoc|ecc)$`)
+
+// PruneOrphanedQEState finds the QE metadata collections in the database whose data collection no
+// longer exists and drops them. With dryRun set, the orphans are only reported.
+func PruneOrphanedQEState(ctx context.Context, db *mongo.Database, dryRun bool) ([]string, error) {
+	names, err := db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	return pruneOrphanedQEState(ctx, names, dryRun, func(ctx context.Context, name string) error {
+		return db.Collection(name).Drop(ctx)
+	})
+}
+
+// pruneOrphanedQEState finds the QE metadata collections among the collection names of a database
+// whose data collection isn't among them, and drops them with drop unless dryRun is set.
+func pruneOrphanedQEState(ctx context.Context, names []string, dryRun bool,
+	drop func(ctx context.Context, name string) error) ([]string, error) {
+	existing := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		existing[name] = struct{}{}
+	}
+
+	var orphans []string
+	for _, name := range names {
+		match := _qeStateCollectionPattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if _, ok := existing[match[1]]; ok {
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+
+	if dryRun {
+		return orphans, nil
+	}
+
+	dropped := make([]string, 0, len(orphans))
+	for _, name := range orphans {
+		if err := drop(ctx, name); err != nil {
+			return dropped, fmt.Errorf("failed to drop orphaned QE state collection '%s': %w", name, err)
+		}
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+// ErrEncryptedFieldsMismatch is returned when an existing QE collection was created with
+// encryptedFields that differ from the ones the application expects.
+var ErrEncryptedFieldsMismatch = errors.New("encryptedFields of the existing collection do not match")
+
+// collectionEncryptedFields returns the encryptedFields the collection was created with, and
+// whether the collection exists.
+func collectionEncryptedFields(
+	ctx context.Context, client *mongo.Client, coll CollRef,
+) (bson.M, bool, error) {
+	specs, err := client.Database(coll.Database).
+		ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: coll.Name}})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list collections: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, false, nil
+	}
+	var collOptions struct {
+		EncryptedFields bson.M `bson:"encryptedFields"`
+	}
+	if specs[0].Options != nil {
+		if err := bson.Unmarshal(specs[0].Options, &collOptions); err != nil {
+			return nil, true, fmt.Errorf("failed to decode the options of '%s': %w", coll, err)
+		}
+	}
+	return collOptions.EncryptedFields, true, nil
+}
+
+// CollectionEncryptedFields returns the encryptedFields, keyIds included, that an existing QE
+// collection was created with, e.g. for the EncryptedFieldsMap of an encrypting client.
+func CollectionEncryptedFields(ctx context.Context, client *mongo.Client, coll CollRef) (bson.M, error) {
+	encryptedFields, exists, err := collectionEncryptedFields(ctx, client, coll)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("collection '%s' does not exist", coll)
+	}
+	if encryptedFields == nil {
+		return nil, fmt.Errorf("collection '%s' has no encryptedFields", coll)
+	}
+	return encryptedFields, nil
+}
+
+// EncryptedFieldPathsFromCollection returns the paths of the encrypted fields, queryable or not,
+// of an existing QE collection, in the order the server reports them. A downstream consumer of
+// the collection (e.g. a CDC decryptor) can use them to know what to decrypt, without its own
+// copy of the encryptedFields.
+func EncryptedFieldPathsFromCollection(
+	ctx context.Context, client *mongo.Client, coll CollRef,
+) ([]string, error) {
+	encryptedFields, err := CollectionEncryptedFields(ctx, client, coll)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedFieldPaths(coll, encryptedFields)
+}
+
+// encryptedFieldPaths returns the paths of the fields of the encryptedFields of a collection.
+func encryptedFieldPaths(coll CollRef, encryptedFields bson.M) ([]string, error) {
+	fields, err := qeFieldList(encryptedFields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryptedFields on collection '%s': %w", coll, err)
+	}
+	paths := make([]string, 0, len(fields))
+	for _, field := range fields {
+		path, _ := field["path"].(string)
+		if path == "" {
+			return nil, fmt.Errorf("encrypted field without a path on collection '%s'", coll)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// VerifyEncryptedFields checks that an existing collection was created with the intended
+// encryptedFields. Otherwise, inserts would fail later (or worse, fields would be queryable in
+// ways the application doesn't expect), so it returns ErrEncryptedFieldsMismatch with a diff.
+// The keyIds are ignored, since the intended fields usually leave them for the server to fill in.
+func VerifyEncryptedFields(ctx context.Context, client *mongo.Client, coll CollRef, intended bson.M) error {
+	actual, exists, err := collectionEncryptedFields(ctx, client, coll)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("collection '%s' does not exist", coll)
+	}
+
+	return compareEncryptedFields(coll, actual, intended)
+}
+
+// compareEncryptedFields compares the encryptedFields a collection was created with to the
+// intended ones, and returns ErrEncryptedFieldsMismatch with a diff if they differ.
+func compareEncryptedFields(coll CollRef, actual, intended bson.M) error {
+	actualFields, err := describeQEFields(actual)
+	if err != nil {
+		return fmt.Errorf("invalid encryptedFields on collection '%s': %w", coll, err)
+	}
+	intendedFields, err := describeQEFields(intended)
+	if err != nil {
+		return fmt.Errorf("invalid intended encryptedFields: %w", err)
+	}
+
+	var diff []string
+	for _, path := range sortedKeys(intendedFields) {
+		actualField, ok := actualFields[path]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("'%s' is missing from the collection", path))
+			continue
+		}
+		if actualField != intendedFields[path] {
+			diff = append(diff, fmt.Sprintf("'%s' is %s, expected %s", path, actualField, intendedFields[path]))
+		}
+	}
+	for _, path := range sortedKeys(actualFields) {
+		if _, ok := intendedFields[path]; !ok {
+			diff = append(diff, fmt.Sprintf("'%s' is encrypted in the collection but not expected", path))
+		}
+	}
+	if len(diff) > 0 {
+		return fmt.Errorf("%w on '%s': %s", ErrEncryptedFieldsMismatch, coll, strings.Join(diff, "; "))
+	}
+	return nil
+}
+
+// describeQEFields returns a comparable description (the bsonType and the queries) of each field
+// of an encryptedFields document, by path.
+func describeQEFields(encryptedFields bson.M) (map[string]string, error) {
+	fields, err := qeFieldList(encryptedFields)
+	if err != nil {
+		return nil, err
+	}
+	described := make(map[string]string, len(fields))
+	for _, field := range fields {
+		path, _ := field["path"].(string)
+		if path == "" {
+			return nil, fmt.Errorf("encrypted field without a path")
+		}
+		description := fmt.Sprintf("%v", field["bsonType"])
+		queries, err := qeQueryList(field["queries"])
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %w", path, err)
+		}
+		for _, query := range queries {
+			description += fmt.Sprintf(" %v", query["queryType"])
+			if query["queryType"] == "range" {
+				description += fmt.Sprintf("[%v,%v]", query["min"], query["max"])
+			}
+		}
+		described[path] = description
+	}
+	return described, nil
+}
+
+// qeFieldList returns the fields array of an encryptedFields document.
+func qeFieldList(encryptedFields bson.M) ([]map[string]interface{}, error) {
+	var fields []map[string]interface{}
+	switch list := encryptedFields["fields"].(type) {
+	case nil:
+	case []bson.M:
+		for _, field := range list {
+			fields = append(fields, field)
+		}
+	case bson.A:
+		for _, elem := range list {
+			field, ok := asMap(elem)
+			if !ok {
+				return nil, fmt.Errorf("encrypted field is not a document")
+			}
+			fields = append(fields, field)
+		}
+	default:
+		return nil, fmt.Errorf("fields of encryptedFields is not an array")
+	}
+	return fields, nil
+}
+
+// qeQueryList returns the queries of an encrypted field, which may be a single document or an
+// array of them.
+func qeQueryList(queries interface{}) ([]map[string]interface{}, error) {
+	switch q := queries.(type) {
+	case nil:
+		return nil, nil
+	case []bson.M:
+		list := make([]map[string]interface{}, 0, len(q))
+		for _, query := range q {
+			list = append(list, query)
+		}
+		return list, nil
+	case bson.A:
+		list := make([]map[string]interface{}, 0, len(q))
+		for _, elem := range q {
+			query, ok := asMap(elem)
+			if !ok {
+				return nil, fmt.Errorf("query is not a document")
+			}
+			list = append(list, query)
+		}
+		return list, nil
+	default:
+		query, ok := asMap(q)
+		if !ok {
+			return nil, fmt.Errorf("queries is neither a document nor an array")
+		}
+		return []map[string]interface{}{query}, nil
+	}
+}
+
+// DateRangeQuery returns the filter matching documents whose date field, declared with
+// AddDateRange, falls between from and to, inclusive. Through a QE client the driver encrypts the
+// bounds into a range query the server evaluates on the encrypted index.
+func DateRangeQuery(field string, from, to time.Time) (bson.M, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("date range query on '%s' ends (%v) before it starts (%v)", field, to, from)
+	}
+	return bson.M{field: bson.M{
+		"$gte": primitive.NewDateTimeFromTime(from),
+		"$lte": primitive.NewDateTimeFromTime(to),
+	}}, nil
+}
+
+// ErrValueOutOfRange is returned when a value is outside the min/max of a QE range field.
+var ErrValueOutOfRange = errors.New("value out of the range of the encrypted field")
+
+// ValidateRangeValue checks a value against the min and max of the range field in the
+// encryptedFields document, before the insert, so the caller gets a clear error instead of the
+// server rejecting the encrypted payload. Fields without a range query are not checked.
+func ValidateRangeValue(field string, value interface{}, fieldsMap bson.M) error {
+	query, ok := rangeQuery(fieldsMap, field)
+	if !ok {
+		return nil
+	}
+	for _, bound := range []struct {
+		name  string
+		limit interface{}
+		bad   int
+	}{{"min", query["min"], -1}, {"max", query["max"], 1}} {
+		if bound.limit == nil {
+			continue
+		}
+		c, err := compareRangeValues(value, bound.limit)
+		if err != nil {
+			return fmt.Errorf("cannot check the range of '%s': %w", field, err)
+		}
+		if c == bound.bad {
+			return fmt.Errorf("%w: %v for '%s' is outside [%v, %v]",
+				ErrValueOutOfRange, value, field, query["min"], query["max"])
+		}
+	}
+	return nil
+}
+
+// rangeQuery returns the range query of the field in the encryptedFields document.
+func rangeQuery(fieldsMap bson.M, path string) (map[string]interface{}, bool) {
+	var fields []interface{}
+	switch v := fieldsMap["fields"].(type) {
+	case []bson.M:
+		for _, f := range v {
+			fields = append(fields, f)
+		}
+	case bson.A:
+		fields = v
+	}
+	for _, f := range fields {
+		field, ok := asMap(f)
+		if !ok || field["path"] != path {
+			continue
+		}
+		var queries []interface{}
+		switch q := field["queries"].(type) {
+		case []bson.M:
+			for _, query := range q {
+				queries = append(queries, query)
+			}
+		case bson.A:
+			queries = q
+		default:
+			queries = []interface{}{q}
+		}
+		for _, q := range queries {
+			if query, ok := asMap(q); ok && query["queryType"] == "range" {
+				return query, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// compareRangeValues compares two values of the numeric or date types QE range fields support,
+// returning -1, 0 or 1.
+func compareRangeValues(a, b interface{}) (int, error) {
+	if ta, ok := asDateMillis(a); ok {
+		tb, ok := asDateMillis(b)
+		if !ok {
+			return 0, fmt.Errorf("cannot compare the date %v with %v (%T)", a, b, b)
+		}
+		return cmp.Compare(ta, tb), nil
+	}
+	if ia, ok := asInt64(a); ok {
+		if ib, ok := asInt64(b); ok {
+			return cmp.Compare(ia, ib), nil
+		}
+	}
+	fa, okA := asFloat64(a)
+	fb, okB := asFloat64(b)
+	if !okA || !okB {
+		return 0, fmt.Errorf("cannot compare %v (%T) with %v (%T)", a, a, b, b)
+	}
+	return cmp.Compare(fa, fb), nil
+}
+
+func asDateMillis(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return int64(t), true
+	case time.Time:
+		return int64(primitive.NewDateTimeFromTime(t)), true
+	default:
+		return 0, false
+	}
+}
+
+func asInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+func asFloat64(v interface{}) (float64, bool) {
+	if n, ok := asInt64(v); ok {
+		return float64(n), true
+	}
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
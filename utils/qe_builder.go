@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrContentionRequired is returned when a low-cardinality field is declared queryable without a
+// contention factor.
+var ErrContentionRequired = errors.New("a contention factor is required for this field")
+
+// ErrTooManyQueryableFields is returned when a collection declares more queryable fields than the
+// builder's limit.
+var ErrTooManyQueryableFields = errors.New("too many queryable encrypted fields")
+
+// The default limit of queryable fields per collection. Each queryable field adds index entries
+// and metadata to every write, and a collection that declares many of them fails at creation
+// or on writes with errors that don't name the fields, so the builder rejects them up front.
+const _defaultMaxQueryableFields = 16
+
+// EncryptedFieldsBuilder builds the encryptedFields document of a QE collection. The keyIds are
+// left nil, so CreateEncryptedCollection creates a DEK per field. The first invalid field is
+// reported by Build.
+type EncryptedFieldsBuilder struct {
+	fields             []bson.M
+	maxQueryableFields int
+	err                error
+}
+
+func NewEncryptedFieldsBuilder() *EncryptedFieldsBuilder {
+	return &EncryptedFieldsBuilder{maxQueryableFields: _defaultMaxQueryableFields}
+}
+
+// SetMaxQueryableFields sets the number of queryable (equality or range) fields Build accepts, 16
+// by default.
+func (b *EncryptedFieldsBuilder) SetMaxQueryableFields(max int) *EncryptedFieldsBuilder {
+	if max <= 0 {
+		b.setErr(fmt.Errorf("the maximum number of queryable fields must be positive, got %d", max))
+		return b
+	}
+	b.maxQueryableFields = max
+	return b
+}
+
+// AddEquality adds a field that supports equality queries.
+func (b *EncryptedFieldsBuilder) AddEquality(path, bsonType string) *EncryptedFieldsBuilder {
+	if bsonType == "bool" {
+		b.setErr(fmt.Errorf("%w: use AddBoolEquality for the bool field '%s'", ErrContentionRequired, path))
+		return b
+	}
+	return b.add(path, bsonType, bson.M{"queryType": "equality"})
+}
+
+// AddBoolEquality adds a bool field that supports equality queries.
+//
+// A field with only two values must never be deterministically encrypted with CSFLE: the
+// ciphertext would take one of two values, and their frequencies reveal which is which. QE's
+// equality index uses randomized tokens instead, and the contention factor spreads each value
+// over contention+1 tokens, which hides the frequency of the two values at the cost of a slower
+// query. A bool field must set it explicitly; the higher the contention the better the frequency
+// of each value is hidden.
+func (b *EncryptedFieldsBuilder) AddBoolEquality(path string, contention int64) *EncryptedFieldsBuilder {
+	if contention <= 0 {
+		b.setErr(fmt.Errorf("%w: bool field '%s' needs a positive contention factor, got %d",
+			ErrContentionRequired, path, contention))
+		return b
+	}
+	return b.add(path, "bool", bson.M{"queryType": "equality", "contention": contention})
+}
+
+// The sparsity values the server accepts for a range field.
+const (
+	_minRangeSparsity = 1
+	_maxRangeSparsity = 4
+	// trimFactor must be less than the number of bits of the field's domain, which is at most 64.
+	_maxRangeTrimFactor = 63
+)
+
+// RangeOptions tunes the index of a range field. Nil settings are left to the server defaults.
+type RangeOptions struct {
+	// How many of the edge tokens of a value are stored: a higher sparsity gives a smaller index
+	// but slower queries. Between 1 and 4; the server default is 2.
+	Sparsity *int64
+	// How many of the topmost levels of the range tree are left out of the index: a higher
+	// trimFactor gives a smaller index and faster inserts, but slower queries of wide ranges. The
+	// server default is 6.
+	TrimFactor *int32
+}
+
+// AddRange adds a field that supports range queries between min and max, inclusive. Values
+// outside the range are rejected by the server. At most one RangeOptions tunes the index.
+func (b *EncryptedFieldsBuilder) AddRange(
+	path, bsonType string, min, max interface{}, opts ...RangeOptions,
+) *EncryptedFieldsBuilder {
+	query := bson.M{"queryType": "range", "min": min, "max": max}
+	if len(opts) > 1 {
+		b.setErr(fmt.Errorf("range field '%s' takes at most one RangeOptions", path))
+		return b
+	}
+	if len(opts) == 1 {
+		if sparsity := opts[0].Sparsity; sparsity != nil {
+			if *sparsity < _minRangeSparsity || *sparsity > _maxRangeSparsity {
+				b.setErr(fmt.Errorf("range field '%s' needs a sparsity between %d and %d, got %d",
+					path, _minRangeSparsity, _maxRangeSparsity, *sparsity))
+				return b
+			}
+			query["sparsity"] = *sparsity
+		}
+		if trimFactor := opts[0].TrimFactor; trimFactor != nil {
+			if *trimFactor < 0 || *trimFactor > _maxRangeTrimFactor {
+				b.setErr(fmt.Errorf("range field '%s' needs a trimFactor between 0 and %d, got %d",
+					path, _maxRangeTrimFactor, *trimFactor))
+				return b
+			}
+			query["trimFactor"] = *trimFactor
+		}
+	}
+	return b.add(path, bsonType, query)
+}
+
+// AddDateRange adds a date field that supports range queries between min and max, inclusive, e.g.
+// for time-window searches with DateRangeQuery. BSON dates have millisecond precision, so min and
+// max are truncated to the millisecond.
+func (b *EncryptedFieldsBuilder) AddDateRange(
+	path string, min, max time.Time, opts ...RangeOptions,
+) *EncryptedFieldsBuilder {
+	if !min.Before(max) {
+		b.setErr(fmt.Errorf("date range field '%s' needs min before max, got %v and %v", path, min, max))
+		return b
+	}
+	return b.AddRange(path, "date", primitive.NewDateTimeFromTime(min), primitive.NewDateTimeFromTime(max), opts...)
+}
+
+// AddUnindexed adds a field that is encrypted but can't be queried.
+func (b *EncryptedFieldsBuilder) AddUnindexed(path, bsonType string) *EncryptedFieldsBuilder {
+	return b.add(path, bsonType, nil)
+}
+
+func (b *EncryptedFieldsBuilder) add(path, bsonType string, query bson.M) *EncryptedFieldsBuilder {
+	if err := validateEncryptedPath(path); err != nil {
+		b.setErr(err)
+		return b
+	}
+	if bsonType == "" {
+		b.setErr(fmt.Errorf("encrypted field '%s' needs a bsonType", path))
+		return b
+	}
+	for _, field := range b.fields {
+		if field["path"] == path {
+			b.setErr(fmt.Errorf("encrypted field '%s' is declared more than once", path))
+			return b
+		}
+	}
+
+	field := bson.M{
+		"keyId":    nil,
+		"path":     path,
+		"bsonType": bsonType,
+	}
+	if query != nil {
+		field["queries"] = []bson.M{query}
+	}
+	b.fields = append(b.fields, field)
+	return b
+}
+
+func (b *EncryptedFieldsBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build returns the encryptedFields document. More queryable fields than the limit (see
+// SetMaxQueryableFields) fail with ErrTooManyQueryableFields.
+func (b *EncryptedFieldsBuilder) Build() (bson.M, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.fields) == 0 {
+		return nil, fmt.Errorf("no encrypted fields declared")
+	}
+	var queryable []string
+	for _, field := range b.fields {
+		if field["queries"] != nil {
+			queryable = append(queryable, field["path"].(string))
+		}
+	}
+	if len(queryable) > b.maxQueryableFields {
+		return nil, fmt.Errorf("%w: %d declared, at most %d are allowed; %v are over the limit",
+			ErrTooManyQueryableFields, len(queryable), b.maxQueryableFields, queryable[b.maxQueryableFields:])
+	}
+	return bson.M{"fields": b.fields}, nil
+}
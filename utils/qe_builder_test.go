@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAddBoolEquality(t *testing.T) {
+	fieldsMap, err := NewEncryptedFieldsBuilder().AddBoolEquality("isVIP", 8).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := bson.M{"fields": []bson.M{{
+		"keyId":    nil,
+		"path":     "isVIP",
+		"bsonType": "bool",
+		"queries":  []bson.M{{"queryType": "equality", "contention": int64(8)}},
+	}}}
+	if !reflect.DeepEqual(fieldsMap, want) {
+		t.Errorf("Build() = %v, want %v", fieldsMap, want)
+	}
+
+	for name, b := range map[string]*EncryptedFieldsBuilder{
+		"without contention":  NewEncryptedFieldsBuilder().AddBoolEquality("isVIP", 0),
+		"through AddEquality": NewEncryptedFieldsBuilder().AddEquality("isVIP", "bool"),
+	} {
+		if _, err := b.Build(); !errors.Is(err, ErrContentionRequired) {
+			t.Errorf("Build() of a bool field %s error = %v, want ErrContentionRequired", name, err)
+		}
+	}
+}
+
+func TestAddDateRange(t *testing.T) {
+	min := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	max := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	fieldsMap, err := NewEncryptedFieldsBuilder().AddDateRange("createdAt", min, max).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := bson.M{"fields": []bson.M{{
+		"keyId":    nil,
+		"path":     "createdAt",
+		"bsonType": "date",
+		"queries": []bson.M{{
+			"queryType": "range",
+			"min":       primitive.NewDateTimeFromTime(min),
+			"max":       primitive.NewDateTimeFromTime(max),
+		}},
+	}}}
+	if !reflect.DeepEqual(fieldsMap, want) {
+		t.Errorf("Build() = %v, want %v", fieldsMap, want)
+	}
+
+	for name, bounds := range map[string][2]time.Time{"equal": {min, min}, "reversed": {max, min}} {
+		b := NewEncryptedFieldsBuilder().AddDateRange("createdAt", bounds[0], bounds[1])
+		if _, err := b.Build(); err == nil {
+			t.Errorf("Build() of a date range with %s bounds succeeded, want an error", name)
+		}
+	}
+}
+
+func TestAddRangeOptions(t *testing.T) {
+	int64Ptr := func(v int64) *int64 { return &v }
+	int32Ptr := func(v int32) *int32 { return &v }
+	fieldsMap, err := NewEncryptedFieldsBuilder().
+		AddRange("age", "int", 0, 120, RangeOptions{Sparsity: int64Ptr(3), TrimFactor: int32Ptr(4)}).
+		AddRange("salary", "int", 0, 1000000).
+		Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	fields := fieldsMap["fields"].([]bson.M)
+	wantAge := bson.M{"queryType": "range", "min": 0, "max": 120, "sparsity": int64(3), "trimFactor": int32(4)}
+	if got := fields[0]["queries"].([]bson.M)[0]; !reflect.DeepEqual(got, wantAge) {
+		t.Errorf("age queries = %v, want %v", got, wantAge)
+	}
+	wantSalary := bson.M{"queryType": "range", "min": 0, "max": 1000000}
+	if got := fields[1]["queries"].([]bson.M)[0]; !reflect.DeepEqual(got, wantSalary) {
+		t.Errorf("salary queries = %v, want the server defaults %v", got, wantSalary)
+	}
+
+	for name, opts := range map[string][]RangeOptions{
+		"negative sparsity":   {{Sparsity: int64Ptr(-1)}},
+		"zero sparsity":       {{Sparsity: int64Ptr(0)}},
+		"sparsity over 4":     {{Sparsity: int64Ptr(5)}},
+		"negative trimFactor": {{TrimFactor: int32Ptr(-1)}},
+		"trimFactor over 63":  {{TrimFactor: int32Ptr(64)}},
+		"two options":         {{}, {}},
+	} {
+		if _, err := NewEncryptedFieldsBuilder().AddRange("age", "int", 0, 120, opts...).Build(); err == nil {
+			t.Errorf("Build() of a range field with %s succeeded, want an error", name)
+		}
+	}
+}
+
+// TestMaxQueryableFields builds exactly the limit of queryable fields, and one past it; unindexed
+// fields don't count.
+func TestMaxQueryableFields(t *testing.T) {
+	build := func(queryable int) (bson.M, error) {
+		b := NewEncryptedFieldsBuilder().AddUnindexed("notes", "string")
+		for i := range queryable {
+			b.AddEquality(fmt.Sprintf("field%d", i), "string")
+		}
+		return b.Build()
+	}
+	if _, err := build(_defaultMaxQueryableFields); err != nil {
+		t.Errorf("Build() of %d queryable fields error = %v", _defaultMaxQueryableFields, err)
+	}
+	_, err := build(_defaultMaxQueryableFields + 1)
+	want := fmt.Sprintf("[field%d] are over the limit", _defaultMaxQueryableFields)
+	if !errors.Is(err, ErrTooManyQueryableFields) || !strings.Contains(err.Error(), want) {
+		t.Errorf("Build() of one field past the limit error = %v, want %q", err, want)
+	}
+
+	b := NewEncryptedFieldsBuilder().SetMaxQueryableFields(1).
+		AddEquality("ssn", "string").
+		AddRange("age", "int", 0, 120)
+	if _, err := b.Build(); !errors.Is(err, ErrTooManyQueryableFields) {
+		t.Errorf("Build() past SetMaxQueryableFields(1) error = %v, want ErrTooManyQueryableFields", err)
+	}
+	if _, err := NewEncryptedFieldsBuilder().SetMaxQueryableFields(0).AddEquality("ssn", "string").
+		Build(); err == nil {
+		t.Error("Build() after SetMaxQueryableFields(0) succeeded, want an error")
+	}
+}
@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidateRangeValue(t *testing.T) {
+	// The encrypted fields of cmd/qe.
+	fieldsMap, err := NewEncryptedFieldsBuilder().
+		AddEquality("ssn", "string").
+		AddRange("age", "int", 0, 120).
+		AddDateRange("hiredAt", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)).
+		AddUnindexed("email", "string").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encryptedFields as read back from the server.
+	serverFieldsMap := bson.M{"fields": bson.A{
+		bson.M{"path": "age", "bsonType": "int", "queries": bson.M{
+			"queryType": "range", "min": int32(0), "max": int32(120),
+		}},
+	}}
+
+	tests := []struct {
+		name      string
+		field     string
+		value     interface{}
+		fieldsMap bson.M
+		wantErr   error
+	}{
+		{name: "age 30", field: "age", value: 30, fieldsMap: fieldsMap},
+		{name: "age 150", field: "age", value: 150, fieldsMap: fieldsMap, wantErr: ErrValueOutOfRange},
+		{name: "negative age", field: "age", value: int32(-1), fieldsMap: fieldsMap, wantErr: ErrValueOutOfRange},
+		{name: "bounds are inclusive", field: "age", value: int64(120), fieldsMap: fieldsMap},
+		{name: "double", field: "age", value: 120.5, fieldsMap: fieldsMap, wantErr: ErrValueOutOfRange},
+		{name: "server format in range", field: "age", value: 30, fieldsMap: serverFieldsMap},
+		{name: "server format out of range", field: "age", value: 150, fieldsMap: serverFieldsMap,
+			wantErr: ErrValueOutOfRange},
+		{name: "date in range", field: "hiredAt", value: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			fieldsMap: fieldsMap},
+		{name: "date out of range", field: "hiredAt", value: time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC),
+			fieldsMap: fieldsMap, wantErr: ErrValueOutOfRange},
+		{name: "equality field", field: "ssn", value: "987-65-4320", fieldsMap: fieldsMap},
+		{name: "unencrypted field", field: "name", value: "Bob", fieldsMap: fieldsMap},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateRangeValue(tt.field, tt.value, tt.fieldsMap)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateRangeValue() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A value that can't be compared with the bounds fails, rather than passing unchecked.
+	if err := ValidateRangeValue("age", "thirty", fieldsMap); err == nil || errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("ValidateRangeValue() of a string error = %v, want a comparison error", err)
+	}
+}
+
+func TestPruneOrphanedQEState(t *testing.T) {
+	names := []string{
+		"users", "enxcol_.users.esc", "enxcol_.users.ecoc",
+		// What dropping orders without its companions leaves behind.
+		"enxcol_.orders.esc", "enxcol_.orders.ecoc",
+		// A pre-7.0 collection dropped the same way.
+		"enxcol_.legacy.ecc",
+	}
+	orphans := []string{"enxcol_.orders.esc", "enxcol_.orders.ecoc", "enxcol_.legacy.ecc"}
+
+	var dropped []string
+	drop := func(ctx context.Context, name string) error {
+		dropped = append(dropped, name)
+		return nil
+	}
+	got, err := pruneOrphanedQEState(context.Background(), names, true, drop)
+	if err != nil {
+		t.Fatalf("pruneOrphanedQEState() in dry-run error = %v", err)
+	}
+	if !reflect.DeepEqual(got, orphans) || dropped != nil {
+		t.Errorf("pruneOrphanedQEState() in dry-run = %v, dropped %v, want %v reported only", got, dropped, orphans)
+	}
+
+	got, err = pruneOrphanedQEState(context.Background(), names, false, drop)
+	if err != nil {
+		t.Fatalf("pruneOrphanedQEState() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, orphans) || !reflect.DeepEqual(dropped, orphans) {
+		t.Errorf("pruneOrphanedQEState() = %v, dropped %v, want %v", got, dropped, orphans)
+	}
+}
+
+func TestPruneOrphanedQEStateDropFails(t *testing.T) {
+	errDrop := errors.New("not authorized")
+	names := []string{"enxcol_.orders.esc", "enxcol_.orders.ecoc"}
+	drop := func(ctx context.Context, name string) error {
+		if name == "enxcol_.orders.ecoc" {
+			return errDrop
+		}
+		return nil
+	}
+	got, err := pruneOrphanedQEState(context.Background(), names, false, drop)
+	if !errors.Is(err, errDrop) {
+		t.Errorf("pruneOrphanedQEState() error = %v, want %v", err, errDrop)
+	}
+	if want := []string{"enxcol_.orders.esc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pruneOrphanedQEState() = %v, want the collections dropped before the failure %v", got, want)
+	}
+}
+
+// TestCompareEncryptedFields compares the fields of cmd/qe to those of a pre-existing collection,
+// as the server reports them.
+func TestCompareEncryptedFields(t *testing.T) {
+	intended, err := NewEncryptedFieldsBuilder().
+		AddEquality("ssn", "string").
+		AddRange("age", "int", 0, 120).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	existing := func(ssnType string) bson.M {
+		return bson.M{"fields": bson.A{
+			bson.M{"keyId": keyID, "path": "ssn", "bsonType": ssnType, "queries": bson.M{"queryType": "equality"}},
+			bson.M{"keyId": keyID, "path": "age", "bsonType": "int", "queries": bson.A{
+				bson.M{"queryType": "range", "min": 0, "max": 120},
+			}},
+		}}
+	}
+
+	users := CollRef{Database: "csfle_db", Name: "users"}
+	if err := compareEncryptedFields(users, existing("string"), intended); err != nil {
+		t.Errorf("compareEncryptedFields() of the same fields error = %v", err)
+	}
+	err = compareEncryptedFields(users, existing("long"), intended)
+	want := "'ssn' is long equality, expected string equality"
+	if !errors.Is(err, ErrEncryptedFieldsMismatch) || !strings.Contains(err.Error(), want) {
+		t.Errorf("compareEncryptedFields() of a changed field type error = %v", err)
+	}
+
+	actual := bson.M{"fields": bson.A{bson.M{"path": "email", "bsonType": "string"}}}
+	err = compareEncryptedFields(users, actual, intended)
+	for _, want := range []string{
+		"'age' is missing", "'ssn' is missing", "'email' is encrypted in the collection but not expected",
+	} {
+		if !errors.Is(err, ErrEncryptedFieldsMismatch) || !strings.Contains(err.Error(), want) {
+			t.Errorf("compareEncryptedFields() error = %v, want %q", err, want)
+		}
+	}
+}
+
+// TestDateRangeQuery selects, with the bounds of the filter, the events of a time window; the
+// bounds are inclusive.
+func TestDateRangeQuery(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	filter, err := DateRangeQuery("createdAt", day(2), day(4))
+	if err != nil {
+		t.Fatalf("DateRangeQuery() error = %v", err)
+	}
+	bounds, ok := filter["createdAt"].(bson.M)
+	if !ok {
+		t.Fatalf("DateRangeQuery() = %v, want a createdAt filter", filter)
+	}
+	from, _ := bounds["$gte"].(primitive.DateTime)
+	to, _ := bounds["$lte"].(primitive.DateTime)
+
+	var got []int
+	for d := 1; d <= 5; d++ {
+		if createdAt := primitive.NewDateTimeFromTime(day(d)); createdAt >= from && createdAt <= to {
+			got = append(got, d)
+		}
+	}
+	if want := []int{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events in the window = %v, want %v", got, want)
+	}
+
+	if _, err := DateRangeQuery("createdAt", day(2), day(2)); err != nil {
+		t.Errorf("DateRangeQuery() of a single instant error = %v", err)
+	}
+	if _, err := DateRangeQuery("createdAt", day(4), day(2)); err == nil {
+		t.Error("DateRangeQuery() ending before it starts succeeded, want an error")
+	}
+}
+
+// TestEncryptedFieldPaths reads the paths of the encryptedFields of cmd/qe as the server reports
+// them.
+func TestEncryptedFieldPaths(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	encryptedFields := bson.M{"fields": bson.A{
+		bson.M{"keyId": keyID, "path": "ssn", "bsonType": "string", "queries": bson.M{"queryType": "equality"}},
+		bson.M{"keyId": keyID, "path": "age", "bsonType": "int", "queries": bson.A{
+			bson.M{"queryType": "range", "min": 0, "max": 120},
+		}},
+		bson.M{"keyId": keyID, "path": "email", "bsonType": "string"},
+	}}
+	users := CollRef{Database: "csfle_db", Name: "users"}
+	got, err := encryptedFieldPaths(users, encryptedFields)
+	if err != nil {
+		t.Fatalf("encryptedFieldPaths() error = %v", err)
+	}
+	if want := []string{"ssn", "age", "email"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("encryptedFieldPaths() = %v, want %v", got, want)
+	}
+
+	invalid := []bson.M{
+		{"fields": "ssn"},
+		{"fields": bson.A{"ssn"}},
+		{"fields": bson.A{bson.M{"bsonType": "string"}}},
+	}
+	for _, encryptedFields := range invalid {
+		if got, err := encryptedFieldPaths(users, encryptedFields); err == nil {
+			t.Errorf("encryptedFieldPaths(%v) = %v, want an error", encryptedFields, got)
+		}
+	}
+}
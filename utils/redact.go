@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const RedactedMarker = "***REDACTED***"
+
+// ReadRedacted reads a document through a regular (non-encrypting) client and replaces the
+// encrypted fields with RedactedMarker. This gives a safe-to-log view of the document without
+// access to the KMS.
+//
+// Any ciphertext in the document is redacted, including in nested documents and arrays. The
+// encFields are redacted even when they hold plaintext, so legacy documents written before
+// encryption was enabled don't leak the value into logs.
+func ReadRedacted(
+	ctx context.Context, rawClient *mongo.Client, coll CollRef, filter bson.M, encFields []string,
+) (bson.M, error) {
+	return redactResult(coll.Collection(rawClient).FindOne(ctx, filter), coll, encFields)
+}
+
+// redactResult decodes the document of a FindOne result with its encFields and ciphertext
+// redacted.
+func redactResult(res *mongo.SingleResult, coll CollRef, encFields []string) (bson.M, error) {
+	var doc bson.M
+	if err := res.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to read document from %s: %w", coll, err)
+	}
+	for _, field := range encFields {
+		if _, ok := doc[field]; ok {
+			doc[field] = RedactedMarker
+		}
+	}
+	return redactCiphertext(doc).(bson.M), nil
+}
+
+func redactCiphertext(value interface{}) interface{} {
+	if _, ok := asCiphertext(value); ok {
+		return RedactedMarker
+	}
+	switch v := value.(type) {
+	case bson.M:
+		for k, elem := range v {
+			v[k] = redactCiphertext(elem)
+		}
+	case bson.D:
+		for i := range v {
+			v[i].Value = redactCiphertext(v[i].Value)
+		}
+	case bson.A:
+		for i := range v {
+			v[i] = redactCiphertext(v[i])
+		}
+	}
+	return value
+}
+
+// Masker returns the display form of a decrypted string value, e.g. MaskSSN.
+type Masker func(string) string
+
+var _ssnPattern = regexp.MustCompile(`^\d{3}-?\d{2}-?(\d{4})$`)
+
+// The masked form of a value that isn't a well-formed SSN; it reveals nothing about the value.
+const _maskedSSN = "***-**-****"
+
+// MaskSSN masks all but the last four digits of an SSN (987-65-4320 or 987654320), for display:
+// ***-**-4320. A malformed value is masked entirely.
+func MaskSSN(s string) string {
+	match := _ssnPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return _maskedSSN
+	}
+	return "***-**-" + match[1]
+}
+
+// ReadMasked reads a document through an encrypting client, which decrypts it, and applies the
+// masker of each field (by dotted path) to its value, so the caller gets a masked view, e.g. for
+// UI display, while the full value stays in the database. A masked field that isn't a string
+// after decryption is replaced with RedactedMarker rather than returned unmasked.
+func ReadMasked(
+	ctx context.Context, encClient *mongo.Client, coll CollRef, filter bson.M, maskers map[string]Masker,
+) (bson.M, error) {
+	var doc bson.M
+	if err := coll.Collection(encClient).FindOne(ctx, normalizeFilter(filter)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to read document from %s: %w", coll, err)
+	}
+	for path, mask := range maskers {
+		maskPath(doc, strings.Split(path, "."), mask)
+	}
+	return doc, nil
+}
+
+func maskPath(doc bson.M, parts []string, mask Masker) {
+	value, ok := doc[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) > 1 {
+		if nested, ok := value.(bson.M); ok {
+			maskPath(nested, parts[1:], mask)
+		}
+		return
+	}
+	if s, ok := value.(string); ok {
+		doc[parts[0]] = mask(s)
+		return
+	}
+	if value != nil {
+		doc[parts[0]] = RedactedMarker
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestMaskSSN(t *testing.T) {
+	tests := []struct {
+		ssn  string
+		want string
+	}{
+		{ssn: "987-65-4320", want: "***-**-4320"},
+		{ssn: "987654320", want: "***-**-4320"},
+		{ssn: " 987-65-4320\n", want: "***-**-4320"},
+		{ssn: "", want: "***-**-****"},
+		{ssn: "987-65-432", want: "***-**-****"},
+		{ssn: "987-65-43201", want: "***-**-****"},
+		{ssn: "987-65-432O", want: "***-**-****"},
+		{ssn: "98-765-4320", want: "***-**-****"},
+		{ssn: "ssn 987-65-4320", want: "***-**-****"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ssn, func(t *testing.T) {
+			if got := MaskSSN(tt.ssn); got != tt.want {
+				t.Errorf("MaskSSN(%q) = %s, want %s", tt.ssn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskPath(t *testing.T) {
+	doc := bson.M{
+		"ssn":     "987-65-4320",
+		"profile": bson.M{"ssn": "123-45-6789"},
+		"count":   int32(3),
+		"empty":   nil,
+		"name":    "Bob",
+	}
+	for _, path := range []string{"ssn", "profile.ssn", "count", "empty", "missing", "name.first"} {
+		maskPath(doc, strings.Split(path, "."), MaskSSN)
+	}
+	want := bson.M{
+		"ssn":     "***-**-4320",
+		"profile": bson.M{"ssn": "***-**-6789"},
+		// A masked field that isn't a string isn't returned as is.
+		"count": RedactedMarker,
+		"empty": nil,
+		"name":  "Bob",
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("masked document = %v, want %v", doc, want)
+	}
+}
+
+func TestRedactCiphertext(t *testing.T) {
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: []byte{1, 2, 3}}
+	doc := bson.M{
+		"ssn":     ciphertext,
+		"name":    "Bob",
+		"photo":   primitive.Binary{Subtype: 0, Data: []byte{1}},
+		"nested":  bson.D{{Key: "email", Value: ciphertext}},
+		"history": bson.A{ciphertext, "plaintext"},
+	}
+	want := bson.M{
+		"ssn":     RedactedMarker,
+		"name":    "Bob",
+		"photo":   primitive.Binary{Subtype: 0, Data: []byte{1}},
+		"nested":  bson.D{{Key: "email", Value: RedactedMarker}},
+		"history": bson.A{RedactedMarker, "plaintext"},
+	}
+	if got := redactCiphertext(doc); !reflect.DeepEqual(got, want) {
+		t.Errorf("redactCiphertext() = %v, want %v", got, want)
+	}
+}
+
+// TestRedactResult redacts a document as the regular client reads it, and a legacy one with the
+// ssn in plaintext.
+func TestRedactResult(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: []byte{1, 2, 3}}
+	for name, ssn := range map[string]interface{}{"encrypted": ciphertext, "legacy": "987-65-4320"} {
+		t.Run(name, func(t *testing.T) {
+			doc := bson.D{{Key: "ssn", Value: ssn}, {Key: "email", Value: "a@b.c"}}
+			got, err := redactResult(mongo.NewSingleResultFromDocument(doc, nil, nil), coll, []string{"ssn"})
+			if err != nil {
+				t.Fatalf("redactResult() error = %v", err)
+			}
+			if want := (bson.M{"ssn": RedactedMarker, "email": "a@b.c"}); !reflect.DeepEqual(got, want) {
+				t.Errorf("redactResult() = %v, want %v", got, want)
+			}
+		})
+	}
+}
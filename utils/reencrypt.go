@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReEncryptDocument rewrites the given fields (dotted paths) of a single document through the
+// encrypting client, so they are encrypted per its current schema, e.g. to fix a document written
+// in plaintext or with the wrong algorithm. The values are read through the encrypting client,
+// which decrypts ciphertext and returns plaintext as is, and set again. A field that is already
+// correctly encrypted is rewritten with the same plaintext, so the call is safe to repeat. Fields
+// missing from the document are skipped.
+//
+// The read and the write are not atomic; a concurrent update of the fields between them is
+// overwritten.
+func ReEncryptDocument(
+	ctx context.Context, rawClient, encClient *mongo.Client, coll CollRef, id interface{}, fields []string,
+) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields to re-encrypt")
+	}
+	projection := bson.D{}
+	for _, field := range fields {
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	opts := options.FindOne().SetProjection(projection)
+
+	// The stored document tells which fields are present, whatever their state.
+	var stored bson.Raw
+	err := coll.Collection(rawClient).FindOne(ctx, bson.M{"_id": id}, opts).Decode(&stored)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("document %v not found in %s: %w", id, coll, err)
+		}
+		return fmt.Errorf("failed to read document %v from %s: %w", id, coll, err)
+	}
+	var decrypted bson.Raw
+	if err := coll.Collection(encClient).FindOne(ctx, bson.M{"_id": id}, opts).Decode(&decrypted); err != nil {
+		return fmt.Errorf("failed to read and decrypt document %v from %s: %w", id, coll, err)
+	}
+
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		if _, err := stored.LookupErr(path...); err != nil {
+			continue
+		}
+		if _, err := decrypted.LookupErr(path...); err != nil {
+			return fmt.Errorf("field '%s' of document %v could not be decrypted", field, id)
+		}
+	}
+	return reEncryptFields(ctx, encClient, coll, id, decrypted, fields)
+}
+
+// EncryptExistingField encrypts a field that was stored in plaintext before it was added to the
+// schema: it streams the documents whose field (a dotted path) has a plaintext value, through the
+// regular client, and sets the value again through the encrypting client, which encrypts it per
+// its schema. Documents whose field is already ciphertext, null or missing are skipped, so an
+// interrupted migration resumes where it stopped when run again, and a completed one migrates
+// nothing. The values are normalized like the insert helpers do. It returns the number of
+// documents migrated.
+//
+// As with ReEncryptDocument, a concurrent update of the field between the read and the write is
+// overwritten.
+func EncryptExistingField(
+	ctx context.Context, rawClient, encClient *mongo.Client, coll CollRef, field string,
+) (int64, error) {
+	if field == "" {
+		return 0, fmt.Errorf("field name is required")
+	}
+	filter := bson.M{field: bson.M{"$exists": true, "$not": bson.M{"$type": bson.A{"binData", "null"}}}}
+	opts := options.Find().SetProjection(bson.M{field: 1}).SetSort(bson.M{"_id": 1})
+	cursor, err := coll.Collection(rawClient).Find(ctx, filter, opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the plaintext '%s' values in %s: %w", field, coll, err)
+	}
+	defer cursor.Close(ctx)
+
+	var migrated int64
+	for cursor.Next(ctx) {
+		id := cursor.Current.Lookup("_id")
+		plaintext, ok, err := plaintextValue(cursor.Current, field)
+		if err != nil {
+			return migrated, fmt.Errorf("document %v: %w", id, err)
+		}
+		if !ok {
+			continue
+		}
+		update := bson.M{"$set": bson.M{field: plaintext}}
+		if _, err := coll.Collection(encClient).UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+			return migrated, fmt.Errorf("failed to encrypt '%s' of document %v in %s: %w", field, id, coll, err)
+		}
+		migrated++
+	}
+	if err := cursor.Err(); err != nil {
+		return migrated, fmt.Errorf("failed to iterate %s: %w", coll, err)
+	}
+	return migrated, nil
+}
+
+// plaintextValue returns the plaintext value, normalized, of the field of a document, and false
+// if there is nothing to encrypt: the field is missing, null or already ciphertext.
+func plaintextValue(doc bson.Raw, field string) (interface{}, bool, error) {
+	value, err := doc.LookupErr(strings.Split(field, ".")...)
+	if err != nil || value.Type == bson.TypeNull || value.Type == bson.TypeBinary {
+		return nil, false, nil
+	}
+	var plaintext interface{}
+	if err := value.Unmarshal(&plaintext); err != nil {
+		return nil, false, fmt.Errorf("failed to decode '%s': %w", field, err)
+	}
+	return normalizeValue(field, plaintext), true, nil
+}
+
+// Progress reports the state of a ReEncryptCollection run.
+type Progress struct {
+	// The documents processed so far, including those of the runs it resumed, and the documents
+	// in the collection when the run started.
+	Processed int64
+	Total     int64
+	// The documents that failed to re-encrypt in this run.
+	Errors int64
+}
+
+// The collection, in the database of the re-encrypted collection, that holds the resume markers
+// of the ReEncryptCollection runs.
+const _reEncryptProgressCollection = "reEncryptProgress"
+
+type reEncryptMarker struct {
+	LastID    bson.RawValue `bson:"lastId"`
+	Processed int64         `bson:"processed"`
+}
+
+// ReEncryptCollection re-encrypts the given fields of every document, as ReEncryptDocument does
+// for one, in _id order. progress, which may be nil, is called after each document. The _id of
+// each processed document is saved as a resume marker right after it, so a run that is
+// interrupted (or fails) continues after it when called again with the same fields, instead of
+// starting over; the marker is removed once the run completes. The _ids must be of a single BSON
+// type for the order to hold.
+//
+// Only a crash between the update of a document and the save of its marker has the next run
+// process that one document again, which is harmless: re-encrypting a document sets the same
+// plaintext again, as ReEncryptDocument does. Its Processed count then includes it twice.
+//
+// A document that fails to re-encrypt doesn't stop the run; the failed _ids are returned in the
+// error at the end, to be fixed with ReEncryptDocument.
+func ReEncryptCollection(
+	ctx context.Context, rawClient, encClient *mongo.Client, coll CollRef, fields []string,
+	progress func(Progress),
+) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields to re-encrypt")
+	}
+	markers := rawClient.Database(coll.Database).Collection(_reEncryptProgressCollection)
+	markerID := coll.Name + ":" + strings.Join(fields, ",")
+
+	var marker reEncryptMarker
+	err := markers.FindOne(ctx, bson.M{"_id": markerID}).Decode(&marker)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("failed to read the resume marker of %s: %w", coll, err)
+	}
+	filter := resumeFilter(marker)
+
+	total, err := coll.Collection(rawClient).CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("failed to count the documents of %s: %w", coll, err)
+	}
+	state := Progress{Processed: marker.Processed, Total: total}
+	saveMarker := func(marker reEncryptMarker) error {
+		// Record a processed document even if ctx is canceled meanwhile.
+		_, err := markers.ReplaceOne(context.WithoutCancel(ctx), bson.M{"_id": markerID}, marker,
+			options.Replace().SetUpsert(true))
+		if err != nil {
+			return fmt.Errorf("failed to save the resume marker of %s: %w", coll, err)
+		}
+		return nil
+	}
+
+	projection := bson.D{}
+	for _, field := range fields {
+		projection = append(projection, bson.E{Key: field, Value: 1})
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetProjection(projection)
+	// The encrypting client decrypts the fields, whether they are ciphertext or plaintext.
+	cursor, err := coll.Collection(encClient).Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", coll, err)
+	}
+	defer cursor.Close(ctx)
+
+	reEncrypt := func(id bson.RawValue, doc bson.Raw) error {
+		return reEncryptFields(ctx, encClient, coll, id, doc, fields)
+	}
+	failed, err := reEncryptDocuments(ctx, cursor, coll, state, reEncrypt, saveMarker, progress)
+	if err != nil {
+		return err
+	}
+
+	if _, err := markers.DeleteOne(ctx, bson.M{"_id": markerID}); err != nil {
+		return fmt.Errorf("failed to remove the resume marker of %s: %w", coll, err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to re-encrypt %d documents of %s: %v", len(failed), coll, failed)
+	}
+	return nil
+}
+
+// resumeFilter selects the documents after the resume marker, or all of them without one.
+func resumeFilter(marker reEncryptMarker) bson.M {
+	if marker.LastID.Type == 0 {
+		return bson.M{}
+	}
+	return bson.M{"_id": bson.M{"$gt": marker.LastID}}
+}
+
+// reEncryptDocuments re-encrypts the documents of the cursor with reEncrypt, in order, from the
+// progress of the runs it resumes, and saves the resume marker after each one. It returns the
+// _ids of the documents that failed to re-encrypt.
+func reEncryptDocuments(
+	ctx context.Context, cursor *mongo.Cursor, coll CollRef, state Progress,
+	reEncrypt func(id bson.RawValue, doc bson.Raw) error, saveMarker func(reEncryptMarker) error,
+	progress func(Progress),
+) ([]interface{}, error) {
+	var failed []interface{}
+	for cursor.Next(ctx) {
+		if ctx.Err() != nil {
+			break
+		}
+		id := cursor.Current.Lookup("_id")
+		if err := reEncrypt(id, cursor.Current); err != nil {
+			state.Errors++
+			failed = append(failed, id)
+		}
+		state.Processed++
+		if err := saveMarker(reEncryptMarker{LastID: id, Processed: state.Processed}); err != nil {
+			return failed, err
+		}
+		if progress != nil {
+			progress(state)
+		}
+	}
+	if err := cmp.Or(ctx.Err(), cursor.Err()); err != nil {
+		return failed, fmt.Errorf("re-encryption of %s stopped after %d documents: %w", coll, state.Processed, err)
+	}
+	return failed, nil
+}
+
+// reEncryptFields sets the fields of a document, as read (decrypted) through the encrypting
+// client, again through it. Fields missing from the document are skipped.
+func reEncryptFields(
+	ctx context.Context, encClient *mongo.Client, coll CollRef, id interface{}, decrypted bson.Raw, fields []string,
+) error {
+	set := bson.D{}
+	for _, field := range fields {
+		value, err := decrypted.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			continue
+		}
+		if subtype, _, ok := value.BinaryOK(); ok && subtype == _encryptedSubtype {
+			return fmt.Errorf("field '%s' of document %v is still ciphertext after decryption", field, id)
+		}
+		set = append(set, bson.E{Key: field, Value: value})
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	if _, err := coll.Collection(encClient).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		return fmt.Errorf("failed to re-encrypt document %v in %s: %w", id, coll, err)
+	}
+	return nil
+}
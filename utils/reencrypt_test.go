@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPlaintextValue picks, from a collection of mixed plaintext and encrypted documents, the
+// values EncryptExistingField migrates.
+func TestPlaintextValue(t *testing.T) {
+	setNormalizers(t, map[string]Normalizer{"profile.email": NormalizeEmail})
+	ciphertext := primitive.Binary{Subtype: 6, Data: make([]byte, 20)}
+	tests := []struct {
+		name   string
+		doc    bson.M
+		field  string
+		want   interface{}
+		wantOK bool
+	}{
+		{name: "plaintext", doc: bson.M{"ssn": "987-65-4320"}, field: "ssn", want: "987-65-4320", wantOK: true},
+		{name: "encrypted", doc: bson.M{"ssn": ciphertext}, field: "ssn"},
+		{name: "null", doc: bson.M{"ssn": nil}, field: "ssn"},
+		{name: "missing", doc: bson.M{"name": "Bob"}, field: "ssn"},
+		{name: "nested plaintext", doc: bson.M{"profile": bson.M{"email": "Bob@Example.com"}},
+			field: "profile.email", want: "bob@example.com", wantOK: true},
+		{name: "nested encrypted", doc: bson.M{"profile": bson.M{"email": ciphertext}}, field: "profile.email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := plaintextValue(raw, tt.field)
+			if err != nil {
+				t.Fatalf("plaintextValue() error = %v", err)
+			}
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("plaintextValue() = %v, %t, want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestReEncryptResume interrupts a re-encryption halfway, and resumes it from its marker: the
+// second run only re-encrypts the remaining documents, and its progress continues the first's.
+func TestReEncryptResume(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	docs := []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}, {"_id": 4}}
+	var reEncrypted []int32
+	reEncrypt := func(id bson.RawValue, _ bson.Raw) error {
+		reEncrypted = append(reEncrypted, id.Int32())
+		return nil
+	}
+	var saved reEncryptMarker
+	saveMarker := func(marker reEncryptMarker) error {
+		saved = marker
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopHalfway := func(p Progress) {
+		if p.Processed == 2 {
+			cancel()
+		}
+	}
+	state := Progress{Total: int64(len(docs))}
+	_, err := reEncryptDocuments(ctx, keyCursor(t, docs...), coll, state, reEncrypt, saveMarker, stopHalfway)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("reEncryptDocuments() error = %v, want context.Canceled", err)
+	}
+	if !reflect.DeepEqual(reEncrypted, []int32{1, 2}) || saved.LastID.Int32() != 2 || saved.Processed != 2 {
+		t.Fatalf("interrupted run re-encrypted %v and saved %+v, want [1 2] up to _id 2", reEncrypted, saved)
+	}
+
+	filter := resumeFilter(saved)
+	if want := (bson.M{"_id": bson.M{"$gt": saved.LastID}}); !reflect.DeepEqual(filter, want) {
+		t.Errorf("resumeFilter() = %v, want %v", filter, want)
+	}
+	var remaining []bson.M
+	for _, doc := range docs {
+		if doc["_id"].(int) > int(saved.LastID.Int32()) {
+			remaining = append(remaining, doc)
+		}
+	}
+	reEncrypted = nil
+	var last Progress
+	state = Progress{Processed: saved.Processed, Total: int64(len(docs))}
+	failed, err := reEncryptDocuments(context.Background(), keyCursor(t, remaining...), coll, state,
+		reEncrypt, saveMarker, func(p Progress) { last = p })
+	if err != nil || failed != nil {
+		t.Fatalf("resumed reEncryptDocuments() = %v, %v", failed, err)
+	}
+	if !reflect.DeepEqual(reEncrypted, []int32{3, 4}) {
+		t.Errorf("resumed run re-encrypted %v, want [3 4]", reEncrypted)
+	}
+	if last != (Progress{Processed: 4, Total: 4}) {
+		t.Errorf("last progress = %+v, want 4 of 4 processed", last)
+	}
+	if got := resumeFilter(reEncryptMarker{}); len(got) != 0 {
+		t.Errorf("resumeFilter() without a marker = %v, want all documents", got)
+	}
+}
+
+// TestReEncryptDocumentsFailure checks that a document that fails doesn't stop the run, and a
+// marker that can't be saved does.
+func TestReEncryptDocumentsFailure(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	docs := []bson.M{{"_id": 1}, {"_id": 2}, {"_id": 3}}
+	reEncrypt := func(id bson.RawValue, _ bson.Raw) error {
+		if id.Int32() == 2 {
+			return errors.New("write conflict")
+		}
+		return nil
+	}
+	var last Progress
+	failed, err := reEncryptDocuments(context.Background(), keyCursor(t, docs...), coll, Progress{Total: 3},
+		reEncrypt, func(reEncryptMarker) error { return nil }, func(p Progress) { last = p })
+	if err != nil || len(failed) != 1 || failed[0].(bson.RawValue).Int32() != 2 {
+		t.Errorf("reEncryptDocuments() = %v, %v, want _id 2 failed", failed, err)
+	}
+	if last != (Progress{Processed: 3, Total: 3, Errors: 1}) {
+		t.Errorf("last progress = %+v, want 3 of 3 processed, 1 error", last)
+	}
+
+	saveErr := errors.New("not primary")
+	var calls int
+	_, err = reEncryptDocuments(context.Background(), keyCursor(t, docs...), coll, Progress{Total: 3},
+		func(bson.RawValue, bson.Raw) error { calls++; return nil },
+		func(reEncryptMarker) error { return saveErr }, nil)
+	if !errors.Is(err, saveErr) || calls != 1 {
+		t.Errorf("reEncryptDocuments() = %v after %d documents, want %v after 1", err, calls, saveErr)
+	}
+}
+
+// TestReEncryptFields sets the decrypted fields of a document again, skipping the missing ones
+// and refusing a field that is still ciphertext.
+func TestReEncryptFields(t *testing.T) {
+	client := unreachableClient(t)
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: make([]byte, 20)}
+	tests := []struct {
+		name    string
+		doc     bson.M
+		wantErr string
+	}{
+		{name: "fields missing", doc: bson.M{"_id": 1, "name": "Bob"}},
+		{name: "still ciphertext", doc: bson.M{"_id": 1, "ssn": ciphertext},
+			wantErr: "field 'ssn' of document 1 is still ciphertext"},
+		// The update reaches the client, which has no server.
+		{name: "decrypted", doc: bson.M{"_id": 1, "ssn": "987-65-4320"},
+			wantErr: "failed to re-encrypt document 1 in csfle_db.users"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = reEncryptFields(context.Background(), client, coll, 1, raw, []string{"ssn", "profile.email"})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("reEncryptFields() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("reEncryptFields() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := ReEncryptDocument(context.Background(), client, client, coll, 1, nil); err == nil {
+		t.Error("ReEncryptDocument() without fields succeeded, want an error")
+	}
+}
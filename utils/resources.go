@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Resources tracks the clients and ClientEncryptions created while composing the helpers of this
+// package, so a single Close tears them all down, including on the error paths of a partially
+// completed setup.
+type Resources struct {
+	mu      sync.Mutex
+	closers []func(ctx context.Context) error
+}
+
+// AddClient tracks a client, and returns it.
+func (r *Resources) AddClient(client *mongo.Client) *mongo.Client {
+	r.add(client.Disconnect)
+	return client
+}
+
+// AddClientEncryption tracks a ClientEncryption, and returns it.
+func (r *Resources) AddClientEncryption(clientEnc *mongo.ClientEncryption) *mongo.ClientEncryption {
+	r.add(func(context.Context) error {
+		return closeClientEncryption(clientEnc, _defaultCloseTimeout)
+	})
+	return clientEnc
+}
+
+func (r *Resources) add(closer func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closers = append(r.closers, closer)
+}
+
+// Close closes everything tracked, in the reverse order it was added: a ClientEncryption is
+// closed before the key vault client it was created on. It carries on past failures and returns
+// all of them. Resources can be reused after Close.
+func (r *Resources) Close(ctx context.Context) error {
+	r.mu.Lock()
+	closers := r.closers
+	r.closers = nil
+	r.mu.Unlock()
+
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i](ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OpenKeyVault connects a regular client and creates a ClientEncryption on it for key management
+// and explicit encryption, tracking both in res.
+func OpenKeyVault(
+	ctx context.Context,
+	res *Resources,
+	keyVaultNamespace string,
+	kmsProviders map[string]map[string]interface{},
+) (*mongo.Client, *mongo.ClientEncryption, error) {
+	client, err := connectClient(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("keyvault client connect error: %w", err)
+	}
+	res.AddClient(client)
+
+	clientEncOpts, err := _config.clientEncryptionOptions(keyVaultNamespace, kmsProviders)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientEnc, err := mongo.NewClientEncryption(client, clientEncOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create client encryption: %w", err)
+	}
+	res.AddClientEncryption(clientEnc)
+	return client, clientEnc, nil
+}
+
+// SharedKeyVault is a key vault client and ClientEncryption shared by concurrent GetDek calls for
+// different tenants, so they use one connection pool instead of a connection each. The
+// ClientEncryption is configured with the KMS providers of all the tenants; the driver's
+// ClientEncryption is safe for concurrent use.
+type SharedKeyVault struct {
+	Client           *mongo.Client
+	ClientEncryption *mongo.ClientEncryption
+	// The DekStore GetDek uses, e.g. a fake in tests. When nil, it's built from the Client and
+	// ClientEncryption.
+	Store DekStore
+
+	keyVaultNamespace string
+	providers         map[string]struct{}
+}
+
+// OpenSharedKeyVault opens a SharedKeyVault for the tenants of the given provider names, loading
+// (or creating) the master key of each. The client and ClientEncryption are added to res.
+func OpenSharedKeyVault(
+	ctx context.Context, res *Resources, keyVaultNamespace string, providerNames []string,
+) (*SharedKeyVault, error) {
+	kmsProviders := make(map[string]map[string]interface{}, len(providerNames))
+	providers := make(map[string]struct{}, len(providerNames))
+	for _, providerName := range providerNames {
+		localMasterKey, err := LoadOrCreateMasterKey(providerName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load or create master key of %s: %v", providerName, err)
+		}
+		kmsProviders[providerName] = map[string]interface{}{"key": localMasterKey}
+		providers[providerName] = struct{}{}
+	}
+	client, clientEnc, err := OpenKeyVault(ctx, res, keyVaultNamespace, kmsProviders)
+	if err != nil {
+		return nil, err
+	}
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedKeyVault{
+		Client:            client,
+		ClientEncryption:  clientEnc,
+		Store:             NewDekStore(clientEnc, keyVault),
+		keyVaultNamespace: keyVaultNamespace,
+		providers:         providers,
+	}, nil
+}
+
+// check fails if the shared key vault can't serve the provider in the key vault namespace.
+func (s *SharedKeyVault) check(keyVaultNamespace, providerName string) error {
+	if s.Store == nil && (s.Client == nil || s.ClientEncryption == nil) {
+		return fmt.Errorf("shared key vault has no client or ClientEncryption")
+	}
+	// A SharedKeyVault put together by hand is trusted to match.
+	if s.providers == nil {
+		return nil
+	}
+	if s.keyVaultNamespace != keyVaultNamespace {
+		return fmt.Errorf("shared key vault is for %s, not %s", s.keyVaultNamespace, keyVaultNamespace)
+	}
+	if _, ok := s.providers[providerName]; !ok {
+		return fmt.Errorf("shared key vault has no KMS provider %s", providerName)
+	}
+	return nil
+}
+
+// dekStore returns the Store of the shared key vault, or the DekStore of its ClientEncryption.
+func (s *SharedKeyVault) dekStore(keyVaultNamespace string) (DekStore, error) {
+	if s.Store != nil {
+		return s.Store, nil
+	}
+	keyVault, err := keyVaultCollection(s.Client, keyVaultNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return NewDekStore(s.ClientEncryption, keyVault), nil
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestResourcesClose(t *testing.T) {
+	var res Resources
+	var closed []string
+	errKeyVault := errors.New("key vault client already disconnected")
+	res.add(func(context.Context) error { closed = append(closed, "key vault client"); return errKeyVault })
+	res.add(func(context.Context) error { closed = append(closed, "client encryption"); return nil })
+	res.add(func(context.Context) error { closed = append(closed, "encrypting client"); return nil })
+
+	err := res.Close(context.Background())
+	if !errors.Is(err, errKeyVault) {
+		t.Errorf("Close() error = %v, want %v", err, errKeyVault)
+	}
+	want := []string{"encrypting client", "client encryption", "key vault client"}
+	if !reflect.DeepEqual(closed, want) {
+		t.Errorf("closed %v, want %v", closed, want)
+	}
+	if err := res.Close(context.Background()); err != nil || len(closed) != 3 {
+		t.Errorf("Close() again = %v and closed %v, want nothing left to close", err, closed)
+	}
+}
+
+// TestOpenKeyVaultFailsMidSetup fails to create the ClientEncryption after the key vault client
+// was connected: the client is tracked, so the deferred Close disconnects it.
+func TestOpenKeyVaultFailsMidSetup(t *testing.T) {
+	SetConfig(Config{URI: "mongodb://localhost:27017"})
+	t.Cleanup(func() { SetConfig(Config{}) })
+
+	var res Resources
+	kmsProviders := map[string]map[string]interface{}{"local:100": {"key": []byte("short")}}
+	_, _, err := OpenKeyVault(context.Background(), &res, "encryption.__keyVault", kmsProviders)
+	if err == nil || !strings.Contains(err.Error(), "local:100") {
+		t.Fatalf("OpenKeyVault() error = %v, want the invalid local key", err)
+	}
+	if len(res.closers) != 1 {
+		t.Fatalf("Resources tracks %d resources, want the key vault client", len(res.closers))
+	}
+	if err := res.Close(context.Background()); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if len(res.closers) != 0 {
+		t.Errorf("Resources tracks %d resources after Close, want none", len(res.closers))
+	}
+}
+
+func TestSharedKeyVaultCheck(t *testing.T) {
+	opened := &SharedKeyVault{
+		Client:            &mongo.Client{},
+		ClientEncryption:  &mongo.ClientEncryption{},
+		keyVaultNamespace: "encryption.__keyVault",
+		providers:         map[string]struct{}{"local:100": {}},
+	}
+	tests := []struct {
+		name              string
+		shared            *SharedKeyVault
+		keyVaultNamespace string
+		providerName      string
+		wantErr           string
+	}{
+		{name: "opened for the provider", shared: opened,
+			keyVaultNamespace: "encryption.__keyVault", providerName: "local:100"},
+		{name: "other namespace", shared: opened, keyVaultNamespace: "other.__keyVault",
+			providerName: "local:100", wantErr: "is for encryption.__keyVault, not other.__keyVault"},
+		{name: "other provider", shared: opened, keyVaultNamespace: "encryption.__keyVault",
+			providerName: "local:200", wantErr: "has no KMS provider local:200"},
+		{name: "put together by hand", shared: &SharedKeyVault{Client: &mongo.Client{},
+			ClientEncryption: &mongo.ClientEncryption{}}, keyVaultNamespace: "other.__keyVault",
+			providerName: "local:200"},
+		{name: "no client", shared: &SharedKeyVault{}, keyVaultNamespace: "encryption.__keyVault",
+			providerName: "local:100", wantErr: "has no client or ClientEncryption"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.shared.check(tt.keyVaultNamespace, tt.providerName)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CSFLE encryption algorithms.
+const (
+	AlgorithmDeterministic = "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"
+	AlgorithmRandom        = "AEAD_AES_256_CBC_HMAC_SHA_512-Random"
+)
+
+// TenantDekAltName returns the alt name under which GetDek registers the tenant's DEK.
+func TenantDekAltName(providerName string) string {
+	return dekAltName(providerName)
+}
+
+// MergeSchemaMaps consolidates per-tenant schema maps into the single schema map of a shared
+// client. This works when every tenant has its own collection (namespace); a namespace can only
+// appear once in a schema map, so two tenants' schemas for the same namespace are rejected.
+func MergeSchemaMaps(schemaMaps ...bson.M) (bson.M, error) {
+	merged := bson.M{}
+	for _, schemaMap := range schemaMaps {
+		for namespace, schema := range schemaMap {
+			if _, ok := merged[namespace]; ok {
+				return nil, fmt.Errorf("namespace '%s' appears in more than one schema map", namespace)
+			}
+			merged[namespace] = schema
+		}
+	}
+	return merged, nil
+}
+
+// SharedCollectionSchema builds the schema for a collection that holds the documents of many
+// tenants, each encrypted under the tenant's own DEK, through a single client.
+//
+// Instead of a fixed keyId, each encrypted field references the DEK by a JSON pointer to a field in
+// the document (altNameField), which holds the tenant's DEK alt name (see TenantDekAltName). The
+// driver resolves the DEK per document at write time, so one client and one connection pool
+// serves every tenant.
+//
+// The tradeoffs against one client per tenant:
+//   - A keyId pointer is only allowed with the random algorithm, so these fields can't be used in
+//     query filters. Fields that must be queried need a per-tenant namespace and
+//     MergeSchemaMaps instead.
+//   - The one client has every tenant's KMS provider configured, so the isolation between tenants
+//     comes from the application selecting the right alt name, not from separate clients.
+//   - The alt name field is stored in plaintext and reveals which tenant owns the document.
+func SharedCollectionSchema(fields map[string]string, altNameField string) bson.M {
+	properties := bson.M{}
+	for path, bsonType := range fields {
+		properties[path] = bson.M{
+			"encrypt": bson.M{
+				"keyId":     "/" + altNameField,
+				"bsonType":  bsonType,
+				"algorithm": AlgorithmRandom,
+			},
+		}
+	}
+	return bson.M{
+		"bsonType":   "object",
+		"properties": properties,
+	}
+}
+
+// PlanCSFLEtoQE converts a CSFLE schema map into the equivalent QE encryptedFields map, to help
+// move a collection from the csfle approach to QE. Deterministic fields become QE equality fields
+// and random fields become unindexed fields. The keyIds are left nil, so CreateEncryptedCollection
+// generates new DEKs; CSFLE ciphertext can't be reused by QE and the data must be re-encrypted.
+func PlanCSFLEtoQE(schema bson.M) (bson.M, error) {
+	plan := bson.M{}
+	for namespace, collSchema := range schema {
+		schemaDoc, ok := asMap(collSchema)
+		if !ok {
+			return nil, fmt.Errorf("schema for namespace '%s' is not a document", namespace)
+		}
+		fields, err := collectEncryptedFields(schemaDoc, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema for namespace '%s': %w", namespace, err)
+		}
+
+		qeFields := make([]bson.M, 0, len(fields))
+		for _, field := range fields {
+			qeField := bson.M{
+				"keyId":    nil,
+				"path":     field.Path,
+				"bsonType": field.BSONType,
+			}
+			switch field.Algorithm {
+			case AlgorithmDeterministic:
+				qeField["queries"] = []bson.M{{"queryType": "equality"}}
+			case AlgorithmRandom:
+				// Unindexed, so there are no queries.
+			default:
+				return nil, fmt.Errorf("unknown algorithm '%s' for field '%s'", field.Algorithm, field.Path)
+			}
+			qeFields = append(qeFields, qeField)
+		}
+		plan[namespace] = bson.M{"fields": qeFields}
+	}
+	return plan, nil
+}
+
+// encryptedField is a field declared with an encrypt keyword in a CSFLE schema.
+type encryptedField struct {
+	Path      string
+	BSONType  string
+	Algorithm string
+	KeyID     interface{}
+}
+
+// collectEncryptedFields walks the properties of a CSFLE schema, including nested objects, and
+// returns the encrypted fields sorted by path. The algorithm can be inherited from the
+// encryptMetadata of an enclosing object.
+func collectEncryptedFields(schema map[string]interface{}, prefix, algorithm string) ([]encryptedField, error) {
+	if metadata, ok := asMap(schema["encryptMetadata"]); ok {
+		if algo, ok := metadata["algorithm"].(string); ok {
+			algorithm = algo
+		}
+	}
+	if schema["properties"] == nil {
+		return nil, nil
+	}
+	properties, ok := asMap(schema["properties"])
+	if !ok {
+		return nil, fmt.Errorf("properties of '%s' is not a document", prefix)
+	}
+
+	var fields []encryptedField
+	for _, name := range sortedKeys(properties) {
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		property, ok := asMap(properties[name])
+		if !ok {
+			return nil, fmt.Errorf("property '%s' is not a document", path)
+		}
+
+		if encrypt, ok := asMap(property["encrypt"]); ok {
+			field := encryptedField{Path: path, Algorithm: algorithm, KeyID: encrypt["keyId"]}
+			field.BSONType, _ = encrypt["bsonType"].(string)
+			if algo, ok := encrypt["algorithm"].(string); ok {
+				field.Algorithm = algo
+			}
+			if field.Algorithm == "" {
+				return nil, fmt.Errorf("no algorithm for field '%s'", path)
+			}
+			fields = append(fields, field)
+			continue
+		}
+
+		nested, err := collectEncryptedFields(property, path, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, nested...)
+	}
+	return fields, nil
+}
+
+// asMap returns the value as a map, accepting the document types a schema is usually built from.
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	case bson.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = e.Value
+		}
+		return m, true
+	default:
+		return nil, false
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FieldDescription is a human-readable record of an encrypted field, for security reviews and
+// external tooling.
+type FieldDescription struct {
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	BSONType  string `json:"bsonType"`
+	Algorithm string `json:"algorithm"`
+	// Whether the field can be used in an equality filter; only deterministic fields can.
+	Queryable bool `json:"queryable"`
+}
+
+// DescribeEncryptionConfig describes every encrypted field declared in a CSFLE schema map, sorted
+// by namespace and path. The result can be serialized to JSON.
+func DescribeEncryptionConfig(schema bson.M) ([]FieldDescription, error) {
+	var descriptions []FieldDescription
+	for _, namespace := range sortedKeys(schema) {
+		schemaDoc, ok := asMap(schema[namespace])
+		if !ok {
+			return nil, fmt.Errorf("schema for namespace '%s' is not a document", namespace)
+		}
+		fields, err := collectEncryptedFields(schemaDoc, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema for namespace '%s': %w", namespace, err)
+		}
+		for _, field := range fields {
+			descriptions = append(descriptions, FieldDescription{
+				Namespace: namespace,
+				Path:      field.Path,
+				BSONType:  field.BSONType,
+				Algorithm: field.Algorithm,
+				Queryable: field.Algorithm == AlgorithmDeterministic,
+			})
+		}
+	}
+	return descriptions, nil
+}
+
+// ErrMixedConfigConflict is returned when a CSFLE schema map and a QE encryptedFields map both
+// claim the same field.
+var ErrMixedConfigConflict = errors.New("CSFLE schema map and QE encryptedFields conflict")
+
+// ValidateMixedConfig checks a CSFLE schema map and a QE encryptedFields map (both keyed by
+// namespace) that are used side by side, e.g. while collections move from CSFLE to QE, and reports
+// every field both declare, or that one declares inside a field the other encrypts as a whole,
+// with ErrMixedConfigConflict. Such a field would be encrypted twice or not at all, depending on
+// the client that writes it. An encrypting client takes only one of the maps (see
+// Config.SchemaMap), so a namespace declared in both is a conflict even if its fields are
+// disjoint.
+func ValidateMixedConfig(schema, encryptedFields bson.M) error {
+	var conflicts []string
+	for _, namespace := range sortedKeys(schema) {
+		if _, ok := encryptedFields[namespace]; !ok {
+			continue
+		}
+		schemaDoc, ok := asMap(schema[namespace])
+		if !ok {
+			return fmt.Errorf("schema for namespace '%s' is not a document", namespace)
+		}
+		csfleFields, err := collectEncryptedFields(schemaDoc, "", "")
+		if err != nil {
+			return fmt.Errorf("invalid schema for namespace '%s': %w", namespace, err)
+		}
+		fieldsDoc, ok := asMap(encryptedFields[namespace])
+		if !ok {
+			return fmt.Errorf("encryptedFields for namespace '%s' is not a document", namespace)
+		}
+		qeFields, err := describeQEFields(fieldsDoc)
+		if err != nil {
+			return fmt.Errorf("invalid encryptedFields for namespace '%s': %w", namespace, err)
+		}
+
+		var overlaps []string
+		for _, csfleField := range csfleFields {
+			for _, qePath := range sortedKeys(qeFields) {
+				if pathsOverlap(csfleField.Path, qePath) {
+					overlaps = append(overlaps, fmt.Sprintf("'%s' (CSFLE) and '%s' (QE)", csfleField.Path, qePath))
+				}
+			}
+		}
+		if len(overlaps) == 0 {
+			conflicts = append(conflicts, fmt.Sprintf("%s is declared in both", namespace))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %s", namespace, strings.Join(overlaps, ", ")))
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ErrMixedConfigConflict, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// pathsOverlap reports whether two dotted paths are the same field, or one is inside the other.
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// SchemaMapFromValidator derives the CSFLE schema map of a collection from the $jsonSchema of
+// its server-side validator, so the schema is maintained in one place; the server enforces the
+// validator, so documents written without encryption are rejected, while the client encrypts
+// per the derived schema map. The result is keyed by the collection's namespace, as the client's
+// SchemaMap expects, and fails if the validator declares no encrypted field.
+func SchemaMapFromValidator(ctx context.Context, client *mongo.Client, coll CollRef) (bson.M, error) {
+	specs, err := client.Database(coll.Database).
+		ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: coll.Name}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collections: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("collection '%s' does not exist", coll)
+	}
+	return schemaMapFromOptions(coll, specs[0].Options)
+}
+
+// schemaMapFromOptions derives the schema map of a collection from the $jsonSchema validator of
+// its options, as the server lists them.
+func schemaMapFromOptions(coll CollRef, specOptions bson.Raw) (bson.M, error) {
+	var collOptions struct {
+		Validator struct {
+			JSONSchema bson.M `bson:"$jsonSchema"`
+		} `bson:"validator"`
+	}
+	if specOptions != nil {
+		if err := bson.Unmarshal(specOptions, &collOptions); err != nil {
+			return nil, fmt.Errorf("failed to decode the options of '%s': %w", coll, err)
+		}
+	}
+	schema := collOptions.Validator.JSONSchema
+	if schema == nil {
+		return nil, fmt.Errorf("collection '%s' has no $jsonSchema validator", coll)
+	}
+	fields, err := collectEncryptedFields(schema, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid $jsonSchema validator on '%s': %w", coll, err)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("the $jsonSchema validator of '%s' declares no encrypted fields", coll)
+	}
+	return bson.M{coll.String(): schema}, nil
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrCannotEncryptID is returned when _id is declared as an encrypted field. Neither CSFLE nor QE
+// can encrypt _id: the server needs its value to identify and index the document, and the driver
+// otherwise fails with a cryptic error at write time.
+var ErrCannotEncryptID = errors.New("_id cannot be encrypted; store the sensitive value in another field")
+
+// _safeContentField is the array of tags Queryable Encryption adds to documents with indexed
+// encrypted fields.
+const _safeContentField = "__safeContent__"
+
+// validateEncryptedPath rejects the paths that CSFLE and QE do not allow to be encrypted.
+func validateEncryptedPath(path string) error {
+	if path == "_id" || strings.HasPrefix(path, "_id.") {
+		return fmt.Errorf("%w: '%s'", ErrCannotEncryptID, path)
+	}
+	if path == "" {
+		return fmt.Errorf("encrypted field needs a path")
+	}
+	for _, part := range strings.Split(path, ".") {
+		if part == "" || strings.HasPrefix(part, "$") {
+			return fmt.Errorf("invalid encrypted field path '%s'", path)
+		}
+		// QE keeps its tags in __safeContent__; it's reserved in both schemas.
+		if part == _safeContentField {
+			return fmt.Errorf("'%s' is reserved by the server and cannot be encrypted", path)
+		}
+	}
+	return nil
+}
+
+// SchemaBuilder builds the JSON schema of a collection for CSFLE automatic encryption. A dotted
+// path declares a field of a nested document. The first invalid field is reported by Build.
+type SchemaBuilder struct {
+	properties bson.M
+	err        error
+}
+
+func NewSchemaBuilder() *SchemaBuilder {
+	return &SchemaBuilder{properties: bson.M{}}
+}
+
+// AddDeterministic adds a field encrypted with the deterministic algorithm, which supports
+// equality queries.
+func (b *SchemaBuilder) AddDeterministic(path, bsonType string, keyID primitive.Binary) *SchemaBuilder {
+	return b.add(path, bsonType, keyID, AlgorithmDeterministic)
+}
+
+// AddRandomObject encrypts a whole sub-document (e.g. an address) as a single ciphertext, rather
+// than field by field. It decrypts back into the nested document. An object can only be encrypted
+// with the random algorithm, so neither it nor any of its fields can be queried.
+func (b *SchemaBuilder) AddRandomObject(path string, keyID primitive.Binary) *SchemaBuilder {
+	return b.add(path, "object", keyID, AlgorithmRandom)
+}
+
+// AddRandom adds a field encrypted with the random algorithm, which can't be queried.
+func (b *SchemaBuilder) AddRandom(path, bsonType string, keyID primitive.Binary) *SchemaBuilder {
+	return b.add(path, bsonType, keyID, AlgorithmRandom)
+}
+
+func (b *SchemaBuilder) add(path, bsonType string, keyID primitive.Binary, algorithm string) *SchemaBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := validateEncryptedPath(path); err != nil {
+		b.err = err
+		return b
+	}
+	if bsonType == "" {
+		b.err = fmt.Errorf("encrypted field '%s' needs a bsonType", path)
+		return b
+	}
+	// Deterministic encryption (i.e. a queryable field) is not supported for these types.
+	if algorithm == AlgorithmDeterministic && !deterministicBSONType(bsonType) {
+		b.err = fmt.Errorf("'%s' of type %s cannot be deterministically encrypted; use random encryption",
+			path, bsonType)
+		return b
+	}
+
+	// Walk down (creating as needed) the nested object schemas of a dotted path.
+	parts := strings.Split(path, ".")
+	properties := b.properties
+	for _, part := range parts[:len(parts)-1] {
+		parent, ok := properties[part].(bson.M)
+		if !ok {
+			if _, exists := properties[part]; exists {
+				b.err = fmt.Errorf("'%s' is both an encrypted field and the parent of '%s'", part, path)
+				return b
+			}
+			parent = bson.M{"bsonType": "object", "properties": bson.M{}}
+			properties[part] = parent
+		}
+		if _, encrypted := parent["encrypt"]; encrypted {
+			b.err = fmt.Errorf("'%s' is both an encrypted field and the parent of '%s'", part, path)
+			return b
+		}
+		properties = parent["properties"].(bson.M)
+	}
+
+	name := parts[len(parts)-1]
+	if _, exists := properties[name]; exists {
+		b.err = fmt.Errorf("encrypted field '%s' is declared more than once", path)
+		return b
+	}
+	properties[name] = bson.M{
+		"encrypt": bson.M{
+			// keyId expects an array of DEK UUIDs
+			"keyId":     bson.A{keyID},
+			"bsonType":  bsonType,
+			"algorithm": algorithm,
+		},
+	}
+	return b
+}
+
+// Build returns the JSON schema of the collection.
+func (b *SchemaBuilder) Build() (bson.M, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.properties) == 0 {
+		return nil, fmt.Errorf("no encrypted fields declared")
+	}
+	return bson.M{
+		"bsonType":   "object",
+		"properties": b.properties,
+	}, nil
+}
+
+// BuildSchemaMap returns a schema map holding the collection's JSON schema under its namespace.
+func (b *SchemaBuilder) BuildSchemaMap(coll CollRef) (bson.M, error) {
+	schema, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{coll.String(): schema}, nil
+}
+
+// deterministicBSONType reports whether CSFLE allows a value of the BSON type to be encrypted with
+// the deterministic algorithm. A bool has too few values to hide, and documents, arrays and
+// floating point numbers have more than one encoding of equal values, which breaks equality on the
+// ciphertext.
+func deterministicBSONType(bsonType string) bool {
+	switch bsonType {
+	case "object", "array", "bool", "double", "decimal", "javascriptWithScope":
+		return false
+	}
+	return true
+}
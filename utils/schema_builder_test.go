@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBuildersRejectID(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	for _, path := range []string{"_id", "_id.tenant"} {
+		_, err := NewSchemaBuilder().AddDeterministic(path, "string", keyID).Build()
+		if !errors.Is(err, ErrCannotEncryptID) {
+			t.Errorf("SchemaBuilder with '%s' error = %v, want ErrCannotEncryptID", path, err)
+		}
+		_, err = NewEncryptedFieldsBuilder().AddEquality(path, "string").Build()
+		if !errors.Is(err, ErrCannotEncryptID) {
+			t.Errorf("EncryptedFieldsBuilder with '%s' error = %v, want ErrCannotEncryptID", path, err)
+		}
+	}
+}
+
+func TestBuildersRejectInvalidPaths(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	tests := []struct {
+		path    string
+		wantErr string
+	}{
+		{path: "", wantErr: "needs a path"},
+		{path: "profile..email", wantErr: "invalid encrypted field path"},
+		{path: "$ssn", wantErr: "invalid encrypted field path"},
+		{path: "__safeContent__", wantErr: "reserved by the server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := NewSchemaBuilder().AddRandom(tt.path, "string", keyID).Build()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("SchemaBuilder error = %v, want %q", err, tt.wantErr)
+			}
+			_, err = NewEncryptedFieldsBuilder().AddUnindexed(tt.path, "string").Build()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("EncryptedFieldsBuilder error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddRandomObject(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	schema, err := NewSchemaBuilder().AddRandomObject("address", keyID).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := bson.M{"encrypt": bson.M{"keyId": bson.A{keyID}, "bsonType": "object", "algorithm": AlgorithmRandom}}
+	if got := schema["properties"].(bson.M)["address"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("address = %v, want %v", got, want)
+	}
+	described, err := DescribeEncryptionConfig(bson.M{"db.users": schema})
+	if err != nil || len(described) != 1 || described[0].Queryable {
+		t.Errorf("DescribeEncryptionConfig() = %+v, %v, want address not queryable", described, err)
+	}
+
+	// Nor can an object be encrypted deterministically, or have its fields encrypted on their own.
+	if _, err := NewSchemaBuilder().AddDeterministic("address", "object", keyID).Build(); err == nil {
+		t.Error("Build() of a deterministic object succeeded, want an error")
+	}
+	_, err = NewSchemaBuilder().
+		AddRandomObject("address", keyID).
+		AddRandom("address.zip", "string", keyID).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "both an encrypted field and the parent") {
+		t.Errorf("Build() of a field inside an encrypted object error = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The collection, in the database of the key vault, holding the canonical schema of each
+// namespace.
+const _schemaRegistryCollection = "schemaRegistry"
+
+// ErrSchemaMismatch is returned when a schema differs from the canonical one registered for its
+// namespace.
+var ErrSchemaMismatch = errors.New("schema differs from the registered canonical schema")
+
+// registeredSchema is the canonical schema of a namespace. Only the encrypted fields matter, and
+// not their keyIds: clients of different tenants use different DEKs for the same fields.
+type registeredSchema struct {
+	Namespace string `bson:"_id"`
+	Hash      string `bson:"hash"`
+	// The encrypted fields, as path:bsonType:algorithm, sorted.
+	Fields []string `bson:"fields"`
+}
+
+// RegisterSchema records the schemas of a CSFLE schema map as the canonical ones of their
+// namespaces, next to the key vault, replacing the ones registered before.
+func RegisterSchema(ctx context.Context, keyVaultNamespace string, schemaMap bson.M) error {
+	schemas, err := describeSchemas(schemaMap)
+	if err != nil {
+		return err
+	}
+	return withSchemaRegistry(ctx, keyVaultNamespace, func(registry *mongo.Collection) error {
+		for _, schema := range schemas {
+			filter := bson.M{"_id": schema.Namespace}
+			_, err := registry.ReplaceOne(ctx, filter, schema, options.Replace().SetUpsert(true))
+			if err != nil {
+				return fmt.Errorf("failed to register the schema of %s: %w", schema.Namespace, err)
+			}
+		}
+		return nil
+	})
+}
+
+// VerifySchemaConsistency checks at startup that the schemas of a client's schema map match the
+// canonical ones registered for their namespaces. Two services encrypting the same collection
+// with different schemas (one encrypting email, the other not) would leave the collection
+// inconsistent, so a divergent schema is reported as ErrSchemaMismatch with the differing fields.
+func VerifySchemaConsistency(ctx context.Context, keyVaultNamespace string, schemaMap bson.M) error {
+	schemas, err := describeSchemas(schemaMap)
+	if err != nil {
+		return err
+	}
+	return withSchemaRegistry(ctx, keyVaultNamespace, func(registry *mongo.Collection) error {
+		for _, schema := range schemas {
+			var canonical registeredSchema
+			err := registry.FindOne(ctx, bson.M{"_id": schema.Namespace}).Decode(&canonical)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return fmt.Errorf("no canonical schema registered for %s", schema.Namespace)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read the canonical schema of %s: %w", schema.Namespace, err)
+			}
+			if err := compareSchema(schema, canonical); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// compareSchema reports a schema that differs from the canonical one of its namespace as
+// ErrSchemaMismatch, with the fields it adds (+) and lacks (-).
+func compareSchema(schema, canonical registeredSchema) error {
+	if canonical.Hash == schema.Hash {
+		return nil
+	}
+	var diff []string
+	for _, field := range schema.Fields {
+		if !slices.Contains(canonical.Fields, field) {
+			diff = append(diff, "+"+field)
+		}
+	}
+	for _, field := range canonical.Fields {
+		if !slices.Contains(schema.Fields, field) {
+			diff = append(diff, "-"+field)
+		}
+	}
+	return fmt.Errorf("%w for %s (hash %s, canonical %s): %s",
+		ErrSchemaMismatch, schema.Namespace, schema.Hash, canonical.Hash, strings.Join(diff, ", "))
+}
+
+// describeSchemas returns the registry entry of each namespace of a schema map.
+func describeSchemas(schemaMap bson.M) ([]registeredSchema, error) {
+	if len(schemaMap) == 0 {
+		return nil, fmt.Errorf("schema map declares no namespaces")
+	}
+	descriptions, err := DescribeEncryptionConfig(schemaMap)
+	if err != nil {
+		return nil, err
+	}
+	byNamespace := make(map[string][]string, len(schemaMap))
+	for _, d := range descriptions {
+		byNamespace[d.Namespace] = append(byNamespace[d.Namespace], d.Path+":"+d.BSONType+":"+d.Algorithm)
+	}
+	schemas := make([]registeredSchema, 0, len(schemaMap))
+	for _, namespace := range sortedKeys(schemaMap) {
+		fields := append([]string{}, byNamespace[namespace]...)
+		slices.Sort(fields)
+		sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+		schemas = append(schemas, registeredSchema{
+			Namespace: namespace,
+			Hash:      hex.EncodeToString(sum[:]),
+			Fields:    fields,
+		})
+	}
+	return schemas, nil
+}
+
+// withSchemaRegistry runs fn on the schema registry collection next to the key vault.
+func withSchemaRegistry(
+	ctx context.Context, keyVaultNamespace string, fn func(registry *mongo.Collection) error,
+) error {
+	dbName, _, err := splitNamespace(keyVaultNamespace)
+	if err != nil {
+		return err
+	}
+	client, err := connectClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+	return fn(client.Database(dbName).Collection(_schemaRegistryCollection))
+}
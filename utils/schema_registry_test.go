@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// usersSchemaMap returns the schema map of csfle_db.users, encrypting ssn and, optionally, email
+// with the given DEK.
+func usersSchemaMap(keyID primitive.Binary, withEmail bool) bson.M {
+	properties := bson.M{
+		"ssn": bson.M{"encrypt": bson.M{
+			"keyId": bson.A{keyID}, "bsonType": "string", "algorithm": AlgorithmDeterministic,
+		}},
+	}
+	if withEmail {
+		properties["email"] = bson.M{"encrypt": bson.M{
+			"keyId": bson.A{keyID}, "bsonType": "string", "algorithm": AlgorithmDeterministic,
+		}}
+	}
+	return bson.M{"csfle_db.users": bson.M{"bsonType": "object", "properties": properties}}
+}
+
+// TestCompareSchema checks that a client whose schema doesn't encrypt email is flagged against the
+// canonical schema, and that a client using another tenant's DEK isn't.
+func TestCompareSchema(t *testing.T) {
+	tenant100 := primitive.Binary{Subtype: 4, Data: []byte("tenant-100-dek-0")}
+	tenant200 := primitive.Binary{Subtype: 4, Data: []byte("tenant-200-dek-0")}
+	describe := func(schemaMap bson.M) registeredSchema {
+		t.Helper()
+		schemas, err := describeSchemas(schemaMap)
+		if err != nil {
+			t.Fatalf("describeSchemas() error = %v", err)
+		}
+		if len(schemas) != 1 {
+			t.Fatalf("describeSchemas() = %v, want one namespace", schemas)
+		}
+		return schemas[0]
+	}
+	canonical := describe(usersSchemaMap(tenant100, true))
+
+	if err := compareSchema(describe(usersSchemaMap(tenant200, true)), canonical); err != nil {
+		t.Errorf("compareSchema() of the schema with another DEK error = %v", err)
+	}
+
+	divergent := describe(usersSchemaMap(tenant100, false))
+	if divergent.Hash == canonical.Hash {
+		t.Fatalf("the divergent schema has the canonical hash %s", canonical.Hash)
+	}
+	err := compareSchema(divergent, canonical)
+	want := "-email:string:" + AlgorithmDeterministic
+	if !errors.Is(err, ErrSchemaMismatch) || !strings.Contains(err.Error(), want) {
+		t.Errorf("compareSchema() of a schema without email error = %v, want ErrSchemaMismatch lacking email", err)
+	}
+}
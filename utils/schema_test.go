@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestSharedCollectionSchema checks that the documents of two tenants in one collection select
+// their own DEK through the alt name field, with the one schema of a shared client.
+func TestSharedCollectionSchema(t *testing.T) {
+	schema := SharedCollectionSchema(map[string]string{"ssn": "string", "email": "string"}, "dekAltName")
+	want := bson.M{"encrypt": bson.M{"keyId": "/dekAltName", "bsonType": "string", "algorithm": AlgorithmRandom}}
+	for _, field := range []string{"ssn", "email"} {
+		if got := schema["properties"].(bson.M)[field]; !reflect.DeepEqual(got, want) {
+			t.Errorf("SharedCollectionSchema() %s = %v, want %v", field, got, want)
+		}
+	}
+
+	tenant100 := bson.M{"ssn": "987-65-4320", "dekAltName": TenantDekAltName("local:100")}
+	tenant200 := bson.M{"ssn": "987-65-4321", "dekAltName": TenantDekAltName("local:200")}
+	if tenant100["dekAltName"] != dekAltName("local:100") || tenant200["dekAltName"] != dekAltName("local:200") {
+		t.Errorf("TenantDekAltName() = %v, %v, want the alt names GetDek registers",
+			tenant100["dekAltName"], tenant200["dekAltName"])
+	}
+	if tenant100["dekAltName"] == tenant200["dekAltName"] {
+		t.Errorf("the two tenants share the DEK alt name %v", tenant100["dekAltName"])
+	}
+}
+
+func TestMergeSchemaMaps(t *testing.T) {
+	tenant100 := bson.M{"db_100.users": bson.M{"bsonType": "object"}}
+	tenant200 := bson.M{"db_200.users": bson.M{"bsonType": "object"}}
+	merged, err := MergeSchemaMaps(tenant100, tenant200)
+	if err != nil {
+		t.Fatalf("MergeSchemaMaps() error = %v", err)
+	}
+	if len(merged) != 2 || merged["db_100.users"] == nil || merged["db_200.users"] == nil {
+		t.Errorf("MergeSchemaMaps() = %v, want both namespaces", merged)
+	}
+
+	_, err = MergeSchemaMaps(tenant100, bson.M{"db_100.users": bson.M{"bsonType": "object"}})
+	if err == nil || !strings.Contains(err.Error(), "more than one schema map") {
+		t.Errorf("MergeSchemaMaps() of a shared namespace error = %v", err)
+	}
+}
+
+func TestPlanCSFLEtoQE(t *testing.T) {
+	schema := bson.M{"db.users": bson.M{
+		"bsonType": "object",
+		"properties": bson.M{
+			"notes": bson.M{"encrypt": bson.M{"bsonType": "string", "algorithm": AlgorithmRandom}},
+		},
+	}}
+	plan, err := PlanCSFLEtoQE(schema)
+	if err != nil {
+		t.Fatalf("PlanCSFLEtoQE() error = %v", err)
+	}
+	want := bson.M{"db.users": bson.M{"fields": []bson.M{{"keyId": nil, "path": "notes", "bsonType": "string"}}}}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("PlanCSFLEtoQE() = %v, want the random field unindexed %v", plan, want)
+	}
+
+	schema["db.users"].(bson.M)["properties"].(bson.M)["notes"] = bson.M{
+		"encrypt": bson.M{"bsonType": "string", "algorithm": "AES_256_GCM"},
+	}
+	if _, err := PlanCSFLEtoQE(schema); err == nil || !strings.Contains(err.Error(), "unknown algorithm") {
+		t.Errorf("PlanCSFLEtoQE() with an unknown algorithm error = %v", err)
+	}
+}
+
+func TestValidateMixedConfig(t *testing.T) {
+	encrypt := func(bsonType string) bson.M {
+		return bson.M{"encrypt": bson.M{"bsonType": bsonType, "algorithm": AlgorithmDeterministic}}
+	}
+	schema := bson.M{
+		"db.users": bson.M{"bsonType": "object", "properties": bson.M{
+			"ssn":     encrypt("string"),
+			"profile": bson.M{"bsonType": "object", "properties": bson.M{"email": encrypt("string")}},
+		}},
+		"db.orders": bson.M{"bsonType": "object", "properties": bson.M{"card": encrypt("string")}},
+	}
+	qeFields := func(paths ...string) bson.M {
+		var fields []bson.M
+		for _, path := range paths {
+			fields = append(fields, bson.M{"keyId": nil, "path": path, "bsonType": "string"})
+		}
+		return bson.M{"fields": fields}
+	}
+
+	tests := []struct {
+		name            string
+		encryptedFields bson.M
+		wantErr         []string
+	}{
+		{name: "other namespaces", encryptedFields: bson.M{"db.payments": qeFields("ssn")}},
+		{name: "same field", encryptedFields: bson.M{"db.users": qeFields("ssn", "age")},
+			wantErr: []string{"db.users: 'ssn' (CSFLE) and 'ssn' (QE)"}},
+		{name: "field inside an encrypted one", encryptedFields: bson.M{"db.users": qeFields("profile")},
+			wantErr: []string{"'profile.email' (CSFLE) and 'profile' (QE)"}},
+		{name: "disjoint fields of one namespace", encryptedFields: bson.M{"db.orders": qeFields("total")},
+			wantErr: []string{"db.orders is declared in both"}},
+		{name: "every conflict", encryptedFields: bson.M{
+			"db.users":  qeFields("ssn"),
+			"db.orders": qeFields("card"),
+		}, wantErr: []string{"'ssn' (CSFLE)", "'card' (CSFLE)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMixedConfig(schema, tt.encryptedFields)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("ValidateMixedConfig() error = %v", err)
+				}
+				return
+			}
+			for _, want := range tt.wantErr {
+				if !errors.Is(err, ErrMixedConfigConflict) || !strings.Contains(err.Error(), want) {
+					t.Errorf("ValidateMixedConfig() error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestSchemaMapFromOptions applies the schema of csfle_db.users (that of cmd/csfle) as a
+// validator, and derives the schema map back from the collection options the server lists.
+func TestSchemaMapFromOptions(t *testing.T) {
+	keyID := primitive.Binary{Subtype: 4, Data: []byte("tenant-100-dek-0")}
+	schemaMap := usersSchemaMap(keyID, true)
+	collOptions, err := bson.Marshal(bson.M{
+		"validator":       bson.M{"$jsonSchema": schemaMap["csfle_db.users"]},
+		"validationLevel": "strict",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := schemaMapFromOptions(CollRef{Database: "csfle_db", Name: "users"}, collOptions)
+	if err != nil {
+		t.Fatalf("schemaMapFromOptions() error = %v", err)
+	}
+	// Compare the BSON of both, since the derived one is decoded with BSON's Go types.
+	roundTrip := func(m bson.M) bson.M {
+		data, err := bson.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded bson.M
+		if err := bson.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		return decoded
+	}
+	if want := roundTrip(schemaMap); !reflect.DeepEqual(got, want) {
+		t.Errorf("schemaMapFromOptions() = %v, want %v", got, want)
+	}
+
+	invalid := map[string]bson.M{
+		"no validator":        {"validationLevel": "strict"},
+		"no $jsonSchema":      {"validator": bson.M{"ssn": bson.M{"$type": "binData"}}},
+		"no encrypted fields": {"validator": bson.M{"$jsonSchema": bson.M{"bsonType": "object"}}},
+		"no algorithm": {"validator": bson.M{"$jsonSchema": bson.M{"properties": bson.M{
+			"ssn": bson.M{"encrypt": bson.M{"bsonType": "string"}}}}}},
+	}
+	for name, opts := range invalid {
+		data, err := bson.Marshal(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := schemaMapFromOptions(CollRef{Database: "csfle_db", Name: "users"}, data); err == nil {
+			t.Errorf("schemaMapFromOptions() with %s = %v, want an error", name, got)
+		}
+	}
+}
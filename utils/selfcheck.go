@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SelfCheckSchema encrypts and decrypts a sample value of the bsonType of each encrypted field of
+// a collection schema, with the field's algorithm and the given DEK, to confirm at startup that
+// the configuration works before real traffic arrives. It reports the first field that fails,
+// e.g. a deterministic field of a type the algorithm doesn't allow.
+func SelfCheckSchema(ctx context.Context, clientEnc ExplicitCipher, schema bson.M, dek primitive.Binary) error {
+	fields, err := collectEncryptedFields(schema, "", "")
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("schema declares no encrypted fields")
+	}
+
+	for _, field := range fields {
+		if field.Algorithm == AlgorithmDeterministic && !deterministicBSONType(field.BSONType) {
+			return fmt.Errorf("field '%s': the deterministic algorithm cannot encrypt %s values",
+				field.Path, field.BSONType)
+		}
+		sample, ok := sampleValue(field.BSONType)
+		if !ok {
+			return fmt.Errorf("field '%s': no sample value for bsonType '%s'", field.Path, field.BSONType)
+		}
+		raw, err := toRawValue(sample)
+		if err != nil {
+			return fmt.Errorf("field '%s': %w", field.Path, err)
+		}
+
+		opts := options.Encrypt().SetKeyID(dek).SetAlgorithm(field.Algorithm)
+		ciphertext, err := clientEnc.Encrypt(ctx, raw, opts)
+		if err != nil {
+			return fmt.Errorf("field '%s': failed to encrypt a %s value with %s: %w",
+				field.Path, field.BSONType, field.Algorithm, err)
+		}
+		decrypted, err := clientEnc.Decrypt(ctx, ciphertext)
+		if err != nil {
+			return fmt.Errorf("field '%s': failed to decrypt the sample value: %w", field.Path, err)
+		}
+		if decrypted.Type != raw.Type || !bytes.Equal(decrypted.Value, raw.Value) {
+			return fmt.Errorf("field '%s': the sample value did not survive the round trip", field.Path)
+		}
+	}
+	return nil
+}
+
+// sampleValue returns a value of the BSON type. A field without a bsonType (allowed for the
+// random algorithm) is checked with a string.
+func sampleValue(bsonType string) (interface{}, bool) {
+	switch bsonType {
+	case "", "string":
+		return "self-check", true
+	case "int":
+		return int32(42), true
+	case "long":
+		return int64(42), true
+	case "double":
+		return 4.2, true
+	case "decimal":
+		d, _ := primitive.ParseDecimal128("4.2")
+		return d, true
+	case "bool":
+		return true, true
+	case "date":
+		return primitive.NewDateTimeFromTime(time.Unix(0, 0)), true
+	case "objectId":
+		return primitive.NewObjectID(), true
+	case "binData":
+		return primitive.Binary{Data: []byte("self-check")}, true
+	case "object":
+		return bson.D{{Key: "check", Value: "self-check"}}, true
+	case "array":
+		return bson.A{"self-check"}, true
+	case "timestamp":
+		return primitive.Timestamp{T: 1}, true
+	case "regex":
+		return primitive.Regex{Pattern: "self-check"}, true
+	case "javascript":
+		return primitive.JavaScript("1"), true
+	default:
+		return nil, false
+	}
+}
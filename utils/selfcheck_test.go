@@ -0,0 +1,54 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestSelfCheckSchema(t *testing.T) {
+	field := func(bsonType, algorithm string) bson.M {
+		return bson.M{"encrypt": bson.M{"bsonType": bsonType, "algorithm": algorithm}}
+	}
+	tests := []struct {
+		name       string
+		properties bson.M
+		encryptErr error
+		wantErr    string
+	}{
+		{name: "deterministic ssn", properties: bson.M{
+			"ssn":     field("string", utils.AlgorithmDeterministic),
+			"profile": bson.M{"bsonType": "object", "properties": bson.M{"age": field("int", utils.AlgorithmRandom)}},
+		}},
+		{name: "deterministic double", properties: bson.M{"salary": field("double", utils.AlgorithmDeterministic)},
+			wantErr: "field 'salary': the deterministic algorithm cannot encrypt double values"},
+		{name: "random double", properties: bson.M{"salary": field("double", utils.AlgorithmRandom)}},
+		{name: "no encrypted fields", properties: bson.M{"name": bson.M{"bsonType": "string"}},
+			wantErr: "schema declares no encrypted fields"},
+		{name: "encryption fails", properties: bson.M{"ssn": field("string", utils.AlgorithmDeterministic)},
+			encryptErr: errors.New("KMS unavailable"), wantErr: "field 'ssn': failed to encrypt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := testutil.NewFakeKeyVault()
+			dek := fake.AddKey("local:100", "dek-local:100")
+			fake.EncryptErr = tt.encryptErr
+			schema := bson.M{"bsonType": "object", "properties": tt.properties}
+			err := utils.SelfCheckSchema(context.Background(), fake, schema, dek)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("SelfCheckSchema() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("SelfCheckSchema() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
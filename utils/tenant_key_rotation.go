@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The prefix of the provider name the DEKs are wrapped under while RotateTenantKey runs. Its
+// leading underscore keeps it out of the tenants' names: GetProviderName rejects such org ids, and
+// ParseProviderName and the environment split of provider names reject such names.
+const _rotationProviderPrefix = "local:_rotation"
+
+// RotateTenantKey replaces the local master key of a tenant with a freshly generated one, and
+// rewraps the tenant's DEKs, selected by their alt names (the dek-<provider> DEK, and the DEK pool
+// of EnsureDeks, dek-<provider>-<i>, which the same key wraps), under it with RewrapManyDataKey.
+// It returns the number of DEKs rewrapped; when the provider has no DEKs, nothing is rotated.
+// Other DEKs wrapped by the provider's key are not rewrapped, and can't be unwrapped once the key
+// is replaced.
+//
+// A ClientEncryption knows a single key per provider name, so the DEKs can't be rewrapped from the
+// old key to the new one under the same name in one step. They are first rewrapped under the new
+// key with a staging provider name (local:_rotation_<name>), then moved back to the tenant's
+// provider name, and only then is the new key written to disk, as the next generation of the
+// master key. If any step fails, the DEKs are rewrapped back under the old key and the new key is
+// discarded, so the data stays decryptable with the key that was on disk before; the old key file
+// is never modified. Other processes fail to unwrap the DEKs until the new key is on disk, so
+// rotate while the tenant is idle.
+func RotateTenantKey(ctx context.Context, providerName, keyVaultNamespace string) (int64, error) {
+	if backend, _, _ := strings.Cut(providerName, ":"); backend != "local" {
+		return 0, fmt.Errorf("provider '%s' is not a local provider; rotate its key in its KMS", providerName)
+	}
+	if err := AssertMasterKeyPersisted(providerName); err != nil {
+		return 0, err
+	}
+	oldKey, err := LoadOrCreateMasterKey(providerName)
+	if err != nil {
+		return 0, err
+	}
+	newKey, err := generateMasterKey()
+	if err != nil {
+		return 0, err
+	}
+	staging := rotationProviderName(providerName)
+
+	// The first ClientEncryption unwraps with the old key and wraps with the new one under the
+	// staging name, and so moves the DEKs from the staging name back under the old key on rollback;
+	// the second moves the DEKs between the tenant's provider name and the staging name under the
+	// new key.
+	var res Resources
+	defer res.Close(ctx)
+	client, toStaging, err := OpenKeyVault(ctx, &res, keyVaultNamespace, map[string]map[string]interface{}{
+		providerName: {"key": oldKey},
+		staging:      {"key": newKey},
+	})
+	if err != nil {
+		return 0, err
+	}
+	clientEncOpts, err := _config.clientEncryptionOptions(keyVaultNamespace, map[string]map[string]interface{}{
+		providerName: {"key": newKey},
+		staging:      {"key": newKey},
+	})
+	if err != nil {
+		return 0, err
+	}
+	toProvider, err := mongo.NewClientEncryption(client, clientEncOpts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create client encryption: %w", err)
+	}
+	res.AddClientEncryption(toProvider)
+	keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+	if err != nil {
+		return 0, err
+	}
+
+	return rotateTenantKey(ctx, toStaging, toProvider, providerName, newKey, func(filter, update bson.M) error {
+		_, err := keyVault.UpdateMany(ctx, filter, update)
+		return err
+	})
+}
+
+// rotateTenantKey rotates the master key of the provider to newKey with the ClientEncryptions of
+// RotateTenantKey, stores newKey as the next generation once the DEKs are rewrapped, and records
+// that generation on the tenant's DEKs with the update setGeneration applies to the filter.
+func rotateTenantKey(
+	ctx context.Context, toStaging, toProvider KeyVault, providerName string, newKey []byte,
+	setGeneration func(filter, update bson.M) error,
+) (int64, error) {
+	var generation int
+	staging := rotationProviderName(providerName)
+	rewrapped, err := rotateTenantDeks(ctx, toStaging, toProvider, providerName, staging,
+		func() (err error) {
+			generation, err = rotateMasterKey(providerName, newKey)
+			return err
+		},
+	)
+	if err != nil || rewrapped == 0 {
+		return rewrapped, err
+	}
+
+	filter := bson.M{"keyAltNames": bson.M{"$regex": tenantAltNamePattern(providerName)}}
+	update := bson.M{"$set": bson.M{_dekMasterKeyGenerationField: generation}}
+	if err := setGeneration(filter, update); err != nil {
+		return rewrapped, fmt.Errorf("rotated the master key of %s, but failed to record its generation: %w",
+			providerName, err)
+	}
+	EncryptionContextFrom(ctx).Logger.InfoContext(ctx, "rotated tenant master key",
+		"provider", providerName, "generation", generation, "deks", rewrapped)
+	return rewrapped, nil
+}
+
+// rotationProviderName returns the staging provider name of a local provider, e.g.
+// local:_rotation_100 for local:100, or local:_rotation for the unnamed local provider.
+func rotationProviderName(providerName string) string {
+	if _, name, ok := strings.Cut(providerName, ":"); ok {
+		return _rotationProviderPrefix + "_" + name
+	}
+	return _rotationProviderPrefix
+}
+
+// rotateTenantDeks runs the rewraps of RotateTenantKey on the DEKs with the tenant's alt names:
+// toStaging unwraps them with the old key and wraps them with the new one under the staging name,
+// toProvider wraps them back under the provider name, and persist then stores the new key. A
+// failure of any step is rolled back in two phases: toProvider first moves any DEKs the second
+// rewrap already wrapped under the provider name (with the new key) back to the staging name, then
+// toStaging wraps every staged DEK under the old key and the provider name again. A DEK under the
+// provider name can't be unwrapped by toStaging, which only knows the old key for that name, so
+// the phases can't be merged into one rewrap.
+func rotateTenantDeks(
+	ctx context.Context, toStaging, toProvider KeyVault, providerName, staging string, persist func() error,
+) (int64, error) {
+	altNames := bson.M{"$regex": tenantAltNamePattern(providerName)}
+	rewrap := func(kv KeyVault, from, to string) (int64, error) {
+		result, err := kv.RewrapManyDataKey(ctx, bson.M{"keyAltNames": altNames, "masterKey.provider": from},
+			options.RewrapManyDataKey().SetProvider(to))
+		return rewrappedCount(result), err
+	}
+
+	rewrapped, err := rewrap(toStaging, providerName, staging)
+	if err != nil {
+		err = fmt.Errorf("failed to rewrap the DEKs of %s under the new master key: %w", providerName, err)
+	} else if rewrapped == 0 {
+		return 0, nil
+	}
+	// The second rewrap may move some of the DEKs before it fails.
+	movedBack := false
+	if err == nil {
+		movedBack = true
+		if _, err = rewrap(toProvider, staging, providerName); err != nil {
+			err = fmt.Errorf("failed to rewrap the DEKs of %s back under its provider name: %w", providerName, err)
+		}
+	}
+	if err == nil {
+		err = persist()
+	}
+	if err == nil {
+		return rewrapped, nil
+	}
+
+	// Wrap the DEKs under the old key again: the new key is only known to this call.
+	var rollbackErr error
+	if movedBack {
+		_, rollbackErr = rewrap(toProvider, providerName, staging)
+	}
+	if rollbackErr == nil {
+		_, rollbackErr = rewrap(toStaging, staging, providerName)
+	}
+	if rollbackErr != nil {
+		// Keep the new key rather than lose it with the DEKs it wraps.
+		_ = persist()
+		return 0, fmt.Errorf("failed to rotate the master key of %s: %w; rolling back failed too, the DEKs "+
+			"need the new master key to be unwrapped: %w", providerName, err, rollbackErr)
+	}
+	return 0, fmt.Errorf("failed to rotate the master key of %s, the DEKs were rewrapped under the old "+
+		"master key: %w", providerName, err)
+}
+
+func rewrappedCount(result *mongo.RewrapManyDataKeyResult) int64 {
+	if result == nil || result.BulkWriteResult == nil {
+		return 0
+	}
+	return result.BulkWriteResult.ModifiedCount
+}
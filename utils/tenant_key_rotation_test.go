@@ -0,0 +1,336 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rewrapRecorder is the KeyVault of one of the ClientEncryptions of RotateTenantKey. It records
+// each rewrap as "<vault>: <from provider> -> <to provider>" and, when failAltName is set, fails
+// the rewrap from failFrom after moving only the DEK with that alt name, like a RewrapManyDataKey
+// that fails part way through its bulk write.
+type rewrapRecorder struct {
+	*testutil.FakeKeyVault
+	name        string
+	calls       *[]string
+	failFrom    string
+	failAltName string
+}
+
+func (r *rewrapRecorder) RewrapManyDataKey(
+	ctx context.Context, filter interface{}, opts ...*options.RewrapManyDataKeyOptions,
+) (*mongo.RewrapManyDataKeyResult, error) {
+	from := filter.(bson.M)["masterKey.provider"]
+	to := *options.MergeRewrapManyDataKeyOptions(opts...).Provider
+	*r.calls = append(*r.calls, fmt.Sprintf("%s: %s -> %s", r.name, from, to))
+	if r.failAltName != "" && from == r.failFrom {
+		partial := bson.M{"keyAltNames": r.failAltName}
+		if _, err := r.FakeKeyVault.RewrapManyDataKey(ctx, partial, opts...); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("bulk write interrupted")
+	}
+	return r.FakeKeyVault.RewrapManyDataKey(ctx, filter, opts...)
+}
+
+// tenantKeyVault returns a key vault with the DEK and a pool DEK of local:100, a DEK of the
+// provider that isn't the tenant's, and the DEKs of other tenants, and their providers by alt name.
+func tenantKeyVault() (*testutil.FakeKeyVault, map[string]string) {
+	kv := testutil.NewFakeKeyVault()
+	providers := map[string]string{
+		"dek-local:100":    "local:100",
+		"dek-local:100-0":  "local:100",
+		"legacy-local:100": "local:100",
+		"dek-local:1000":   "local:1000",
+		"dek-local:200":    "local:200",
+	}
+	for altName, provider := range providers {
+		kv.AddKey(provider, altName)
+	}
+	return kv, providers
+}
+
+func providersByAltName(kv *testutil.FakeKeyVault) map[string]string {
+	providers := map[string]string{}
+	for _, key := range kv.Keys() {
+		providers[key["keyAltNames"].([]string)[0]] = key["masterKey"].(bson.M)["provider"].(string)
+	}
+	return providers
+}
+
+func TestRotateTenantDeks(t *testing.T) {
+	kv, want := tenantKeyVault()
+	var calls []string
+	toStaging := &rewrapRecorder{FakeKeyVault: kv, name: "old", calls: &calls}
+	toProvider := &rewrapRecorder{FakeKeyVault: kv, name: "new", calls: &calls}
+
+	rewrapped, err := utils.RotateTenantDeks(context.Background(), toStaging, toProvider,
+		"local:100", "local:_rotation_100",
+		func() error { calls = append(calls, "persist"); return nil },
+	)
+	if err != nil {
+		t.Fatalf("rotateTenantDeks() error = %v", err)
+	}
+	if rewrapped != 2 {
+		t.Errorf("rotateTenantDeks() = %d DEKs, want 2", rewrapped)
+	}
+	// The new key is only persisted once both rewraps succeeded.
+	wantCalls := []string{
+		"old: local:100 -> local:_rotation_100",
+		"new: local:_rotation_100 -> local:100",
+		"persist",
+	}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("steps = %q, want %q", calls, wantCalls)
+	}
+	if got := providersByAltName(kv); !reflect.DeepEqual(got, want) {
+		t.Errorf("DEK providers = %v, want %v", got, want)
+	}
+}
+
+func TestRotateTenantDeksNoDeks(t *testing.T) {
+	kv := testutil.NewFakeKeyVault()
+	kv.AddKey("local:100", "legacy-local:100")
+	kv.AddKey("local:200", "dek-local:200")
+	var calls []string
+	persisted := false
+	rewrapped, err := utils.RotateTenantDeks(context.Background(),
+		&rewrapRecorder{FakeKeyVault: kv, name: "old", calls: &calls},
+		&rewrapRecorder{FakeKeyVault: kv, name: "new", calls: &calls},
+		"local:100", "local:_rotation_100",
+		func() error { persisted = true; return nil },
+	)
+	if err != nil || rewrapped != 0 {
+		t.Fatalf("rotateTenantDeks() = %d, %v, want 0, nil", rewrapped, err)
+	}
+	if persisted {
+		t.Error("the new master key was persisted without any DEK to rotate")
+	}
+}
+
+// TestRotateTenantDeksRollback fails the rotation at each step, and checks every DEK ends up
+// under the tenant's provider name and the old key, i.e. last rewrapped there by the vault that
+// knows the old key, and that the new key is never persisted.
+func TestRotateTenantDeksRollback(t *testing.T) {
+	tests := []struct {
+		name       string
+		failFirst  bool
+		failSecond bool
+		persistErr error
+		wantCalls  []string
+	}{
+		{
+			name:      "first rewrap fails part way",
+			failFirst: true,
+			wantCalls: []string{
+				"old: local:100 -> local:_rotation_100",
+				"old: local:_rotation_100 -> local:100",
+			},
+		},
+		{
+			name:       "second rewrap fails part way",
+			failSecond: true,
+			wantCalls: []string{
+				"old: local:100 -> local:_rotation_100",
+				"new: local:_rotation_100 -> local:100",
+				"new: local:100 -> local:_rotation_100",
+				"old: local:_rotation_100 -> local:100",
+			},
+		},
+		{
+			name:       "persisting the new key fails",
+			persistErr: errors.New("disk full"),
+			wantCalls: []string{
+				"old: local:100 -> local:_rotation_100",
+				"new: local:_rotation_100 -> local:100",
+				"persist",
+				"new: local:100 -> local:_rotation_100",
+				"old: local:_rotation_100 -> local:100",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv, want := tenantKeyVault()
+			var calls []string
+			toStaging := &rewrapRecorder{FakeKeyVault: kv, name: "old", calls: &calls}
+			toProvider := &rewrapRecorder{FakeKeyVault: kv, name: "new", calls: &calls}
+			// Fail only the rewrap of the step; the rollback's rewraps go the other way.
+			if tt.failFirst {
+				toStaging.failFrom, toStaging.failAltName = "local:100", "dek-local:100"
+			}
+			if tt.failSecond {
+				toProvider.failFrom, toProvider.failAltName = "local:_rotation_100", "dek-local:100"
+			}
+
+			rewrapped, err := utils.RotateTenantDeks(context.Background(), toStaging, toProvider,
+				"local:100", "local:_rotation_100",
+				func() error { calls = append(calls, "persist"); return tt.persistErr },
+			)
+			if err == nil {
+				t.Fatal("rotateTenantDeks() succeeded, want an error")
+			}
+			if tt.persistErr != nil && !errors.Is(err, tt.persistErr) {
+				t.Errorf("rotateTenantDeks() error = %v, want %v", err, tt.persistErr)
+			}
+			if rewrapped != 0 {
+				t.Errorf("rotateTenantDeks() = %d DEKs, want 0", rewrapped)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("steps = %q, want %q", calls, tt.wantCalls)
+			}
+			if got := providersByAltName(kv); !reflect.DeepEqual(got, want) {
+				t.Errorf("DEK providers = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestRotateTenantDeksRollbackFails checks that the new key is persisted when the DEKs can't be
+// rewrapped back under the old one, since they can only be unwrapped with it then.
+func TestRotateTenantDeksRollbackFails(t *testing.T) {
+	kv := testutil.NewFakeKeyVault()
+	kv.AddKey("local:100", "dek-local:100")
+	var calls []string
+	toStaging := &rewrapRecorder{FakeKeyVault: kv, name: "old", calls: &calls,
+		failFrom: "local:_rotation_100", failAltName: "none"}
+	toProvider := &rewrapRecorder{FakeKeyVault: kv, name: "new", calls: &calls,
+		failFrom: "local:_rotation_100", failAltName: "none"}
+
+	_, err := utils.RotateTenantDeks(context.Background(), toStaging, toProvider,
+		"local:100", "local:_rotation_100",
+		func() error { calls = append(calls, "persist"); return nil },
+	)
+	if err == nil || !strings.Contains(err.Error(), "rolling back failed too") {
+		t.Fatalf("rotateTenantDeks() error = %v, want the rollback to fail", err)
+	}
+	if calls[len(calls)-1] != "persist" {
+		t.Errorf("steps = %q, want the new master key persisted last", calls)
+	}
+}
+
+// setGenerationOf applies the generation update of rotateTenantKey to the DEKs of the fake whose
+// alt names match the filter.
+func setGenerationOf(kv *testutil.FakeKeyVault) func(filter, update bson.M) error {
+	return func(filter, update bson.M) error {
+		pattern := regexp.MustCompile(filter["keyAltNames"].(bson.M)["$regex"].(string))
+		for _, key := range kv.Keys() {
+			for _, altName := range key["keyAltNames"].([]string) {
+				if !pattern.MatchString(altName) {
+					continue
+				}
+				if err := kv.AnnotateKey(context.Background(), key["_id"].(primitive.Binary),
+					update["$set"].(bson.M)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		return nil
+	}
+}
+
+func generationsByAltName(kv *testutil.FakeKeyVault) map[string]interface{} {
+	generations := map[string]interface{}{}
+	for _, key := range kv.Keys() {
+		if generation, ok := key["masterKeyGeneration"]; ok {
+			generations[key["keyAltNames"].([]string)[0]] = generation
+		}
+	}
+	return generations
+}
+
+// TestRotateTenantKey rotates the master key of local:100, successfully and with a failing
+// rewrap, and checks the key files on disk and the generation recorded on the DEKs.
+func TestRotateTenantKey(t *testing.T) {
+	tests := []struct {
+		name            string
+		failSecond      bool
+		wantGeneration  int
+		wantGenerations map[string]interface{}
+	}{
+		{name: "success", wantGeneration: 1,
+			wantGenerations: map[string]interface{}{"dek-local:100": 1, "dek-local:100-0": 1}},
+		{name: "rewrap fails", failSecond: true, wantGenerations: map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			oldKey, err := utils.LoadOrCreateMasterKey("local:100")
+			if err != nil {
+				t.Fatal(err)
+			}
+			oldKeyFile := filepath.Join("keys", "local:100_master_key.bin")
+			newKey := bytes.Repeat([]byte{9}, len(oldKey))
+
+			kv, _ := tenantKeyVault()
+			var calls []string
+			toStaging := &rewrapRecorder{FakeKeyVault: kv, name: "old", calls: &calls}
+			toProvider := &rewrapRecorder{FakeKeyVault: kv, name: "new", calls: &calls}
+			if tt.failSecond {
+				toProvider.failFrom, toProvider.failAltName = "local:_rotation_100", "dek-local:100"
+			}
+			rewrapped, err := utils.RotateTenantKeyWith(context.Background(), toStaging, toProvider,
+				"local:100", newKey, setGenerationOf(kv))
+			if tt.failSecond != (err != nil) {
+				t.Fatalf("rotateTenantKey() = %d, %v", rewrapped, err)
+			}
+
+			if stored, err := os.ReadFile(oldKeyFile); err != nil || !bytes.Equal(stored, oldKey) {
+				t.Errorf("old master key file = %x, %v, want it untouched", stored, err)
+			}
+			if generation, err := utils.CurrentMasterKeyGeneration("local:100"); err != nil ||
+				generation != tt.wantGeneration {
+				t.Errorf("CurrentMasterKeyGeneration() = %d, %v, want %d", generation, err, tt.wantGeneration)
+			}
+			wantKey := oldKey
+			if tt.wantGeneration > 0 {
+				wantKey = newKey
+			}
+			if current, err := utils.LoadOrCreateMasterKey("local:100"); err != nil || !bytes.Equal(current, wantKey) {
+				t.Errorf("LoadOrCreateMasterKey() = %x, %v, want %x", current, err, wantKey)
+			}
+			if got := generationsByAltName(kv); !reflect.DeepEqual(got, tt.wantGenerations) {
+				t.Errorf("DEK generations = %v, want %v", got, tt.wantGenerations)
+			}
+		})
+	}
+}
+
+// TestRotationProviderName checks that no tenant can own a staging provider name: neither parser
+// accepts one, and GetProviderName can't build one.
+func TestRotationProviderName(t *testing.T) {
+	seen := map[string]bool{}
+	for _, providerName := range []string{"local", "local:100", "local:prod_100", "local:rotation"} {
+		staging := utils.RotationProviderName(providerName)
+		if seen[staging] {
+			t.Errorf("rotationProviderName(%s) = %s, which another provider also stages under", providerName, staging)
+		}
+		seen[staging] = true
+		if _, orgID, err := utils.ParseProviderName(staging); err == nil {
+			t.Errorf("ParseProviderName(%s) = org %s, want an error", staging, orgID)
+		}
+		if _, env, orgID, err := utils.ParseProviderNameWithEnv(staging); err == nil {
+			t.Errorf("ParseProviderNameWithEnv(%s) = %s, %s, want an error", staging, env, orgID)
+		}
+		don := "don:identity:dvrv-us-1:devo/" + strings.TrimPrefix(staging, "local:")
+		if got, err := utils.GetProviderName(don); err == nil {
+			t.Errorf("GetProviderName(%s) = %s, want an error", don, got)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Package testutil provides in-memory test doubles for the utils package.
+package testutil
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	_deterministicAlgorithm = "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"
+	_encryptedSubtype       = 6
+	_uuidSubtype            = 4
+)
+
+// FakeKeyVault is an in-memory utils.KeyVault. Its "ciphertext" has the same header layout as the
+// real one (blob subtype, DEK UUID, BSON type), followed by the plaintext as is; it's only fit for
+// tests.
+type FakeKeyVault struct {
+	mu   sync.Mutex
+	keys map[string]bson.M
+
+	// When set, the corresponding operation fails with the error.
+	CreateErr   error
+	EncryptErr  error
+	DecryptErr  error
+	RewrapErr   error
+	DeleteErr   error
+	AnnotateErr error
+
+	// The number of calls made to each operation.
+	LookupCalls  int
+	CreateCalls  int
+	DecryptCalls int
+}
+
+func NewFakeKeyVault() *FakeKeyVault {
+	return &FakeKeyVault{keys: make(map[string]bson.M)}
+}
+
+// AddKey seeds a DEK wrapped by the given provider, and returns its UUID.
+func (f *FakeKeyVault) AddKey(provider string, altNames ...string) primitive.Binary {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addKey(provider, altNames)
+}
+
+func (f *FakeKeyVault) addKey(provider string, altNames []string) primitive.Binary {
+	data := make([]byte, 16)
+	_, _ = rand.Read(data)
+	id := primitive.Binary{Subtype: _uuidSubtype, Data: data}
+	f.keys[string(data)] = bson.M{
+		"_id":         id,
+		"keyAltNames": altNames,
+		"masterKey":   bson.M{"provider": provider},
+	}
+	return id
+}
+
+// Keys returns a copy of the DEK documents.
+func (f *FakeKeyVault) Keys() []bson.M {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]bson.M, 0, len(f.keys))
+	for _, key := range f.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (f *FakeKeyVault) GetKeyByAltName(_ context.Context, keyAltName string) *mongo.SingleResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.LookupCalls++
+	for _, key := range f.keys {
+		for _, altName := range key["keyAltNames"].([]string) {
+			if altName == keyAltName {
+				return mongo.NewSingleResultFromDocument(key, nil, nil)
+			}
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (f *FakeKeyVault) CreateDataKey(
+	_ context.Context, kmsProvider string, opts ...*options.DataKeyOptions,
+) (primitive.Binary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.CreateCalls++
+	if f.CreateErr != nil {
+		return primitive.Binary{}, f.CreateErr
+	}
+	var altNames []string
+	for _, opt := range opts {
+		if opt != nil && opt.KeyAltNames != nil {
+			altNames = opt.KeyAltNames
+		}
+	}
+	return f.addKey(kmsProvider, altNames), nil
+}
+
+func (f *FakeKeyVault) Encrypt(
+	_ context.Context, val bson.RawValue, opts ...*options.EncryptOptions,
+) (primitive.Binary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.EncryptErr != nil {
+		return primitive.Binary{}, f.EncryptErr
+	}
+	var keyID *primitive.Binary
+	algorithm := ""
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if opt.KeyID != nil {
+			keyID = opt.KeyID
+		}
+		algorithm = opt.Algorithm
+	}
+	if keyID == nil {
+		return primitive.Binary{}, errors.New("fake key vault: no key id")
+	}
+	if _, ok := f.keys[string(keyID.Data)]; !ok {
+		return primitive.Binary{}, fmt.Errorf("fake key vault: unknown key id %x", keyID.Data)
+	}
+
+	blobSubtype := byte(2)
+	if algorithm == _deterministicAlgorithm {
+		blobSubtype = 1
+	}
+	data := append([]byte{blobSubtype}, keyID.Data...)
+	data = append(data, byte(val.Type))
+	data = append(data, val.Value...)
+	return primitive.Binary{Subtype: _encryptedSubtype, Data: data}, nil
+}
+
+func (f *FakeKeyVault) Decrypt(_ context.Context, val primitive.Binary) (bson.RawValue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.DecryptCalls++
+	if f.DecryptErr != nil {
+		return bson.RawValue{}, f.DecryptErr
+	}
+	if val.Subtype != _encryptedSubtype || len(val.Data) < 18 {
+		return bson.RawValue{}, errors.New("fake key vault: not a ciphertext")
+	}
+	if _, ok := f.keys[string(val.Data[1:17])]; !ok {
+		return bson.RawValue{}, fmt.Errorf("fake key vault: unknown key id %x", val.Data[1:17])
+	}
+	return bson.RawValue{Type: bsontype.Type(val.Data[17]), Value: val.Data[18:]}, nil
+}
+
+// RewrapManyDataKey rewraps the DEKs matching the filter, which may be empty or match on
+// keyAltNames (a string or a $regex) and masterKey.provider, under opts' provider.
+func (f *FakeKeyVault) RewrapManyDataKey(
+	_ context.Context, filter interface{}, opts ...*options.RewrapManyDataKeyOptions,
+) (*mongo.RewrapManyDataKeyResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.RewrapErr != nil {
+		return nil, f.RewrapErr
+	}
+	var provider *string
+	for _, opt := range opts {
+		if opt != nil && opt.Provider != nil {
+			provider = opt.Provider
+		}
+	}
+
+	altName, _ := filterValue(filter, "keyAltNames")
+	altNamePattern, err := filterRegex(filter, "keyAltNames")
+	if err != nil {
+		return nil, err
+	}
+	keyProvider, _ := filterValue(filter, "masterKey.provider")
+	var modified int64
+	for _, key := range f.keys {
+		if altName != "" && !hasAltName(key, altName) {
+			continue
+		}
+		if altNamePattern != nil && !matchesAltName(key, altNamePattern) {
+			continue
+		}
+		if keyProvider != "" && key["masterKey"].(bson.M)["provider"] != keyProvider {
+			continue
+		}
+		if provider != nil {
+			key["masterKey"] = bson.M{"provider": *provider}
+		}
+		modified++
+	}
+	return &mongo.RewrapManyDataKeyResult{
+		BulkWriteResult: &mongo.BulkWriteResult{MatchedCount: modified, ModifiedCount: modified},
+	}, nil
+}
+
+func (f *FakeKeyVault) DeleteKey(_ context.Context, id primitive.Binary) (*mongo.DeleteResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DeleteErr != nil {
+		return nil, f.DeleteErr
+	}
+	if _, ok := f.keys[string(id.Data)]; !ok {
+		return &mongo.DeleteResult{}, nil
+	}
+	delete(f.keys, string(id.Data))
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+// AnnotateKey sets the fields on the DEK document, as returned by Keys and GetKeyByAltName.
+func (f *FakeKeyVault) AnnotateKey(_ context.Context, id primitive.Binary, fields bson.M) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.AnnotateErr != nil {
+		return f.AnnotateErr
+	}
+	key, ok := f.keys[string(id.Data)]
+	if !ok {
+		return fmt.Errorf("fake key vault: unknown key id %x", id.Data)
+	}
+	for field, value := range fields {
+		key[field] = value
+	}
+	return nil
+}
+
+// AddKeyAltName adds the alt name to the DEK. An alt name already used by another DEK fails with a
+// duplicate key error, as the unique index of the key vault does.
+func (f *FakeKeyVault) AddKeyAltName(
+	_ context.Context, id primitive.Binary, keyAltName string,
+) *mongo.SingleResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[string(id.Data)]
+	if !ok {
+		return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+	}
+	for otherID, other := range f.keys {
+		if otherID != string(id.Data) && hasAltName(other, keyAltName) {
+			return mongo.NewSingleResultFromDocument(bson.M{}, mongo.WriteException{
+				WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error"}},
+			}, nil)
+		}
+	}
+	before := copyKey(key)
+	if !hasAltName(key, keyAltName) {
+		key["keyAltNames"] = append(key["keyAltNames"].([]string), keyAltName)
+	}
+	return mongo.NewSingleResultFromDocument(before, nil, nil)
+}
+
+// RemoveKeyAltName removes the alt name from the DEK.
+func (f *FakeKeyVault) RemoveKeyAltName(
+	_ context.Context, id primitive.Binary, keyAltName string,
+) *mongo.SingleResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[string(id.Data)]
+	if !ok {
+		return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+	}
+	before := copyKey(key)
+	var altNames []string
+	for _, name := range key["keyAltNames"].([]string) {
+		if name != keyAltName {
+			altNames = append(altNames, name)
+		}
+	}
+	key["keyAltNames"] = altNames
+	return mongo.NewSingleResultFromDocument(before, nil, nil)
+}
+
+func copyKey(key bson.M) bson.M {
+	copied := make(bson.M, len(key))
+	for field, value := range key {
+		copied[field] = value
+	}
+	copied["keyAltNames"] = append([]string(nil), key["keyAltNames"].([]string)...)
+	return copied
+}
+
+// filterValue returns the value a filter requires a string field to equal.
+func filterValue(filter interface{}, field string) (string, bool) {
+	switch f := filter.(type) {
+	case bson.M:
+		value, ok := f[field].(string)
+		return value, ok
+	case bson.D:
+		for _, e := range f {
+			if e.Key == field {
+				value, ok := e.Value.(string)
+				return value, ok
+			}
+		}
+	}
+	return "", false
+}
+
+// filterRegex returns the pattern of a {"$regex": <pattern>} condition of a filter on the field,
+// or nil if there's none.
+func filterRegex(filter interface{}, field string) (*regexp.Regexp, error) {
+	f, ok := filter.(bson.M)
+	if !ok {
+		return nil, nil
+	}
+	condition, ok := f[field].(bson.M)
+	if !ok {
+		return nil, nil
+	}
+	pattern, ok := condition["$regex"].(string)
+	if !ok {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func matchesAltName(key bson.M, pattern *regexp.Regexp) bool {
+	for _, name := range key["keyAltNames"].([]string) {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAltName(key bson.M, altName string) bool {
+	for _, name := range key["keyAltNames"].([]string) {
+		if name == altName {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ utils.DekStore          = (*FakeKeyVault)(nil)
+	_ utils.KeyAltNameManager = (*FakeKeyVault)(nil)
+)
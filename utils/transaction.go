@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// WithEncryptedTransaction runs fn in a transaction on a session of the encrypting client, and
+// commits it if fn returns nil, or aborts it otherwise. Every operation fn runs with sessCtx goes
+// through the client, so it is encrypted and decrypted as usual; operations on another client, or
+// with another context, are not part of the transaction. The driver retries the whole callback on
+// transient transaction errors, so fn must be safe to run more than once.
+//
+// The driver reads the DEKs through its key vault client, outside the transaction, so they don't
+// need to be in a collection the transaction can read.
+func WithEncryptedTransaction(
+	ctx context.Context, client *mongo.Client, fn func(sessCtx mongo.SessionContext) error,
+) error {
+	// Snapshot reads and majority writes, so the documents committed together are also read
+	// together.
+	txnOpts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.Majority())
+	err := client.UseSession(ctx, func(sessCtx mongo.SessionContext) error {
+		_, err := sessCtx.WithTransaction(sessCtx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sessCtx)
+		}, txnOpts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("encrypted transaction failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestWithEncryptedTransaction runs callbacks that write nothing, which the driver commits and
+// aborts without a server.
+func TestWithEncryptedTransaction(t *testing.T) {
+	client := unreachableClient(t)
+	insertFailed := errors.New("insert of the account failed")
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{name: "commit"},
+		{name: "abort", err: insertFailed, wantErr: insertFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := WithEncryptedTransaction(context.Background(), client, func(sessCtx mongo.SessionContext) error {
+				calls++
+				if mongo.SessionFromContext(sessCtx) == nil {
+					t.Error("the callback context has no session")
+				}
+				return tt.err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("WithEncryptedTransaction() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != 1 {
+				t.Errorf("callback called %d times, want 1", calls)
+			}
+		})
+	}
+}
@@ -2,11 +2,8 @@ package utils
 
 import (
 	"context"
-	"crypto/rand"
-	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -19,81 +16,147 @@ func GetProviderName(devOrgDON string) (string, error) {
 	// Find the value after last /
 	lastSlashIndex := strings.LastIndex(devOrgDON, "/")
 	if lastSlashIndex > 0 {
-		devOrgDON = devOrgDON[lastSlashIndex+1:]
-		return fmt.Sprintf("local:%s", devOrgDON), nil
+		org := devOrgDON[lastSlashIndex+1:]
+		// The org becomes the name of a named provider, which GetDek and the key vault only accept
+		// in the characters of _providerNamePattern. A leading underscore is reserved for the
+		// staging names of RotateTenantKey.
+		if !_providerNamePattern.MatchString(org) || strings.HasPrefix(org, "_") {
+			return "", fmt.Errorf("invalid Dev org DON format: %s", devOrgDON)
+		}
+		return fmt.Sprintf("local:%s", org), nil
 	}
 	return "", fmt.Errorf("invalid Dev org DON format: %s", devOrgDON)
 }
 
+// GetDek returns the DEK of the tenant, creating it if it doesn't exist yet, and the KMS
+// providers to use it with. By default it opens and closes its own key vault connection; when
+// warming many tenants concurrently, pass a SharedKeyVault so the calls share one connection pool.
+// The provider is the tenant's local provider; use GetDekFor for a cloud KMS.
 func GetDek(
 	ctx context.Context,
 	providerName string,
-	keyVaultNamespace string) (
+	keyVaultNamespace string,
+	shared ...*SharedKeyVault) (
 	dataKey *primitive.Binary, kmsProviders map[string]map[string]interface{}, err error,
 ) {
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, nil, fmt.Errorf("MONGODB_URI environment variable is not set")
-	}
-
 	// Load or create the local master key from the file system.
-	localMasterKey, err := LoadOrCreateMasterKey(providerName)
+	provider, err := NewLocalKmsProvider(providerName)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to load or create master key: %v", err)
 	}
+	return GetDekFor(ctx, provider, keyVaultNamespace, shared...)
+}
 
+// GetDekFor is GetDek for a tenant whose DEK is wrapped by the given KMS provider, e.g. a
+// GcpKmsProvider, and is created with the provider's master key document.
+func GetDekFor(
+	ctx context.Context,
+	provider KmsProvider,
+	keyVaultNamespace string,
+	shared ...*SharedKeyVault) (
+	dataKey *primitive.Binary, kmsProviders map[string]map[string]interface{}, err error,
+) {
+	providerName := provider.ProviderName()
 	// Construct the KMS providers map.
-	kmsProviders = map[string]map[string]interface{}{
-		providerName: {"key": localMasterKey},
-	}
-
-	// Create a regular MongoDB client for key operations.
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	kmsProviders, err = KmsProvidersMap(provider)
 	if err != nil {
-		return nil, nil, fmt.Errorf("keyvault client connect error: %v", err)
+		return nil, nil, err
 	}
-	defer client.Disconnect(ctx)
 
-	// This is used for key management operations.
-	clientEnc, err := mongo.NewClientEncryption(client,
-		options.ClientEncryption().
-			SetKeyVaultNamespace(keyVaultNamespace).
-			SetKmsProviders(kmsProviders),
-	)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create client encryption: %v", err)
+	// The DEK id for a tenant does not change once created, so we skip the key vault round trip if
+	// we resolved it recently.
+	keyAltName := dekAltName(providerName)
+	cacheKey := dekCacheKey(keyVaultNamespace, keyAltName)
+	ec := EncryptionContextFrom(ctx)
+	if cached, ok := _dekCache.Get(cacheKey); ok {
+		ec.Metrics.Count("dek_cache_hits", 1)
+		return &cached, kmsProviders, nil
 	}
-	defer clientEnc.Close(ctx)
+	ec.Metrics.Count("dek_cache_misses", 1)
 
-	keyAltName := fmt.Sprintf("dek-%s", providerName)
-	singleResult := clientEnc.GetKeyByAltName(ctx, keyAltName)
+	var store DekStore
+	if len(shared) > 0 && shared[0] != nil {
+		if err := shared[0].check(keyVaultNamespace, providerName); err != nil {
+			return nil, nil, err
+		}
+		if store, err = shared[0].dekStore(keyVaultNamespace); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// Create a regular MongoDB client and a ClientEncryption for key management operations.
+		// Both are closed on return, whether or not the setup completes.
+		var res Resources
+		defer res.Close(ctx)
+		client, clientEnc, err := OpenKeyVault(ctx, &res, keyVaultNamespace, kmsProviders)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyVault, err := keyVaultCollection(client, keyVaultNamespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		store = NewDekStore(clientEnc, keyVault)
+	}
 
-	var dekDoc bson.D
-	err = singleResult.Decode(&dekDoc)
+	id, created, err := resolveDekByAltName(ctx, store, providerName, keyAltName, provider.MasterKeyDoc())
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			fmt.Printf("DEK with alt name '%s' not found, creating a new one.\n", keyAltName)
-			opts := options.DataKey().SetKeyAltNames([]string{keyAltName})
-			newDekResult, err := clientEnc.CreateDataKey(ctx, providerName, opts)
-			if err != nil {
-				return nil, nil, fmt.Errorf("failed to create DEK: %v", err)
-			}
-			return &newDekResult, kmsProviders, nil
+		return nil, nil, err
+	}
+	if created {
+		if err := initDek(ctx, store, providerName, id); err != nil {
+			return nil, nil, err
 		}
-		return nil, nil, fmt.Errorf("failed to decode DEK lookup result: %w", err)
 	}
+	_dekCache.Put(cacheKey, id)
+	return &id, kmsProviders, nil
+}
 
-	fmt.Printf("Found existing DEK with alt name: %s\n", keyAltName)
+// initDek completes the setup of a DEK just created in the key vault: it records the master key
+// generation and the expiration on the datakey document, and registers the DEK with the
+// OnDEKCreated hook.
+func initDek(ctx context.Context, store DekStore, providerName string, id primitive.Binary) error {
+	// Record which generation of the local master key wrapped the new DEK, for auditing and staged
+	// rotation. A cloud KMS versions its keys itself.
+	fields := bson.M{}
+	if backend, _, _ := strings.Cut(providerName, ":"); backend == "local" {
+		generation, err := CurrentMasterKeyGeneration(providerName)
+		if err != nil {
+			return err
+		}
+		fields[_dekMasterKeyGenerationField] = generation
+	}
+	if _config.DEKLifetime > 0 {
+		fields[_dekExpiresAtField] = _config.now().Add(_config.DEKLifetime)
+	}
+	if err := store.AnnotateKey(ctx, id, fields); err != nil {
+		return err
+	}
+	if err := registerDek(ctx, store, providerName, id); err != nil {
+		return err
+	}
+	ec := EncryptionContextFrom(ctx)
+	ec.Metrics.Count("deks_created", 1)
+	ec.Logger.InfoContext(ctx, "created DEK",
+		"provider", providerName, "keyId", fmt.Sprintf("%x", id.Data), "actor", ec.Actor)
+	return nil
+}
 
-	idVal, ok := dekDoc.Map()["_id"]
-	if !ok {
-		return nil, nil, fmt.Errorf("DEK document missing _id field")
+// registerDek runs the configured OnDEKCreated hook for a new DEK, and deletes the DEK if it
+// fails, so the key vault holds no DEK the external inventory doesn't know about.
+func registerDek(ctx context.Context, store DekStore, providerName string, keyID primitive.Binary) error {
+	if _config.OnDEKCreated == nil {
+		return nil
 	}
-	id, ok := idVal.(primitive.Binary)
-	if !ok {
-		return nil, nil, fmt.Errorf("DEK _id field is not of type primitive.Binary")
+	hookErr := _config.OnDEKCreated(providerName, keyID)
+	if hookErr == nil {
+		return nil
 	}
-	return &id, kmsProviders, nil
+	if _, err := store.DeleteKey(ctx, keyID); err != nil {
+		return fmt.Errorf("DEK creation hook failed: %w; deleting the new DEK %x failed too: %w",
+			hookErr, keyID.Data, err)
+	}
+	_dekCache.InvalidateDek(keyID)
+	return fmt.Errorf("DEK creation hook failed, the new DEK was deleted: %w", hookErr)
 }
 
 func NewEncClient(
@@ -103,67 +166,68 @@ func NewEncClient(
 	kmsProviders map[string]map[string]interface{},
 	bypassAutoEncryption bool,
 ) (*mongo.Client, error) {
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		return nil, fmt.Errorf("MONGODB_URI environment variable is not set")
-	}
-
 	autoEncryptionOpts := options.AutoEncryption().
 		SetKeyVaultNamespace(keyVaultNamespace).
 		SetKmsProviders(kmsProviders).
 		// Provide the schema map for automatic encryption/decryption.
 		SetSchemaMap(schemaMap).
 		SetBypassAutoEncryption(bypassAutoEncryption)
+	return connectEncClient(ctx, _config, autoEncryptionOpts)
+}
 
-	client, err := mongo.Connect(ctx, options.Client().
-		ApplyURI(uri).
-		SetAutoEncryptionOptions(autoEncryptionOpts),
-	)
+// NewEncClientFor is NewEncClient with the KMS providers given as KmsProvider values, e.g. a
+// LocalKmsProvider and an AzureKmsProvider for data spread across both.
+func NewEncClientFor(
+	ctx context.Context,
+	keyVaultNamespace string,
+	schemaMap bson.M,
+	providers []KmsProvider,
+	bypassAutoEncryption bool,
+) (*mongo.Client, error) {
+	kmsProviders, err := KmsProvidersMap(providers...)
 	if err != nil {
-		return nil, fmt.Errorf("encryption client failed to connect: %w", err)
+		return nil, err
 	}
-	return client, nil
+	return NewEncClient(ctx, keyVaultNamespace, schemaMap, kmsProviders, bypassAutoEncryption)
 }
 
 func LoadOrCreateMasterKey(providerName string) ([]byte, error) {
-	const (
-		keySize                 = 96
-		masterKeyDirPermissions = 0700
-		masterKeyDir            = "keys"
-	)
+	const keySize = _masterKeySize
 
 	key := make([]byte, keySize)
 
-	// Construct the file path within the _masterKeyDir
-	filePath := filepath.Join(masterKeyDir, fmt.Sprintf("%s_master_key.bin", providerName))
-
 	// Ensure the directory exists
-	if err := os.MkdirAll(masterKeyDir, masterKeyDirPermissions); err != nil {
-		return nil, fmt.Errorf("failed to create master key directory '%s': %w", masterKeyDir, err)
+	if err := os.MkdirAll(_masterKeyDir, _masterKeyDirPermissions); err != nil {
+		return nil, fmt.Errorf("failed to create master key directory '%s': %w", _masterKeyDir, err)
+	}
+
+	// Construct the file path of the current generation of the key within the _masterKeyDir
+	generation, err := CurrentMasterKeyGeneration(providerName)
+	if err != nil {
+		return nil, err
 	}
+	filePath := masterKeyPath(providerName, generation)
 
 	// Check if the file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// File does not exist, generate a new key and save it
-		_, err := rand.Read(key)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate new master key: %w", err)
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		if _config.RequireExistingMasterKey {
+			return nil, fmt.Errorf("%w: '%s'", ErrMasterKeyMissing, filePath)
 		}
-
-		file, err := os.Create(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create master key file '%s': %w", filePath, err)
+		// File does not exist, generate a new key and save it, readable only by the owner.
+		if key, err = generateMasterKey(); err != nil {
+			return nil, err
 		}
-		defer file.Close()
-
-		_, err = file.Write(key)
-		if err != nil {
-			return nil, fmt.Errorf("failed to write master key to file '%s': %w", filePath, err)
+		if err := writeMasterKeyFile(filePath, key); err != nil {
+			return nil, err
 		}
 	} else if err != nil {
 		return nil, fmt.Errorf("error checking master key file status '%s': %w", filePath, err)
 	} else {
-		// File exists, read the key from it.
+		// File exists, check that only the owner can access it, and read the key from it.
+		if err := checkMasterKeyFilePermissions(filePath, info); err != nil {
+			return nil, err
+		}
 		file, err := os.Open(filePath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to open master key file '%s': %w", filePath, err)
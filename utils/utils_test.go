@@ -0,0 +1,441 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prabath/mongodb-enc-poc/utils"
+	"github.com/prabath/mongodb-enc-poc/utils/testutil"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const _testKeyVaultNamespace = "encryption.__keyVault"
+
+// setupGetDek runs GetDek in a temporary directory for the master keys, with an empty DEK cache.
+func setupGetDek(t *testing.T) {
+	t.Chdir(t.TempDir())
+	utils.SetDekCache(utils.NewDekCache(time.Hour, nil))
+	t.Cleanup(func() { utils.SetDekCache(utils.NewDekCache(time.Hour, nil)) })
+}
+
+func TestGetDekCreatesMissingDek(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	dek, kmsProviders, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake})
+	if err != nil {
+		t.Fatalf("GetDek() error = %v", err)
+	}
+	if fake.CreateCalls != 1 {
+		t.Errorf("CreateDataKey called %d times, want 1", fake.CreateCalls)
+	}
+	if _, ok := kmsProviders["local:100"]; !ok {
+		t.Errorf("KMS providers = %v, want local:100", kmsProviders)
+	}
+
+	keys := fake.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("key vault holds %d DEKs, want 1", len(keys))
+	}
+	key := keys[0]
+	if id := key["_id"].(primitive.Binary); string(id.Data) != string(dek.Data) {
+		t.Errorf("GetDek() = %x, want the created DEK %x", dek.Data, id.Data)
+	}
+	if altNames := key["keyAltNames"].([]string); len(altNames) != 1 || altNames[0] != "dek-local:100" {
+		t.Errorf("keyAltNames = %v, want [dek-local:100]", altNames)
+	}
+	if _, ok := key["masterKeyGeneration"]; !ok {
+		t.Errorf("the created DEK %v has no masterKeyGeneration", key)
+	}
+
+	// The DEK is cached, so the next call doesn't even look it up.
+	again, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake})
+	if err != nil || string(again.Data) != string(dek.Data) {
+		t.Errorf("GetDek() again = %v, %v, want %x", again, err, dek.Data)
+	}
+	if fake.CreateCalls != 1 {
+		t.Errorf("CreateDataKey called %d times after the second call, want 1", fake.CreateCalls)
+	}
+}
+
+func TestGetDekFindsExistingDek(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	existing := fake.AddKey("local:100", "dek-local:100")
+	dek, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake})
+	if err != nil {
+		t.Fatalf("GetDek() error = %v", err)
+	}
+	if string(dek.Data) != string(existing.Data) {
+		t.Errorf("GetDek() = %x, want the existing DEK %x", dek.Data, existing.Data)
+	}
+	if fake.CreateCalls != 0 {
+		t.Errorf("CreateDataKey called %d times, want 0", fake.CreateCalls)
+	}
+}
+
+func TestGetDekCreateFails(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	fake.CreateErr = errors.New("KMS unavailable")
+	if _, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake}); err == nil || !strings.Contains(err.Error(), "KMS unavailable") {
+		t.Fatalf("GetDek() error = %v, want the create error", err)
+	}
+	if len(fake.Keys()) != 0 {
+		t.Errorf("key vault holds %v, want no DEK", fake.Keys())
+	}
+}
+
+// TestGetDekSharedKeyVaultConcurrent resolves the DEKs of 20 tenants concurrently through one
+// shared key vault. Run it with -race.
+func TestGetDekSharedKeyVaultConcurrent(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	shared := &utils.SharedKeyVault{Store: fake}
+
+	const tenants = 20
+	deks := make([]*primitive.Binary, tenants)
+	var wg sync.WaitGroup
+	for i := range tenants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			providerName := fmt.Sprintf("local:%d", 100+i)
+			dek, _, err := utils.GetDek(context.Background(), providerName, _testKeyVaultNamespace, shared)
+			if err != nil {
+				t.Errorf("GetDek(%s) error = %v", providerName, err)
+				return
+			}
+			deks[i] = dek
+		}()
+	}
+	wg.Wait()
+
+	if len(fake.Keys()) != tenants {
+		t.Fatalf("key vault holds %d DEKs, want %d", len(fake.Keys()), tenants)
+	}
+	seen := make(map[string]bool, tenants)
+	for i, dek := range deks {
+		if dek == nil {
+			continue
+		}
+		if seen[string(dek.Data)] {
+			t.Errorf("tenant %d got the DEK %x of another tenant", i, dek.Data)
+		}
+		seen[string(dek.Data)] = true
+	}
+}
+
+func TestGetDekHookReceivesKeyID(t *testing.T) {
+	setupGetDek(t)
+	var gotProvider string
+	var gotKeyID primitive.Binary
+	utils.SetConfig(utils.Config{OnDEKCreated: func(providerName string, keyID primitive.Binary) error {
+		gotProvider, gotKeyID = providerName, keyID
+		return nil
+	}})
+	t.Cleanup(func() { utils.SetConfig(utils.Config{}) })
+
+	fake := testutil.NewFakeKeyVault()
+	dek, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake})
+	if err != nil {
+		t.Fatalf("GetDek() error = %v", err)
+	}
+	if gotProvider != "local:100" || !bytes.Equal(gotKeyID.Data, dek.Data) || gotKeyID.Subtype != dek.Subtype {
+		t.Errorf("OnDEKCreated(%s, %x), want local:100, %x", gotProvider, gotKeyID.Data, dek.Data)
+	}
+	if len(fake.Keys()) != 1 {
+		t.Errorf("key vault holds %d DEKs, want 1", len(fake.Keys()))
+	}
+}
+
+func TestGetDekHookFailureDeletesDek(t *testing.T) {
+	setupGetDek(t)
+	var registered []primitive.Binary
+	utils.SetConfig(utils.Config{OnDEKCreated: func(providerName string, keyID primitive.Binary) error {
+		registered = append(registered, keyID)
+		return errors.New("inventory unavailable")
+	}})
+	t.Cleanup(func() { utils.SetConfig(utils.Config{}) })
+
+	fake := testutil.NewFakeKeyVault()
+	_, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake})
+	if err == nil || !strings.Contains(err.Error(), "the new DEK was deleted") {
+		t.Fatalf("GetDek() error = %v, want the hook failure", err)
+	}
+	if len(registered) != 1 {
+		t.Errorf("OnDEKCreated called %d times, want 1", len(registered))
+	}
+	if len(fake.Keys()) != 0 {
+		t.Errorf("key vault holds %v, want the DEK deleted", fake.Keys())
+	}
+
+	// Nothing was cached, so the next call creates a new DEK.
+	utils.SetConfig(utils.Config{})
+	if _, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake}); err != nil {
+		t.Fatalf("GetDek() after the hook recovered error = %v", err)
+	}
+	if fake.CreateCalls != 2 {
+		t.Errorf("CreateDataKey called %d times, want 2", fake.CreateCalls)
+	}
+}
+
+func TestGetDekCacheExpires(t *testing.T) {
+	t.Chdir(t.TempDir())
+	clock := utils.NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	utils.SetDekCache(utils.NewDekCache(time.Minute, clock))
+	t.Cleanup(func() { utils.SetDekCache(utils.NewDekCache(time.Hour, nil)) })
+
+	fake := testutil.NewFakeKeyVault()
+	getDek := func() {
+		t.Helper()
+		if _, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+			&utils.SharedKeyVault{Store: fake}); err != nil {
+			t.Fatalf("GetDek() error = %v", err)
+		}
+	}
+	getDek()
+	clock.Advance(time.Minute - time.Second)
+	getDek()
+	if fake.LookupCalls != 1 {
+		t.Fatalf("key vault looked up %d times within the TTL, want 1", fake.LookupCalls)
+	}
+
+	// Past the TTL, the DEK is looked up again, and found.
+	clock.Advance(time.Second)
+	getDek()
+	if fake.LookupCalls != 2 {
+		t.Errorf("key vault looked up %d times past the TTL, want 2", fake.LookupCalls)
+	}
+	if fake.CreateCalls != 1 {
+		t.Errorf("CreateDataKey called %d times, want 1", fake.CreateCalls)
+	}
+}
+
+// racingKeyVault is a key vault that went read-only right after another process created the DEK:
+// its CreateDataKey registers the other process's DEK and fails with err.
+type racingKeyVault struct {
+	*testutil.FakeKeyVault
+	err error
+}
+
+func (kv *racingKeyVault) CreateDataKey(
+	ctx context.Context, kmsProvider string, opts ...*options.DataKeyOptions,
+) (primitive.Binary, error) {
+	kv.AddKey(kmsProvider, "dek-"+kmsProvider)
+	return primitive.Binary{}, kv.err
+}
+
+func TestGetDekKeyVaultReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "not writable primary", err: mongo.CommandError{Code: 10107, Name: "NotWritablePrimary"}},
+		{name: "duplicate alt name", err: mongo.WriteException{
+			WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error"}},
+		}},
+		{name: "other error", err: mongo.CommandError{Code: 13, Name: "Unauthorized"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupGetDek(t)
+			kv := &racingKeyVault{FakeKeyVault: testutil.NewFakeKeyVault(), err: tt.err}
+			dek, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+				&utils.SharedKeyVault{Store: kv})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("GetDek() = %x, want the create error", dek.Data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetDek() error = %v", err)
+			}
+			keys := kv.Keys()
+			if len(keys) != 1 || string(keys[0]["_id"].(primitive.Binary).Data) != string(dek.Data) {
+				t.Errorf("GetDek() = %x, want the DEK the other process created %v", dek.Data, keys)
+			}
+		})
+	}
+}
+
+func TestGetDekRecordsExpiry(t *testing.T) {
+	setupGetDek(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	utils.SetConfig(utils.Config{DEKLifetime: 90 * 24 * time.Hour, Clock: utils.NewFakeClock(now)})
+	t.Cleanup(func() { utils.SetConfig(utils.Config{}) })
+
+	fake := testutil.NewFakeKeyVault()
+	if _, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake}); err != nil {
+		t.Fatalf("GetDek() error = %v", err)
+	}
+	keys := fake.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("key vault holds %d DEKs, want 1", len(keys))
+	}
+	if got, want := keys[0]["expiresAt"], now.Add(90*24*time.Hour); got != want {
+		t.Errorf("expiresAt = %v, want %v", got, want)
+	}
+}
+
+// TestKeyAltNameRotation renames a tenant's DEK: during the migration GetDek and the key vault
+// resolve it under both names, and once the old name is removed, only under the new one.
+func TestKeyAltNameRotation(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	ctx := context.Background()
+	resolve := func(altName string) (primitive.Binary, error) {
+		var key struct {
+			ID primitive.Binary `bson:"_id"`
+		}
+		err := fake.GetKeyByAltName(ctx, altName).Decode(&key)
+		return key.ID, err
+	}
+
+	if err := utils.AddKeyAltName(ctx, fake, keyID, "dek-local:dvrv-us-1:100"); err != nil {
+		t.Fatalf("AddKeyAltName() error = %v", err)
+	}
+	for _, altName := range []string{"dek-local:100", "dek-local:dvrv-us-1:100"} {
+		if id, err := resolve(altName); err != nil || string(id.Data) != string(keyID.Data) {
+			t.Errorf("DEK by '%s' = %x, %v, want %x", altName, id.Data, err, keyID.Data)
+		}
+	}
+	dek, _, err := utils.GetDek(ctx, "local:100", _testKeyVaultNamespace, &utils.SharedKeyVault{Store: fake})
+	if err != nil || string(dek.Data) != string(keyID.Data) {
+		t.Errorf("GetDek() during the migration = %v, %v, want %x", dek, err, keyID.Data)
+	}
+
+	if err := utils.RemoveKeyAltName(ctx, fake, keyID, "dek-local:100"); err != nil {
+		t.Fatalf("RemoveKeyAltName() error = %v", err)
+	}
+	if _, err := resolve("dek-local:100"); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("DEK by the removed alt name error = %v, want mongo.ErrNoDocuments", err)
+	}
+	if id, err := resolve("dek-local:dvrv-us-1:100"); err != nil || string(id.Data) != string(keyID.Data) {
+		t.Errorf("DEK by the new alt name = %x, %v, want %x", id.Data, err, keyID.Data)
+	}
+	// The removal invalidated the cached DEK, so GetDek no longer resolves it by the old name.
+	lookups := fake.LookupCalls
+	if _, _, err := utils.GetDek(ctx, "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake}); err != nil {
+		t.Fatalf("GetDek() after the migration error = %v", err)
+	}
+	if fake.LookupCalls == lookups {
+		t.Error("GetDek() after the migration served the DEK of the removed alt name from its cache")
+	}
+}
+
+func TestAddKeyAltNameErrors(t *testing.T) {
+	fake := testutil.NewFakeKeyVault()
+	keyID := fake.AddKey("local:100", "dek-local:100")
+	fake.AddKey("local:200", "dek-local:200")
+	ctx := context.Background()
+
+	if err := utils.AddKeyAltName(ctx, fake, keyID, ""); err == nil {
+		t.Error("AddKeyAltName() of an empty alt name succeeded, want an error")
+	}
+	err := utils.AddKeyAltName(ctx, fake, keyID, "dek-local:200")
+	if err == nil || !strings.Contains(err.Error(), "already used by another DEK") {
+		t.Errorf("AddKeyAltName() of another DEK's alt name error = %v", err)
+	}
+	unknown := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	if err := utils.AddKeyAltName(ctx, fake, unknown, "dek-local:300"); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("AddKeyAltName() of a missing DEK error = %v, want mongo.ErrNoDocuments", err)
+	}
+}
+
+func TestGetDekRecordsMasterKeyGeneration(t *testing.T) {
+	setupGetDek(t)
+	if _, err := utils.LoadOrCreateMasterKey("local:100"); err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 2; want++ {
+		generation, err := utils.RotateMasterKey("local:100", bytes.Repeat([]byte{byte(want)}, 96))
+		if err != nil || generation != want {
+			t.Fatalf("rotateMasterKey() = %d, %v, want generation %d", generation, err, want)
+		}
+		if current, err := utils.CurrentMasterKeyGeneration("local:100"); err != nil || current != want {
+			t.Errorf("CurrentMasterKeyGeneration() = %d, %v, want %d", current, err, want)
+		}
+	}
+
+	fake := testutil.NewFakeKeyVault()
+	if _, _, err := utils.GetDek(context.Background(), "local:100", _testKeyVaultNamespace,
+		&utils.SharedKeyVault{Store: fake}); err != nil {
+		t.Fatalf("GetDek() error = %v", err)
+	}
+	if got := fake.Keys()[0]["masterKeyGeneration"]; got != 2 {
+		t.Errorf("masterKeyGeneration = %v, want 2", got)
+	}
+}
+
+// TestGetDekAfterDeletedDek deletes the cached DEK of a tenant: once forgotten, the next GetDek
+// looks the tenant up in the key vault again and creates a new DEK, instead of serving the deleted
+// one from its cache.
+func TestGetDekAfterDeletedDek(t *testing.T) {
+	setupGetDek(t)
+	fake := testutil.NewFakeKeyVault()
+	ctx := context.Background()
+	getDek := func() primitive.Binary {
+		t.Helper()
+		dek, _, err := utils.GetDek(ctx, "local:100", _testKeyVaultNamespace, &utils.SharedKeyVault{Store: fake})
+		if err != nil {
+			t.Fatalf("GetDek() error = %v", err)
+		}
+		return *dek
+	}
+
+	deleted := getDek()
+	if _, err := fake.DeleteKey(ctx, deleted); err != nil {
+		t.Fatal(err)
+	}
+	utils.ForgetDek("local:100")
+	lookups := fake.LookupCalls
+	dek := getDek()
+	if fake.LookupCalls == lookups {
+		t.Error("GetDek() after the deletion served the deleted DEK from its cache")
+	}
+	if dek.Equal(deleted) || fake.CreateCalls != 2 {
+		t.Errorf("GetDek() after the deletion = %x with %d DEKs created, want a new DEK",
+			dek.Data, fake.CreateCalls)
+	}
+}
+
+// TestDekCacheInvalidateDek checks that InvalidateDek, which the helpers deleting DEKs call, drops
+// the DEK under every namespace and alt name, and only that DEK.
+func TestDekCacheInvalidateDek(t *testing.T) {
+	cache := utils.NewDekCache(time.Hour, nil)
+	dek := primitive.Binary{Subtype: 4, Data: []byte("0123456789abcdef")}
+	other := primitive.Binary{Subtype: 4, Data: []byte("fedcba9876543210")}
+	cache.Put("ns1/dek-local:100", dek)
+	cache.Put("ns2/dek-local:100", dek)
+	cache.Put("ns1/dek-local:200", other)
+
+	cache.InvalidateDek(dek)
+	for _, key := range []string{"ns1/dek-local:100", "ns2/dek-local:100"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("Get(%s) after InvalidateDek() hit, want a miss", key)
+		}
+	}
+	if got, ok := cache.Get("ns1/dek-local:200"); !ok || !got.Equal(other) {
+		t.Errorf("Get(ns1/dek-local:200) = %x, %v, want the other DEK", got.Data, ok)
+	}
+}
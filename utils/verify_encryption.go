@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrEncryptionDidNotEngage is returned when a document written through an encrypting client was
+// stored with an encrypted field in plaintext, e.g. because the schema map is keyed on the wrong
+// namespace, which the driver doesn't report.
+var ErrEncryptionDidNotEngage = errors.New("automatic encryption did not engage")
+
+// verifyStoredEncryption reads an inserted document back through a regular client, which doesn't
+// decrypt, and checks that each of the fields it has is ciphertext. Fields in skip (stored as
+// plain nulls by design) are not checked.
+func verifyStoredEncryption(
+	ctx context.Context, rawClient *mongo.Client, coll CollRef, id interface{}, fields, skip []string,
+) error {
+	var stored bson.Raw
+	if err := coll.Collection(rawClient).FindOne(ctx, bson.M{"_id": id}).Decode(&stored); err != nil {
+		return fmt.Errorf("failed to read back document %v from %s: %w", id, coll, err)
+	}
+	if plaintext := plaintextFields(stored, fields, skip); len(plaintext) > 0 {
+		return fmt.Errorf("%w: %v of document %v in %s were stored in plaintext",
+			ErrEncryptionDidNotEngage, plaintext, id, coll)
+	}
+	return nil
+}
+
+// plaintextFields returns the fields, other than those in skip, the stored document has a value
+// other than ciphertext for.
+func plaintextFields(stored bson.Raw, fields, skip []string) []string {
+	var plaintext []string
+	for _, field := range fields {
+		if slices.Contains(skip, field) {
+			continue
+		}
+		value, err := stored.LookupErr(strings.Split(field, ".")...)
+		if err != nil {
+			continue
+		}
+		if subtype, _, ok := value.BinaryOK(); !ok || subtype != _encryptedSubtype {
+			plaintext = append(plaintext, field)
+		}
+	}
+	return plaintext
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPlaintextFields(t *testing.T) {
+	ciphertext := primitive.Binary{Subtype: _encryptedSubtype, Data: []byte{1, 2, 3}}
+	tests := []struct {
+		name string
+		doc  bson.D
+		want []string
+	}{
+		{
+			name: "encrypted",
+			doc: bson.D{
+				{Key: "ssn", Value: ciphertext},
+				{Key: "profile", Value: bson.D{{Key: "email", Value: ciphertext}}},
+			},
+		},
+		{
+			// What a schema map keyed on the wrong namespace stores.
+			name: "schema map on another namespace",
+			doc: bson.D{
+				{Key: "ssn", Value: "987-65-4320"},
+				{Key: "profile", Value: bson.D{{Key: "email", Value: "a@b.c"}}},
+			},
+			want: []string{"ssn", "profile.email"},
+		},
+		{
+			name: "binary that isn't ciphertext",
+			doc:  bson.D{{Key: "ssn", Value: primitive.Binary{Subtype: 0, Data: []byte("987-65-4320")}}},
+			want: []string{"ssn"},
+		},
+		{
+			name: "missing and skipped fields",
+			doc:  bson.D{{Key: "nickname", Value: nil}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, err := bson.Marshal(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := plaintextFields(stored, []string{"ssn", "profile.email", "nickname"}, []string{"nickname"})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("plaintextFields() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestInsertEncryptedVerifyNeedsRawClient checks that the verification fails up front, before the
+// insert, without a regular client to read the document back with.
+func TestInsertEncryptedVerifyNeedsRawClient(t *testing.T) {
+	SetConfig(Config{VerifyEncryptionOnInsert: true})
+	t.Cleanup(func() { SetConfig(Config{}) })
+	err := InsertEncrypted(context.Background(), nil, nil, CollRef{Database: "csfle_db", Name: "users"},
+		bson.M{"ssn": "987-65-4320"}, []string{"ssn"})
+	if err == nil || !strings.Contains(err.Error(), "regular client is required") {
+		t.Errorf("InsertEncrypted() without a regular client error = %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CreateNonSensitiveView creates a read-only view, in the database of the source collection, that
+// projects the encrypted fields (dotted paths) out of it entirely, for analytics tools that can't
+// use an encrypting client but only need the non-sensitive fields. The Queryable Encryption tags
+// field is projected out too.
+//
+// The view is defined by the field list at creation, so a field encrypted later must be added by
+// dropping and recreating the view.
+func CreateNonSensitiveView(
+	ctx context.Context, client *mongo.Client, source CollRef, viewName string, encFields []string,
+) error {
+	pipeline, err := nonSensitiveViewPipeline(viewName, encFields)
+	if err != nil {
+		return err
+	}
+	db := client.Database(source.Database)
+	if err := db.CreateView(ctx, viewName, source.Name, pipeline); err != nil {
+		return fmt.Errorf("failed to create view %s.%s on %s: %w", source.Database, viewName, source, err)
+	}
+	return nil
+}
+
+// nonSensitiveViewPipeline returns the pipeline of a view that projects out the encrypted fields
+// and the Queryable Encryption tags.
+func nonSensitiveViewPipeline(viewName string, encFields []string) (mongo.Pipeline, error) {
+	if len(encFields) == 0 {
+		return nil, fmt.Errorf("no encrypted fields to project out of view %s", viewName)
+	}
+	projection := bson.D{{Key: _safeContentField, Value: 0}}
+	for _, field := range encFields {
+		if field == _safeContentField {
+			continue
+		}
+		if err := validateEncryptedPath(field); err != nil {
+			return nil, err
+		}
+		projection = append(projection, bson.E{Key: field, Value: 0})
+	}
+	return mongo.Pipeline{{{Key: "$project", Value: projection}}}, nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestNonSensitiveViewPipeline applies the projection of the view over a users document: ssn and
+// the QE tags are left out, name and email are kept.
+func TestNonSensitiveViewPipeline(t *testing.T) {
+	pipeline, err := nonSensitiveViewPipeline("users_analytics", []string{"ssn", "profile.dob"})
+	if err != nil {
+		t.Fatalf("nonSensitiveViewPipeline() error = %v", err)
+	}
+	if len(pipeline) != 1 || pipeline[0][0].Key != "$project" {
+		t.Fatalf("nonSensitiveViewPipeline() = %v, want a single $project", pipeline)
+	}
+	var excluded []string
+	for _, elem := range pipeline[0][0].Value.(bson.D) {
+		if elem.Value != 0 {
+			t.Errorf("the projection includes '%s', want only exclusions", elem.Key)
+		}
+		excluded = append(excluded, elem.Key)
+	}
+
+	data, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "email", Value: "bob@example.com"},
+		{Key: "ssn", Value: []byte("ciphertext")},
+		{Key: "profile", Value: bson.D{{Key: "dob", Value: []byte("ciphertext")}, {Key: "city", Value: "Paris"}}},
+		{Key: _safeContentField, Value: bson.A{[]byte("tag")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view, err := withoutFields(data, excluded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{
+		{Key: "name", Value: "Bob"},
+		{Key: "email", Value: "bob@example.com"},
+		{Key: "profile", Value: bson.D{{Key: "city", Value: "Paris"}}},
+	}
+	if !reflect.DeepEqual(view, want) {
+		t.Errorf("view document = %v, want %v", view, want)
+	}
+
+	for _, encFields := range [][]string{nil, {"_id"}, {"$ssn"}} {
+		if _, err := nonSensitiveViewPipeline("users_analytics", encFields); err == nil {
+			t.Errorf("nonSensitiveViewPipeline(%v) succeeded, want an error", encFields)
+		}
+	}
+}
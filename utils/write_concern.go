@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// The code of the write concern error a write gets when it isn't acknowledged by enough members
+// within wtimeout (WriteConcernFailed).
+const _writeConcernTimeoutCode = 64
+
+// WriteConcernErrorFrom returns the write concern error of a failed write, as returned by the
+// insert and update helpers (or the driver), with its code and errInfo. A write that failed with
+// one was applied on the primary, but isn't known to be durable: after a timeout the caller can
+// wait and check for it or retry an idempotent write, whereas other errors mean the write wasn't
+// applied.
+func WriteConcernErrorFrom(err error) (*mongo.WriteConcernError, bool) {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError != nil {
+		return writeErr.WriteConcernError, true
+	}
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError != nil {
+		return bulkErr.WriteConcernError, true
+	}
+	return nil, false
+}
+
+// IsWriteConcernTimeout reports whether a write failed because it wasn't acknowledged by the
+// requested write concern (e.g. w=majority, the default) within its wtimeout.
+func IsWriteConcernTimeout(err error) bool {
+	wce, ok := WriteConcernErrorFrom(err)
+	return ok && (wce.Code == _writeConcernTimeoutCode || wce.Name == "WriteConcernFailed")
+}
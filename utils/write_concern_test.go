@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestWriteConcernErrorFrom extracts the write concern error of an insert that timed out waiting
+// for w=majority, as the insert helpers return it.
+func TestWriteConcernErrorFrom(t *testing.T) {
+	coll := CollRef{Database: "csfle_db", Name: "users"}
+	errInfo, err := bson.Marshal(bson.M{"wtimeout": true, "writeConcern": bson.M{"w": "majority"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtimeout := &mongo.WriteConcernError{
+		Name: "WriteConcernFailed", Code: _writeConcernTimeoutCode, Message: "waiting for replication timed out",
+		Details: errInfo,
+	}
+	unsatisfiable := &mongo.WriteConcernError{
+		Name: "UnsatisfiableWriteConcern", Code: 100, Message: "Not enough data-bearing nodes",
+	}
+	tests := []struct {
+		name        string
+		err         error
+		want        *mongo.WriteConcernError
+		wantTimeout bool
+	}{
+		{name: "wtimeout on insert", want: wtimeout, wantTimeout: true, err: fmt.Errorf(
+			"failed to insert document into %s: %w", coll, mongo.WriteException{WriteConcernError: wtimeout})},
+		{name: "wtimeout on a bulk write", want: wtimeout, wantTimeout: true,
+			err: mongo.BulkWriteException{WriteConcernError: wtimeout}},
+		{name: "unsatisfiable write concern", want: unsatisfiable,
+			err: mongo.WriteException{WriteConcernError: unsatisfiable}},
+		{name: "write error", err: mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}},
+		{name: "other error", err: errors.New("server selection timeout")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := WriteConcernErrorFrom(tt.err)
+			if got != tt.want || ok != (tt.want != nil) {
+				t.Errorf("WriteConcernErrorFrom() = %v, %t, want %v", got, ok, tt.want)
+			}
+			if IsWriteConcernTimeout(tt.err) != tt.wantTimeout {
+				t.Errorf("IsWriteConcernTimeout() = %t, want %t", !tt.wantTimeout, tt.wantTimeout)
+			}
+		})
+	}
+
+	wce, _ := WriteConcernErrorFrom(tests[0].err)
+	if wce == nil || !wce.Details.Lookup("wtimeout").Boolean() {
+		t.Errorf("WriteConcernErrorFrom() = %v, want the errInfo of the write concern error", wce)
+	}
+}